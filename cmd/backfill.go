@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/alitto/pond"
+	"github.com/estahn/k8s-image-swapper/pkg/backfill"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/estahn/k8s-image-swapper/pkg/secrets"
+	"github.com/estahn/k8s-image-swapper/pkg/webhook"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var backfillFlags struct {
+	kubeconfig  string
+	namespace   string
+	concurrency int
+	dryRun      bool
+	journal     string
+	output      string
+}
+
+// backfillCmd mirrors the images of workloads admitted before the webhook was installed
+var backfillCmd = &cobra.Command{
+	Use:   "backfill",
+	Short: "Mirror the images of existing workloads",
+	Long: `Mirror the images of existing workloads into the target registry.
+
+The webhook only mirrors images of pods admitted after it was installed. Backfill lists the pods,
+deployments, statefulsets, daemonsets, jobs and cronjobs of the cluster, applies the source filters
+of the config file and copies every image missing in the target registry.
+
+Pods keep pulling from the source registry until they are recreated and swapped by the webhook.`,
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if backfillFlags.output != "text" && backfillFlags.output != "json" {
+			return fmt.Errorf("unknown output format %q, must be one of [text json]", backfillFlags.output)
+		}
+		if backfillFlags.concurrency < 1 {
+			return errors.New("concurrency must be at least 1")
+		}
+
+		if configErr == nil {
+			configErr = config.Validate(cfg)
+		}
+		if configErr != nil {
+			return configErr
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		clientset, err := setupKubeconfigClient(backfillFlags.kubeconfig)
+		if err != nil {
+			return fmt.Errorf("error configuring Kubernetes client: %w", err)
+		}
+
+		imageSwapper, targetRegistryClient, closeRegistries, err := setupImageCopies(setupImagePullSecretsProvider(clientset), backfillFlags.concurrency)
+		if err != nil {
+			return err
+		}
+		defer closeRegistries()
+
+		workloads, err := backfill.ListWorkloads(ctx, clientset, backfillFlags.namespace)
+		if err != nil {
+			return fmt.Errorf("error listing workloads: %w", err)
+		}
+
+		report, err := backfill.New(imageSwapper, targetRegistryClient,
+			backfill.Concurrency(backfillFlags.concurrency),
+			backfill.DryRun(backfillFlags.dryRun),
+			backfill.Journal(backfillFlags.journal),
+			backfill.Progress(cmd.ErrOrStderr()),
+		).Run(ctx, workloads)
+		if err != nil {
+			return err
+		}
+
+		return writeReport(cmd, report, backfillFlags.output)
+	},
+}
+
+// setupImageCopies configures an image swapper copying into the target registry, outside of admissions,
+// running up to concurrency copies on its backfill lane. The returned function closes the registry clients, their cache and the bandwidth limiter.
+func setupImageCopies(imagePullSecretProvider secrets.ImagePullSecretsProvider, concurrency int) (*webhook.ImageSwapper, registry.Client, func(), error) {
+	newRegistryClient, closeCache, err := setupRegistryCache()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error configuring registry cache: %w", err)
+	}
+
+	sourceRegistries, err := newSourceRegistries(cfg.Source.Registries, newRegistryClient)
+	if err != nil {
+		closeCache()
+		return nil, nil, nil, fmt.Errorf("error creating source registry clients: %w", err)
+	}
+
+	targetRegistryClient, err := newRegistryClient(cfg.Target)
+	if err != nil {
+		closeSourceRegistries(sourceRegistries)
+		closeCache()
+		return nil, nil, nil, fmt.Errorf("error connecting to target registry at %s: %w", cfg.Target.Domain(), err)
+	}
+
+	bandwidthProxy, err := setupBandwidth()
+	if err != nil {
+		targetRegistryClient.Close()
+		closeSourceRegistries(sourceRegistries)
+		closeCache()
+		return nil, nil, nil, fmt.Errorf("error configuring bandwidth limiter: %w", err)
+	}
+
+	imagePullSecretProvider.SetAuthenticatedRegistries(registryClients(sourceRegistries))
+	imagePullSecretProvider.SetSourceCredentials(cfg.Source.Credentials)
+
+	imageSwapper := webhook.NewImageSwapperWithOpts(
+		targetRegistryClient,
+		webhook.Filters(cfg.Source.Filters),
+		webhook.ImagePullSecretsProvider(imagePullSecretProvider),
+		webhook.BackfillCopier(pond.New(concurrency, 0)),
+		webhook.CopyLimits(cfg.CopyLimits),
+		webhook.Bandwidth(bandwidthProxy),
+	)
+
+	closeRegistries := func() {
+		_ = bandwidthProxy.Close()
+		targetRegistryClient.Close()
+		closeSourceRegistries(sourceRegistries)
+		closeCache()
+	}
+
+	return imageSwapper, targetRegistryClient, closeRegistries, nil
+}
+
+// writeReport prints the report in the output format and fails if any image failed to copy
+func writeReport(cmd *cobra.Command, report *backfill.Report, output string) error {
+	var err error
+	if output == "json" {
+		encoder := json.NewEncoder(cmd.OutOrStdout())
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	} else {
+		err = report.WriteText(cmd.OutOrStdout())
+	}
+	if err != nil {
+		return err
+	}
+
+	if report.Failed() {
+		return fmt.Errorf("%d images failed to copy", report.Summary[backfill.ResultFailed])
+	}
+
+	return nil
+}
+
+// setupKubeconfigClient configures a client from the kubeconfig, falling back to the cluster the command is running in
+func setupKubeconfigClient(kubeconfig string) (kubernetes.Interface, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(restConfig)
+}
+
+func init() {
+	backfillCmd.Flags().StringVar(&backfillFlags.kubeconfig, "kubeconfig", "", "kubeconfig file (default is $KUBECONFIG, ~/.kube/config or the in-cluster config)")
+	backfillCmd.Flags().StringVarP(&backfillFlags.namespace, "namespace", "n", "", "only backfill workloads of this namespace (default is all namespaces)")
+	backfillCmd.Flags().IntVar(&backfillFlags.concurrency, "concurrency", backfill.DefaultConcurrency, "number of images copied in parallel")
+	backfillCmd.Flags().BoolVar(&backfillFlags.dryRun, "dry-run", false, "only report the images missing in the target registry")
+	backfillCmd.Flags().StringVar(&backfillFlags.journal, "journal", "", "file recording completed images, a rerun skips them")
+	backfillCmd.Flags().StringVarP(&backfillFlags.output, "output", "o", "text", "format of the report: text or json")
+
+	rootCmd.AddCommand(backfillCmd)
+}
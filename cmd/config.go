@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var validateFile string
+
+// configCmd groups the commands working with the config file
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Work with the config file",
+}
+
+// configValidateCmd checks a config file without starting the webhook, e.g. in CI
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate a config file",
+	Long: `Validate a config file the same way the webhook does on startup.
+
+Unknown keys, unknown values of enumerations, missing fields of registries,
+invalid JMESPath filters, invalid ECR policy documents and out of bound durations are reported.`,
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := readConfigFile(validateFile); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "%s is valid\n", validateFile)
+
+		return nil
+	},
+}
+
+// readConfigFile reads and validates a config file independent of the global configuration
+func readConfigFile(file string) (*config.Config, error) {
+	v := viper.New()
+	config.SetViperDefaults(v)
+	v.SetConfigFile(file)
+
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	c := &config.Config{}
+	if err := config.Unmarshal(v, c); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	if err := config.Validate(c); err != nil {
+		return nil, fmt.Errorf("%s is invalid:\n%w", file, err)
+	}
+
+	return c, nil
+}
+
+func init() {
+	configValidateCmd.Flags().StringVarP(&validateFile, "file", "f", "", "config file to validate")
+	_ = configValidateCmd.MarkFlagRequired("file")
+
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+}
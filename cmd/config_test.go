@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		file := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(file, []byte(content), 0600))
+		return file
+	}
+
+	valid := write("valid.yaml", `
+imageSwapPolicy: always
+target:
+  type: aws
+  aws:
+    accountId: "123456789"
+    region: ap-southeast-2
+`)
+	c, err := readConfigFile(valid)
+	assert.NoError(t, err)
+	assert.Equal(t, "always", c.ImageSwapPolicy)
+
+	unknownKey := write("unknown-key.yaml", `
+imageSwapPolicy: always
+imageCopyPolicyy: delayed
+`)
+	_, err = readConfigFile(unknownKey)
+	assert.ErrorContains(t, err, "imagecopypolicyy")
+
+	invalid := write("invalid.yaml", `
+imageSwapPolicy: exist
+target:
+  type: aws
+`)
+	_, err = readConfigFile(invalid)
+	assert.ErrorContains(t, err, `imageSwapPolicy: unknown value "exist"`)
+	assert.ErrorContains(t, err, `target: registry of type "aws" requires a field "region"`)
+
+	_, err = readConfigFile(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/estahn/k8s-image-swapper/pkg/webhook"
+	kwhmodel "github.com/slok/kubewebhook/v2/pkg/model"
+	"github.com/spf13/cobra"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+var explainFlags struct {
+	file        string
+	namespace   string
+	imageExists bool
+	output      string
+}
+
+// explainCmd replays an admission without side effects to debug filters and policies
+var explainCmd = &cobra.Command{
+	Use:   "explain",
+	Short: "Explain how a pod is admitted",
+	Long: `Explain how a pod is admitted by replaying an AdmissionReview or a Pod manifest locally.
+
+The pod is mutated the same way the webhook does with the filters and policies of the config file,
+but without connecting to the target registry: repositories are not created and images are not copied.
+For each container the filter results, the target image, the copy and the swap decision are printed,
+followed by the JSON patch of the admission response.
+
+  kubectl get pod nginx -o yaml | k8s-image-swapper explain
+  k8s-image-swapper explain -f test/requests/admissionreview-simple.json --image-exists`,
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if explainFlags.output != "text" && explainFlags.output != "json" {
+			return fmt.Errorf("unknown output format %q, must be one of [text json]", explainFlags.output)
+		}
+
+		if configErr == nil {
+			configErr = config.Validate(cfg)
+		}
+		if configErr != nil {
+			return configErr
+		}
+
+		var data []byte
+		var err error
+		if explainFlags.file == "-" {
+			data, err = io.ReadAll(cmd.InOrStdin())
+		} else {
+			data, err = os.ReadFile(explainFlags.file)
+		}
+		if err != nil {
+			return err
+		}
+
+		review, err := readAdmissionReview(data, explainFlags.namespace)
+		if err != nil {
+			return err
+		}
+
+		registryClient, err := registry.NewDryRunClient(cfg.Target, explainFlags.imageExists)
+		if err != nil {
+			return err
+		}
+
+		result, err := explain(cmd.Context(), cfg, registryClient, review)
+		if err != nil {
+			return err
+		}
+
+		if explainFlags.output == "json" {
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(result)
+		}
+
+		return result.WriteText(cmd.OutOrStdout())
+	},
+}
+
+// explanation is the outcome of replaying an admission
+type explanation struct {
+	Decisions []webhook.Decision `json:"decisions"`
+	Patch     json.RawMessage    `json:"patch"`
+}
+
+// WriteText writes the decisions as table, followed by the filter results and the patch
+func (e *explanation) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONTAINER\tIMAGE\tRESULT\tCOPY\tTARGET")
+	for _, decision := range e.Decisions {
+		copyPolicy := decision.Copy
+		if copyPolicy == "" {
+			copyPolicy = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", containerName(decision), decision.SourceImage, decision.Result, copyPolicy, decision.TargetImage)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, decision := range e.Decisions {
+		if len(decision.Filters) == 0 && decision.Error == "" {
+			continue
+		}
+
+		fmt.Fprintf(w, "\n%s:\n", containerName(decision))
+		for _, filter := range decision.Filters {
+			result, _ := json.Marshal(filter.Result)
+			fmt.Fprintf(w, "  filter %q => %s", filter.JMESPath, result)
+			if filter.Matched {
+				fmt.Fprint(w, " (matched)")
+			}
+			if filter.Error != "" {
+				fmt.Fprintf(w, " (%s)", filter.Error)
+			}
+			fmt.Fprintln(w)
+		}
+		if decision.Error != "" {
+			fmt.Fprintf(w, "  error: %s\n", decision.Error)
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "\nPatch:\n%s\n", e.Patch)
+
+	return err
+}
+
+// containerName returns the name of the container, marking init containers
+func containerName(decision webhook.Decision) string {
+	if decision.InitContainer {
+		return decision.Container + " (init)"
+	}
+
+	return decision.Container
+}
+
+// explain mutates the pod of the review with the filters and policies of the configuration, without side effects.
+// The registry client answers whether images exist in the target registry, images are never copied.
+func explain(ctx context.Context, c *config.Config, registryClient registry.Client, review *admissionv1.AdmissionReview) (*explanation, error) {
+	settings, err := swapperSettings(c)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &explanation{Decisions: []webhook.Decision{}}
+	imageSwapper := webhook.NewImageSwapperWithOpts(registryClient,
+		webhook.DecisionsOnly(),
+		webhook.Decisions(func(decision webhook.Decision) {
+			result.Decisions = append(result.Decisions, decision)
+		}),
+	)
+	imageSwapper.UpdateSettings(settings)
+
+	wh, err := webhook.NewWebhook(imageSwapper)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := wh.Review(ctx, kwhmodel.NewAdmissionReviewV1(review))
+	if err != nil {
+		return nil, err
+	}
+
+	result.Patch = json.RawMessage("[]")
+	if mutating, ok := response.(*kwhmodel.MutatingAdmissionResponse); ok && len(mutating.JSONPatchPatch) > 0 {
+		result.Patch = mutating.JSONPatchPatch
+	}
+
+	return result, nil
+}
+
+// readAdmissionReview reads an AdmissionReview or a Pod manifest as JSON or YAML.
+// A pod is wrapped into the review of its creation in the namespace, unless the manifest sets one.
+func readAdmissionReview(data []byte, namespace string) (*admissionv1.AdmissionReview, error) {
+	data, err := utilyaml.ToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	typeMeta := metav1.TypeMeta{}
+	if err := json.Unmarshal(data, &typeMeta); err != nil {
+		return nil, err
+	}
+
+	switch typeMeta.Kind {
+	case "AdmissionReview":
+		review := &admissionv1.AdmissionReview{}
+		if err := json.Unmarshal(data, review); err != nil {
+			return nil, err
+		}
+		if review.Request == nil {
+			return nil, errors.New("AdmissionReview without request")
+		}
+
+		return review, nil
+	case "Pod":
+		pod := &corev1.Pod{}
+		if err := json.Unmarshal(data, pod); err != nil {
+			return nil, err
+		}
+		if pod.Namespace != "" {
+			namespace = pod.Namespace
+		}
+
+		return &admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "explain",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+				Namespace: namespace,
+				Name:      pod.Name,
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: data},
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported kind %q, must be one of [AdmissionReview Pod]", typeMeta.Kind)
+	}
+}
+
+func init() {
+	explainCmd.Flags().StringVarP(&explainFlags.file, "file", "f", "-", "file with an AdmissionReview or a Pod manifest, - reads stdin")
+	explainCmd.Flags().StringVarP(&explainFlags.namespace, "namespace", "n", "default", "namespace of a Pod manifest without namespace")
+	explainCmd.Flags().BoolVar(&explainFlags.imageExists, "image-exists", false, "assume the images exist in the target registry")
+	explainCmd.Flags().StringVarP(&explainFlags.output, "output", "o", "text", "format of the explanation: text or json")
+
+	rootCmd.AddCommand(explainCmd)
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func explainConfig() *config.Config {
+	return &config.Config{
+		ImageSwapPolicy: "exists",
+		Source: config.Source{
+			Filters: []config.JMESPathFilter{{JMESPath: "contains(container.image, 'ingress')"}},
+		},
+		Target: config.Registry{Type: "aws", AWS: config.AWS{AccountID: "123456789", Region: "ap-southeast-2"}},
+	}
+}
+
+// copyCountingClient counts the repositories created and images copied, explaining must not do either
+type copyCountingClient struct {
+	*registry.DryRunClient
+	copies int
+}
+
+func (c *copyCountingClient) CreateRepository(ctx context.Context, name string) error {
+	c.copies++
+	return nil
+}
+
+func (c *copyCountingClient) CopyImage(ctx context.Context, src types.ImageReference, srcCreds string, dest types.ImageReference, destCreds string) error {
+	c.copies++
+	return nil
+}
+
+func explainClient(t *testing.T, c *config.Config, imageExists bool) *copyCountingClient {
+	client, err := registry.NewDryRunClient(c.Target, imageExists)
+	require.NoError(t, err)
+
+	return &copyCountingClient{DryRunClient: client}
+}
+
+func TestExplain(t *testing.T) {
+	data, err := os.ReadFile("../test/requests/admissionreview-simple.json")
+	assert.NoError(t, err)
+	review, err := readAdmissionReview(data, "default")
+	assert.NoError(t, err)
+
+	client := explainClient(t, explainConfig(), false)
+	result, err := explain(context.Background(), explainConfig(), client, review)
+	assert.NoError(t, err)
+	assert.Zero(t, client.copies)
+
+	results := map[string]string{}
+	for _, decision := range result.Decisions {
+		results[decision.Container] = decision.Result
+	}
+	assert.Equal(t, map[string]string{
+		"nginx28":          "not_found",
+		"ingress-nginx28":  "filtered",
+		"skip-test-ecr":    "same_registry",
+		"skip-test-gar":    "filtered",
+		"init-container28": "not_found",
+	}, results)
+	assert.NotContains(t, string(result.Patch), "/spec/containers")
+
+	// the same review swaps the images if they exist
+	result, err = explain(context.Background(), explainConfig(), explainClient(t, explainConfig(), true), review)
+	assert.NoError(t, err)
+	assert.Contains(t, string(result.Patch), `{"op":"replace","path":"/spec/containers/0/image","value":"123456789.dkr.ecr.ap-southeast-2.amazonaws.com/docker.io/library/nginx:latest"}`)
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, result.WriteText(out))
+	assert.Contains(t, out.String(), "init-container28 (init)")
+	assert.Contains(t, out.String(), `filter "contains(container.image, 'ingress')" => true (matched)`)
+}
+
+func TestExplain_NeverCopies(t *testing.T) {
+	data, err := os.ReadFile("../test/requests/admissionreview-simple.json")
+	require.NoError(t, err)
+	review, err := readAdmissionReview(data, "default")
+	require.NoError(t, err)
+
+	for _, policy := range []string{"delayed", "immediate", "force"} {
+		c := explainConfig()
+		c.ImageCopyPolicy = policy
+		client := explainClient(t, c, false)
+
+		result, err := explain(context.Background(), c, client, review)
+		assert.NoError(t, err)
+		assert.Zero(t, client.copies, policy)
+		assert.Equal(t, policy, result.Decisions[0].Copy)
+	}
+}
+
+func TestReadAdmissionReview(t *testing.T) {
+	review, err := readAdmissionReview([]byte(`
+apiVersion: v1
+kind: Pod
+metadata:
+  name: nginx
+spec:
+  containers:
+    - name: nginx
+      image: nginx:latest
+`), "test-ns")
+	assert.NoError(t, err)
+	assert.Equal(t, "test-ns", review.Request.Namespace)
+	assert.Equal(t, "Pod", review.Request.Kind.Kind)
+
+	result, err := explain(context.Background(), explainConfig(), explainClient(t, explainConfig(), true), review)
+	assert.NoError(t, err)
+	assert.Len(t, result.Decisions, 1)
+	assert.Equal(t, "swapped", result.Decisions[0].Result)
+	assert.Equal(t, "delayed", result.Decisions[0].Copy)
+
+	_, err = readAdmissionReview([]byte(`{"apiVersion":"v1","kind":"Service"}`), "default")
+	assert.EqualError(t, err, `unsupported kind "Service", must be one of [AdmissionReview Pod]`)
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/estahn/k8s-image-swapper/pkg/backfill"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+	"github.com/estahn/k8s-image-swapper/pkg/secrets"
+	"github.com/estahn/k8s-image-swapper/pkg/webhook"
+	"github.com/spf13/cobra"
+)
+
+var mirrorFlags struct {
+	files       []string
+	concurrency int
+	dryRun      bool
+	journal     string
+	output      string
+}
+
+// mirrorCmd copies a list of images into the target registry, e.g. to pre-seed an air-gapped target
+var mirrorCmd = &cobra.Command{
+	Use:   "mirror",
+	Short: "Mirror a list of images",
+	Long: `Mirror a list of images into the target registry without a cluster, e.g. to pre-seed
+an air-gapped registry or a new region.
+
+The images are read from files or stdin, either as a list with an image per line, or from
+Kubernetes manifests like the output of "helm template" or "kubectl get -o yaml".
+The images are copied the same way the webhook does, including the naming in the target
+registry and the creation of repositories. Source filters do not apply.
+
+  helm template my-release my-chart | k8s-image-swapper mirror --journal mirror.journal`,
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if mirrorFlags.output != "text" && mirrorFlags.output != "json" {
+			return fmt.Errorf("unknown output format %q, must be one of [text json]", mirrorFlags.output)
+		}
+		if mirrorFlags.concurrency < 1 {
+			return errors.New("concurrency must be at least 1")
+		}
+
+		if configErr == nil {
+			configErr = config.Validate(cfg)
+		}
+		if configErr != nil {
+			return configErr
+		}
+
+		images, err := readImages(cmd.InOrStdin(), mirrorFlags.files)
+		if err != nil {
+			return err
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		imageSwapper, targetRegistryClient, closeRegistries, err := setupImageCopies(secrets.NewRegistriesImagePullSecretsProvider(), mirrorFlags.concurrency)
+		if err != nil {
+			return err
+		}
+		defer closeRegistries()
+
+		jobs := []queue.Job{}
+		skipped := 0
+		for _, image := range images {
+			job, err := imageSwapper.ImageJob(image)
+			if errors.Is(err, webhook.ErrTargetImage) {
+				skipped++
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("invalid image %q: %w", image, err)
+			}
+			jobs = append(jobs, job)
+		}
+
+		report, err := backfill.New(imageSwapper, targetRegistryClient,
+			backfill.Concurrency(mirrorFlags.concurrency),
+			backfill.DryRun(mirrorFlags.dryRun),
+			backfill.Journal(mirrorFlags.journal),
+			backfill.Progress(cmd.ErrOrStderr()),
+		).RunJobs(ctx, jobs)
+		if err != nil {
+			return err
+		}
+		report.Skipped = skipped
+
+		return writeReport(cmd, report, mirrorFlags.output)
+	},
+}
+
+// readImages reads the images of the files, "-" or no file reads stdin
+func readImages(stdin io.Reader, files []string) ([]string, error) {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	images := []string{}
+	for _, file := range files {
+		r := stdin
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			r = f
+		}
+
+		parsed, err := backfill.ParseImages(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		images = append(images, parsed...)
+	}
+
+	return images, nil
+}
+
+func init() {
+	mirrorCmd.Flags().StringSliceVarP(&mirrorFlags.files, "file", "f", nil, "file with a list of images or manifests, - reads stdin (default is stdin)")
+	mirrorCmd.Flags().IntVar(&mirrorFlags.concurrency, "concurrency", backfill.DefaultConcurrency, "number of images copied in parallel")
+	mirrorCmd.Flags().BoolVar(&mirrorFlags.dryRun, "dry-run", false, "only report the images missing in the target registry")
+	mirrorCmd.Flags().StringVar(&mirrorFlags.journal, "journal", "", "file recording completed images, a rerun skips them")
+	mirrorCmd.Flags().StringVarP(&mirrorFlags.output, "output", "o", "json", "format of the summary: json or text")
+
+	rootCmd.AddCommand(mirrorCmd)
+}
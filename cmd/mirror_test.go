@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadImages(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "images.txt")
+	assert.NoError(t, os.WriteFile(file, []byte("nginx:latest\nredis:7\n"), 0o644))
+	stdin := strings.NewReader("apiVersion: v1\nkind: Pod\nspec:\n  containers:\n    - name: app\n      image: ghcr.io/example/app:1.0\n")
+
+	images, err := readImages(stdin, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ghcr.io/example/app:1.0"}, images)
+
+	images, err = readImages(strings.NewReader("busybox:1.36"), []string{file, "-"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nginx:latest", "redis:7", "busybox:1.36"}, images)
+
+	_, err = readImages(stdin, []string{filepath.Join(t.TempDir(), "missing.txt")})
+	assert.Error(t, err)
+}
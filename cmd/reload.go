@@ -0,0 +1,276 @@
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/metrics"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/estahn/k8s-image-swapper/pkg/secrets"
+	"github.com/estahn/k8s-image-swapper/pkg/types"
+	"github.com/estahn/k8s-image-swapper/pkg/webhook"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// flagConfig holds the configuration set by flags before the config file is read, a reload starts from it
+var flagConfig config.Config
+
+// sourceRegistry is a source registry client along with the configuration it was created from
+type sourceRegistry struct {
+	config config.Registry
+	client registry.Client
+}
+
+// newSourceRegistries creates a client for each source registry
+func newSourceRegistries(registries []config.Registry, newClient func(config.Registry) (registry.Client, error)) ([]sourceRegistry, error) {
+	sources := []sourceRegistry{}
+	for _, reg := range registries {
+		client, err := newClient(reg)
+		if err != nil {
+			closeSourceRegistries(sources)
+			return nil, fmt.Errorf("error connecting to source registry at %s: %w", reg.Domain(), err)
+		}
+		sources = append(sources, sourceRegistry{config: reg, client: client})
+	}
+
+	return sources, nil
+}
+
+// closeSourceRegistries stops the background work of the clients
+func closeSourceRegistries(sources []sourceRegistry) {
+	for _, source := range sources {
+		source.client.Close()
+	}
+}
+
+// reloader applies a changed configuration at runtime.
+// Filters, policies, the copy deadline, source registries and credentials and the log level are reloaded,
+// all other settings require a restart.
+type reloader struct {
+	mu sync.Mutex
+
+	config           *config.Config
+	imageSwapper     *webhook.ImageSwapper
+	secretsProvider  secrets.ImagePullSecretsProvider
+	sourceRegistries []sourceRegistry
+
+	// newClient creates the client of a source registry
+	newClient func(config.Registry) (registry.Client, error)
+}
+
+// SourceRegistryClients returns the clients of the current source registries
+func (r *reloader) SourceRegistryClients() []registry.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return registryClients(r.sourceRegistries)
+}
+
+func registryClients(sources []sourceRegistry) []registry.Client {
+	clients := []registry.Client{}
+	for _, source := range sources {
+		clients = append(clients, source.client)
+	}
+
+	return clients
+}
+
+// Reload validates the configuration and applies it, the current configuration is kept if it is invalid.
+// Only clients of source registries with a changed configuration are created anew.
+func (r *reloader) Reload(next *config.Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := config.Validate(next); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// the policies are validated already
+	settings, _ := swapperSettings(next)
+
+	kept := map[int]bool{}
+	sources := []sourceRegistry{}
+	created := []sourceRegistry{}
+	for _, reg := range next.Source.Registries {
+		if index := r.findSourceRegistry(reg, kept); index >= 0 {
+			kept[index] = true
+			sources = append(sources, r.sourceRegistries[index])
+			continue
+		}
+
+		client, err := r.newClient(reg)
+		if err != nil {
+			closeSourceRegistries(created)
+			return fmt.Errorf("error connecting to source registry at %s: %w", reg.Domain(), err)
+		}
+		source := sourceRegistry{config: reg, client: client}
+		created = append(created, source)
+		sources = append(sources, source)
+	}
+
+	r.imageSwapper.UpdateSettings(settings)
+	r.secretsProvider.SetAuthenticatedRegistries(registryClients(sources))
+	r.secretsProvider.SetSourceCredentials(next.Source.Credentials)
+
+	replaced := []sourceRegistry{}
+	for index, source := range r.sourceRegistries {
+		if !kept[index] {
+			replaced = append(replaced, source)
+		}
+	}
+	r.sourceRegistries = sources
+
+	// copies running meanwhile may still use the credentials of the replaced registries
+	r.imageSwapper.AfterCredentialUsers(func() {
+		closeSourceRegistries(replaced)
+	})
+
+	if next.LogLevel != "" && next.LogLevel != r.config.LogLevel {
+		// the level is validated already
+		lvl, _ := zerolog.ParseLevel(next.LogLevel)
+		zerolog.SetGlobalLevel(lvl)
+	}
+
+	if changed := restartRequired(r.config, next); len(changed) > 0 {
+		log.Warn().Strs("settings", changed).Msg("changed settings require a restart to take effect")
+	}
+
+	log.Info().
+		Int("filters", len(settings.Filters)).
+		Str("imageSwapPolicy", settings.ImageSwapPolicy.String()).
+		Str("imageCopyPolicy", settings.ImageCopyPolicy.String()).
+		Dur("imageCopyDeadline", settings.ImageCopyDeadline).
+		Int("sourceRegistries", len(sources)).
+		Int("sourceRegistriesCreated", len(created)).
+		Int("sourceCredentials", len(next.Source.Credentials)).
+		Msg("configuration reloaded")
+
+	r.config = next
+
+	return nil
+}
+
+// findSourceRegistry returns the index of a current source registry with the same configuration, or -1
+func (r *reloader) findSourceRegistry(reg config.Registry, taken map[int]bool) int {
+	for index, source := range r.sourceRegistries {
+		if !taken[index] && reflect.DeepEqual(source.config, reg) {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// restartRequired lists the changed settings which are not reloaded
+func restartRequired(current *config.Config, next *config.Config) []string {
+	changed := []string{}
+	if current.LogFormat != next.LogFormat {
+		changed = append(changed, "logFormat")
+	}
+	if current.DrainTimeout != next.DrainTimeout {
+		changed = append(changed, "drainTimeout")
+	}
+	if current.ShutdownDelay != next.ShutdownDelay {
+		changed = append(changed, "shutdownDelay")
+	}
+	if !reflect.DeepEqual(current.CopyQueue, next.CopyQueue) {
+		changed = append(changed, "copyQueue")
+	}
+	if current.CopyWorkers != next.CopyWorkers {
+		changed = append(changed, "copyWorkers")
+	}
+	if !reflect.DeepEqual(current.CopyLimits, next.CopyLimits) {
+		changed = append(changed, "copyLimits")
+	}
+	if !reflect.DeepEqual(current.Bandwidth, next.Bandwidth) {
+		changed = append(changed, "bandwidth")
+	}
+	if current.Tracing != next.Tracing {
+		changed = append(changed, "tracing")
+	}
+	if current.Events != next.Events {
+		changed = append(changed, "events")
+	}
+	if current.TLS != next.TLS {
+		changed = append(changed, "tls")
+	}
+	if current.Resync != next.Resync {
+		changed = append(changed, "resync")
+	}
+	if current.GC != next.GC {
+		changed = append(changed, "gc")
+	}
+	if current.Status != next.Status {
+		changed = append(changed, "status")
+	}
+	if current.Cache != next.Cache {
+		changed = append(changed, "cache")
+	}
+	if current.LeaderElection != next.LeaderElection {
+		changed = append(changed, "leaderElection")
+	}
+	if !reflect.DeepEqual(current.Target, next.Target) {
+		changed = append(changed, "target")
+	}
+
+	return changed
+}
+
+// swapperSettings returns the reloadable settings of the image swapper, policies which are not set fall back to their default
+func swapperSettings(c *config.Config) (webhook.Settings, error) {
+	imageSwapPolicy, err := types.ParseImageSwapPolicy(c.ImageSwapPolicy)
+	if err != nil && c.ImageSwapPolicy != "" {
+		return webhook.Settings{}, err
+	}
+
+	imageCopyPolicy, err := types.ParseImageCopyPolicy(c.ImageCopyPolicy)
+	if err != nil && c.ImageCopyPolicy != "" {
+		return webhook.Settings{}, err
+	}
+
+	imageCopyDeadline := config.DefaultImageCopyDeadline
+	if c.ImageCopyDeadline != 0 {
+		imageCopyDeadline = c.ImageCopyDeadline
+	}
+
+	return webhook.Settings{
+		Filters:           c.Source.Filters,
+		ImageSwapPolicy:   imageSwapPolicy,
+		ImageCopyPolicy:   imageCopyPolicy,
+		ImageCopyDeadline: imageCopyDeadline,
+	}, nil
+}
+
+// loadConfig reads the configuration from viper on top of the flags
+func loadConfig() (*config.Config, error) {
+	next := flagConfig
+	if err := config.Unmarshal(viper.GetViper(), &next); err != nil {
+		return nil, err
+	}
+
+	return &next, nil
+}
+
+// reloadConfig loads the configuration and applies it, the trigger (e.g. watch or SIGHUP) is logged
+func (r *reloader) reloadConfig(trigger string) {
+	next, err := loadConfig()
+	if err == nil {
+		err = r.Reload(next)
+	}
+
+	if err != nil {
+		metrics.ConfigReloads.WithLabelValues("failure").Inc()
+		log.Err(err).Str("trigger", trigger).Msg("configuration reload failed, keeping the current configuration")
+		return
+	}
+
+	// background work started later, e.g. on a change of the leader, reads the reloaded configuration
+	setConfig(next)
+
+	metrics.ConfigReloads.WithLabelValues("success").Inc()
+	metrics.ConfigLastReloadSuccess.SetToCurrentTime()
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/estahn/k8s-image-swapper/pkg/secrets"
+	"github.com/estahn/k8s-image-swapper/pkg/types"
+	"github.com/estahn/k8s-image-swapper/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRegistryClient records whether it was closed
+type fakeRegistryClient struct {
+	registry.Client
+	endpoint string
+	closed   atomic.Bool
+}
+
+func (f *fakeRegistryClient) Endpoint() string { return f.endpoint }
+func (f *fakeRegistryClient) Close()           { f.closed.Store(true) }
+
+func gar(repositoryID string) config.Registry {
+	return config.Registry{Type: "gcp", GCP: config.GCP{Location: "us-central1", ProjectID: "test-project", RepositoryID: repositoryID}}
+}
+
+func testConfig(registries ...config.Registry) *config.Config {
+	return &config.Config{
+		LogLevel:        "info",
+		ImageSwapPolicy: "exists",
+		ImageCopyPolicy: "delayed",
+		Source:          config.Source{Registries: registries},
+		Target:          gar("target"),
+	}
+}
+
+func newTestReloader(t *testing.T, c *config.Config) (*reloader, *[]*fakeRegistryClient) {
+	created := []*fakeRegistryClient{}
+	newClient := func(reg config.Registry) (registry.Client, error) {
+		if reg.GCP.RepositoryID == "unreachable" {
+			return nil, errors.New("unreachable")
+		}
+		client := &fakeRegistryClient{endpoint: reg.Domain()}
+		created = append(created, client)
+		return client, nil
+	}
+
+	sources, err := newSourceRegistries(c.Source.Registries, newClient)
+	assert.NoError(t, err)
+
+	return &reloader{
+		config:           c,
+		imageSwapper:     webhook.NewImageSwapperWithOpts(nil),
+		secretsProvider:  secrets.NewDummyImagePullSecretsProvider(),
+		sourceRegistries: sources,
+		newClient:        newClient,
+	}, &created
+}
+
+func TestReloader_Reload(t *testing.T) {
+	r, created := newTestReloader(t, testConfig(gar("a"), gar("b")))
+	a, b := (*created)[0], (*created)[1]
+
+	next := testConfig(gar("b"), gar("c"))
+	next.ImageSwapPolicy = "always"
+	next.ImageCopyPolicy = "none"
+	next.ImageCopyDeadline = time.Minute
+	next.Source.Filters = []config.JMESPathFilter{{JMESPath: "obj.metadata.namespace == 'kube-system'"}}
+
+	assert.NoError(t, r.Reload(next))
+
+	// only the client of the added registry is created, the removed one is closed
+	assert.Len(t, *created, 3)
+	c := (*created)[2]
+	assert.Eventually(t, a.closed.Load, time.Second, 10*time.Millisecond)
+	assert.False(t, b.closed.Load())
+	assert.False(t, c.closed.Load())
+	assert.Equal(t, []registry.Client{b, c}, r.SourceRegistryClients())
+	assert.Same(t, next, r.config)
+}
+
+func TestReloader_ReloadInvalid(t *testing.T) {
+	current := testConfig(gar("a"))
+	r, created := newTestReloader(t, current)
+
+	invalid := []*config.Config{
+		testConfig(gar("a"), config.Registry{Type: "gcp"}),
+		func() *config.Config {
+			c := testConfig(gar("a"))
+			c.ImageSwapPolicy = "sometimes"
+			return c
+		}(),
+		func() *config.Config {
+			c := testConfig(gar("a"))
+			c.Source.Filters = []config.JMESPathFilter{{JMESPath: "obj.metadata.namespace =="}}
+			return c
+		}(),
+		// creating the client fails, the other new client is closed again
+		testConfig(gar("b"), gar("unreachable")),
+	}
+
+	for _, next := range invalid {
+		assert.Error(t, r.Reload(next))
+		assert.Same(t, current, r.config)
+		assert.Equal(t, []registry.Client{(*created)[0]}, r.SourceRegistryClients())
+	}
+
+	assert.Len(t, *created, 2)
+	assert.False(t, (*created)[0].closed.Load())
+	assert.True(t, (*created)[1].closed.Load())
+}
+
+func TestSwapperSettings(t *testing.T) {
+	settings, err := swapperSettings(&config.Config{})
+	assert.NoError(t, err)
+	assert.Equal(t, webhook.Settings{
+		ImageSwapPolicy:   types.ImageSwapPolicyExists,
+		ImageCopyPolicy:   types.ImageCopyPolicyDelayed,
+		ImageCopyDeadline: config.DefaultImageCopyDeadline,
+	}, settings)
+
+	_, err = swapperSettings(&config.Config{ImageCopyPolicy: "later"})
+	assert.Error(t, err)
+}
+
+func TestRestartRequired(t *testing.T) {
+	current := testConfig(gar("a"))
+	next := testConfig(gar("b"))
+	next.ImageCopyPolicy = "immediate"
+	assert.Empty(t, restartRequired(current, next))
+
+	next.Target = gar("other")
+	next.CopyQueue.Capacity = 10
+	assert.Equal(t, []string{"copyQueue", "target"}, restartRequired(current, next))
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	// a mounted ConfigMap resolves the file through a symlink to a versioned directory
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "v1"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "v1", "config.yaml"), []byte("logLevel: info"), 0o600))
+	require.NoError(t, os.Symlink("v1", filepath.Join(dir, "data")))
+	require.NoError(t, os.Symlink(filepath.Join("data", "config.yaml"), filepath.Join(dir, "config.yaml")))
+
+	triggers := make(chan string, 1)
+	require.NoError(t, watchConfigFile(filepath.Join(dir, "config.yaml"), triggers))
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "v2"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "v2", "config.yaml"), []byte("logLevel: debug"), 0o600))
+	require.NoError(t, os.Symlink("v2", filepath.Join(dir, "data.tmp")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "data.tmp"), filepath.Join(dir, "data")))
+
+	select {
+	case trigger := <-triggers:
+		assert.Equal(t, "watch", trigger)
+	case <-time.After(time.Second):
+		assert.Fail(t, "no reload triggered by the swapped ConfigMap")
+	}
+
+	// triggers arriving while a reload is pending are coalesced
+	triggerReload(triggers, "SIGHUP")
+	triggerReload(triggers, "SIGHUP")
+	assert.Len(t, triggers, 1)
+}
@@ -23,32 +23,84 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/alitto/pond"
+	"github.com/estahn/k8s-image-swapper/pkg/backfill"
+	"github.com/estahn/k8s-image-swapper/pkg/bandwidth"
+	"github.com/estahn/k8s-image-swapper/pkg/certs"
 	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/gc"
+	"github.com/estahn/k8s-image-swapper/pkg/health"
+	"github.com/estahn/k8s-image-swapper/pkg/inventory"
+	"github.com/estahn/k8s-image-swapper/pkg/leader"
+	"github.com/estahn/k8s-image-swapper/pkg/metrics"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
 	"github.com/estahn/k8s-image-swapper/pkg/registry"
 	"github.com/estahn/k8s-image-swapper/pkg/secrets"
+	"github.com/estahn/k8s-image-swapper/pkg/status"
+	"github.com/estahn/k8s-image-swapper/pkg/tracing"
 	"github.com/estahn/k8s-image-swapper/pkg/types"
 	"github.com/estahn/k8s-image-swapper/pkg/webhook"
+	"github.com/fsnotify/fsnotify"
 	homedir "github.com/mitchellh/go-homedir"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	kwhhttp "github.com/slok/kubewebhook/v2/pkg/http"
+	kwhprometheus "github.com/slok/kubewebhook/v2/pkg/metrics/prometheus"
+	kwhotel "github.com/slok/kubewebhook/v2/pkg/tracing/otel"
+	kwhwebhook "github.com/slok/kubewebhook/v2/pkg/webhook"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 )
 
 var cfgFile string
 var cfg *config.Config = &config.Config{}
 
+// cfgMu guards cfg once the configuration is reloaded at runtime
+var cfgMu sync.RWMutex
+
+// currentConfig returns the configuration applied last, background work started after a reload reads it
+func currentConfig() *config.Config {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+
+	return cfg
+}
+
+// setConfig replaces the configuration after a reload
+func setConfig(c *config.Config) {
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
+
+	cfg = c
+}
+
+// configErr holds the error of reading the config file, commands relying on it refuse to start
+var configErr error
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "k8s-image-swapper",
@@ -59,23 +111,37 @@ A mutating webhook for Kubernetes, pointing the images to a new location.`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	Run: func(cmd *cobra.Command, args []string) {
-		//promReg := prometheus.NewRegistry()
-		//metricsRec := metrics.NewPrometheus(promReg)
 		log.Trace().Interface("config", cfg).Msg("config")
 
+		if configErr == nil {
+			configErr = config.Validate(cfg)
+		}
+		if configErr != nil {
+			log.Err(configErr).Msg("invalid configuration")
+			os.Exit(1)
+		}
+
+		shutdownTracing, err := setupTracing()
+		if err != nil {
+			log.Err(err).Msg("error configuring tracing")
+			os.Exit(1)
+		}
+
+		newRegistryClient, closeCache, err := setupRegistryCache()
+		if err != nil {
+			log.Err(err).Msg("error configuring registry cache")
+			os.Exit(1)
+		}
+
 		// Create registry clients for source registries
-		sourceRegistryClients := []registry.Client{}
-		for _, reg := range cfg.Source.Registries {
-			sourceRegistryClient, err := registry.NewClient(reg)
-			if err != nil {
-				log.Err(err).Msgf("error connecting to source registry at %s", reg.Domain())
-				os.Exit(1)
-			}
-			sourceRegistryClients = append(sourceRegistryClients, sourceRegistryClient)
+		sourceRegistries, err := newSourceRegistries(cfg.Source.Registries, newRegistryClient)
+		if err != nil {
+			log.Err(err).Msg("error creating source registry clients")
+			os.Exit(1)
 		}
 
 		// Create a registry client for private target registry
-		targetRegistryClient, err := registry.NewClient(cfg.Target)
+		targetRegistryClient, err := newRegistryClient(cfg.Target)
 		if err != nil {
 			log.Err(err).Msgf("error connecting to target registry at %s", cfg.Target.Domain())
 			os.Exit(1)
@@ -96,24 +162,121 @@ A mutating webhook for Kubernetes, pointing the images to a new location.`,
 			imageCopyDeadline = cfg.ImageCopyDeadline
 		}
 
-		imagePullSecretProvider := setupImagePullSecretsProvider()
+		kubernetesClient, err := setupKubernetesClient()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to configure Kubernetes client, will continue without reading secrets")
+		}
+
+		imagePullSecretProvider := setupImagePullSecretsProvider(kubernetesClient)
 
 		// Inform secret provider about managed private source registries
-		imagePullSecretProvider.SetAuthenticatedRegistries(sourceRegistryClients)
+		imagePullSecretProvider.SetAuthenticatedRegistries(registryClients(sourceRegistries))
+		imagePullSecretProvider.SetSourceCredentials(cfg.Source.Credentials)
+
+		tlsCertificates, stopTLS, err := setupTLS(kubernetesClient)
+		if err != nil {
+			log.Err(err).Msg("error configuring TLS")
+			os.Exit(1)
+		}
+
+		eventRecorder, shutdownEvents, err := setupEventRecorder(kubernetesClient)
+		if err != nil {
+			log.Err(err).Msg("error configuring events")
+			os.Exit(1)
+		}
+
+		copyQueueOptions, err := setupCopyQueue(kubernetesClient)
+		if err != nil {
+			log.Err(err).Msg("error configuring copy queue")
+			os.Exit(1)
+		}
 
-		wh, err := webhook.NewImageSwapperWebhookWithOpts(
-			targetRegistryClient,
+		bandwidthProxy, err := setupBandwidth()
+		if err != nil {
+			log.Err(err).Msg("error configuring bandwidth limiter")
+			os.Exit(1)
+		}
+
+		imageInventory := inventory.New()
+
+		imageSwapperOptions := append(setupCopyWorkers(),
 			webhook.Filters(cfg.Source.Filters),
 			webhook.ImagePullSecretsProvider(imagePullSecretProvider),
 			webhook.ImageSwapPolicy(imageSwapPolicy),
 			webhook.ImageCopyPolicy(imageCopyPolicy),
 			webhook.ImageCopyDeadline(imageCopyDeadline),
+			webhook.CopyQueue(copyQueueOptions...),
+			webhook.CopyLimits(cfg.CopyLimits),
+			webhook.Bandwidth(bandwidthProxy),
+			webhook.EventRecorder(eventRecorder),
+			webhook.Inventory(imageInventory),
 		)
+		if kubernetesClient != nil {
+			imageSwapperOptions = append(imageSwapperOptions, webhook.ResyncPods(listPods(kubernetesClient)))
+		}
+		imageSwapper := webhook.NewImageSwapperWithOpts(targetRegistryClient, imageSwapperOptions...)
+
+		collector, stopGC, err := setupGC(kubernetesClient, targetRegistryClient, imageInventory)
+		if err != nil {
+			log.Err(err).Msg("error configuring garbage collection")
+			os.Exit(1)
+		}
+
+		singletons := []leader.Task{
+			func() func() { return startResync(imageSwapper) },
+			func() func() { return startGC(collector) },
+		}
+
+		// a shared cache is warmed by the leader for all replicas, a cache in memory by each replica
+		stopCacheWarmup := func() {}
+		warmCache := func() func() { return startCacheWarmup(targetRegistryClient) }
+		if cacheType, _ := types.ParseCacheType(cfg.Cache.Type); cacheType == types.CacheTypeRedis {
+			singletons = append(singletons, warmCache)
+		} else {
+			stopCacheWarmup = warmCache()
+		}
+
+		stopSingletons, err := startLeaderElection(kubernetesClient, singletons...)
+		if err != nil {
+			log.Err(err).Msg("error configuring leader election")
+			os.Exit(1)
+		}
+
+		// Apply changes of the config file, or on SIGHUP, without a restart
+		configReloader := &reloader{
+			config:           cfg,
+			imageSwapper:     imageSwapper,
+			secretsProvider:  imagePullSecretProvider,
+			sourceRegistries: sourceRegistries,
+			newClient:        newRegistryClient,
+		}
+		metrics.ConfigLastReloadSuccess.SetToCurrentTime()
+		watchConfig(configReloader)
+
+		if err := metrics.RegisterCopyQueue(prometheus.DefaultRegisterer, imageSwapper.Queue()); err != nil {
+			log.Err(err).Msg("error registering copy queue metrics")
+		}
+		if err := metrics.RegisterCopyLanes(prometheus.DefaultRegisterer, imageSwapper.CopyLanes()); err != nil {
+			log.Err(err).Msg("error registering copy lane metrics")
+		}
+
+		wh, err := webhook.NewWebhook(imageSwapper)
 		if err != nil {
 			log.Err(err).Msg("error creating webhook")
 			os.Exit(1)
 		}
 
+		// Measure admission reviews and their latency
+		metricsRecorder, err := kwhprometheus.NewRecorder(kwhprometheus.RecorderConfig{Registry: prometheus.DefaultRegisterer})
+		if err != nil {
+			log.Err(err).Msg("error creating webhook metrics recorder")
+			os.Exit(1)
+		}
+		wh = kwhwebhook.NewMeasuredWebhook(metricsRecorder, wh)
+
+		// Trace admission reviews, spans of the image swapper become children of the review
+		wh = kwhwebhook.NewTracedWebhook(kwhotel.NewTracer(otel.GetTracerProvider(), tracing.Propagator()), wh)
+
 		// Get the handler for our webhook.
 		whHandler, err := kwhhttp.HandlerFor(kwhhttp.HandlerConfig{Webhook: wh})
 		if err != nil {
@@ -121,22 +284,64 @@ A mutating webhook for Kubernetes, pointing the images to a new location.`,
 			os.Exit(1)
 		}
 
+		statusAuth, err := setupStatusAuth(kubernetesClient)
+		if err != nil {
+			log.Err(err).Msg("error configuring status page")
+			os.Exit(1)
+		}
+		// the copy queue and the garbage collection report require the authentication of the status page if enabled
+		protect := func(handler http.Handler) http.Handler {
+			if statusAuth == nil {
+				return handler
+			}
+			return statusAuth(handler)
+		}
+		// re-queueing dead-lettered jobs is never served without authentication, Kubernetes auth applies without a status page
+		requeueAuth := statusAuth
+		if requeueAuth == nil && kubernetesClient != nil {
+			requeueAuth = status.KubernetesAuth(kubernetesClient)
+		}
+
+		healthChecks := setupHealthChecks(targetRegistryClient, configReloader.SourceRegistryClients, imageSwapper.Queue(), kubernetesClient, tlsCertificates)
+
 		handler := http.NewServeMux()
 		handler.Handle("/webhook", whHandler)
+		handler.Handle("/healthz", healthChecks.LivenessHandler())
+		handler.Handle("/readyz", healthChecks.ReadinessHandler())
 		handler.Handle("/metrics", promhttp.Handler())
-		handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			_, err := w.Write([]byte(`<html>
+		handler.Handle("/queue", protect(imageSwapper.Queue().BacklogHandler()))
+		handler.Handle("GET /queue/dead-letters", protect(imageSwapper.Queue().DeadLetterHandler()))
+		if requeueAuth != nil {
+			handler.Handle("POST /queue/dead-letters", requeueAuth(imageSwapper.Queue().DeadLetterHandler()))
+		} else {
+			handler.Handle("POST /queue/dead-letters", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "re-queueing dead-lettered jobs requires authentication, configure status.auth", http.StatusForbidden)
+			}))
+		}
+		if collector != nil {
+			handler.Handle("/gc", protect(collector.ReportHandler()))
+		}
+		if statusAuth != nil {
+			statusServer := status.New(imageInventory, imageSwapper.Queue(), func() []registry.Client {
+				return append([]registry.Client{targetRegistryClient}, configReloader.SourceRegistryClients()...)
+			})
+			handler.Handle("/", statusAuth(statusServer.Handler()))
+		} else {
+			// without status page the index only links the unauthenticated endpoints
+			handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				_, err := w.Write([]byte(`<html>
 			 <head><title>k8s-image-webhook</title></head>
 			 <body>
 			 <h1>k8s-image-webhook</h1>
-			 <ul><li><a href='/metrics'>Metrics</a></li><li><a href='/webhook'>Webhook</a></li></ul>
+			 <ul><li><a href='/metrics'>Metrics</a></li><li><a href='/healthz'>Liveness</a></li><li><a href='/readyz'>Readiness</a></li><li><a href='/webhook'>Webhook</a></li></ul>
 			 </body>
 			 </html>`))
 
-			if err != nil {
-				log.Error()
-			}
-		})
+				if err != nil {
+					log.Err(err).Msg("error writing index page")
+				}
+			})
+		}
 
 		srv := &http.Server{
 			Addr: cfg.ListenAddress,
@@ -149,14 +354,15 @@ A mutating webhook for Kubernetes, pointing the images to a new location.`,
 
 		go func() {
 			log.Info().Msgf("Listening on %v", cfg.ListenAddress)
-			//err = http.ListenAndServeTLS(":8080", cfg.certFile, cfg.keyFile, whHandler)
-			if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
-				if err := srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			if tlsCertificates != nil {
+				// the certificate is looked up per handshake, so renewals are served without a restart
+				srv.TLSConfig = tlsCertificates.TLSConfig()
+				if err := srv.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
 					log.Err(err).Msg("error serving webhook")
 					os.Exit(1)
 				}
 			} else {
-				if err := srv.ListenAndServe(); err != nil {
+				if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 					log.Err(err).Msg("error serving webhook")
 					os.Exit(1)
 				}
@@ -171,23 +377,192 @@ A mutating webhook for Kubernetes, pointing the images to a new location.`,
 		// Block until we receive our signal.
 		<-c
 
-		// Create a deadline to wait for.
-		var wait time.Duration
-		ctx, cancel := context.WithTimeout(context.Background(), wait)
+		drainTimeout := config.DefaultDrainTimeout
+		if timeout := currentConfig().DrainTimeout; timeout != 0 {
+			drainTimeout = timeout
+		}
+		shutdownDelay := config.DefaultShutdownDelay
+		if delay := currentConfig().ShutdownDelay; delay != 0 {
+			shutdownDelay = delay
+		}
+
+		// Create a deadline to wait for, the delay counts towards it.
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
 		defer cancel()
-		// Doesn't block if no connections, but will otherwise wait
-		// until the timeout deadline.
+
+		log.Info().Dur("drainTimeout", drainTimeout).Dur("shutdownDelay", shutdownDelay).Msg("Draining")
+		healthChecks.ShuttingDown()
+
+		// Keep accepting admissions until the endpoints no longer route to the failing readiness
+		select {
+		case <-time.After(shutdownDelay):
+		case <-ctx.Done():
+		}
+
+		// Stop accepting admissions and wait for in-flight requests, including immediate copies
 		if err := srv.Shutdown(ctx); err != nil {
 			log.Err(err).Msg("Error during shutdown")
 		}
-		// Optionally, you could run srv.Shutdown in a goroutine and block on
-		// <-ctx.Done() if your application should wait for other services
-		// to finalize based on context cancellation.
+
+		// Stop comparing digests before the queue stops accepting copies of drifted images,
+		// stop deleting unreferenced images and release the leadership
+		stopSingletons()
+		stopGC()
+
+		// Stop listing the target registry
+		stopCacheWarmup()
+
+		// Let queued and in-flight copy jobs finish until the deadline
+		abandoned := imageSwapper.Queue().Stop(ctx)
+		for _, job := range abandoned {
+			log.Warn().
+				Str("job", job.ID).
+				Str("source-image", job.SourceImage).
+				Str("target-image", job.TargetImage).
+				Bool("persisted", imageSwapper.Queue().Persistent()).
+				Msg("copy job not completed before shutdown")
+		}
+		log.Info().
+			Int("abandoned", len(abandoned)).
+			Bool("persisted", imageSwapper.Queue().Persistent()).
+			Msg("copy queue drained")
+
+		// Abort the transfers of copies still running
+		if err := bandwidthProxy.Close(); err != nil {
+			log.Err(err).Msg("error stopping bandwidth limiter")
+		}
+
+		// Stop background work of the registry clients
+		targetRegistryClient.Close()
+		for _, sourceRegistryClient := range configReloader.SourceRegistryClients() {
+			sourceRegistryClient.Close()
+		}
+		closeCache()
+
+		// Stop watching and renewing certificates
+		stopTLS()
+
+		// Send pending events
+		shutdownEvents()
+
+		// Flush pending spans, the drain deadline may have passed already
+		tracingCtx, tracingCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer tracingCancel()
+		if err := shutdownTracing(tracingCtx); err != nil {
+			log.Err(err).Msg("error flushing traces")
+		}
+
 		log.Info().Msg("Shutting down")
 		os.Exit(0)
 	},
 }
 
+// setupTracing configures the export of traces if enabled, the returned function flushes pending spans
+func setupTracing() (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	if !cfg.Tracing.Enabled {
+		return noop, nil
+	}
+
+	if err := config.CheckTracingConfiguration(cfg.Tracing); err != nil {
+		return noop, err
+	}
+
+	shutdown, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		return noop, err
+	}
+
+	log.Info().
+		Str("endpoint", cfg.Tracing.Endpoint).
+		Float64("samplingRatio", cfg.Tracing.SamplingRatio).
+		Msg("exporting traces via OTLP")
+
+	return shutdown, nil
+}
+
+// watchConfig reloads the configuration when the config file changes or on SIGHUP.
+// All triggers are applied one after another by a single goroutine, triggers arriving meanwhile are coalesced.
+func watchConfig(r *reloader) {
+	triggers := make(chan string, 1)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			triggerReload(triggers, "SIGHUP")
+		}
+	}()
+
+	if file := viper.ConfigFileUsed(); file == "" {
+		log.Debug().Msg("no config file to watch")
+	} else if err := watchConfigFile(file, triggers); err != nil {
+		log.Err(err).Str("file", file).Msg("error watching config file, reloads are triggered by SIGHUP only")
+	}
+
+	go func() {
+		for trigger := range triggers {
+			if err := viper.ReadInConfig(); err != nil {
+				metrics.ConfigReloads.WithLabelValues("failure").Inc()
+				log.Err(err).Str("trigger", trigger).Msg("configuration reload failed, keeping the current configuration")
+				continue
+			}
+			r.reloadConfig(trigger)
+		}
+	}()
+}
+
+// triggerReload requests a reload unless one is pending already, the pending reload reads the latest config file
+func triggerReload(triggers chan<- string, trigger string) {
+	select {
+	case triggers <- trigger:
+	default:
+	}
+}
+
+// watchConfigFile requests a reload when the config file is written or replaced.
+// The directory is watched, as a mounted ConfigMap is updated by swapping the symlink the file resolves through.
+func watchConfigFile(file string, triggers chan<- string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	configFile := filepath.Clean(file)
+	realConfigFile, _ := filepath.EvalSymlinks(configFile)
+	if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				currentConfigFile, _ := filepath.EvalSymlinks(configFile)
+				written := filepath.Clean(event.Name) == configFile && event.Op&(fsnotify.Write|fsnotify.Create) != 0
+				swapped := currentConfigFile != "" && currentConfigFile != realConfigFile
+				if written || swapped {
+					realConfigFile = currentConfigFile
+					triggerReload(triggers, "watch")
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Err(err).Msg("error watching config file")
+			}
+		}
+	}()
+
+	return nil
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -247,15 +622,12 @@ func initConfig() {
 		log.Info().Str("file", viper.ConfigFileUsed()).Msg("using config file")
 	}
 
-	if err := viper.Unmarshal(&cfg); err != nil {
-		log.Err(err).Msg("failed to unmarshal the config file")
-	}
+	// remember the flags, a reload applies the config file on top of them
+	flagConfig = *cfg
 
-	//validate := validator.New()
-	//if err := validate.Struct(cfg); err != nil {
-	//	validationErrors := err.(validator.ValidationErrors)
-	//	log.Err(validationErrors).Msg("validation errors for config file")
-	//}
+	if err := config.Unmarshal(viper.GetViper(), cfg); err != nil {
+		configErr = fmt.Errorf("failed to unmarshal the config file: %w", err)
+	}
 }
 
 // initLogger configures the log level
@@ -278,19 +650,606 @@ func initLogger() {
 	}
 }
 
-// setupImagePullSecretsProvider configures the provider handling secrets
-func setupImagePullSecretsProvider() secrets.ImagePullSecretsProvider {
+// setupKubernetesClient configures a client for the cluster the webhook is running in
+func setupKubernetesClient() (kubernetes.Interface, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
-		log.Warn().Err(err).Msg("failed to configure Kubernetes client, will continue without reading secrets")
-		return secrets.NewDummyImagePullSecretsProvider()
+		return nil, err
 	}
 
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		log.Warn().Err(err).Msg("failed to configure Kubernetes client, will continue without reading secrets")
+		return nil, err
+	}
+
+	return clientset, nil
+}
+
+// setupImagePullSecretsProvider configures the provider handling secrets
+func setupImagePullSecretsProvider(clientset kubernetes.Interface) secrets.ImagePullSecretsProvider {
+	if clientset == nil {
 		return secrets.NewDummyImagePullSecretsProvider()
 	}
 
 	return secrets.NewKubernetesImagePullSecretsProvider(clientset)
 }
+
+// setupHealthChecks configures the checks of the dependencies reported by /healthz and /readyz
+func setupHealthChecks(targetRegistryClient registry.Client, sourceRegistryClients func() []registry.Client, copyQueue *queue.Queue, clientset kubernetes.Interface, tlsCertificates *certs.Reloader) *health.Health {
+	healthChecks := health.New()
+
+	// the token is renewed in the background, a restart would not make a failing renewal succeed
+	if renewer, ok := targetRegistryClient.(registry.TokenRenewer); ok {
+		healthChecks.AddReadinessCheck("target-registry-token", health.TokenCheck(renewer))
+	}
+
+	// the source registries change on a configuration reload, images of the other registries are still copied
+	healthChecks.AddDegradedCheck("source-registry-tokens", health.TokensCheck(sourceRegistryClients))
+
+	healthChecks.AddReadinessCheck("copy-queue", health.QueueCheck(copyQueue))
+
+	if clientset != nil {
+		healthChecks.AddReadinessCheck("kubernetes", health.KubernetesCheck(clientset))
+	}
+
+	if tlsCertificates != nil {
+		healthChecks.AddReadinessCheck("tls-certificate", health.ServedCertificateCheck(tlsCertificates.Leaf))
+	}
+
+	return healthChecks
+}
+
+// serviceAccountNamespaceFile holds the namespace of the pod
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// setupTLS configures the certificate served by the webhook, either read from files or self-managed,
+// the returned function stops watching and renewing it. Without certificate the webhook is served via HTTP.
+func setupTLS(clientset kubernetes.Interface) (*certs.Reloader, func(), error) {
+	selfManaged := cfg.TLS.SelfManaged
+	if !selfManaged.Enabled && (cfg.TLSCertFile == "" || cfg.TLSKeyFile == "") {
+		return nil, func() {}, nil
+	}
+
+	if err := config.CheckTLSConfiguration(cfg.TLS); err != nil {
+		return nil, func() {}, err
+	}
+
+	reloader := certs.NewReloader()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if !selfManaged.Enabled {
+		if err := certs.LoadFiles(reloader, cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			cancel()
+			return nil, func() {}, err
+		}
+
+		if err := certs.WatchFiles(ctx, reloader, cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			cancel()
+			return nil, func() {}, err
+		}
+
+		log.Info().Str("certFile", cfg.TLSCertFile).Msg("serving TLS certificate, reloaded on change")
+
+		return reloader, cancel, nil
+	}
+
+	if cfg.TLSCertFile != "" {
+		cancel()
+		return nil, func() {}, errors.New("self-managed certificates cannot be combined with --tls-cert-file")
+	}
+
+	if clientset == nil {
+		cancel()
+		return nil, func() {}, errors.New("self-managed certificates require a Kubernetes client")
+	}
+
+	if selfManaged.Namespace == "" {
+		namespace, err := os.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			cancel()
+			return nil, func() {}, fmt.Errorf("self-managed certificates require a namespace: %w", err)
+		}
+		selfManaged.Namespace = strings.TrimSpace(string(namespace))
+	}
+
+	manager := certs.NewManager(clientset, reloader, selfManaged)
+
+	reconcileCtx, reconcileCancel := context.WithTimeout(ctx, 30*time.Second)
+	defer reconcileCancel()
+	if err := manager.Reconcile(reconcileCtx); err != nil {
+		// the caBundle is updated on the next attempt as long as a certificate can be served
+		if reloader.Leaf() == nil {
+			cancel()
+			return nil, func() {}, err
+		}
+		log.Err(err).Str("webhook", selfManaged.WebhookName).Msg("failed updating caBundle of webhook configuration")
+	}
+
+	go manager.Run(ctx)
+
+	log.Info().
+		Str("namespace", selfManaged.Namespace).
+		Str("secret", selfManaged.SecretName).
+		Strs("dnsNames", manager.DNSNames()).
+		Msg("serving self-managed TLS certificate")
+
+	return reloader, cancel, nil
+}
+
+// setupEventRecorder configures the recorder of Kubernetes events if enabled, the returned function stops it.
+// Similar events are aggregated and rate-limited per object to avoid flooding the API server during rollouts.
+func setupEventRecorder(clientset kubernetes.Interface) (record.EventRecorder, func(), error) {
+	if !cfg.Events.Enabled {
+		return nil, func() {}, nil
+	}
+
+	if err := config.CheckEventsConfiguration(cfg.Events); err != nil {
+		return nil, func() {}, err
+	}
+
+	if clientset == nil {
+		return nil, func() {}, errors.New("events require a Kubernetes client")
+	}
+
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		QPS:       cfg.Events.QPS,
+		BurstSize: cfg.Events.Burst,
+	})
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "k8s-image-swapper"})
+
+	log.Info().Float32("qps", cfg.Events.QPS).Int("burst", cfg.Events.Burst).Msg("recording Kubernetes events")
+
+	return recorder, broadcaster.Shutdown, nil
+}
+
+// startResync re-syncs the mirrored tags in the background if enabled, the returned function stops it
+func startResync(imageSwapper *webhook.ImageSwapper) func() {
+	resync := currentConfig().Resync
+	if !resync.Enabled {
+		return func() {}
+	}
+
+	interval := config.DefaultResyncInterval
+	if resync.Interval != 0 {
+		interval = resync.Interval
+	}
+
+	ctx, cancel := context.WithCancel(log.Logger.WithContext(context.Background()))
+	go imageSwapper.RunResync(ctx, interval)
+
+	log.Info().Dur("interval", interval).Msg("re-syncing mirrored tags")
+
+	return cancel
+}
+
+// listPods returns a function listing the pods of all namespaces in pages, the re-sync covers pods admitted by any replica
+func listPods(clientset kubernetes.Interface) func(ctx context.Context) ([]corev1.Pod, error) {
+	return func(ctx context.Context) ([]corev1.Pod, error) {
+		pods := []corev1.Pod{}
+		opts := metav1.ListOptions{Limit: 500}
+		for {
+			list, err := clientset.CoreV1().Pods("").List(ctx, opts)
+			if err != nil {
+				return nil, err
+			}
+			pods = append(pods, list.Items...)
+
+			if list.Continue == "" {
+				return pods, nil
+			}
+			opts.Continue = list.Continue
+		}
+	}
+}
+
+// startCacheWarmup fills the cache of the target registry client at startup and periodically if enabled, the returned function stops it
+func startCacheWarmup(registryClient registry.Client) func() {
+	warmup := currentConfig().Cache.Warmup
+	if !warmup.Enabled {
+		return func() {}
+	}
+
+	interval := config.DefaultCacheWarmupInterval
+	if warmup.Interval != 0 {
+		interval = warmup.Interval
+	}
+	limits := registry.WarmupLimits{
+		MaxRepositories: config.DefaultCacheWarmupMaxRepositories,
+		MaxImages:       config.DefaultCacheWarmupMaxImages,
+	}
+	if warmup.MaxRepositories != 0 {
+		limits.MaxRepositories = warmup.MaxRepositories
+	}
+	if warmup.MaxImages != 0 {
+		limits.MaxImages = warmup.MaxImages
+	}
+
+	ctx, cancel := context.WithCancel(log.Logger.WithContext(context.Background()))
+	go registry.RunWarmup(ctx, registryClient, interval, limits)
+
+	log.Info().
+		Dur("interval", interval).
+		Int("maxRepositories", limits.MaxRepositories).
+		Int("maxImages", limits.MaxImages).
+		Msg("warming cache of target registry")
+
+	return cancel
+}
+
+// setupGC configures the garbage collection of unreferenced images if enabled, the returned function stops it.
+// Pods of all namespaces are watched to track the images they reference.
+func setupGC(clientset kubernetes.Interface, registryClient registry.Client, imageInventory *inventory.Inventory) (*gc.Collector, func(), error) {
+	if !cfg.GC.Enabled {
+		return nil, func() {}, nil
+	}
+
+	if err := config.CheckGCConfiguration(cfg.GC); err != nil {
+		return nil, func() {}, err
+	}
+
+	if clientset == nil {
+		return nil, func() {}, errors.New("garbage collection requires a Kubernetes client")
+	}
+
+	gracePeriod := config.DefaultGCGracePeriod
+	if cfg.GC.GracePeriod != 0 {
+		gracePeriod = cfg.GC.GracePeriod
+	}
+
+	namespace := cfg.GC.Namespace
+	if namespace == "" {
+		content, err := os.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return nil, func() {}, fmt.Errorf("garbage collection requires a namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(content))
+	}
+	configMap := config.DefaultGCConfigMap
+	if cfg.GC.ConfigMap != "" {
+		configMap = cfg.GC.ConfigMap
+	}
+
+	// replicas caching the existence of images in memory would keep swapping to deleted images
+	dryRun := cfg.GC.DryRun
+	if cacheType, _ := types.ParseCacheType(cfg.Cache.Type); !dryRun && cfg.LeaderElection.Enabled && cacheType != types.CacheTypeRedis {
+		log.Warn().Msg("deleting images with multiple replicas requires a redis cache, collecting in dry-run mode")
+		dryRun = true
+	}
+
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	podInformer := factory.Core().V1().Pods()
+	if err := podInformer.Informer().SetTransform(gc.TrimPod); err != nil {
+		return nil, func() {}, err
+	}
+
+	collector, err := gc.New(registryClient, podInformer,
+		gc.GracePeriod(gracePeriod),
+		gc.DryRun(dryRun),
+		gc.DeleteRepositories(cfg.GC.DeleteRepositories),
+		gc.Inventory(imageInventory),
+		gc.Templates(listTemplates(clientset)),
+		gc.Store(gc.NewConfigMapStore(clientset, namespace, configMap)),
+	)
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	// pods are tracked by all replicas, so the report is served by each and a new leader collects right away
+	ctx, cancel := context.WithCancel(context.Background())
+	factory.Start(ctx.Done())
+
+	log.Info().
+		Dur("gracePeriod", gracePeriod).
+		Bool("dryRun", dryRun).
+		Bool("deleteRepositories", cfg.GC.DeleteRepositories).
+		Msg("tracking images referenced by pods")
+
+	return collector, func() {
+		cancel()
+		factory.Shutdown()
+	}, nil
+}
+
+// listTemplates returns a function listing the pod templates of the workload controllers of all namespaces
+func listTemplates(clientset kubernetes.Interface) func(ctx context.Context) ([]*corev1.Pod, error) {
+	return func(ctx context.Context) ([]*corev1.Pod, error) {
+		workloads, err := backfill.ListTemplates(ctx, clientset, metav1.NamespaceAll)
+		if err != nil {
+			return nil, err
+		}
+
+		templates := make([]*corev1.Pod, 0, len(workloads))
+		for _, workload := range workloads {
+			templates = append(templates, workload.Pod)
+		}
+
+		return templates, nil
+	}
+}
+
+// startGC collects unreferenced images in the background if enabled, the returned function stops it
+func startGC(collector *gc.Collector) func() {
+	if collector == nil {
+		return func() {}
+	}
+
+	interval := config.DefaultGCInterval
+	if gcInterval := currentConfig().GC.Interval; gcInterval != 0 {
+		interval = gcInterval
+	}
+
+	ctx, cancel := context.WithCancel(log.Logger.WithContext(context.Background()))
+	go collector.Run(ctx, interval)
+
+	log.Info().Dur("interval", interval).Msg("collecting unreferenced images")
+
+	return cancel
+}
+
+// startLeaderElection starts the singleton background work on the leader only if enabled, otherwise right away.
+// The returned function stops the work and releases the leadership.
+func startLeaderElection(clientset kubernetes.Interface, tasks ...leader.Task) (func(), error) {
+	if !cfg.LeaderElection.Enabled {
+		stops := []func(){}
+		for _, task := range tasks {
+			stops = append(stops, task())
+		}
+		// every replica runs the work
+		metrics.Leader.Set(1)
+
+		return func() {
+			for _, stop := range stops {
+				stop()
+			}
+		}, nil
+	}
+
+	if err := config.CheckLeaderElectionConfiguration(cfg.LeaderElection); err != nil {
+		return nil, err
+	}
+
+	if clientset == nil {
+		return nil, errors.New("leader election requires a Kubernetes client")
+	}
+
+	leaderElection := cfg.LeaderElection
+	if leaderElection.Namespace == "" {
+		namespace, err := os.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("leader election requires a namespace: %w", err)
+		}
+		leaderElection.Namespace = strings.TrimSpace(string(namespace))
+	}
+	if leaderElection.LeaseName == "" {
+		leaderElection.LeaseName = config.DefaultLeaderElectionLeaseName
+	}
+
+	// the hostname is the name of the pod
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	elector, err := leader.New(clientset, leaderElection, identity, tasks...)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(log.Logger.WithContext(context.Background()))
+	done := make(chan struct{})
+	go func() {
+		elector.Run(ctx)
+		close(done)
+	}()
+
+	log.Info().
+		Str("namespace", leaderElection.Namespace).
+		Str("lease", leaderElection.LeaseName).
+		Str("identity", identity).
+		Int("tasks", len(tasks)).
+		Msg("competing for leadership of singleton background work")
+
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// setupRegistryCache returns the constructor of registry clients keeping their caches in the configured backend.
+// The returned function closes the connection to a shared cache.
+func setupRegistryCache() (func(config.Registry) (registry.Client, error), func(), error) {
+	if err := config.CheckCacheConfiguration(cfg.Cache); err != nil {
+		return nil, nil, err
+	}
+
+	// an unset type defaults to memory
+	cacheType, _ := types.ParseCacheType(cfg.Cache.Type)
+	if cacheType != types.CacheTypeRedis {
+		newClient := func(r config.Registry) (registry.Client, error) {
+			return registry.NewClient(r)
+		}
+		return newClient, func() {}, nil
+	}
+
+	options := &redis.Options{
+		Addr:     cfg.Cache.Redis.Address,
+		Username: cfg.Cache.Redis.Username,
+		DB:       cfg.Cache.Redis.DB,
+	}
+	if cfg.Cache.Redis.PasswordFile != "" {
+		password, err := os.ReadFile(cfg.Cache.Redis.PasswordFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading redis password: %w", err)
+		}
+		options.Password = strings.TrimRight(string(password), "\r\n")
+	}
+	if cfg.Cache.Redis.TLS {
+		options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	client := redis.NewClient(options)
+
+	// an unreachable cache is not fatal, lookups fall back to the registries
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		log.Warn().Err(err).Str("address", options.Addr).Msg("redis cache unreachable, registries are inspected until it is available")
+	}
+
+	keyPrefix := config.DefaultCacheKeyPrefix
+	if cfg.Cache.Redis.KeyPrefix != "" {
+		keyPrefix = cfg.Cache.Redis.KeyPrefix
+	}
+	newCache := registry.NewRedisCacheFactory(client, keyPrefix)
+	newClient := func(r config.Registry) (registry.Client, error) {
+		return registry.NewClient(r, registry.WithCache(newCache))
+	}
+	closeCache := func() {
+		if err := client.Close(); err != nil {
+			log.Err(err).Msg("error closing redis cache")
+		}
+	}
+
+	return newClient, closeCache, nil
+}
+
+// setupStatusAuth returns the authentication of the status page and the API, it is nil if the status page is disabled
+func setupStatusAuth(clientset kubernetes.Interface) (status.Middleware, error) {
+	if !cfg.Status.Enabled {
+		return nil, nil
+	}
+
+	if err := config.CheckStatusConfiguration(cfg.Status); err != nil {
+		return nil, err
+	}
+
+	// an unset type defaults to kubernetes
+	auth, _ := types.ParseStatusAuth(cfg.Status.Auth.Type)
+	switch auth {
+	case types.StatusAuthBasic:
+		return status.BasicAuth(cfg.Status.Auth.Username, cfg.Status.Auth.PasswordFile), nil
+	default:
+		if clientset == nil {
+			return nil, errors.New("status page with kubernetes auth requires a Kubernetes client")
+		}
+		return status.KubernetesAuth(clientset), nil
+	}
+}
+
+// setupCopyWorkers creates the worker pools of the copy lanes, the delayed and backfill lanes hold as many jobs as the copy queue
+func setupCopyWorkers() []webhook.Option {
+	capacity := config.DefaultCopyQueueCapacity
+	if cfg.CopyQueue.Capacity != 0 {
+		capacity = cfg.CopyQueue.Capacity
+	}
+
+	immediate := config.DefaultImmediateCopyWorkers
+	if cfg.CopyWorkers.Immediate != 0 {
+		immediate = cfg.CopyWorkers.Immediate
+	}
+	delayed := config.DefaultDelayedCopyWorkers
+	if cfg.CopyWorkers.Delayed != 0 {
+		delayed = cfg.CopyWorkers.Delayed
+	}
+	backfill := config.DefaultBackfillCopyWorkers
+	if cfg.CopyWorkers.Backfill != 0 {
+		backfill = cfg.CopyWorkers.Backfill
+	}
+
+	return []webhook.Option{
+		webhook.ImmediateCopier(pond.New(immediate, 0)),
+		webhook.Copier(pond.New(delayed, capacity)),
+		webhook.BackfillCopier(pond.New(backfill, capacity)),
+	}
+}
+
+// setupBandwidth starts the proxy capping the bandwidth of the copies, it measures the copied bytes without caps as well
+func setupBandwidth() (*bandwidth.Proxy, error) {
+	return bandwidth.NewProxy(cfg.Bandwidth)
+}
+
+// setupCopyQueue configures the queue holding delayed copy jobs
+func setupCopyQueue(clientset kubernetes.Interface) ([]queue.Option, error) {
+	if err := config.CheckCopyQueueConfiguration(cfg.CopyQueue); err != nil {
+		return nil, err
+	}
+
+	capacity := config.DefaultCopyQueueCapacity
+	if cfg.CopyQueue.Capacity != 0 {
+		capacity = cfg.CopyQueue.Capacity
+	}
+
+	overflowPolicy := types.QueueOverflowPolicy(types.QueueOverflowPolicyBlock)
+	if cfg.CopyQueue.OverflowPolicy != "" {
+		var err error
+		overflowPolicy, err = types.ParseQueueOverflowPolicy(cfg.CopyQueue.OverflowPolicy)
+		if err != nil {
+			log.Err(err).Str("policy", cfg.CopyQueue.OverflowPolicy).Msg("parsing copy queue overflow policy failed")
+		}
+	}
+
+	retryPolicy := queue.RetryPolicy{
+		MaxAttempts:    config.DefaultCopyRetryMaxAttempts,
+		InitialBackoff: config.DefaultCopyRetryInitialBackoff,
+		MaxBackoff:     config.DefaultCopyRetryMaxBackoff,
+
+		MaxTooManyRequests: config.DefaultCopyRetryMaxTooManyRequests,
+	}
+	if cfg.CopyQueue.Retry.MaxAttempts != 0 {
+		retryPolicy.MaxAttempts = cfg.CopyQueue.Retry.MaxAttempts
+	}
+	if cfg.CopyQueue.Retry.InitialBackoff != 0 {
+		retryPolicy.InitialBackoff = cfg.CopyQueue.Retry.InitialBackoff
+	}
+	if cfg.CopyQueue.Retry.MaxBackoff != 0 {
+		retryPolicy.MaxBackoff = cfg.CopyQueue.Retry.MaxBackoff
+	}
+	if cfg.CopyQueue.Retry.MaxTooManyRequests != 0 {
+		retryPolicy.MaxTooManyRequests = cfg.CopyQueue.Retry.MaxTooManyRequests
+	}
+
+	opts := []queue.Option{
+		queue.WithCapacity(capacity),
+		queue.WithOverflowPolicy(overflowPolicy),
+		queue.WithRetryPolicy(retryPolicy),
+	}
+
+	storeType := types.QueueStore(types.QueueStoreMemory)
+	if cfg.CopyQueue.Store.Type != "" {
+		var err error
+		storeType, err = types.ParseQueueStore(cfg.CopyQueue.Store.Type)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch storeType {
+	case types.QueueStoreFile:
+		store, err := queue.NewFileStore(cfg.CopyQueue.Store.Path)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, queue.WithStore(store))
+	case types.QueueStoreKubernetes:
+		if clientset == nil {
+			return nil, fmt.Errorf("copy queue store of type %q requires a Kubernetes client", storeType)
+		}
+		// the hostname is the name of the pod, jobs of replicas whose pod is gone are taken over
+		holder := queue.Holder{Namespace: cfg.CopyQueue.Store.Namespace}
+		holder.Name, _ = os.Hostname()
+		if namespace, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+			holder.Namespace = strings.TrimSpace(string(namespace))
+		}
+		opts = append(opts, queue.WithStore(queue.NewConfigMapStore(clientset, cfg.CopyQueue.Store.Namespace, cfg.CopyQueue.Store.ConfigMap, holder)))
+	}
+
+	log.Info().
+		Str("store", storeType.String()).
+		Int("capacity", capacity).
+		Str("overflowPolicy", overflowPolicy.String()).
+		Int("maxAttempts", retryPolicy.MaxAttempts).
+		Msg("copy queue configured")
+
+	return opts, nil
+}
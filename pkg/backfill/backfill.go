@@ -0,0 +1,264 @@
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/alitto/pond"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DefaultConcurrency is the number of images copied in parallel
+const DefaultConcurrency = 5
+
+const (
+	// ResultCopied means the image was copied to the target registry
+	ResultCopied = "copied"
+	// ResultPresent means the image is in the target registry already
+	ResultPresent = "present"
+	// ResultMissing means the image is not in the target registry and was not copied due to dry-run
+	ResultMissing = "missing"
+	// ResultFailed means copying the image failed
+	ResultFailed = "failed"
+	// ResultResumed means the image was copied or present in a previous run recorded in the journal
+	ResultResumed = "resumed"
+)
+
+// Mirror plans and executes copies the same way admissions do, e.g. *webhook.ImageSwapper
+type Mirror interface {
+	CopyJob(pod *corev1.Pod, container corev1.Container) (queue.Job, bool)
+	Copy(ctx context.Context, job queue.Job) error
+}
+
+// Option represents an option that can be passed when instantiating a backfill to customize it
+type Option func(*Backfill)
+
+// Concurrency limits the number of images copied in parallel
+func Concurrency(concurrency int) Option {
+	return func(b *Backfill) {
+		b.concurrency = concurrency
+	}
+}
+
+// DryRun only reports the images missing in the target registry without copying them
+func DryRun(dryRun bool) Option {
+	return func(b *Backfill) {
+		b.dryRun = dryRun
+	}
+}
+
+// Progress writes a line per processed image to the writer
+func Progress(w io.Writer) Option {
+	return func(b *Backfill) {
+		b.progress = w
+	}
+}
+
+// Journal records completed images in the file, images recorded by a previous run are not processed again
+func Journal(file string) Option {
+	return func(b *Backfill) {
+		b.journalFile = file
+	}
+}
+
+// Backfill mirrors images into the target registry ahead of admission, e.g. the images of workloads
+// which were admitted before the webhook was installed
+type Backfill struct {
+	mirror         Mirror
+	registryClient registry.Client
+
+	concurrency int
+	dryRun      bool
+	progress    io.Writer
+	journalFile string
+}
+
+// New returns a backfill copying into the target registry of the registry client
+func New(mirror Mirror, registryClient registry.Client, opts ...Option) *Backfill {
+	b := &Backfill{
+		mirror:         mirror,
+		registryClient: registryClient,
+		concurrency:    DefaultConcurrency,
+		progress:       io.Discard,
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	return b
+}
+
+// ImageReport is the outcome for a single image
+type ImageReport struct {
+	SourceImage string   `json:"sourceImage"`
+	TargetImage string   `json:"targetImage"`
+	Workloads   []string `json:"workloads,omitempty"`
+	Result      string   `json:"result"`
+	Error       string   `json:"error,omitempty"`
+
+	job queue.Job
+}
+
+// Report is the outcome of a backfill
+type Report struct {
+	// Workloads is the number of workloads inspected
+	Workloads int `json:"workloads,omitempty"`
+	// Skipped is the number of images not mirrored, e.g. due to a filter or originating from the target registry
+	Skipped int `json:"skipped"`
+	// Images lists each image to mirror once, even if used by many workloads
+	Images []*ImageReport `json:"images"`
+	// Summary counts the images by result
+	Summary map[string]int `json:"summary"`
+
+	images map[string]*ImageReport
+}
+
+// Failed returns true if any image failed to copy
+func (r *Report) Failed() bool {
+	return r.Summary[ResultFailed] > 0
+}
+
+// WriteText writes the report as table
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESULT\tSOURCE\tTARGET\tWORKLOADS\tERROR")
+	for _, image := range r.Images {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", image.Result, image.SourceImage, image.TargetImage, len(image.Workloads), image.Error)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\n%d workloads, %d images: %d copied, %d present, %d missing, %d failed, %d resumed, %d skipped\n",
+		r.Workloads, len(r.Images), r.Summary[ResultCopied], r.Summary[ResultPresent], r.Summary[ResultMissing], r.Summary[ResultFailed], r.Summary[ResultResumed], r.Skipped)
+
+	return err
+}
+
+// Run mirrors the images of the workloads missing in the target registry
+func (b *Backfill) Run(ctx context.Context, workloads []Workload) (*Report, error) {
+	report := newReport()
+	report.Workloads = len(workloads)
+
+	for _, workload := range workloads {
+		containers := append(append([]corev1.Container{}, workload.Pod.Spec.InitContainers...), workload.Pod.Spec.Containers...)
+		for _, container := range containers {
+			job, ok := b.mirror.CopyJob(workload.Pod, container)
+			if !ok {
+				report.Skipped++
+				continue
+			}
+
+			image := report.add(job)
+			image.Workloads = append(image.Workloads, workload.String())
+		}
+	}
+
+	return report, b.execute(ctx, report)
+}
+
+// RunJobs mirrors the images of the jobs missing in the target registry, e.g. jobs of an image list
+func (b *Backfill) RunJobs(ctx context.Context, jobs []queue.Job) (*Report, error) {
+	report := newReport()
+	for _, job := range jobs {
+		report.add(job)
+	}
+
+	return report, b.execute(ctx, report)
+}
+
+func newReport() *Report {
+	return &Report{Images: []*ImageReport{}, Summary: map[string]int{}, images: map[string]*ImageReport{}}
+}
+
+// add returns the report of the image copied by the job, each image is processed once
+func (r *Report) add(job queue.Job) *ImageReport {
+	image, exists := r.images[job.ID]
+	if !exists {
+		image = &ImageReport{SourceImage: job.SourceImage, TargetImage: job.TargetImage, Workloads: []string{}, job: job}
+		r.images[job.ID] = image
+		r.Images = append(r.Images, image)
+	}
+
+	return image
+}
+
+// execute processes the images of the report with limited concurrency
+func (b *Backfill) execute(ctx context.Context, report *Report) error {
+	journal, err := openJournal(b.journalFile)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	pool := pond.New(b.concurrency, 0, pond.Context(ctx))
+	defer pool.StopAndWait()
+
+	var mu sync.Mutex
+	done := 0
+	group := pool.Group()
+	for _, image := range report.Images {
+		image := image
+		group.Submit(func() {
+			if journal.Completed(image.TargetImage) {
+				image.Result = ResultResumed
+			} else {
+				b.process(ctx, image)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			done++
+			report.Summary[image.Result]++
+			if image.Result == ResultCopied || image.Result == ResultPresent {
+				if err := journal.Record(image.TargetImage, image.Result); err != nil {
+					log.Ctx(ctx).Err(err).Str("image", image.TargetImage).Msg("failed recording completed image in journal")
+				}
+			}
+			fmt.Fprintf(b.progress, "[%d/%d] %s %s\n", done, len(report.Images), image.Result, image.SourceImage)
+		})
+	}
+	group.Wait()
+
+	return nil
+}
+
+// process copies a single image unless it is present already
+func (b *Backfill) process(ctx context.Context, image *ImageReport) {
+	if err := ctx.Err(); err != nil {
+		image.Result, image.Error = ResultFailed, err.Error()
+		return
+	}
+
+	targetRef, err := alltransports.ParseImageName("docker://" + image.TargetImage)
+	if err != nil {
+		image.Result, image.Error = ResultFailed, err.Error()
+		return
+	}
+
+	if b.registryClient.ImageExists(ctx, targetRef) {
+		image.Result = ResultPresent
+		return
+	}
+
+	if b.dryRun {
+		image.Result = ResultMissing
+		return
+	}
+
+	if err := b.mirror.Copy(ctx, image.job); err != nil {
+		log.Ctx(ctx).Err(err).Str("image", image.SourceImage).Msg("backfill copy failed")
+		image.Result, image.Error = ResultFailed, err.Error()
+		return
+	}
+
+	image.Result = ResultCopied
+}
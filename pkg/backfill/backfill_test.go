@@ -0,0 +1,195 @@
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type fakeMirror struct {
+	mu     sync.Mutex
+	copied []string
+}
+
+func (m *fakeMirror) CopyJob(pod *corev1.Pod, container corev1.Container) (queue.Job, bool) {
+	if strings.HasPrefix(container.Image, "target.example.com/") || pod.Namespace == "kube-system" {
+		return queue.Job{}, false
+	}
+
+	target := "target.example.com/" + container.Image
+	return queue.Job{ID: queue.JobID(target), SourceImage: container.Image, TargetImage: target}, true
+}
+
+func (m *fakeMirror) Copy(ctx context.Context, job queue.Job) error {
+	if strings.Contains(job.SourceImage, "broken") {
+		return errors.New("manifest unknown")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.copied = append(m.copied, job.SourceImage)
+
+	return nil
+}
+
+type fakeRegistryClient struct {
+	registry.Client
+	images []string
+}
+
+func (c *fakeRegistryClient) ImageExists(ctx context.Context, ref ctypes.ImageReference) bool {
+	for _, image := range c.images {
+		if ref.DockerReference().String() == image {
+			return true
+		}
+	}
+
+	return false
+}
+
+func podSpec(name string, images ...string) corev1.PodSpec {
+	spec := corev1.PodSpec{}
+	for _, image := range images {
+		spec.Containers = append(spec.Containers, corev1.Container{Name: name, Image: image})
+	}
+
+	return spec
+}
+
+func testWorkloads(t *testing.T) []Workload {
+	clientset := fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx-1"}, Spec: podSpec("nginx", "docker.io/library/nginx:latest")},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "coredns"}, Spec: podSpec("coredns", "registry.k8s.io/coredns:v1.11.1")},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"},
+			Spec:       appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: podSpec("nginx", "docker.io/library/nginx:latest", "target.example.com/docker.io/library/redis:7")}},
+		},
+		&batchv1.CronJob{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "jobs", Name: "report"},
+			Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "init", Image: "docker.io/library/busybox:1.36"}},
+				Containers:     []corev1.Container{{Name: "report", Image: "ghcr.io/example/broken:1.0"}},
+			}}}}},
+		},
+	)
+
+	workloads, err := ListWorkloads(context.Background(), clientset, "")
+	assert.NoError(t, err)
+
+	return workloads
+}
+
+func TestListWorkloads(t *testing.T) {
+	workloads := testWorkloads(t)
+
+	names := []string{}
+	for _, workload := range workloads {
+		names = append(names, workload.String())
+	}
+	assert.ElementsMatch(t, []string{"Pod/default/nginx-1", "Pod/kube-system/coredns", "Deployment/default/nginx", "CronJob/jobs/report"}, names)
+
+	for _, workload := range workloads {
+		if workload.Kind == "CronJob" {
+			assert.Equal(t, "jobs", workload.Pod.Namespace)
+			assert.Equal(t, "CronJob", workload.Pod.OwnerReferences[0].Kind)
+			assert.Len(t, workload.Pod.Spec.InitContainers, 1)
+		}
+	}
+}
+
+func TestBackfill_Run(t *testing.T) {
+	mirror := &fakeMirror{}
+	target := &fakeRegistryClient{images: []string{"target.example.com/docker.io/library/busybox:1.36"}}
+	progress := &bytes.Buffer{}
+
+	report, err := New(mirror, target, Concurrency(2), Progress(progress)).Run(context.Background(), testWorkloads(t))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 4, report.Workloads)
+	// coredns is filtered, redis is swapped already
+	assert.Equal(t, 2, report.Skipped)
+	assert.Len(t, report.Images, 3)
+	assert.Equal(t, map[string]int{ResultCopied: 1, ResultPresent: 1, ResultFailed: 1}, report.Summary)
+	assert.True(t, report.Failed())
+	assert.Equal(t, []string{"docker.io/library/nginx:latest"}, mirror.copied)
+	assert.Equal(t, 3, strings.Count(progress.String(), "\n"))
+	assert.Contains(t, progress.String(), "[3/3]")
+
+	for _, image := range report.Images {
+		switch image.SourceImage {
+		case "docker.io/library/nginx:latest":
+			assert.Equal(t, ResultCopied, image.Result)
+			assert.ElementsMatch(t, []string{"Pod/default/nginx-1", "Deployment/default/nginx"}, image.Workloads)
+		case "docker.io/library/busybox:1.36":
+			assert.Equal(t, ResultPresent, image.Result)
+		case "ghcr.io/example/broken:1.0":
+			assert.Equal(t, ResultFailed, image.Result)
+			assert.Equal(t, "manifest unknown", image.Error)
+		}
+	}
+
+	text := &bytes.Buffer{}
+	assert.NoError(t, report.WriteText(text))
+	assert.Contains(t, text.String(), "4 workloads, 3 images: 1 copied, 1 present, 0 missing, 1 failed, 0 resumed, 2 skipped")
+}
+
+func TestBackfill_RunDryRun(t *testing.T) {
+	mirror := &fakeMirror{}
+
+	report, err := New(mirror, &fakeRegistryClient{}, DryRun(true)).Run(context.Background(), testWorkloads(t))
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]int{ResultMissing: 3}, report.Summary)
+	assert.False(t, report.Failed())
+	assert.Empty(t, mirror.copied)
+}
+
+func TestBackfill_RunJobsResumes(t *testing.T) {
+	jobs := []queue.Job{}
+	for _, image := range []string{"docker.io/library/nginx:latest", "ghcr.io/example/broken:1.0", "docker.io/library/nginx:latest"} {
+		job, _ := (&fakeMirror{}).CopyJob(&corev1.Pod{}, corev1.Container{Image: image})
+		jobs = append(jobs, job)
+	}
+	journalFile := filepath.Join(t.TempDir(), "journal")
+
+	mirror := &fakeMirror{}
+	report, err := New(mirror, &fakeRegistryClient{}, Journal(journalFile)).RunJobs(context.Background(), jobs)
+	assert.NoError(t, err)
+	assert.Len(t, report.Images, 2)
+	assert.Equal(t, map[string]int{ResultCopied: 1, ResultFailed: 1}, report.Summary)
+
+	// simulate a run killed while writing
+	file, err := os.OpenFile(journalFile, os.O_APPEND|os.O_WRONLY, 0)
+	assert.NoError(t, err)
+	_, err = file.WriteString(`{"targetImage":"target.exa`)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	// the copied image is not copied again
+	mirror = &fakeMirror{}
+	report, err = New(mirror, &fakeRegistryClient{}, Journal(journalFile)).RunJobs(context.Background(), jobs)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{ResultResumed: 1, ResultFailed: 1}, report.Summary)
+	assert.Empty(t, mirror.copied)
+
+	journal, err := openJournal(journalFile)
+	assert.NoError(t, err)
+	assert.True(t, journal.Completed("target.example.com/docker.io/library/nginx:latest"))
+	assert.False(t, journal.Completed("target.example.com/ghcr.io/example/broken:1.0"))
+	assert.NoError(t, journal.Close())
+}
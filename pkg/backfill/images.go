@@ -0,0 +1,77 @@
+package backfill
+
+import (
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// ParseImages reads the images of a list or of Kubernetes manifests, e.g. rendered by `helm template`.
+// A list contains an image per line, comments start with #. Manifests are YAML or JSON documents and
+// the string value of every "image" field is read, which covers the containers of pods and pod templates.
+// Each image is returned once in the order of appearance.
+func ParseImages(r io.Reader) ([]string, error) {
+	images := []string{}
+	seen := map[string]bool{}
+	add := func(image string) {
+		if image != "" && !seen[image] {
+			seen[image] = true
+			images = append(images, image)
+		}
+	}
+
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var document interface{}
+		if err := decoder.Decode(&document); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+
+		switch document := document.(type) {
+		case string:
+			// the lines of a list are folded into a single string
+			for _, image := range strings.Fields(document) {
+				add(image)
+			}
+		case []interface{}:
+			for _, item := range document {
+				if image, ok := item.(string); ok {
+					add(image)
+				} else {
+					walkImages(item, add)
+				}
+			}
+		default:
+			walkImages(document, add)
+		}
+	}
+
+	return images, nil
+}
+
+// walkImages calls add for the string value of every "image" field of a document
+func walkImages(node interface{}, add func(string)) {
+	switch node := node.(type) {
+	case map[string]interface{}:
+		// sorted keys keep the order of images stable
+		for _, key := range slices.Sorted(maps.Keys(node)) {
+			value := node[key]
+			if image, ok := value.(string); ok && key == "image" {
+				add(image)
+				continue
+			}
+			walkImages(value, add)
+		}
+	case []interface{}:
+		for _, item := range node {
+			walkImages(item, add)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package backfill
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseImages(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name: "list",
+			input: `# base images
+docker.io/library/nginx:latest
+redis:7
+
+registry.k8s.io/pause@sha256:7031c1b283388d2c2e09b57badb803c05ebed362dc88d84b480cc47f72a21097
+nginx:latest
+`,
+			want: []string{"docker.io/library/nginx:latest", "redis:7", "registry.k8s.io/pause@sha256:7031c1b283388d2c2e09b57badb803c05ebed362dc88d84b480cc47f72a21097", "nginx:latest"},
+		},
+		{
+			name: "rendered helm chart",
+			input: `---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: init
+          image: busybox:1.36
+      containers:
+        - name: app
+          image: "ghcr.io/example/app:1.0"
+---
+# Source: app/templates/cronjob.yaml
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: report
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: report
+              image: ghcr.io/example/app:1.0
+`,
+			want: []string{"ghcr.io/example/app:1.0", "busybox:1.36"},
+		},
+		{
+			name:  "kubectl json",
+			input: `{"apiVersion":"v1","kind":"List","items":[{"kind":"Pod","spec":{"containers":[{"name":"nginx","image":"nginx:1.25"}]}}]}`,
+			want:  []string{"nginx:1.25"},
+		},
+		{
+			name:  "values with image maps are ignored",
+			input: "image:\n  repository: nginx\n  tag: latest\n",
+			want:  []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			images, err := ParseImages(strings.NewReader(tt.input))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, images)
+		})
+	}
+
+	_, err := ParseImages(strings.NewReader("kind: [Pod"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,101 @@
+package backfill
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// journalEntry is a line of the journal file
+type journalEntry struct {
+	TargetImage string    `json:"targetImage"`
+	Result      string    `json:"result"`
+	Time        time.Time `json:"time"`
+}
+
+// journal records the completed images, so an interrupted run resumes with the remaining images.
+// Without file nothing is recorded.
+type journal struct {
+	mu        sync.Mutex
+	file      *os.File
+	completed map[string]bool
+}
+
+// openJournal reads the images completed by previous runs and appends to the file
+func openJournal(path string) (*journal, error) {
+	j := &journal{completed: map[string]bool{}}
+	if path == "" {
+		return j, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	terminated := true
+	for scanner.Scan() {
+		entry := journalEntry{}
+		// a line may be truncated if the previous run was killed
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			j.completed[entry.TargetImage] = true
+		}
+		terminated = len(scanner.Bytes()) == 0 || json.Valid(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// start on a new line after a truncated one
+	if !terminated {
+		if _, err := file.WriteString("\n"); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	j.file = file
+
+	return j, nil
+}
+
+// Completed returns true if the image was completed by a previous run
+func (j *journal) Completed(targetImage string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.completed[targetImage]
+}
+
+// Record appends a completed image to the journal
+func (j *journal) Record(targetImage string, result string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.completed[targetImage] = true
+	if j.file == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(journalEntry{TargetImage: targetImage, Result: result, Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	_, err = j.file.Write(append(line, '\n'))
+
+	return err
+}
+
+// Close closes the journal file
+func (j *journal) Close() error {
+	if j.file == nil {
+		return nil
+	}
+
+	return j.file.Close()
+}
@@ -0,0 +1,111 @@
+package backfill
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Workload is a pod or a controller with its pod template, e.g. a Deployment scaled to zero or a CronJob
+type Workload struct {
+	Kind string
+	// Pod is the running pod, or a pod built from the template of the controller
+	Pod *corev1.Pod
+}
+
+// String identifies the workload, e.g. Deployment/default/nginx
+func (w Workload) String() string {
+	return w.Kind + "/" + w.Pod.Namespace + "/" + w.Pod.Name
+}
+
+// ListWorkloads lists the pods and the controllers creating pods of a namespace, or all namespaces if empty
+func ListWorkloads(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]Workload, error) {
+	workloads := []Workload{}
+	opts := metav1.ListOptions{}
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		workloads = append(workloads, Workload{Kind: "Pod", Pod: &pods.Items[i]})
+	}
+
+	templates, err := ListTemplates(ctx, clientset, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(workloads, templates...), nil
+}
+
+// ListTemplates lists the controllers creating pods of a namespace, or all namespaces if empty, with their pod template
+func ListTemplates(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]Workload, error) {
+	workloads := []Workload{}
+	opts := metav1.ListOptions{}
+
+	deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, deployment := range deployments.Items {
+		workloads = append(workloads, templateWorkload("apps/v1", "Deployment", deployment.ObjectMeta, deployment.Spec.Template))
+	}
+
+	statefulSets, err := clientset.AppsV1().StatefulSets(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, statefulSet := range statefulSets.Items {
+		workloads = append(workloads, templateWorkload("apps/v1", "StatefulSet", statefulSet.ObjectMeta, statefulSet.Spec.Template))
+	}
+
+	daemonSets, err := clientset.AppsV1().DaemonSets(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, daemonSet := range daemonSets.Items {
+		workloads = append(workloads, templateWorkload("apps/v1", "DaemonSet", daemonSet.ObjectMeta, daemonSet.Spec.Template))
+	}
+
+	jobs, err := clientset.BatchV1().Jobs(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs.Items {
+		workloads = append(workloads, templateWorkload("batch/v1", "Job", job.ObjectMeta, job.Spec.Template))
+	}
+
+	cronJobs, err := clientset.BatchV1().CronJobs(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, cronJob := range cronJobs.Items {
+		workloads = append(workloads, templateWorkload("batch/v1", "CronJob", cronJob.ObjectMeta, cronJob.Spec.JobTemplate.Spec.Template))
+	}
+
+	return workloads, nil
+}
+
+// templateWorkload builds the pod a controller would create, so filters on the pod apply the same way
+func templateWorkload(apiVersion string, kind string, owner metav1.ObjectMeta, template corev1.PodTemplateSpec) Workload {
+	pod := &corev1.Pod{
+		ObjectMeta: *template.ObjectMeta.DeepCopy(),
+		Spec:       *template.Spec.DeepCopy(),
+	}
+	pod.Namespace = owner.Namespace
+	pod.Name = owner.Name
+
+	controller := true
+	pod.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Name:       owner.Name,
+		UID:        owner.UID,
+		Controller: &controller,
+	}}
+
+	return Workload{Kind: kind, Pod: pod}
+}
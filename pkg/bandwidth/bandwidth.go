@@ -0,0 +1,442 @@
+package bandwidth
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // schedules may use a time zone missing in the container image
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/metrics"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// bufferSize is the size of the chunks transferred between waits for the limiters, also their burst
+const bufferSize = 32 * 1024
+
+// scheduleInterval is how often the caps of the schedules are applied
+const scheduleInterval = 30 * time.Second
+
+const (
+	received = iota
+	sent
+)
+
+var directions = [...]string{received: "received", sent: "sent"}
+
+// Proxy caps the bandwidth of the copies, globally and per job, in each direction, and measures the bytes they received.
+// It tunnels the HTTPS connections of the copy commands, which reach it through the HTTPS_PROXY environment variable.
+type Proxy struct {
+	schedules []schedule
+	defaults  caps
+	location  *time.Location
+
+	listener net.Listener
+	server   *http.Server
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// proxy returns the proxy registries are reached through, the environment of the process configures it
+	proxy func(*http.Request) (*url.URL, error)
+
+	global [2]*rate.Limiter
+
+	mu     sync.Mutex
+	caps   caps
+	jobs   map[string]*job
+	closed chan struct{}
+}
+
+// caps holds the bytes per second in each direction, 0 is unlimited
+type caps struct {
+	global int64
+	perJob int64
+}
+
+// schedule applies its caps from start until end, in minutes of the day
+type schedule struct {
+	start, end int
+	caps       caps
+}
+
+// job is a copy with limiters of its own, identified by the token it authenticates at the proxy with
+type job struct {
+	limiters [2]*rate.Limiter
+	started  time.Time
+
+	mu       sync.Mutex
+	received int64
+}
+
+// NewProxy starts a proxy on the loopback interface applying the caps of the configuration
+func NewProxy(cfg config.Bandwidth) (*Proxy, error) {
+	if err := config.CheckBandwidthConfiguration(cfg); err != nil {
+		return nil, err
+	}
+
+	location, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		defaults: caps{global: cfg.Global, perJob: cfg.PerJob},
+		location: location,
+		jobs:     map[string]*job{},
+		closed:   make(chan struct{}),
+		proxy:    http.ProxyFromEnvironment,
+	}
+	for _, s := range cfg.Schedules {
+		start, _ := time.Parse(config.BandwidthScheduleLayout, s.Start)
+		end, _ := time.Parse(config.BandwidthScheduleLayout, s.End)
+		p.schedules = append(p.schedules, schedule{
+			start: start.Hour()*60 + start.Minute(),
+			end:   end.Hour()*60 + end.Minute(),
+			caps:  caps{global: s.Global, perJob: s.PerJob},
+		})
+	}
+
+	p.caps = p.capsAt(time.Now())
+	for direction := range p.global {
+		p.global[direction] = rate.NewLimiter(limit(p.caps.global), bufferSize)
+	}
+	p.exposeCaps()
+
+	p.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("error listening for copies: %w", err)
+	}
+
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.server = &http.Server{Handler: p, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := p.server.Serve(p.listener); err != nil && err != http.ErrServerClosed {
+			log.Err(err).Msg("bandwidth limiter stopped")
+		}
+	}()
+
+	if len(p.schedules) > 0 {
+		go p.applySchedules()
+	}
+
+	return p, nil
+}
+
+// Job registers a copy and returns the environment directing its connections through the proxy.
+// The returned function unregisters the copy once it is done and returns the bytes it received.
+func (p *Proxy) Job() ([]string, func() int64) {
+	if p == nil {
+		return nil, func() int64 { return 0 }
+	}
+
+	token := newToken()
+	j := &job{started: time.Now()}
+
+	p.mu.Lock()
+	for direction := range j.limiters {
+		j.limiters[direction] = rate.NewLimiter(limit(p.caps.perJob), bufferSize)
+	}
+	p.jobs[token] = j
+	p.mu.Unlock()
+
+	env := []string{
+		fmt.Sprintf("HTTPS_PROXY=http://%s@%s", token, p.listener.Addr()),
+		// connections bypassing the proxy would not be capped, the proxy honours NO_PROXY of the process when dialing
+		"NO_PROXY=",
+		"no_proxy=",
+	}
+
+	var once sync.Once
+	var receivedBytes int64
+	return env, func() int64 {
+		once.Do(func() {
+			p.mu.Lock()
+			delete(p.jobs, token)
+			p.mu.Unlock()
+
+			j.mu.Lock()
+			defer j.mu.Unlock()
+			receivedBytes = j.received
+			if elapsed := time.Since(j.started).Seconds(); j.received > 0 && elapsed > 0 {
+				metrics.CopyThroughput.Observe(float64(j.received) / elapsed)
+			}
+		})
+
+		return receivedBytes
+	}
+}
+
+// Close stops the proxy, aborting the transfers still running
+func (p *Proxy) Close() error {
+	if p == nil {
+		return nil
+	}
+
+	close(p.closed)
+	p.cancel()
+
+	return p.server.Close()
+}
+
+// ServeHTTP tunnels the CONNECT requests of registered copies
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	j := p.authenticate(r)
+	if j == nil {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="k8s-image-swapper"`)
+		http.Error(w, "unknown copy", http.StatusProxyAuthRequired)
+		return
+	}
+
+	upstream, err := p.dial(r.Context(), r.Host)
+	if err != nil {
+		log.Debug().Err(err).Str("host", r.Host).Msg("failed connecting to registry")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		log.Err(err).Msg("failed hijacking connection of copy")
+		return
+	}
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+
+	// closing both connections once either direction ends unblocks the other one
+	var wg sync.WaitGroup
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			conn.Close()
+			upstream.Close()
+		})
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer closeBoth()
+		p.transfer(upstream, buffered.Reader, j, sent)
+	}()
+	go func() {
+		defer wg.Done()
+		defer closeBoth()
+		p.transfer(conn, upstream, j, received)
+	}()
+	wg.Wait()
+}
+
+// dial connects to the registry, through the proxy of the environment if one applies to it, e.g. HTTPS_PROXY
+func (p *Proxy) dial(ctx context.Context, host string) (net.Conn, error) {
+	var dialer net.Dialer
+
+	proxyURL, err := p.proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: host}})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", host)
+	}
+
+	proxyAddress := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddress = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+	}
+
+	connect := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		connect.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	// the registry does not send anything before the TLS handshake, nothing is buffered beyond the response
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err := connect.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connect)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused connecting to %s: %s", proxyURL.Redacted(), host, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// transfer copies src to dst in chunks, waiting for the limiters of the job and the global ones before each chunk
+func (p *Proxy) transfer(dst io.Writer, src io.Reader, j *job, direction int) {
+	buf := make([]byte, bufferSize)
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			if err := j.limiters[direction].WaitN(p.ctx, n); err != nil {
+				return
+			}
+			if err := p.global[direction].WaitN(p.ctx, n); err != nil {
+				return
+			}
+
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+
+			metrics.TransferredBytes.WithLabelValues(directions[direction]).Add(float64(n))
+			if direction == received {
+				j.mu.Lock()
+				j.received += int64(n)
+				j.mu.Unlock()
+			}
+		}
+		if readErr != nil {
+			return
+		}
+	}
+}
+
+// authenticate returns the job of the token sent as user name of the proxy credentials
+func (p *Proxy) authenticate(r *http.Request) *job {
+	encoded, found := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !found {
+		return nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil
+	}
+	token, _, _ := strings.Cut(string(decoded), ":")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.jobs[token]
+}
+
+// applySchedules updates the caps of the global and the job limiters as the schedules start and end
+func (p *Proxy) applySchedules() {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.closed:
+			return
+		case now := <-ticker.C:
+			next := p.capsAt(now)
+
+			p.mu.Lock()
+			if next != p.caps {
+				log.Info().Int64("global", next.global).Int64("perJob", next.perJob).Msg("applying bandwidth caps")
+
+				p.caps = next
+				for direction := range p.global {
+					p.global[direction].SetLimit(limit(next.global))
+				}
+				for _, j := range p.jobs {
+					for direction := range j.limiters {
+						j.limiters[direction].SetLimit(limit(next.perJob))
+					}
+				}
+				p.exposeCaps()
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// capsAt returns the caps of the first schedule covering the time of the day, the default caps otherwise
+func (p *Proxy) capsAt(now time.Time) caps {
+	now = now.In(p.location)
+	minute := now.Hour()*60 + now.Minute()
+
+	for _, s := range p.schedules {
+		if s.start < s.end && minute >= s.start && minute < s.end {
+			return s.caps
+		}
+		// spans midnight
+		if s.start > s.end && (minute >= s.start || minute < s.end) {
+			return s.caps
+		}
+	}
+
+	return p.defaults
+}
+
+func (p *Proxy) exposeCaps() {
+	metrics.BandwidthLimit.WithLabelValues("global").Set(float64(p.caps.global))
+	metrics.BandwidthLimit.WithLabelValues("per_job").Set(float64(p.caps.perJob))
+}
+
+// limit converts bytes per second into the limit of a limiter, 0 is unlimited
+func limit(bytesPerSecond int64) rate.Limit {
+	if bytesPerSecond <= 0 {
+		return rate.Inf
+	}
+
+	return rate.Limit(bytesPerSecond)
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	// never returns an error
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,166 @@
+package bandwidth
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// proxiedClient returns a client of the TLS server connecting through the proxy of the environment
+func proxiedClient(t *testing.T, server *httptest.Server, env []string) *http.Client {
+	t.Helper()
+
+	proxy, found := strings.CutPrefix(env[0], "HTTPS_PROXY=")
+	require.True(t, found)
+	proxyURL, err := url.Parse(proxy)
+	require.NoError(t, err)
+
+	client := server.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	client.Transport = transport
+
+	return client
+}
+
+func TestProxy_PerJob(t *testing.T) {
+	body := strings.Repeat("a", 96*1024)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	proxy, err := NewProxy(config.Bandwidth{PerJob: 64 * 1024})
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	env, done := proxy.Job()
+	defer done()
+
+	started := time.Now()
+	resp, err := proxiedClient(t, server, env).Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	received, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(received))
+	// the burst covers the first chunk, the remaining 64KiB take a second
+	assert.Greater(t, time.Since(started), 700*time.Millisecond)
+
+	// the TLS handshake and the response headers are received as well
+	assert.Greater(t, done(), int64(len(body)))
+}
+
+func TestProxy_UnknownJob(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	proxy, err := NewProxy(config.Bandwidth{Global: 1024})
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	env, done := proxy.Job()
+	done()
+
+	_, err = proxiedClient(t, server, env).Get(server.URL)
+	assert.ErrorContains(t, err, "Proxy Authentication Required")
+}
+
+func TestProxy_Upstream(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	// the egress proxy of the environment, tunnelling to the registry
+	var authorization string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Proxy-Authorization")
+		conn, err := net.Dial("tcp", r.Host)
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer conn.Close()
+
+		client, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer client.Close()
+		_, _ = io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n")
+
+		go func() { _, _ = io.Copy(conn, client) }()
+		_, _ = io.Copy(client, conn)
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewProxy(config.Bandwidth{Global: 1024 * 1024})
+	require.NoError(t, err)
+	defer proxy.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	upstreamURL.User = url.UserPassword("user", "secret")
+	proxy.proxy = http.ProxyURL(upstreamURL)
+
+	env, done := proxy.Job()
+	defer done()
+
+	resp, err := proxiedClient(t, server, env).Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	received, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(received))
+	assert.Equal(t, "Basic dXNlcjpzZWNyZXQ=", authorization)
+}
+
+func TestProxy_capsAt(t *testing.T) {
+	proxy, err := NewProxy(config.Bandwidth{
+		Global: 100,
+		PerJob: 10,
+		Schedules: []config.BandwidthSchedule{
+			{Start: "08:00", End: "18:00", Global: 20, PerJob: 5},
+			{Start: "22:00", End: "02:00"},
+		},
+		TimeZone: "Europe/Berlin",
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	tests := []struct {
+		at   time.Time
+		caps caps
+	}{
+		{at: time.Date(2024, 6, 3, 7, 59, 0, 0, berlin), caps: caps{global: 100, perJob: 10}},
+		{at: time.Date(2024, 6, 3, 8, 0, 0, 0, berlin), caps: caps{global: 20, perJob: 5}},
+		{at: time.Date(2024, 6, 3, 16, 30, 0, 0, time.UTC), caps: caps{global: 100, perJob: 10}},
+		{at: time.Date(2024, 6, 3, 23, 0, 0, 0, berlin), caps: caps{}},
+		{at: time.Date(2024, 6, 4, 1, 59, 0, 0, berlin), caps: caps{}},
+		{at: time.Date(2024, 6, 4, 2, 0, 0, 0, berlin), caps: caps{global: 100, perJob: 10}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.caps, proxy.capsAt(test.at), test.at.String())
+	}
+}
+
+func TestProxy_Nil(t *testing.T) {
+	var proxy *Proxy
+
+	env, done := proxy.Job()
+	assert.Nil(t, env)
+	assert.Zero(t, done())
+	assert.NoError(t, proxy.Close())
+}
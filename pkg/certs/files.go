@@ -0,0 +1,79 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// debounce coalesces the events of a single rotation, e.g. the certificate and key being written one after another
+const debounce = 250 * time.Millisecond
+
+// LoadFiles loads the key pair from the files into the reloader
+func LoadFiles(r *Reloader, certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	return r.SetCertificate(&cert)
+}
+
+// WatchFiles reloads the key pair when the files change until the context is done.
+// The directories are watched instead of the files, Kubernetes updates mounted secrets by swapping a symlink.
+// A key pair failing to load, e.g. while only the certificate was written so far, keeps the current one in place.
+func WatchFiles(ctx context.Context, r *Reloader, certFile string, keyFile string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	dirs := map[string]bool{filepath.Dir(certFile): true, filepath.Dir(keyFile): true}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		timer := time.NewTimer(debounce)
+		timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				log.Trace().Str("file", event.Name).Str("op", event.Op.String()).Msg("certificate directory changed")
+				timer.Reset(debounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Err(err).Msg("error watching certificate files")
+			case <-timer.C:
+				if err := LoadFiles(r, certFile, keyFile); err != nil {
+					log.Err(err).Str("certFile", certFile).Str("keyFile", keyFile).Msg("failed reloading TLS certificate, keeping the current one")
+					continue
+				}
+				log.Info().
+					Str("certFile", certFile).
+					Time("notAfter", r.Leaf().NotAfter).
+					Msg("reloaded TLS certificate")
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package certs
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeKeyPair(t *testing.T, dir string, commonName string) {
+	cert, key, err := issue(&x509.Certificate{
+		Subject:   pkix.Name{CommonName: commonName},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}, nil, nil)
+	assert.NoError(t, err)
+
+	keyPEM, err := encodePrivateKey(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "tls.key"), keyPEM, 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "tls.crt"), encodeCertificate(cert), 0600))
+}
+
+func TestWatchFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeKeyPair(t, dir, "first")
+
+	reloader := NewReloader()
+	_, err := reloader.GetCertificate(nil)
+	assert.Error(t, err)
+
+	assert.NoError(t, LoadFiles(reloader, certFile, keyFile))
+	assert.Equal(t, "first", reloader.Leaf().Subject.CommonName)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, WatchFiles(ctx, reloader, certFile, keyFile))
+
+	// a partially written key pair keeps the current certificate
+	assert.NoError(t, os.WriteFile(keyFile, []byte("invalid"), 0600))
+	time.Sleep(2 * debounce)
+	assert.Equal(t, "first", reloader.Leaf().Subject.CommonName)
+
+	writeKeyPair(t, dir, "second")
+	assert.Eventually(t, func() bool {
+		return reloader.Leaf().Subject.CommonName == "second"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	cert, err := reloader.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", cert.Leaf.Subject.CommonName)
+}
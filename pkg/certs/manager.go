@@ -0,0 +1,418 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// secretKeyCABundle holds the current CA followed by previous CAs which are still trusted
+	secretKeyCABundle = "ca.crt"
+	secretKeyCAKey    = "ca.key"
+)
+
+// caValidityFactor lets the CA outlive the serving certificates it signs, it is rotated less often
+const caValidityFactor = 10
+
+const (
+	// checkInterval is the interval of checking whether the certificate is due for renewal
+	checkInterval = time.Hour
+	// retryInterval is the interval of retrying a failed renewal
+	retryInterval = time.Minute
+)
+
+// Manager issues a serving certificate signed by its own CA, stores both in a Secret shared by all replicas
+// and keeps the caBundle of the MutatingWebhookConfiguration in sync.
+type Manager struct {
+	kubernetesClient kubernetes.Interface
+	reloader         *Reloader
+	config           config.SelfManagedTLS
+
+	now func() time.Time
+}
+
+// NewManager returns a manager serving its certificate through the reloader
+func NewManager(clientset kubernetes.Interface, reloader *Reloader, c config.SelfManagedTLS) *Manager {
+	if c.Validity == 0 {
+		c.Validity = config.DefaultCertificateValidity
+	}
+	if c.RenewBefore == 0 {
+		c.RenewBefore = config.DefaultCertificateRenewBefore
+	}
+
+	return &Manager{
+		kubernetesClient: clientset,
+		reloader:         reloader,
+		config:           c,
+		now:              time.Now,
+	}
+}
+
+// DNSNames returns the names of the webhook service the serving certificate is valid for
+func (m *Manager) DNSNames() []string {
+	service := m.config.ServiceName
+	namespace := m.config.Namespace
+
+	return []string{
+		service,
+		service + "." + namespace,
+		service + "." + namespace + ".svc",
+		service + "." + namespace + ".svc.cluster.local",
+	}
+}
+
+// Run renews the certificate when it is due until the context is done,
+// it picks up certificates renewed by other replicas as well
+func (m *Manager) Run(ctx context.Context) {
+	interval := checkInterval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		interval = checkInterval
+		if err := m.Reconcile(ctx); err != nil {
+			log.Err(err).Str("secret", m.config.SecretName).Msg("failed renewing self-managed certificate")
+			interval = retryInterval
+		}
+	}
+}
+
+// Reconcile ensures a valid certificate is stored in the Secret, served and trusted by the webhook configuration
+func (m *Manager) Reconcile(ctx context.Context) error {
+	var current *keyPairs
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var err error
+		current, err = m.reconcileSecret(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.X509KeyPair(current.cert, current.key)
+	if err != nil {
+		return err
+	}
+
+	if leaf := m.reloader.Leaf(); leaf == nil || !bytes.Equal(leaf.Raw, cert.Certificate[0]) {
+		if err := m.reloader.SetCertificate(&cert); err != nil {
+			return err
+		}
+		log.Info().
+			Str("secret", m.config.SecretName).
+			Time("notAfter", cert.Leaf.NotAfter).
+			Msg("serving self-managed certificate")
+	}
+
+	return m.patchCABundle(ctx, current.caBundle)
+}
+
+// reconcileSecret returns the key pairs stored in the Secret, renewing them if they are due
+func (m *Manager) reconcileSecret(ctx context.Context) (*keyPairs, error) {
+	secrets := m.kubernetesClient.CoreV1().Secrets(m.config.Namespace)
+
+	secret, err := secrets.Get(ctx, m.config.SecretName, metav1.GetOptions{})
+	notFound := apierrors.IsNotFound(err)
+	if err != nil && !notFound {
+		return nil, err
+	}
+
+	var stored *keyPairs
+	if !notFound {
+		stored = &keyPairs{
+			caBundle: secret.Data[secretKeyCABundle],
+			caKey:    secret.Data[secretKeyCAKey],
+			cert:     secret.Data[corev1.TLSCertKey],
+			key:      secret.Data[corev1.TLSPrivateKeyKey],
+		}
+	}
+
+	renewed, err := m.renew(stored)
+	if err != nil {
+		return nil, err
+	}
+	if renewed == stored {
+		return stored, nil
+	}
+
+	if notFound {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m.config.SecretName,
+				Namespace: m.config.Namespace,
+				Labels:    map[string]string{"app.kubernetes.io/managed-by": "k8s-image-swapper"},
+			},
+			Type: corev1.SecretTypeTLS,
+			Data: renewed.data(),
+		}
+		_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// another replica created it in the meantime, retry with its certificate
+			return nil, apierrors.NewConflict(corev1.Resource("secrets"), m.config.SecretName, err)
+		}
+	} else {
+		secret.Data = renewed.data()
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return renewed, nil
+}
+
+// patchCABundle lets the API server trust the CA for all webhooks of the configuration
+func (m *Manager) patchCABundle(ctx context.Context, caBundle []byte) error {
+	configurations := m.kubernetesClient.AdmissionregistrationV1().MutatingWebhookConfigurations()
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configuration, err := configurations.Get(ctx, m.config.WebhookName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		for i := range configuration.Webhooks {
+			if !bytes.Equal(configuration.Webhooks[i].ClientConfig.CABundle, caBundle) {
+				configuration.Webhooks[i].ClientConfig.CABundle = caBundle
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+
+		_, err = configurations.Update(ctx, configuration, metav1.UpdateOptions{})
+		if err == nil {
+			log.Info().Str("webhook", m.config.WebhookName).Msg("updated caBundle of webhook configuration")
+		}
+
+		return err
+	})
+}
+
+// keyPairs are the PEM encoded CA and serving certificate
+type keyPairs struct {
+	caBundle []byte
+	caKey    []byte
+	cert     []byte
+	key      []byte
+}
+
+func (k *keyPairs) data() map[string][]byte {
+	return map[string][]byte{
+		secretKeyCABundle:       k.caBundle,
+		secretKeyCAKey:          k.caKey,
+		corev1.TLSCertKey:       k.cert,
+		corev1.TLSPrivateKeyKey: k.key,
+	}
+}
+
+// renew returns the stored key pairs if they are valid, otherwise they are issued anew.
+// The CA is kept unless it is due for renewal, a renewed CA is added to the bundle next to the previous one
+// so certificates of replicas which did not pick up the renewal yet are still trusted.
+func (m *Manager) renew(stored *keyPairs) (*keyPairs, error) {
+	now := m.now()
+
+	var ca *x509.Certificate
+	var caKey crypto.Signer
+	var previousCAs []*x509.Certificate
+	if stored != nil {
+		cas := parseCertificates(stored.caBundle)
+		if len(cas) > 0 {
+			ca, previousCAs = cas[0], cas[1:]
+			caKey, _ = parsePrivateKey(stored.caKey)
+		}
+	}
+
+	caRenewed := false
+	if ca == nil || caKey == nil || m.due(ca, now) {
+		if ca != nil {
+			previousCAs = append([]*x509.Certificate{ca}, previousCAs...)
+		}
+
+		var err error
+		ca, caKey, err = issue(&x509.Certificate{
+			Subject:               pkix.Name{CommonName: "k8s-image-swapper-ca"},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(caValidityFactor * m.config.Validity),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		caRenewed = true
+	}
+
+	if !caRenewed && m.valid(stored, ca, now) {
+		return stored, nil
+	}
+
+	cert, key, err := issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: m.DNSNames()[2]},
+		DNSNames:    m.DNSNames(),
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(m.config.Validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	renewed := &keyPairs{cert: encodeCertificate(cert)}
+	if renewed.key, err = encodePrivateKey(key); err != nil {
+		return nil, err
+	}
+	if renewed.caKey, err = encodePrivateKey(caKey); err != nil {
+		return nil, err
+	}
+
+	renewed.caBundle = encodeCertificate(ca)
+	for _, previous := range previousCAs {
+		if now.Before(previous.NotAfter) {
+			renewed.caBundle = append(renewed.caBundle, encodeCertificate(previous)...)
+		}
+	}
+
+	log.Info().
+		Bool("caRenewed", caRenewed).
+		Strs("dnsNames", cert.DNSNames).
+		Time("notAfter", cert.NotAfter).
+		Msg("issued self-managed certificate")
+
+	return renewed, nil
+}
+
+// due returns true if the certificate is about to expire
+func (m *Manager) due(cert *x509.Certificate, now time.Time) bool {
+	return !now.Add(m.config.RenewBefore).Before(cert.NotAfter)
+}
+
+// valid returns true if the stored serving certificate is signed by the CA, covers the service and is not due
+func (m *Manager) valid(stored *keyPairs, ca *x509.Certificate, now time.Time) bool {
+	if _, err := tls.X509KeyPair(stored.cert, stored.key); err != nil {
+		return false
+	}
+
+	certs := parseCertificates(stored.cert)
+	if len(certs) == 0 {
+		return false
+	}
+	cert := certs[0]
+
+	if cert.CheckSignatureFrom(ca) != nil || m.due(cert, now) {
+		return false
+	}
+
+	for _, name := range m.DNSNames() {
+		if !slices.Contains(cert.DNSNames, name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// issue creates a key and a certificate from the template, it is self-signed if no parent is given
+func issue(template *x509.Certificate, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+func encodeCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// parseCertificates returns the certificates of a PEM bundle, skipping unreadable ones
+func parseCertificates(data []byte) []*x509.Certificate {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+
+	return signer, nil
+}
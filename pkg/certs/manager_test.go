@@ -0,0 +1,109 @@
+package certs
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/stretchr/testify/assert"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestManager(clientset *fake.Clientset, now *time.Time) *Manager {
+	manager := NewManager(clientset, NewReloader(), config.SelfManagedTLS{
+		Enabled:     true,
+		Namespace:   "k8s-image-swapper",
+		SecretName:  "k8s-image-swapper-tls",
+		ServiceName: "k8s-image-swapper",
+		WebhookName: "k8s-image-swapper",
+	})
+	manager.now = func() time.Time { return *now }
+
+	return manager
+}
+
+func caBundle(t *testing.T, clientset *fake.Clientset) []byte {
+	configuration, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), "k8s-image-swapper", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	return configuration.Webhooks[0].ClientConfig.CABundle
+}
+
+// verify asserts the served certificate is trusted by the bundle
+func verify(t *testing.T, manager *Manager, bundle []byte, now time.Time) {
+	_, err := manager.reloader.Leaf().Verify(x509.VerifyOptions{
+		DNSName:     "k8s-image-swapper.k8s-image-swapper.svc",
+		Roots:       poolOf(bundle),
+		CurrentTime: now,
+	})
+	assert.NoError(t, err)
+}
+
+func TestManager_Reconcile(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "k8s-image-swapper"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "k8s-image-swapper.github.io"}},
+	})
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	manager := newTestManager(clientset, &now)
+
+	assert.NoError(t, manager.Reconcile(context.Background()))
+
+	secret, err := clientset.CoreV1().Secrets("k8s-image-swapper").Get(context.Background(), "k8s-image-swapper-tls", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, corev1.SecretTypeTLS, secret.Type)
+	assert.Equal(t, secret.Data["ca.crt"], caBundle(t, clientset))
+	assert.Equal(t, manager.DNSNames(), manager.reloader.Leaf().DNSNames)
+	verify(t, manager, caBundle(t, clientset), now)
+
+	issued := manager.reloader.Leaf()
+
+	// another replica serves the stored certificate
+	replica := newTestManager(clientset, &now)
+	assert.NoError(t, replica.Reconcile(context.Background()))
+	assert.Equal(t, issued.Raw, replica.reloader.Leaf().Raw)
+
+	// the serving certificate is renewed before it expires, signed by the same CA
+	now = issued.NotAfter.Add(-config.DefaultCertificateRenewBefore)
+	ca := caBundle(t, clientset)
+	assert.NoError(t, manager.Reconcile(context.Background()))
+	assert.NotEqual(t, issued.Raw, manager.reloader.Leaf().Raw)
+	assert.Equal(t, ca, caBundle(t, clientset))
+	verify(t, manager, caBundle(t, clientset), now)
+
+	// the renewed certificate is picked up by the replica
+	assert.NoError(t, replica.Reconcile(context.Background()))
+	assert.Equal(t, manager.reloader.Leaf().Raw, replica.reloader.Leaf().Raw)
+
+	// a renewed CA is trusted next to the previous one
+	caCert := parseCertificates(ca)[0]
+	now = caCert.NotAfter.Add(-config.DefaultCertificateRenewBefore)
+	previous := replica.reloader.Leaf()
+	assert.NoError(t, manager.Reconcile(context.Background()))
+	assert.Len(t, parseCertificates(caBundle(t, clientset)), 2)
+	verify(t, manager, caBundle(t, clientset), now)
+	_, err = previous.Verify(x509.VerifyOptions{Roots: poolOf(caBundle(t, clientset)), CurrentTime: previous.NotBefore.Add(time.Hour)})
+	assert.NoError(t, err)
+}
+
+func TestManager_ReconcileWithoutWebhookConfiguration(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	now := time.Now()
+	manager := newTestManager(clientset, &now)
+
+	// the certificate is served even if the caBundle cannot be updated yet
+	assert.Error(t, manager.Reconcile(context.Background()))
+	assert.NotNil(t, manager.reloader.Leaf())
+}
+
+func poolOf(bundle []byte) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(bundle)
+
+	return pool
+}
@@ -0,0 +1,73 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+)
+
+// Reloader serves the current certificate of a TLS server, the certificate can be replaced without a restart
+type Reloader struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewReloader returns a reloader without certificate, handshakes fail until one is set
+func NewReloader() *Reloader {
+	return &Reloader{}
+}
+
+// SetCertificate replaces the certificate for new connections
+func (r *Reloader) SetCertificate(cert *tls.Certificate) error {
+	if cert.Leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return errors.New("certificate chain is empty")
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cert = cert
+
+	return nil
+}
+
+// GetCertificate satisfies tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.cert == nil {
+		return nil, errors.New("no certificate loaded")
+	}
+
+	return r.cert, nil
+}
+
+// Leaf returns the parsed certificate currently served, or nil if none is set
+func (r *Reloader) Leaf() *x509.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.cert == nil {
+		return nil
+	}
+
+	return r.cert.Leaf
+}
+
+// TLSConfig returns a server configuration serving the current certificate
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
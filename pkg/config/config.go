@@ -32,17 +32,109 @@ import (
 
 const DefaultImageCopyDeadline = 8 * time.Second
 
+const DefaultCopyQueueCapacity = 1000
+
+const (
+	DefaultImmediateCopyWorkers = 20
+	DefaultDelayedCopyWorkers   = 100
+	DefaultBackfillCopyWorkers  = 10
+)
+
+const DefaultDrainTimeout = 25 * time.Second
+
+const DefaultShutdownDelay = 5 * time.Second
+
+const (
+	DefaultCopyRetryMaxAttempts    = 5
+	DefaultCopyRetryInitialBackoff = 30 * time.Second
+	DefaultCopyRetryMaxBackoff     = 30 * time.Minute
+
+	DefaultCopyRetryMaxTooManyRequests = 10
+)
+
+// BandwidthScheduleLayout is the format of the time of the day a bandwidth schedule starts and ends
+const BandwidthScheduleLayout = "15:04"
+
+// DefaultTooManyRequestsBackoff is how long copies from a registry pause after it responded with 429 Too Many Requests
+const DefaultTooManyRequestsBackoff = time.Minute
+
+const DefaultTracingSamplingRatio = 1.0
+
+const (
+	DefaultResyncInterval = 6 * time.Hour
+	MinResyncInterval     = time.Minute
+)
+
+const (
+	DefaultGCInterval    = 24 * time.Hour
+	DefaultGCGracePeriod = 7 * 24 * time.Hour
+	MinGCInterval        = time.Minute
+	MinGCGracePeriod     = time.Hour
+	DefaultGCConfigMap   = "k8s-image-swapper-gc"
+)
+
+const DefaultCacheKeyPrefix = "k8s-image-swapper/"
+
+const (
+	DefaultCacheWarmupInterval        = 12 * time.Hour
+	DefaultCacheWarmupMaxRepositories = 1000
+	DefaultCacheWarmupMaxImages       = 10000
+	MinCacheWarmupInterval            = time.Minute
+)
+
+const (
+	DefaultRegistryCacheTTL         = 24 * time.Hour
+	DefaultRegistryCacheJitter      = 3 * time.Hour
+	DefaultRegistryCacheNegativeTTL = time.Minute
+	DefaultRegistryCacheSize        = 1_000_000
+)
+
+const (
+	DefaultLeaderElectionLeaseName     = "k8s-image-swapper"
+	DefaultLeaderElectionLeaseDuration = 15 * time.Second
+	DefaultLeaderElectionRenewDeadline = 10 * time.Second
+	DefaultLeaderElectionRetryPeriod   = 2 * time.Second
+)
+
+const (
+	DefaultCertificateValidity    = 365 * 24 * time.Hour
+	DefaultCertificateRenewBefore = 30 * 24 * time.Hour
+)
+
 type Config struct {
 	LogLevel  string `yaml:"logLevel" validate:"oneof=trace debug info warn error fatal"`
 	LogFormat string `yaml:"logFormat" validate:"oneof=json console"`
 
 	ListenAddress string
+	DrainTimeout  time.Duration `yaml:"drainTimeout"`
+	ShutdownDelay time.Duration `yaml:"shutdownDelay"`
 
 	DryRun            bool          `yaml:"dryRun"`
 	ImageSwapPolicy   string        `yaml:"imageSwapPolicy" validate:"oneof=always exists"`
 	ImageCopyPolicy   string        `yaml:"imageCopyPolicy" validate:"oneof=delayed immediate force none"`
 	ImageCopyDeadline time.Duration `yaml:"imageCopyDeadline"`
 
+	CopyQueue   CopyQueue   `yaml:"copyQueue"`
+	CopyWorkers CopyWorkers `yaml:"copyWorkers"`
+	CopyLimits  CopyLimits  `yaml:"copyLimits"`
+	Bandwidth   Bandwidth   `yaml:"bandwidth"`
+
+	Tracing Tracing `yaml:"tracing"`
+
+	Events Events `yaml:"events"`
+
+	TLS TLS `yaml:"tls"`
+
+	Resync Resync `yaml:"resync"`
+
+	GC GC `yaml:"gc"`
+
+	Status Status `yaml:"status"`
+
+	Cache Cache `yaml:"cache"`
+
+	LeaderElection LeaderElection `yaml:"leaderElection"`
+
 	Source Source   `yaml:"source"`
 	Target Registry `yaml:"target"`
 
@@ -50,19 +142,201 @@ type Config struct {
 	TLSKeyFile  string
 }
 
+type CopyQueue struct {
+	Capacity       int            `yaml:"capacity"`
+	OverflowPolicy string         `yaml:"overflowPolicy" validate:"oneof=block drop defer"`
+	Store          CopyQueueStore `yaml:"store"`
+	Retry          CopyQueueRetry `yaml:"retry"`
+}
+
+type CopyQueueStore struct {
+	Type      string `yaml:"type" validate:"oneof=memory file kubernetes"`
+	Path      string `yaml:"path"`
+	Namespace string `yaml:"namespace"`
+	ConfigMap string `yaml:"configMap"`
+}
+
+type CopyQueueRetry struct {
+	MaxAttempts    int           `yaml:"maxAttempts"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+
+	MaxTooManyRequests int `yaml:"maxTooManyRequests"`
+}
+
+// CopyWorkers sizes the worker pools of the copy lanes, copies never wait for a worker of another lane
+type CopyWorkers struct {
+	Immediate int `yaml:"immediate"`
+	Delayed   int `yaml:"delayed"`
+	Backfill  int `yaml:"backfill"`
+}
+
+// CopyLimits bound the copies running against each registry, unset limits are unlimited
+type CopyLimits struct {
+	// Default applies to each source registry without an entry in Registries
+	Default    RegistryLimit   `yaml:"default"`
+	Registries []RegistryLimit `yaml:"registries"`
+	Target     RegistryLimit   `yaml:"target"`
+
+	TooManyRequestsBackoff time.Duration `yaml:"tooManyRequestsBackoff"`
+}
+
+// RegistryLimit limits the concurrent copies and the rate copies start at (per second) for a registry
+type RegistryLimit struct {
+	Registry    string  `yaml:"registry"`
+	Concurrency int     `yaml:"concurrency"`
+	Rate        float64 `yaml:"rate"`
+	Burst       int     `yaml:"burst"`
+}
+
+// Bandwidth caps the throughput of the copies in bytes per second, unset caps are unlimited
+type Bandwidth struct {
+	Global int64 `yaml:"global"`
+	PerJob int64 `yaml:"perJob"`
+	// Schedules replace the caps during a time of the day, the first matching schedule applies
+	Schedules []BandwidthSchedule `yaml:"schedules"`
+	TimeZone  string              `yaml:"timeZone"`
+}
+
+// BandwidthSchedule caps the throughput from start until end, given as "15:04".
+// A schedule ending before it starts spans midnight.
+type BandwidthSchedule struct {
+	Start  string `yaml:"start"`
+	End    string `yaml:"end"`
+	Global int64  `yaml:"global"`
+	PerJob int64  `yaml:"perJob"`
+}
+
+type Tracing struct {
+	Enabled       bool    `yaml:"enabled"`
+	Endpoint      string  `yaml:"endpoint"`
+	Insecure      bool    `yaml:"insecure"`
+	SamplingRatio float64 `yaml:"samplingRatio"`
+}
+
+type Events struct {
+	Enabled bool    `yaml:"enabled"`
+	QPS     float32 `yaml:"qps"`
+	Burst   int     `yaml:"burst"`
+}
+
+type TLS struct {
+	SelfManaged SelfManagedTLS `yaml:"selfManaged"`
+}
+
+type SelfManagedTLS struct {
+	Enabled     bool          `yaml:"enabled"`
+	Namespace   string        `yaml:"namespace"`
+	SecretName  string        `yaml:"secretName"`
+	ServiceName string        `yaml:"serviceName"`
+	WebhookName string        `yaml:"webhookName"`
+	Validity    time.Duration `yaml:"validity"`
+	RenewBefore time.Duration `yaml:"renewBefore"`
+}
+
+type Resync struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+type GC struct {
+	Enabled            bool          `yaml:"enabled"`
+	Interval           time.Duration `yaml:"interval"`
+	GracePeriod        time.Duration `yaml:"gracePeriod"`
+	DryRun             bool          `yaml:"dryRun"`
+	DeleteRepositories bool          `yaml:"deleteRepositories"`
+	// Namespace and ConfigMap locate the ConfigMap persisting the references, the namespace defaults to the one of the pod
+	Namespace string `yaml:"namespace"`
+	ConfigMap string `yaml:"configMap"`
+}
+
+type Status struct {
+	Enabled bool       `yaml:"enabled"`
+	Auth    StatusAuth `yaml:"auth"`
+}
+
+type StatusAuth struct {
+	Type         string `yaml:"type" validate:"oneof=kubernetes basic"`
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"passwordFile"`
+}
+
+type Cache struct {
+	Type   string      `yaml:"type" validate:"oneof=memory redis"`
+	Redis  RedisCache  `yaml:"redis"`
+	Warmup CacheWarmup `yaml:"warmup"`
+}
+
+type RedisCache struct {
+	Address      string `yaml:"address"`
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"passwordFile"`
+	DB           int    `yaml:"db"`
+	TLS          bool   `yaml:"tls"`
+	KeyPrefix    string `yaml:"keyPrefix"`
+}
+
+// CacheWarmup lists the target registry at startup and periodically to fill the cache
+type CacheWarmup struct {
+	Enabled         bool          `yaml:"enabled"`
+	Interval        time.Duration `yaml:"interval"`
+	MaxRepositories int           `yaml:"maxRepositories"`
+	MaxImages       int           `yaml:"maxImages"`
+}
+
+// LeaderElection runs the singleton background work only on the replica holding a Lease
+type LeaderElection struct {
+	Enabled       bool          `yaml:"enabled"`
+	Namespace     string        `yaml:"namespace"`
+	LeaseName     string        `yaml:"leaseName"`
+	LeaseDuration time.Duration `yaml:"leaseDuration"`
+	RenewDeadline time.Duration `yaml:"renewDeadline"`
+	RetryPeriod   time.Duration `yaml:"retryPeriod"`
+}
+
 type JMESPathFilter struct {
 	JMESPath string `yaml:"jmespath"`
 }
 
 type Source struct {
-	Registries []Registry       `yaml:"registries"`
-	Filters    []JMESPathFilter `yaml:"filters"`
+	Registries  []Registry         `yaml:"registries"`
+	Credentials []SourceCredential `yaml:"credentials"`
+	Filters     []JMESPathFilter   `yaml:"filters"`
+}
+
+// SourceCredential authenticates the copies from a source registry. Secrets are read from a file or an environment variable,
+// either a password, an identity token, a docker config.json file or a docker credential helper.
+type SourceCredential struct {
+	Registry     string `yaml:"registry"`
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"passwordFile"`
+	PasswordEnv  string `yaml:"passwordEnv"`
+	TokenFile    string `yaml:"tokenFile"`
+	TokenEnv     string `yaml:"tokenEnv"`
+	// DockerConfig is the path of a docker config.json file holding the credentials of any number of registries
+	DockerConfig string `yaml:"dockerConfig"`
+	// CredentialHelper is the name of a docker credential helper, e.g. "gcloud" runs docker-credential-gcloud
+	CredentialHelper string `yaml:"credentialHelper"`
+
+	// Password and Token are only declared to reject inline secrets
+	Password string `yaml:"password"`
+	Token    string `yaml:"token"`
 }
 
 type Registry struct {
-	Type string `yaml:"type"`
-	AWS  AWS    `yaml:"aws"`
-	GCP  GCP    `yaml:"gcp"`
+	Type  string        `yaml:"type"`
+	AWS   AWS           `yaml:"aws"`
+	GCP   GCP           `yaml:"gcp"`
+	Cache RegistryCache `yaml:"cache"`
+}
+
+// RegistryCache configures how long the repositories and images are known to exist, or to be missing, without asking the registry
+type RegistryCache struct {
+	TTL         time.Duration `yaml:"ttl"`
+	Jitter      time.Duration `yaml:"jitter"`
+	NegativeTTL time.Duration `yaml:"negativeTTL"`
+	// Size is the maximum number of entries kept in memory, it does not limit a shared cache
+	Size int `yaml:"size"`
 }
 
 type AWS struct {
@@ -155,6 +429,331 @@ func CheckRegistryConfiguration(r Registry) error {
 		}
 	}
 
+	if err := CheckRegistryCacheConfiguration(r.Cache); err != nil {
+		return errorWithType(err.Error())
+	}
+
+	return nil
+}
+
+// CheckSourceCredentialConfiguration provides detailed information about wrongly provided source registry credentials
+func CheckSourceCredentialConfiguration(c SourceCredential) error {
+	if c.Password != "" || c.Token != "" {
+		return fmt.Errorf(`inline secrets are not supported, use "passwordFile", "passwordEnv", "tokenFile" or "tokenEnv"`)
+	}
+	if c.PasswordFile != "" && c.PasswordEnv != "" {
+		return fmt.Errorf(`requires either "passwordFile" or "passwordEnv"`)
+	}
+	if c.TokenFile != "" && c.TokenEnv != "" {
+		return fmt.Errorf(`requires either "tokenFile" or "tokenEnv"`)
+	}
+
+	sources := 0
+	for _, source := range []bool{
+		c.PasswordFile != "" || c.PasswordEnv != "",
+		c.TokenFile != "" || c.TokenEnv != "",
+		c.DockerConfig != "",
+		c.CredentialHelper != "",
+	} {
+		if source {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf(`requires exactly one of a password, a token, "dockerConfig" or "credentialHelper"`)
+	}
+
+	if c.DockerConfig != "" {
+		if c.Registry != "" || c.Username != "" {
+			return fmt.Errorf(`"dockerConfig" does not support "registry" and "username"`)
+		}
+		return nil
+	}
+
+	if c.Registry == "" {
+		return fmt.Errorf(`requires a field "registry"`)
+	}
+	if (c.PasswordFile != "" || c.PasswordEnv != "") && c.Username == "" {
+		return fmt.Errorf(`requires a field "username" with a password`)
+	}
+
+	return nil
+}
+
+// CheckRegistryCacheConfiguration provides detailed information about wrongly provided registry cache configuration
+func CheckRegistryCacheConfiguration(c RegistryCache) error {
+	if c.TTL < 0 {
+		return fmt.Errorf(`requires a positive "cache.ttl"`)
+	}
+	if c.Jitter < 0 {
+		return fmt.Errorf(`requires a positive "cache.jitter"`)
+	}
+	if c.NegativeTTL < 0 {
+		return fmt.Errorf(`requires a positive "cache.negativeTTL"`)
+	}
+	if c.Size < 0 {
+		return fmt.Errorf(`requires a positive "cache.size"`)
+	}
+
+	return nil
+}
+
+// CheckCopyQueueConfiguration provides detailed information about wrongly provided copy queue configuration
+func CheckCopyQueueConfiguration(q CopyQueue) error {
+	if q.Capacity < 0 {
+		return fmt.Errorf(`copy queue requires a positive "capacity"`)
+	}
+	if q.Retry.MaxAttempts < 0 {
+		return fmt.Errorf(`copy queue requires a positive "retry.maxAttempts"`)
+	}
+	if q.Retry.InitialBackoff < 0 || q.Retry.MaxBackoff < 0 {
+		return fmt.Errorf(`copy queue requires positive "retry.initialBackoff" and "retry.maxBackoff"`)
+	}
+	if q.Retry.MaxTooManyRequests < 0 {
+		return fmt.Errorf(`copy queue requires a positive "retry.maxTooManyRequests"`)
+	}
+
+	errorWithType := func(info string) error {
+		return fmt.Errorf(`copy queue store of type "%s" %s`, q.Store.Type, info)
+	}
+
+	store, _ := types.ParseQueueStore(q.Store.Type)
+	switch store {
+	case types.QueueStoreFile:
+		if q.Store.Path == "" {
+			return errorWithType(`requires a field "path"`)
+		}
+	case types.QueueStoreKubernetes:
+		if q.Store.Namespace == "" {
+			return errorWithType(`requires a field "namespace"`)
+		}
+		if q.Store.ConfigMap == "" {
+			return errorWithType(`requires a field "configMap"`)
+		}
+	}
+
+	return nil
+}
+
+// CheckCopyWorkersConfiguration provides detailed information about wrongly provided copy workers configuration
+func CheckCopyWorkersConfiguration(w CopyWorkers) error {
+	if w.Immediate < 0 || w.Delayed < 0 || w.Backfill < 0 {
+		return fmt.Errorf(`copy workers require positive "immediate", "delayed" and "backfill"`)
+	}
+
+	return nil
+}
+
+// CheckCopyLimitsConfiguration provides detailed information about wrongly provided copy limits configuration
+func CheckCopyLimitsConfiguration(c CopyLimits) error {
+	if c.TooManyRequestsBackoff < 0 {
+		return fmt.Errorf(`copy limits require a positive "tooManyRequestsBackoff"`)
+	}
+	if err := checkRegistryLimit(c.Default); err != nil {
+		return fmt.Errorf(`copy limits "default" %s`, err)
+	}
+	if err := checkRegistryLimit(c.Target); err != nil {
+		return fmt.Errorf(`copy limits "target" %s`, err)
+	}
+
+	registries := map[string]bool{}
+	for i, limit := range c.Registries {
+		if limit.Registry == "" {
+			return fmt.Errorf(`copy limits "registries[%d]" require a field "registry"`, i)
+		}
+		if registries[limit.Registry] {
+			return fmt.Errorf(`copy limits "registries[%d]" duplicate registry %q`, i, limit.Registry)
+		}
+		registries[limit.Registry] = true
+
+		if err := checkRegistryLimit(limit); err != nil {
+			return fmt.Errorf(`copy limits "registries[%d]" %s`, i, err)
+		}
+	}
+
+	return nil
+}
+
+func checkRegistryLimit(l RegistryLimit) error {
+	if l.Concurrency < 0 || l.Rate < 0 || l.Burst < 0 {
+		return fmt.Errorf(`require positive "concurrency", "rate" and "burst"`)
+	}
+
+	return nil
+}
+
+// CheckBandwidthConfiguration provides detailed information about wrongly provided bandwidth configuration
+func CheckBandwidthConfiguration(b Bandwidth) error {
+	if b.Global < 0 || b.PerJob < 0 {
+		return fmt.Errorf(`bandwidth requires positive "global" and "perJob"`)
+	}
+	if _, err := time.LoadLocation(b.TimeZone); err != nil {
+		return fmt.Errorf(`bandwidth requires a valid "timeZone": %w`, err)
+	}
+
+	for i, schedule := range b.Schedules {
+		if _, err := time.Parse(BandwidthScheduleLayout, schedule.Start); err != nil {
+			return fmt.Errorf(`bandwidth "schedules[%d]" requires a "start" formatted as %q`, i, BandwidthScheduleLayout)
+		}
+		if _, err := time.Parse(BandwidthScheduleLayout, schedule.End); err != nil {
+			return fmt.Errorf(`bandwidth "schedules[%d]" requires an "end" formatted as %q`, i, BandwidthScheduleLayout)
+		}
+		if schedule.Start == schedule.End {
+			return fmt.Errorf(`bandwidth "schedules[%d]" requires a "start" different from the "end"`, i)
+		}
+		if schedule.Global < 0 || schedule.PerJob < 0 {
+			return fmt.Errorf(`bandwidth "schedules[%d]" requires positive "global" and "perJob"`, i)
+		}
+	}
+
+	return nil
+}
+
+// CheckTracingConfiguration provides detailed information about wrongly provided tracing configuration
+func CheckTracingConfiguration(t Tracing) error {
+	if t.SamplingRatio < 0 || t.SamplingRatio > 1 {
+		return fmt.Errorf(`tracing requires a "samplingRatio" between 0 and 1`)
+	}
+
+	return nil
+}
+
+// CheckEventsConfiguration provides detailed information about wrongly provided events configuration
+func CheckEventsConfiguration(e Events) error {
+	if e.QPS < 0 || e.Burst < 0 {
+		return fmt.Errorf(`events require positive "qps" and "burst"`)
+	}
+
+	return nil
+}
+
+// CheckTLSConfiguration provides detailed information about wrongly provided TLS configuration
+func CheckTLSConfiguration(t TLS) error {
+	if !t.SelfManaged.Enabled {
+		return nil
+	}
+
+	if t.SelfManaged.SecretName == "" {
+		return fmt.Errorf(`self-managed certificates require a field "secretName"`)
+	}
+	if t.SelfManaged.ServiceName == "" {
+		return fmt.Errorf(`self-managed certificates require a field "serviceName"`)
+	}
+	if t.SelfManaged.WebhookName == "" {
+		return fmt.Errorf(`self-managed certificates require a field "webhookName"`)
+	}
+	if t.SelfManaged.Validity < 0 || t.SelfManaged.RenewBefore < 0 {
+		return fmt.Errorf(`self-managed certificates require positive "validity" and "renewBefore"`)
+	}
+
+	validity := DefaultCertificateValidity
+	if t.SelfManaged.Validity != 0 {
+		validity = t.SelfManaged.Validity
+	}
+	renewBefore := DefaultCertificateRenewBefore
+	if t.SelfManaged.RenewBefore != 0 {
+		renewBefore = t.SelfManaged.RenewBefore
+	}
+	if renewBefore >= validity {
+		return fmt.Errorf(`self-managed certificates require "renewBefore" to be less than "validity"`)
+	}
+
+	return nil
+}
+
+// CheckResyncConfiguration provides detailed information about wrongly provided re-sync configuration
+func CheckResyncConfiguration(r Resync) error {
+	if r.Interval != 0 && r.Interval < MinResyncInterval {
+		return fmt.Errorf(`re-sync requires an "interval" of at least %s`, MinResyncInterval)
+	}
+
+	return nil
+}
+
+// CheckGCConfiguration provides detailed information about wrongly provided garbage collection configuration
+func CheckGCConfiguration(g GC) error {
+	if g.Interval != 0 && g.Interval < MinGCInterval {
+		return fmt.Errorf(`garbage collection requires an "interval" of at least %s`, MinGCInterval)
+	}
+	if g.GracePeriod != 0 && g.GracePeriod < MinGCGracePeriod {
+		return fmt.Errorf(`garbage collection requires a "gracePeriod" of at least %s`, MinGCGracePeriod)
+	}
+
+	return nil
+}
+
+// CheckStatusConfiguration provides detailed information about wrongly provided status page configuration
+func CheckStatusConfiguration(s Status) error {
+	if !s.Enabled {
+		return nil
+	}
+
+	// an unset type defaults to kubernetes
+	auth, _ := types.ParseStatusAuth(s.Auth.Type)
+	if auth == types.StatusAuthBasic {
+		if s.Auth.Username == "" {
+			return fmt.Errorf(`status page with basic auth requires a field "auth.username"`)
+		}
+		if s.Auth.PasswordFile == "" {
+			return fmt.Errorf(`status page with basic auth requires a field "auth.passwordFile"`)
+		}
+	}
+
+	return nil
+}
+
+// CheckCacheConfiguration provides detailed information about wrongly provided cache configuration
+func CheckCacheConfiguration(c Cache) error {
+	if c.Warmup.Interval != 0 && c.Warmup.Interval < MinCacheWarmupInterval {
+		return fmt.Errorf(`cache warm-up requires a "warmup.interval" of at least %s`, MinCacheWarmupInterval)
+	}
+	if c.Warmup.MaxRepositories < 0 || c.Warmup.MaxImages < 0 {
+		return fmt.Errorf(`cache warm-up requires positive "warmup.maxRepositories" and "warmup.maxImages"`)
+	}
+
+	// an unset type defaults to memory
+	cacheType, _ := types.ParseCacheType(c.Type)
+	if cacheType != types.CacheTypeRedis {
+		return nil
+	}
+
+	if c.Redis.Address == "" {
+		return fmt.Errorf(`cache of type "redis" requires a field "redis.address"`)
+	}
+	if c.Redis.DB < 0 {
+		return fmt.Errorf(`cache of type "redis" requires a positive "redis.db"`)
+	}
+
+	return nil
+}
+
+// CheckLeaderElectionConfiguration provides detailed information about wrongly provided leader election configuration
+func CheckLeaderElectionConfiguration(l LeaderElection) error {
+	if l.LeaseDuration < 0 || l.RenewDeadline < 0 || l.RetryPeriod < 0 {
+		return fmt.Errorf(`leader election requires positive "leaseDuration", "renewDeadline" and "retryPeriod"`)
+	}
+
+	leaseDuration := DefaultLeaderElectionLeaseDuration
+	if l.LeaseDuration != 0 {
+		leaseDuration = l.LeaseDuration
+	}
+	renewDeadline := DefaultLeaderElectionRenewDeadline
+	if l.RenewDeadline != 0 {
+		renewDeadline = l.RenewDeadline
+	}
+	retryPeriod := DefaultLeaderElectionRetryPeriod
+	if l.RetryPeriod != 0 {
+		retryPeriod = l.RetryPeriod
+	}
+
+	// the leader gives up before others may take over the lease
+	if renewDeadline >= leaseDuration {
+		return fmt.Errorf(`leader election requires a "renewDeadline" (%s) shorter than the "leaseDuration" (%s)`, renewDeadline, leaseDuration)
+	}
+	if retryPeriod >= renewDeadline {
+		return fmt.Errorf(`leader election requires a "retryPeriod" (%s) shorter than the "renewDeadline" (%s)`, retryPeriod, renewDeadline)
+	}
+
 	return nil
 }
 
@@ -164,4 +763,5 @@ func SetViperDefaults(v *viper.Viper) {
 	v.SetDefault("Target.AWS.ECROptions.ImageScanningConfiguration.ImageScanOnPush", true)
 	v.SetDefault("Target.AWS.ECROptions.ImageTagMutability", "MUTABLE")
 	v.SetDefault("Target.AWS.ECROptions.EncryptionConfiguration.EncryptionType", "AES256")
+	v.SetDefault("GC.DryRun", true)
 }
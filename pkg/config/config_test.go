@@ -3,6 +3,7 @@ package config
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 
@@ -21,6 +22,7 @@ func TestConfigParses(t *testing.T) {
 			name: "should render empty config with defaults",
 			cfg:  "",
 			expCfg: Config{
+				GC: GC{DryRun: true},
 				Target: Registry{
 					Type: "aws",
 					AWS: AWS{
@@ -46,6 +48,7 @@ source:
     - jmespath: "obj.metadata.namespace != 'playground'"
 `,
 			expCfg: Config{
+				GC: GC{DryRun: true},
 				Target: Registry{
 					Type: "aws",
 					AWS: AWS{
@@ -85,6 +88,7 @@ target:
           value: B
 `,
 			expCfg: Config{
+				GC: GC{DryRun: true},
 				Target: Registry{
 					Type: "aws",
 					AWS: AWS{
@@ -127,8 +131,16 @@ source:
       aws:
         accountId: "12345678912"
         region: "us-east-1"
+  credentials:
+    - registry: docker.io
+      username: mirror
+      passwordEnv: DOCKERHUB_PASSWORD
+    - dockerConfig: /etc/k8s-image-swapper/config.json
+    - registry: gcr.io
+      credentialHelper: gcloud
 `,
 			expCfg: Config{
+				GC: GC{DryRun: true},
 				Target: Registry{
 					Type: "aws",
 					AWS: AWS{
@@ -158,6 +170,369 @@ source:
 								Region:    "us-east-1",
 							}},
 					},
+					Credentials: []SourceCredential{
+						{Registry: "docker.io", Username: "mirror", PasswordEnv: "DOCKERHUB_PASSWORD"},
+						{DockerConfig: "/etc/k8s-image-swapper/config.json"},
+						{Registry: "gcr.io", CredentialHelper: "gcloud"},
+					},
+				},
+			},
+		},
+		{
+			name: "should render copy queue config",
+			cfg: `
+copyQueue:
+  capacity: 500
+  overflowPolicy: defer
+  store:
+    type: kubernetes
+    namespace: k8s-image-swapper
+    configMap: k8s-image-swapper-copy-queue
+  retry:
+    maxAttempts: 3
+    initialBackoff: 10s
+    maxBackoff: 5m
+`,
+			expCfg: Config{
+				GC: GC{DryRun: true},
+				Target: Registry{
+					Type: "aws",
+					AWS: AWS{
+						ECROptions: ECROptions{
+							ImageTagMutability: "MUTABLE",
+							ImageScanningConfiguration: ImageScanningConfiguration{
+								ImageScanOnPush: true,
+							},
+							EncryptionConfiguration: EncryptionConfiguration{
+								EncryptionType: "AES256",
+							},
+						},
+					},
+				},
+				CopyQueue: CopyQueue{
+					Capacity:       500,
+					OverflowPolicy: "defer",
+					Store: CopyQueueStore{
+						Type:      "kubernetes",
+						Namespace: "k8s-image-swapper",
+						ConfigMap: "k8s-image-swapper-copy-queue",
+					},
+					Retry: CopyQueueRetry{
+						MaxAttempts:    3,
+						InitialBackoff: 10 * time.Second,
+						MaxBackoff:     5 * time.Minute,
+					},
+				},
+			},
+		},
+		{
+			name: "should render tracing config",
+			cfg: `
+tracing:
+  enabled: true
+  endpoint: otel-collector.observability:4317
+  insecure: true
+  samplingRatio: 0.25
+`,
+			expCfg: Config{
+				GC: GC{DryRun: true},
+				Target: Registry{
+					Type: "aws",
+					AWS: AWS{
+						ECROptions: ECROptions{
+							ImageTagMutability: "MUTABLE",
+							ImageScanningConfiguration: ImageScanningConfiguration{
+								ImageScanOnPush: true,
+							},
+							EncryptionConfiguration: EncryptionConfiguration{
+								EncryptionType: "AES256",
+							},
+						},
+					},
+				},
+				Tracing: Tracing{
+					Enabled:       true,
+					Endpoint:      "otel-collector.observability:4317",
+					Insecure:      true,
+					SamplingRatio: 0.25,
+				},
+			},
+		},
+		{
+			name: "should render events config",
+			cfg: `
+events:
+  enabled: true
+  qps: 0.5
+  burst: 10
+`,
+			expCfg: Config{
+				GC: GC{DryRun: true},
+				Target: Registry{
+					Type: "aws",
+					AWS: AWS{
+						ECROptions: ECROptions{
+							ImageTagMutability: "MUTABLE",
+							ImageScanningConfiguration: ImageScanningConfiguration{
+								ImageScanOnPush: true,
+							},
+							EncryptionConfiguration: EncryptionConfiguration{
+								EncryptionType: "AES256",
+							},
+						},
+					},
+				},
+				Events: Events{
+					Enabled: true,
+					QPS:     0.5,
+					Burst:   10,
+				},
+			},
+		},
+		{
+			name: "should render resync config",
+			cfg: `
+resync:
+  enabled: true
+  interval: 1h
+`,
+			expCfg: Config{
+				GC: GC{DryRun: true},
+				Target: Registry{
+					Type: "aws",
+					AWS: AWS{
+						ECROptions: ECROptions{
+							ImageTagMutability: "MUTABLE",
+							ImageScanningConfiguration: ImageScanningConfiguration{
+								ImageScanOnPush: true,
+							},
+							EncryptionConfiguration: EncryptionConfiguration{
+								EncryptionType: "AES256",
+							},
+						},
+					},
+				},
+				Resync: Resync{
+					Enabled:  true,
+					Interval: time.Hour,
+				},
+			},
+		},
+		{
+			name: "should render status config",
+			cfg: `
+status:
+  enabled: true
+  auth:
+    type: basic
+    username: admin
+    passwordFile: /etc/k8s-image-swapper/status-password
+`,
+			expCfg: Config{
+				GC: GC{DryRun: true},
+				Target: Registry{
+					Type: "aws",
+					AWS: AWS{
+						ECROptions: ECROptions{
+							ImageTagMutability: "MUTABLE",
+							ImageScanningConfiguration: ImageScanningConfiguration{
+								ImageScanOnPush: true,
+							},
+							EncryptionConfiguration: EncryptionConfiguration{
+								EncryptionType: "AES256",
+							},
+						},
+					},
+				},
+				Status: Status{
+					Enabled: true,
+					Auth: StatusAuth{
+						Type:         "basic",
+						Username:     "admin",
+						PasswordFile: "/etc/k8s-image-swapper/status-password",
+					},
+				},
+			},
+		},
+		{
+			name: "should render cache config",
+			cfg: `
+cache:
+  type: redis
+  redis:
+    address: redis:6379
+    passwordFile: /etc/k8s-image-swapper/redis/password
+    db: 2
+    tls: true
+  warmup:
+    enabled: true
+    interval: 6h
+    maxRepositories: 100
+    maxImages: 5000
+`,
+			expCfg: Config{
+				GC: GC{DryRun: true},
+				Target: Registry{
+					Type: "aws",
+					AWS: AWS{
+						ECROptions: ECROptions{
+							ImageTagMutability: "MUTABLE",
+							ImageScanningConfiguration: ImageScanningConfiguration{
+								ImageScanOnPush: true,
+							},
+							EncryptionConfiguration: EncryptionConfiguration{
+								EncryptionType: "AES256",
+							},
+						},
+					},
+				},
+				Cache: Cache{
+					Type: "redis",
+					Redis: RedisCache{
+						Address:      "redis:6379",
+						PasswordFile: "/etc/k8s-image-swapper/redis/password",
+						DB:           2,
+						TLS:          true,
+					},
+					Warmup: CacheWarmup{
+						Enabled:         true,
+						Interval:        6 * time.Hour,
+						MaxRepositories: 100,
+						MaxImages:       5000,
+					},
+				},
+			},
+		},
+		{
+			name: "should render leader election config",
+			cfg: `
+leaderElection:
+  enabled: true
+  namespace: k8s-image-swapper
+  leaseName: image-swapper
+  leaseDuration: 30s
+  renewDeadline: 20s
+  retryPeriod: 5s
+`,
+			expCfg: Config{
+				GC: GC{DryRun: true},
+				Target: Registry{
+					Type: "aws",
+					AWS: AWS{
+						ECROptions: ECROptions{
+							ImageTagMutability: "MUTABLE",
+							ImageScanningConfiguration: ImageScanningConfiguration{
+								ImageScanOnPush: true,
+							},
+							EncryptionConfiguration: EncryptionConfiguration{
+								EncryptionType: "AES256",
+							},
+						},
+					},
+				},
+				LeaderElection: LeaderElection{
+					Enabled:       true,
+					Namespace:     "k8s-image-swapper",
+					LeaseName:     "image-swapper",
+					LeaseDuration: 30 * time.Second,
+					RenewDeadline: 20 * time.Second,
+					RetryPeriod:   5 * time.Second,
+				},
+			},
+		},
+		{
+			name: "should render copy workers, limits and bandwidth config",
+			cfg: `
+copyWorkers:
+  immediate: 10
+  delayed: 50
+  backfill: 2
+bandwidth:
+  global: 104857600
+  perJob: 10485760
+  schedules:
+  - start: "08:00"
+    end: "18:00"
+    global: 20971520
+  timeZone: Europe/Berlin
+copyLimits:
+  default:
+    concurrency: 10
+  registries:
+  - registry: docker.io
+    concurrency: 5
+    rate: 0.5
+    burst: 2
+  target:
+    concurrency: 50
+  tooManyRequestsBackoff: 5m
+`,
+			expCfg: Config{
+				GC: GC{DryRun: true},
+				Target: Registry{
+					Type: "aws",
+					AWS: AWS{
+						ECROptions: ECROptions{
+							ImageTagMutability: "MUTABLE",
+							ImageScanningConfiguration: ImageScanningConfiguration{
+								ImageScanOnPush: true,
+							},
+							EncryptionConfiguration: EncryptionConfiguration{
+								EncryptionType: "AES256",
+							},
+						},
+					},
+				},
+				CopyWorkers: CopyWorkers{Immediate: 10, Delayed: 50, Backfill: 2},
+				Bandwidth: Bandwidth{
+					Global: 100 << 20,
+					PerJob: 10 << 20,
+					Schedules: []BandwidthSchedule{
+						{Start: "08:00", End: "18:00", Global: 20 << 20},
+					},
+					TimeZone: "Europe/Berlin",
+				},
+				CopyLimits: CopyLimits{
+					Default: RegistryLimit{Concurrency: 10},
+					Registries: []RegistryLimit{
+						{Registry: "docker.io", Concurrency: 5, Rate: 0.5, Burst: 2},
+					},
+					Target:                 RegistryLimit{Concurrency: 50},
+					TooManyRequestsBackoff: 5 * time.Minute,
+				},
+			},
+		},
+		{
+			name: "should render registry cache config",
+			cfg: `
+target:
+  cache:
+    ttl: 12h
+    jitter: 1h
+    negativeTTL: 30s
+    size: 10000
+`,
+			expCfg: Config{
+				GC: GC{DryRun: true},
+				Target: Registry{
+					Type: "aws",
+					AWS: AWS{
+						ECROptions: ECROptions{
+							ImageTagMutability: "MUTABLE",
+							ImageScanningConfiguration: ImageScanningConfiguration{
+								ImageScanOnPush: true,
+							},
+							EncryptionConfiguration: EncryptionConfiguration{
+								EncryptionType: "AES256",
+							},
+						},
+					},
+					Cache: RegistryCache{
+						TTL:         12 * time.Hour,
+						Jitter:      time.Hour,
+						NegativeTTL: 30 * time.Second,
+						Size:        10000,
+					},
 				},
 			},
 		},
@@ -178,6 +553,7 @@ target:
           value: B
 `,
 			expCfg: Config{
+				GC: GC{DryRun: true},
 				Target: Registry{
 					Type: "aws",
 					AWS: AWS{
@@ -231,3 +607,185 @@ target:
 		})
 	}
 }
+
+func TestCheckCopyQueueConfiguration(t *testing.T) {
+	tests := []struct {
+		name   string
+		queue  CopyQueue
+		expErr bool
+	}{
+		{
+			name:  "defaults to memory",
+			queue: CopyQueue{},
+		},
+		{
+			name:   "negative capacity",
+			queue:  CopyQueue{Capacity: -1},
+			expErr: true,
+		},
+		{
+			name:   "file store without path",
+			queue:  CopyQueue{Store: CopyQueueStore{Type: "file"}},
+			expErr: true,
+		},
+		{
+			name:  "file store",
+			queue: CopyQueue{Store: CopyQueueStore{Type: "file", Path: "/var/lib/k8s-image-swapper"}},
+		},
+		{
+			name:   "kubernetes store without configMap",
+			queue:  CopyQueue{Store: CopyQueueStore{Type: "kubernetes", Namespace: "default"}},
+			expErr: true,
+		},
+		{
+			name:  "kubernetes store",
+			queue: CopyQueue{Store: CopyQueueStore{Type: "kubernetes", Namespace: "default", ConfigMap: "copy-queue"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckCopyQueueConfiguration(test.queue)
+			if test.expErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckTracingConfiguration(t *testing.T) {
+	assert.NoError(t, CheckTracingConfiguration(Tracing{}))
+	assert.NoError(t, CheckTracingConfiguration(Tracing{Enabled: true, SamplingRatio: 0.5}))
+	assert.Error(t, CheckTracingConfiguration(Tracing{Enabled: true, SamplingRatio: 1.5}))
+	assert.Error(t, CheckTracingConfiguration(Tracing{Enabled: true, SamplingRatio: -0.1}))
+}
+
+func TestCheckEventsConfiguration(t *testing.T) {
+	assert.NoError(t, CheckEventsConfiguration(Events{}))
+	assert.NoError(t, CheckEventsConfiguration(Events{Enabled: true, QPS: 0.1, Burst: 5}))
+	assert.Error(t, CheckEventsConfiguration(Events{Enabled: true, QPS: -1}))
+	assert.Error(t, CheckEventsConfiguration(Events{Enabled: true, Burst: -1}))
+}
+
+func TestCheckResyncConfiguration(t *testing.T) {
+	assert.NoError(t, CheckResyncConfiguration(Resync{}))
+	assert.NoError(t, CheckResyncConfiguration(Resync{Enabled: true, Interval: time.Hour}))
+	assert.Error(t, CheckResyncConfiguration(Resync{Enabled: true, Interval: time.Second}))
+	assert.Error(t, CheckResyncConfiguration(Resync{Enabled: true, Interval: -time.Hour}))
+}
+
+func TestCheckGCConfiguration(t *testing.T) {
+	assert.NoError(t, CheckGCConfiguration(GC{}))
+	assert.NoError(t, CheckGCConfiguration(GC{Enabled: true, Interval: time.Hour, GracePeriod: 24 * time.Hour}))
+	assert.Error(t, CheckGCConfiguration(GC{Enabled: true, Interval: time.Second}))
+	assert.Error(t, CheckGCConfiguration(GC{Enabled: true, GracePeriod: time.Minute}))
+	assert.Error(t, CheckGCConfiguration(GC{Enabled: true, GracePeriod: -time.Hour}))
+}
+
+func TestCheckStatusConfiguration(t *testing.T) {
+	assert.NoError(t, CheckStatusConfiguration(Status{}))
+	assert.NoError(t, CheckStatusConfiguration(Status{Enabled: true}), "kubernetes auth by default")
+	assert.NoError(t, CheckStatusConfiguration(Status{Enabled: true, Auth: StatusAuth{Type: "basic", Username: "admin", PasswordFile: "/etc/password"}}))
+	assert.Error(t, CheckStatusConfiguration(Status{Enabled: true, Auth: StatusAuth{Type: "basic", PasswordFile: "/etc/password"}}))
+	assert.Error(t, CheckStatusConfiguration(Status{Enabled: true, Auth: StatusAuth{Type: "basic", Username: "admin"}}))
+}
+
+func TestCheckCacheConfiguration(t *testing.T) {
+	assert.NoError(t, CheckCacheConfiguration(Cache{}))
+	assert.NoError(t, CheckCacheConfiguration(Cache{Type: "memory"}))
+	assert.NoError(t, CheckCacheConfiguration(Cache{Type: "redis", Redis: RedisCache{Address: "redis:6379"}}))
+	assert.Error(t, CheckCacheConfiguration(Cache{Type: "redis"}))
+	assert.Error(t, CheckCacheConfiguration(Cache{Type: "redis", Redis: RedisCache{Address: "redis:6379", DB: -1}}))
+	assert.NoError(t, CheckCacheConfiguration(Cache{Warmup: CacheWarmup{Enabled: true, Interval: time.Hour, MaxImages: 100}}))
+	assert.Error(t, CheckCacheConfiguration(Cache{Warmup: CacheWarmup{Enabled: true, Interval: time.Second}}))
+	assert.Error(t, CheckCacheConfiguration(Cache{Warmup: CacheWarmup{Enabled: true, MaxImages: -1}}))
+}
+
+func TestCheckLeaderElectionConfiguration(t *testing.T) {
+	assert.NoError(t, CheckLeaderElectionConfiguration(LeaderElection{}))
+	assert.NoError(t, CheckLeaderElectionConfiguration(LeaderElection{Enabled: true, LeaseDuration: 30 * time.Second, RenewDeadline: 20 * time.Second}))
+	assert.Error(t, CheckLeaderElectionConfiguration(LeaderElection{Enabled: true, LeaseDuration: -time.Second}))
+	assert.Error(t, CheckLeaderElectionConfiguration(LeaderElection{Enabled: true, LeaseDuration: 10 * time.Second}), "renewDeadline defaults to 10s")
+	assert.Error(t, CheckLeaderElectionConfiguration(LeaderElection{Enabled: true, RetryPeriod: 10 * time.Second}))
+}
+
+func TestCheckBandwidthConfiguration(t *testing.T) {
+	assert.NoError(t, CheckBandwidthConfiguration(Bandwidth{}))
+	assert.NoError(t, CheckBandwidthConfiguration(Bandwidth{
+		Global:    100 << 20,
+		Schedules: []BandwidthSchedule{{Start: "08:00", End: "18:00", Global: 10 << 20}, {Start: "22:00", End: "02:00"}},
+		TimeZone:  "Europe/Berlin",
+	}))
+	assert.Error(t, CheckBandwidthConfiguration(Bandwidth{PerJob: -1}))
+	assert.Error(t, CheckBandwidthConfiguration(Bandwidth{TimeZone: "Mars/Olympus_Mons"}))
+	assert.Error(t, CheckBandwidthConfiguration(Bandwidth{Schedules: []BandwidthSchedule{{Start: "8am", End: "18:00"}}}))
+	assert.Error(t, CheckBandwidthConfiguration(Bandwidth{Schedules: []BandwidthSchedule{{Start: "08:00", End: "08:00"}}}))
+	assert.Error(t, CheckBandwidthConfiguration(Bandwidth{Schedules: []BandwidthSchedule{{Start: "08:00", End: "18:00", Global: -1}}}))
+}
+
+func TestCheckCopyWorkersConfiguration(t *testing.T) {
+	assert.NoError(t, CheckCopyWorkersConfiguration(CopyWorkers{}))
+	assert.NoError(t, CheckCopyWorkersConfiguration(CopyWorkers{Immediate: 5, Delayed: 50, Backfill: 1}))
+	assert.Error(t, CheckCopyWorkersConfiguration(CopyWorkers{Backfill: -1}))
+}
+
+func TestCheckCopyLimitsConfiguration(t *testing.T) {
+	assert.NoError(t, CheckCopyLimitsConfiguration(CopyLimits{}))
+	assert.NoError(t, CheckCopyLimitsConfiguration(CopyLimits{
+		Default:    RegistryLimit{Concurrency: 10},
+		Registries: []RegistryLimit{{Registry: "docker.io", Rate: 0.5}, {Registry: "ghcr.io", Concurrency: 20}},
+	}))
+	assert.Error(t, CheckCopyLimitsConfiguration(CopyLimits{TooManyRequestsBackoff: -time.Minute}))
+	assert.Error(t, CheckCopyLimitsConfiguration(CopyLimits{Default: RegistryLimit{Rate: -1}}))
+	assert.Error(t, CheckCopyLimitsConfiguration(CopyLimits{Target: RegistryLimit{Concurrency: -1}}))
+	assert.Error(t, CheckCopyLimitsConfiguration(CopyLimits{Registries: []RegistryLimit{{Concurrency: 5}}}), "registry is required")
+	assert.Error(t, CheckCopyLimitsConfiguration(CopyLimits{Registries: []RegistryLimit{{Registry: "docker.io"}, {Registry: "docker.io"}}}))
+}
+
+func TestCheckSourceCredentialConfiguration(t *testing.T) {
+	assert.NoError(t, CheckSourceCredentialConfiguration(SourceCredential{Registry: "docker.io", Username: "mirror", PasswordFile: "/secrets/password"}))
+	assert.NoError(t, CheckSourceCredentialConfiguration(SourceCredential{Registry: "myregistry.azurecr.io", TokenEnv: "ACR_TOKEN"}))
+	assert.NoError(t, CheckSourceCredentialConfiguration(SourceCredential{DockerConfig: "/secrets/config.json"}))
+	assert.NoError(t, CheckSourceCredentialConfiguration(SourceCredential{Registry: "gcr.io", CredentialHelper: "gcloud"}))
+
+	assert.ErrorContains(t, CheckSourceCredentialConfiguration(SourceCredential{Registry: "docker.io", Username: "mirror", Password: "secret"}), "inline secrets")
+	assert.Error(t, CheckSourceCredentialConfiguration(SourceCredential{Registry: "docker.io", Username: "mirror", PasswordFile: "/secrets/password", PasswordEnv: "PASSWORD"}))
+	assert.Error(t, CheckSourceCredentialConfiguration(SourceCredential{Registry: "docker.io"}))
+	assert.Error(t, CheckSourceCredentialConfiguration(SourceCredential{Registry: "gcr.io", CredentialHelper: "gcloud", TokenEnv: "TOKEN"}))
+	assert.Error(t, CheckSourceCredentialConfiguration(SourceCredential{Username: "mirror", PasswordEnv: "PASSWORD"}))
+	assert.Error(t, CheckSourceCredentialConfiguration(SourceCredential{Registry: "docker.io", PasswordEnv: "PASSWORD"}))
+	assert.Error(t, CheckSourceCredentialConfiguration(SourceCredential{Registry: "docker.io", DockerConfig: "/secrets/config.json"}))
+}
+
+func TestCheckRegistryCacheConfiguration(t *testing.T) {
+	assert.NoError(t, CheckRegistryCacheConfiguration(RegistryCache{}))
+	assert.NoError(t, CheckRegistryCacheConfiguration(RegistryCache{TTL: time.Hour, NegativeTTL: time.Second, Size: 100}))
+	assert.Error(t, CheckRegistryCacheConfiguration(RegistryCache{TTL: -time.Hour}))
+	assert.Error(t, CheckRegistryCacheConfiguration(RegistryCache{Jitter: -time.Hour}))
+	assert.Error(t, CheckRegistryCacheConfiguration(RegistryCache{NegativeTTL: -time.Second}))
+	assert.Error(t, CheckRegistryCacheConfiguration(RegistryCache{Size: -1}))
+}
+
+func TestCheckTLSConfiguration(t *testing.T) {
+	selfManaged := SelfManagedTLS{Enabled: true, SecretName: "k8s-image-swapper-tls", ServiceName: "k8s-image-swapper", WebhookName: "k8s-image-swapper"}
+
+	assert.NoError(t, CheckTLSConfiguration(TLS{}))
+	assert.NoError(t, CheckTLSConfiguration(TLS{SelfManaged: selfManaged}))
+
+	withoutSecret := selfManaged
+	withoutSecret.SecretName = ""
+	assert.Error(t, CheckTLSConfiguration(TLS{SelfManaged: withoutSecret}))
+
+	withoutWebhook := selfManaged
+	withoutWebhook.WebhookName = ""
+	assert.Error(t, CheckTLSConfiguration(TLS{SelfManaged: withoutWebhook}))
+
+	// renewal would start right after issuing the certificate
+	shortValidity := selfManaged
+	shortValidity.Validity = 24 * time.Hour
+	assert.Error(t, CheckTLSConfiguration(TLS{SelfManaged: shortValidity}))
+	shortValidity.RenewBefore = time.Hour
+	assert.NoError(t, CheckTLSConfiguration(TLS{SelfManaged: shortValidity}))
+}
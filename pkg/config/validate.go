@@ -0,0 +1,185 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/types"
+	jmespath "github.com/jmespath/go-jmespath"
+	"github.com/spf13/viper"
+)
+
+// MaxAdmissionCopyDeadline is the longest a copy may block an admission, the API server waits at most 30s for a webhook
+const MaxAdmissionCopyDeadline = 30 * time.Second
+
+var (
+	logLevels          = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+	logFormats         = []string{"json", "console"}
+	imageTagMutability = []string{"MUTABLE", "IMMUTABLE"}
+	encryptionTypes    = []string{"KMS", "AES256"}
+
+	imageSwapPolicies = []string{
+		types.ImageSwapPolicy(types.ImageSwapPolicyAlways).String(),
+		types.ImageSwapPolicy(types.ImageSwapPolicyExists).String(),
+	}
+	imageCopyPolicies = []string{
+		types.ImageCopyPolicy(types.ImageCopyPolicyDelayed).String(),
+		types.ImageCopyPolicy(types.ImageCopyPolicyImmediate).String(),
+		types.ImageCopyPolicy(types.ImageCopyPolicyForce).String(),
+		types.ImageCopyPolicy(types.ImageCopyPolicyNone).String(),
+	}
+	overflowPolicies = []string{
+		types.QueueOverflowPolicy(types.QueueOverflowPolicyBlock).String(),
+		types.QueueOverflowPolicy(types.QueueOverflowPolicyDrop).String(),
+		types.QueueOverflowPolicy(types.QueueOverflowPolicyDefer).String(),
+	}
+	queueStores = []string{
+		types.QueueStore(types.QueueStoreMemory).String(),
+		types.QueueStore(types.QueueStoreFile).String(),
+		types.QueueStore(types.QueueStoreKubernetes).String(),
+	}
+	statusAuths = []string{
+		types.StatusAuth(types.StatusAuthKubernetes).String(),
+		types.StatusAuth(types.StatusAuthBasic).String(),
+	}
+	cacheTypes = []string{
+		types.CacheType(types.CacheTypeMemory).String(),
+		types.CacheType(types.CacheTypeRedis).String(),
+	}
+	registryTypes = []string{
+		types.Registry(types.RegistryAWS).String(),
+		types.Registry(types.RegistryGCP).String(),
+	}
+)
+
+// Unmarshal decodes the configuration read by viper, keys not matching any option (e.g. typos) are rejected
+func Unmarshal(v *viper.Viper, c *Config) error {
+	return v.UnmarshalExact(c)
+}
+
+// Validate checks the whole configuration and returns all problems found, each prefixed with the path of the option.
+// Options which are not set are valid as long as they have a default.
+func Validate(c *Config) error {
+	errs := []error{}
+	add := func(path string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+
+	add("logLevel", oneOf(c.LogLevel, logLevels))
+	add("logFormat", oneOf(c.LogFormat, logFormats))
+
+	if c.DrainTimeout < 0 {
+		add("drainTimeout", errors.New("must not be negative"))
+	}
+	if c.ShutdownDelay < 0 {
+		add("shutdownDelay", errors.New("must not be negative"))
+	}
+
+	add("imageSwapPolicy", oneOf(c.ImageSwapPolicy, imageSwapPolicies))
+	add("imageCopyPolicy", oneOf(c.ImageCopyPolicy, imageCopyPolicies))
+
+	// an unset policy defaults to delayed
+	imageCopyPolicy, _ := types.ParseImageCopyPolicy(c.ImageCopyPolicy)
+
+	switch {
+	case c.ImageCopyDeadline < 0:
+		add("imageCopyDeadline", errors.New("must not be negative"))
+	case c.ImageCopyDeadline > MaxAdmissionCopyDeadline &&
+		(imageCopyPolicy == types.ImageCopyPolicyImmediate || imageCopyPolicy == types.ImageCopyPolicyForce):
+		add("imageCopyDeadline", fmt.Errorf("must not exceed %s with image copy policy %q, the admission would time out", MaxAdmissionCopyDeadline, imageCopyPolicy))
+	}
+
+	add("copyQueue.overflowPolicy", oneOf(c.CopyQueue.OverflowPolicy, overflowPolicies))
+	add("copyQueue.store.type", oneOf(c.CopyQueue.Store.Type, queueStores))
+	if c.CopyQueue.Retry.InitialBackoff > 0 && c.CopyQueue.Retry.MaxBackoff > 0 && c.CopyQueue.Retry.InitialBackoff > c.CopyQueue.Retry.MaxBackoff {
+		add("copyQueue.retry", errors.New(`"initialBackoff" must not exceed "maxBackoff"`))
+	}
+	add("copyQueue", CheckCopyQueueConfiguration(c.CopyQueue))
+	add("copyWorkers", CheckCopyWorkersConfiguration(c.CopyWorkers))
+	add("copyLimits", CheckCopyLimitsConfiguration(c.CopyLimits))
+	add("bandwidth", CheckBandwidthConfiguration(c.Bandwidth))
+
+	add("tracing", CheckTracingConfiguration(c.Tracing))
+	add("events", CheckEventsConfiguration(c.Events))
+	add("tls", CheckTLSConfiguration(c.TLS))
+	add("resync", CheckResyncConfiguration(c.Resync))
+	add("gc", CheckGCConfiguration(c.GC))
+	add("status.auth.type", oneOf(c.Status.Auth.Type, statusAuths))
+	add("status", CheckStatusConfiguration(c.Status))
+	add("cache.type", oneOf(c.Cache.Type, cacheTypes))
+	add("cache", CheckCacheConfiguration(c.Cache))
+	add("leaderElection", CheckLeaderElectionConfiguration(c.LeaderElection))
+
+	for i, filter := range c.Source.Filters {
+		if _, err := jmespath.Compile(filter.JMESPath); err != nil {
+			add(fmt.Sprintf("source.filters[%d]", i), fmt.Errorf("invalid JMESPath expression %q: %w", filter.JMESPath, err))
+		}
+	}
+
+	for i, r := range c.Source.Registries {
+		for _, err := range validateRegistry(r) {
+			add(fmt.Sprintf("source.registries[%d]", i), err)
+		}
+	}
+
+	for i, credential := range c.Source.Credentials {
+		add(fmt.Sprintf("source.credentials[%d]", i), CheckSourceCredentialConfiguration(credential))
+	}
+
+	for _, err := range validateRegistry(c.Target) {
+		add("target", err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateRegistry checks the registry type, its required fields and the options of the repositories it creates
+func validateRegistry(r Registry) []error {
+	if err := oneOf(r.Type, registryTypes); err != nil {
+		return []error{fmt.Errorf("type: %w", err)}
+	}
+
+	if err := CheckRegistryConfiguration(r); err != nil {
+		return []error{err}
+	}
+
+	if r.Type != types.Registry(types.RegistryAWS).String() {
+		return nil
+	}
+
+	errs := []error{}
+	options := r.AWS.ECROptions
+	if err := oneOf(options.ImageTagMutability, imageTagMutability); err != nil {
+		errs = append(errs, fmt.Errorf("aws.ecrOptions.imageTagMutability: %w", err))
+	}
+	if err := oneOf(options.EncryptionConfiguration.EncryptionType, encryptionTypes); err != nil {
+		errs = append(errs, fmt.Errorf("aws.ecrOptions.encryptionConfiguration.encryptionType: %w", err))
+	}
+	if options.AccessPolicy != "" && !json.Valid([]byte(options.AccessPolicy)) {
+		errs = append(errs, errors.New("aws.ecrOptions.accessPolicy: invalid JSON policy document"))
+	}
+	if options.LifecyclePolicy != "" && !json.Valid([]byte(options.LifecyclePolicy)) {
+		errs = append(errs, errors.New("aws.ecrOptions.lifecyclePolicy: invalid JSON policy document"))
+	}
+	for i, tag := range options.Tags {
+		if tag.Key == "" {
+			errs = append(errs, fmt.Errorf("aws.ecrOptions.tags[%d]: requires a field \"key\"", i))
+		}
+	}
+
+	return errs
+}
+
+// oneOf returns an error if the value is set but not one of the allowed values
+func oneOf(value string, allowed []string) error {
+	if value == "" || slices.Contains(allowed, value) {
+		return nil
+	}
+
+	return fmt.Errorf("unknown value %q, must be one of %v", value, allowed)
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func validConfig() *Config {
+	return &Config{
+		LogLevel:        "info",
+		LogFormat:       "json",
+		ImageSwapPolicy: "exists",
+		ImageCopyPolicy: "delayed",
+		Source: Source{
+			Registries: []Registry{{Type: "gcp", GCP: GCP{Location: "us-central1", ProjectID: "project", RepositoryID: "source"}}},
+			Filters:    []JMESPathFilter{{JMESPath: "obj.metadata.namespace == 'kube-system'"}},
+		},
+		Target: Registry{Type: "aws", AWS: AWS{
+			AccountID: "123456789",
+			Region:    "ap-southeast-2",
+			ECROptions: ECROptions{
+				AccessPolicy:            `{"Version":"2012-10-17","Statement":[]}`,
+				ImageTagMutability:      "MUTABLE",
+				EncryptionConfiguration: EncryptionConfiguration{EncryptionType: "AES256"},
+			},
+		}},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		expErr string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *Config) {},
+		},
+		{
+			name:   "unset policies fall back to their default",
+			modify: func(c *Config) { c.ImageSwapPolicy, c.ImageCopyPolicy = "", "" },
+		},
+		{
+			name:   "unknown log level",
+			modify: func(c *Config) { c.LogLevel = "verbose" },
+			expErr: `logLevel: unknown value "verbose"`,
+		},
+		{
+			name:   "typo in image swap policy",
+			modify: func(c *Config) { c.ImageSwapPolicy = "exist" },
+			expErr: `imageSwapPolicy: unknown value "exist", must be one of [always exists]`,
+		},
+		{
+			name:   "unknown image copy policy",
+			modify: func(c *Config) { c.ImageCopyPolicy = "later" },
+			expErr: `imageCopyPolicy: unknown value "later"`,
+		},
+		{
+			name:   "negative deadline",
+			modify: func(c *Config) { c.ImageCopyDeadline = -time.Second },
+			expErr: "imageCopyDeadline: must not be negative",
+		},
+		{
+			name: "deadline exceeding the admission timeout",
+			modify: func(c *Config) {
+				c.ImageCopyPolicy = "immediate"
+				c.ImageCopyDeadline = time.Minute
+			},
+			expErr: "imageCopyDeadline: must not exceed 30s",
+		},
+		{
+			name:   "long deadline for delayed copies",
+			modify: func(c *Config) { c.ImageCopyDeadline = time.Minute },
+		},
+		{
+			name:   "unknown overflow policy",
+			modify: func(c *Config) { c.CopyQueue.OverflowPolicy = "discard" },
+			expErr: "copyQueue.overflowPolicy:",
+		},
+		{
+			name: "initial backoff exceeding max backoff",
+			modify: func(c *Config) {
+				c.CopyQueue.Retry = CopyQueueRetry{InitialBackoff: time.Hour, MaxBackoff: time.Minute}
+			},
+			expErr: "copyQueue.retry:",
+		},
+		{
+			name:   "unknown status auth",
+			modify: func(c *Config) { c.Status.Auth.Type = "oidc" },
+			expErr: `status.auth.type: unknown value "oidc"`,
+		},
+		{
+			name:   "redis cache without address",
+			modify: func(c *Config) { c.Cache.Type = "redis" },
+			expErr: `cache: cache of type "redis" requires a field "redis.address"`,
+		},
+		{
+			name:   "negative registry cache ttl",
+			modify: func(c *Config) { c.Target.Cache.NegativeTTL = -time.Minute },
+			expErr: `target: registry of type "aws" requires a positive "cache.negativeTTL"`,
+		},
+		{
+			name: "invalid JMESPath",
+			modify: func(c *Config) {
+				c.Source.Filters = append(c.Source.Filters, JMESPathFilter{JMESPath: "obj.metadata.namespace =="})
+			},
+			expErr: "source.filters[1]: invalid JMESPath expression",
+		},
+		{
+			name:   "unknown registry type",
+			modify: func(c *Config) { c.Source.Registries[0].Type = "acr" },
+			expErr: `source.registries[0]: type: unknown value "acr", must be one of [aws gcp]`,
+		},
+		{
+			name:   "missing required field",
+			modify: func(c *Config) { c.Source.Registries[0].GCP.ProjectID = "" },
+			expErr: `source.registries[0]: registry of type "gcp" requires a field "projectId"`,
+		},
+		{
+			name:   "invalid access policy",
+			modify: func(c *Config) { c.Target.AWS.ECROptions.AccessPolicy = `{"Version":` },
+			expErr: "target: aws.ecrOptions.accessPolicy: invalid JSON policy document",
+		},
+		{
+			name:   "invalid lifecycle policy",
+			modify: func(c *Config) { c.Target.AWS.ECROptions.LifecyclePolicy = `rules: []` },
+			expErr: "target: aws.ecrOptions.lifecyclePolicy: invalid JSON policy document",
+		},
+		{
+			name:   "unknown image tag mutability",
+			modify: func(c *Config) { c.Target.AWS.ECROptions.ImageTagMutability = "mutable" },
+			expErr: "target: aws.ecrOptions.imageTagMutability:",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := validConfig()
+			test.modify(c)
+
+			err := Validate(c)
+			if test.expErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, test.expErr)
+			}
+		})
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	c := validConfig()
+	c.LogFormat = "text"
+	c.ImageSwapPolicy = "exist"
+
+	err := Validate(c)
+	assert.ErrorContains(t, err, "logFormat:")
+	assert.ErrorContains(t, err, "imageSwapPolicy:")
+}
+
+func TestUnmarshal(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	SetViperDefaults(v)
+	assert.NoError(t, v.ReadConfig(strings.NewReader(`
+imageSwapPolicy: always
+imageCopyPolicyy: delayed
+`)))
+
+	c := Config{}
+	err := Unmarshal(v, &c)
+	assert.ErrorContains(t, err, "imagecopypolicyy")
+	assert.Equal(t, "always", c.ImageSwapPolicy)
+}
@@ -0,0 +1,580 @@
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/estahn/k8s-image-swapper/pkg/inventory"
+	"github.com/estahn/k8s-image-swapper/pkg/metrics"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Results of deleting an image or repository
+const (
+	ResultDeleted = "deleted"
+	ResultDryRun  = "dry_run"
+	ResultFailed  = "failed"
+)
+
+// ErrPodsNotSynced is returned when collecting before the pods are known, every image would appear unreferenced
+var ErrPodsNotSynced = errors.New("pods not synced yet")
+
+// Option represents an option that can be passed when instantiating the collector to customize it
+type Option func(*Collector)
+
+// GracePeriod allows to pass the duration an image must be unreferenced before it is deleted
+func GracePeriod(gracePeriod time.Duration) Option {
+	return func(c *Collector) {
+		c.gracePeriod = gracePeriod
+	}
+}
+
+// DryRun allows to only report the images which would be deleted
+func DryRun(dryRun bool) Option {
+	return func(c *Collector) {
+		c.dryRun = dryRun
+	}
+}
+
+// DeleteRepositories allows to delete repositories once all their images are deleted
+func DeleteRepositories(deleteRepositories bool) Option {
+	return func(c *Collector) {
+		c.deleteRepositories = deleteRepositories
+	}
+}
+
+// Inventory allows to pass the inventory of mirrored images, deleted images are removed from it
+func Inventory(inv *inventory.Inventory) Option {
+	return func(c *Collector) {
+		c.inventory = inv
+	}
+}
+
+// Templates allows to pass the pod templates of the workload controllers, e.g. of Deployments scaled to zero or CronJobs,
+// they reference their images while no pod runs them
+func Templates(list func(ctx context.Context) ([]*corev1.Pod, error)) Option {
+	return func(c *Collector) {
+		c.templates = list
+	}
+}
+
+// Store allows to pass the store persisting the references across restarts and changes of the leader
+func Store(store ReferenceStore) Option {
+	return func(c *Collector) {
+		c.store = store
+	}
+}
+
+// Collector deletes images from the target registry which are not referenced by any pod for the grace period.
+// Pods reference an image of the target registry directly once swapped, or by the image of the source registry
+// which is swapped on the next admission. Running pods also reference the digest they were started with.
+// The pod templates of workload controllers reference their images as well.
+type Collector struct {
+	registryClient registry.Client
+	pods           corelisters.PodLister
+	podsSynced     cache.InformerSynced
+	templates      func(ctx context.Context) ([]*corev1.Pod, error)
+	store          ReferenceStore
+
+	gracePeriod        time.Duration
+	dryRun             bool
+	deleteRepositories bool
+	inventory          *inventory.Inventory
+
+	// started is the earliest time an image can be known to be unreferenced, references before are not tracked
+	started time.Time
+	now     func() time.Time
+
+	// mu guards the references and the last report
+	mu sync.Mutex
+	// lastReferenced holds the last time a reference to the target registry was used by a pod
+	lastReferenced map[string]time.Time
+	report         *Report
+}
+
+// New returns a collector tracking the references of the pods of the informer
+func New(registryClient registry.Client, pods coreinformers.PodInformer, opts ...Option) (*Collector, error) {
+	c := &Collector{
+		registryClient: registryClient,
+		pods:           pods.Lister(),
+		podsSynced:     pods.Informer().HasSynced,
+		started:        time.Now().UTC(),
+		now:            time.Now,
+		lastReferenced: map[string]time.Time{},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	// references of deleted pods and replaced images are remembered, the grace period starts when they disappear
+	_, err := pods.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if pod, ok := oldObj.(*corev1.Pod); ok {
+				c.markReferenced(c.podReferences(pod))
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*corev1.Pod); ok {
+				c.markReferenced(c.podReferences(pod))
+			}
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Report is the outcome of a collection
+type Report struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	DryRun   bool      `json:"dryRun"`
+
+	// Images is the number of images in the target registry, Referenced and Pending are kept
+	Images     int `json:"images"`
+	Referenced int `json:"referenced"`
+	Pending    int `json:"pending"`
+
+	Deletions           []Deletion `json:"deletions"`
+	RepositoryDeletions []Deletion `json:"repositoryDeletions"`
+}
+
+// Deletion is an image or repository deleted, or which would be deleted in dry-run mode
+type Deletion struct {
+	Repository        string    `json:"repository"`
+	Digest            string    `json:"digest,omitempty"`
+	Tags              []string  `json:"tags,omitempty"`
+	Children          []string  `json:"children,omitempty"`
+	UnreferencedSince time.Time `json:"unreferencedSince,omitempty"`
+	Result            string    `json:"result"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// Run collects in the interval until the context is canceled
+func (c *Collector) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := c.Collect(ctx); err != nil {
+				log.Ctx(ctx).Err(err).Msg("failed collecting unreferenced images")
+			}
+		}
+	}
+}
+
+// Collect deletes the images of the target registry which are unreferenced for the grace period.
+// Repositories are deleted if all their images are deleted and deleting repositories is enabled.
+func (c *Collector) Collect(ctx context.Context) (*Report, error) {
+	if !c.podsSynced() {
+		return nil, ErrPodsNotSynced
+	}
+
+	report := &Report{
+		Started:             c.now().UTC(),
+		DryRun:              c.dryRun,
+		Deletions:           []Deletion{},
+		RepositoryDeletions: []Deletion{},
+	}
+
+	images, err := c.registryClient.ListImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.Images = len(images)
+
+	pods, err := c.pods.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := map[string]bool{}
+	// an unknown template would leave its images unreferenced, nothing is collected without them
+	if c.templates != nil {
+		templates, err := c.templates(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error listing pod templates: %w", err)
+		}
+		pods = append(pods, templates...)
+	}
+
+	for _, pod := range pods {
+		for _, ref := range c.podReferences(pod) {
+			referenced[ref] = true
+		}
+	}
+
+	if err := c.restore(ctx); err != nil {
+		return nil, err
+	}
+	c.markReferenced(slices.Collect(maps.Keys(referenced)))
+	if err := c.persist(ctx); err != nil {
+		return nil, err
+	}
+
+	// repositories are only deleted if none of their images is kept
+	kept := map[string]bool{}
+	deleted := map[string]bool{}
+
+	// images per platform shared with a kept multi-arch image are kept with it
+	keptChildren := map[string]bool{}
+	type unreferenced struct {
+		image registry.Image
+		since time.Time
+	}
+	deletions := []unreferenced{}
+
+	endpoint := c.registryClient.Endpoint()
+	for _, image := range images {
+		references := image.References(endpoint)
+		since := c.unreferencedSince(image, references)
+		switch {
+		case slices.ContainsFunc(references, func(ref string) bool { return referenced[ref] }):
+			report.Referenced++
+		case report.Started.Sub(since) < c.gracePeriod:
+			report.Pending++
+		default:
+			deletions = append(deletions, unreferenced{image: image, since: since})
+			continue
+		}
+
+		kept[image.Repository] = true
+		for _, child := range image.Children {
+			keptChildren[image.Repository+"@"+child] = true
+		}
+	}
+
+	for _, unreferenced := range deletions {
+		image := unreferenced.image
+		image.Children = slices.DeleteFunc(slices.Clone(image.Children), func(child string) bool {
+			return keptChildren[image.Repository+"@"+child]
+		})
+
+		deletion := c.deleteImage(ctx, image, unreferenced.since)
+		metrics.GCDeletions.WithLabelValues("image", deletion.Result).Inc()
+		report.Deletions = append(report.Deletions, deletion)
+		if deletion.Result == ResultFailed {
+			kept[image.Repository] = true
+		} else {
+			deleted[image.Repository] = true
+		}
+	}
+
+	if c.deleteRepositories {
+		for _, repository := range slices.Sorted(maps.Keys(deleted)) {
+			if kept[repository] {
+				continue
+			}
+
+			deletion := c.deleteRepository(ctx, repository)
+			metrics.GCDeletions.WithLabelValues("repository", deletion.Result).Inc()
+			report.RepositoryDeletions = append(report.RepositoryDeletions, deletion)
+		}
+	}
+
+	report.Finished = c.now().UTC()
+
+	c.mu.Lock()
+	c.report = report
+	c.mu.Unlock()
+
+	log.Ctx(ctx).Info().
+		Bool("dryRun", report.DryRun).
+		Int("images", report.Images).
+		Int("referenced", report.Referenced).
+		Int("pending", report.Pending).
+		Int("deletions", len(report.Deletions)).
+		Int("repositoryDeletions", len(report.RepositoryDeletions)).
+		Msg("collected unreferenced images")
+
+	return report, nil
+}
+
+// deleteImage deletes an unreferenced image unless in dry-run mode
+func (c *Collector) deleteImage(ctx context.Context, image registry.Image, since time.Time) Deletion {
+	deletion := Deletion{
+		Repository:        image.Repository,
+		Digest:            image.Digest,
+		Tags:              image.Tags,
+		Children:          image.Children,
+		UnreferencedSince: since,
+		Result:            ResultDryRun,
+	}
+
+	logger := log.Ctx(ctx).With().
+		Str("repository", image.Repository).
+		Str("digest", image.Digest).
+		Strs("tags", image.Tags).
+		Time("unreferencedSince", since).
+		Logger()
+
+	if c.dryRun {
+		logger.Info().Msg("would delete unreferenced image (dry-run)")
+		return deletion
+	}
+
+	if err := c.registryClient.DeleteImage(ctx, image); err != nil {
+		logger.Err(err).Msg("failed deleting unreferenced image")
+		deletion.Result = ResultFailed
+		deletion.Error = err.Error()
+		return deletion
+	}
+
+	logger.Info().Msg("deleted unreferenced image")
+	deletion.Result = ResultDeleted
+
+	if c.inventory != nil {
+		for _, ref := range image.References(c.registryClient.Endpoint()) {
+			c.inventory.Remove(ref)
+		}
+	}
+
+	return deletion
+}
+
+// deleteRepository deletes a repository without images unless in dry-run mode
+func (c *Collector) deleteRepository(ctx context.Context, repository string) Deletion {
+	deletion := Deletion{Repository: repository, Result: ResultDryRun}
+
+	if c.dryRun {
+		log.Ctx(ctx).Info().Str("repository", repository).Msg("would delete repository without images (dry-run)")
+		return deletion
+	}
+
+	if err := c.registryClient.DeleteRepository(ctx, repository); err != nil {
+		log.Ctx(ctx).Err(err).Str("repository", repository).Msg("failed deleting repository without images")
+		deletion.Result = ResultFailed
+		deletion.Error = err.Error()
+		return deletion
+	}
+
+	log.Ctx(ctx).Info().Str("repository", repository).Msg("deleted repository without images")
+	deletion.Result = ResultDeleted
+
+	return deletion
+}
+
+// unreferencedSince returns the time the image is unreferenced since, at the earliest the time it was pushed or the collector started
+func (c *Collector) unreferencedSince(image registry.Image, references []string) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	since := c.started
+	if image.PushedAt.After(since) {
+		since = image.PushedAt
+	}
+	for _, ref := range references {
+		if lastReferenced := c.lastReferenced[ref]; lastReferenced.After(since) {
+			since = lastReferenced
+		}
+	}
+
+	return since
+}
+
+// markReferenced records the references as used now
+func (c *Collector) markReferenced(references []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now().UTC()
+	for _, ref := range references {
+		c.lastReferenced[ref] = now
+	}
+}
+
+// restore merges the references persisted by previous collections, e.g. of the previous leader
+func (c *Collector) restore(ctx context.Context) error {
+	if c.store == nil {
+		return nil
+	}
+
+	state, err := c.store.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("error loading references: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !state.Since.IsZero() && state.Since.Before(c.started) {
+		c.started = state.Since
+	}
+	for ref, lastReferenced := range state.LastReferenced {
+		if lastReferenced.After(c.lastReferenced[ref]) {
+			c.lastReferenced[ref] = lastReferenced
+		}
+	}
+
+	return nil
+}
+
+// persist saves the references, those unused for the grace period are dropped as they do not delay any deletion
+func (c *Collector) persist(ctx context.Context) error {
+	if c.store == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	expired := c.now().Add(-c.gracePeriod)
+	maps.DeleteFunc(c.lastReferenced, func(ref string, lastReferenced time.Time) bool {
+		return lastReferenced.Before(expired)
+	})
+	state := ReferenceState{Since: c.started, LastReferenced: maps.Clone(c.lastReferenced)}
+	c.mu.Unlock()
+
+	if err := c.store.Save(ctx, state); err != nil {
+		return fmt.Errorf("error saving references: %w", err)
+	}
+
+	return nil
+}
+
+// podReferences returns the references in the target registry the pod uses, by tag and by the digest it runs
+func (c *Collector) podReferences(pod *corev1.Pod) []string {
+	images := []string{}
+	for _, container := range pod.Spec.InitContainers {
+		images = append(images, container.Image)
+	}
+	for _, container := range pod.Spec.Containers {
+		images = append(images, container.Image)
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		images = append(images, container.Image)
+	}
+	for _, status := range slices.Concat(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses) {
+		// the image id carries the digest, e.g. docker-pullable://nginx@sha256:...
+		if _, imageID, found := strings.Cut(status.ImageID, "://"); found {
+			images = append(images, imageID)
+		} else {
+			images = append(images, status.ImageID)
+		}
+	}
+
+	references := []string{}
+	for _, image := range images {
+		references = append(references, c.targetReferences(image)...)
+	}
+
+	return references
+}
+
+// targetReferences returns the references of an image in the target registry.
+// Images of other registries reference the image they are mirrored to.
+func (c *Collector) targetReferences(image string) []string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil
+	}
+
+	refs := []reference.Named{}
+	if tagged, ok := named.(reference.NamedTagged); ok {
+		ref, _ := reference.WithTag(reference.TrimNamed(named), tagged.Tag())
+		refs = append(refs, ref)
+	}
+	if digested, ok := named.(reference.Canonical); ok {
+		ref, _ := reference.WithDigest(reference.TrimNamed(named), digested.Digest())
+		refs = append(refs, ref)
+	}
+	if len(refs) == 0 {
+		refs = append(refs, reference.TagNameOnly(named))
+	}
+
+	endpoint := c.registryClient.Endpoint()
+	references := []string{}
+	for _, ref := range refs {
+		if strings.HasPrefix(ref.String(), endpoint+"/") {
+			references = append(references, ref.String())
+		} else {
+			references = append(references, endpoint+"/"+ref.String())
+		}
+	}
+
+	return references
+}
+
+// Report returns the report of the last collection, nil if there was none yet
+func (c *Collector) Report() *Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.report
+}
+
+// ReportHandler exposes the report of the last collection as JSON
+func (c *Collector) ReportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := c.Report()
+		if report == nil {
+			http.Error(w, "no collection yet", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Err(err).Msg("failed writing garbage collection report")
+		}
+	})
+}
+
+// TrimPod is an informer transform keeping only the details of pods required to track references
+func TrimPod(obj interface{}) (interface{}, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return obj, nil
+	}
+
+	trimmed := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       pod.Namespace,
+			Name:            pod.Name,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+		},
+	}
+	for _, container := range pod.Spec.InitContainers {
+		trimmed.Spec.InitContainers = append(trimmed.Spec.InitContainers, corev1.Container{Name: container.Name, Image: container.Image})
+	}
+	for _, container := range pod.Spec.Containers {
+		trimmed.Spec.Containers = append(trimmed.Spec.Containers, corev1.Container{Name: container.Name, Image: container.Image})
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		trimmed.Spec.EphemeralContainers = append(trimmed.Spec.EphemeralContainers, corev1.EphemeralContainer{
+			EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: container.Name, Image: container.Image},
+		})
+	}
+	for _, status := range pod.Status.InitContainerStatuses {
+		trimmed.Status.InitContainerStatuses = append(trimmed.Status.InitContainerStatuses, corev1.ContainerStatus{Name: status.Name, ImageID: status.ImageID})
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		trimmed.Status.ContainerStatuses = append(trimmed.Status.ContainerStatuses, corev1.ContainerStatus{Name: status.Name, ImageID: status.ImageID})
+	}
+
+	return trimmed, nil
+}
@@ -0,0 +1,292 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/inventory"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const digestA = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+const digestB = "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+const digestC = "sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"
+
+// fakeRegistryClient is a target registry holding images and recording deletions
+type fakeRegistryClient struct {
+	registry.Client
+	images              []registry.Image
+	deletedImages       []string
+	deletedRepositories []string
+	failDelete          string
+}
+
+func (f *fakeRegistryClient) Endpoint() string { return "target.example.com" }
+
+func (f *fakeRegistryClient) ListImages(ctx context.Context) ([]registry.Image, error) {
+	return f.images, nil
+}
+
+func (f *fakeRegistryClient) DeleteImage(ctx context.Context, image registry.Image) error {
+	if image.Digest == f.failDelete {
+		return errors.New("denied")
+	}
+	f.deletedImages = append(f.deletedImages, image.Repository+"@"+image.Digest)
+	return nil
+}
+
+func (f *fakeRegistryClient) DeleteRepository(ctx context.Context, name string) error {
+	f.deletedRepositories = append(f.deletedRepositories, name)
+	return nil
+}
+
+// newCollector returns a collector of the pods with synced informers
+func newCollector(t *testing.T, registryClient registry.Client, pods []corev1.Pod, opts ...Option) *Collector {
+	clientset := fake.NewClientset()
+	for i := range pods {
+		_, err := clientset.CoreV1().Pods(pods[i].Namespace).Create(context.Background(), &pods[i], metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	podInformer := factory.Core().V1().Pods()
+	require.NoError(t, podInformer.Informer().SetTransform(TrimPod))
+	collector, err := New(registryClient, podInformer, opts...)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+
+	return collector
+}
+
+func testPods() []corev1.Pod {
+	return []corev1.Pod{
+		{
+			// swapped and running the digest of the previous tag
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "target.example.com/docker.io/library/nginx:stable"}}},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				Name:    "nginx",
+				ImageID: "docker-pullable://target.example.com/docker.io/library/nginx@" + digestB,
+			}}},
+		},
+		{
+			// not swapped yet, the mirror is used on the next admission
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "redis"},
+			Spec:       corev1.PodSpec{InitContainers: []corev1.Container{{Name: "redis", Image: "redis:7"}}},
+		},
+	}
+}
+
+func testImages(pushedAt time.Time) []registry.Image {
+	return []registry.Image{
+		{Repository: "docker.io/library/nginx", Digest: digestA, Tags: []string{"stable"}, PushedAt: pushedAt},
+		{Repository: "docker.io/library/nginx", Digest: digestB, PushedAt: pushedAt},
+		{Repository: "docker.io/library/nginx", Digest: digestC, Tags: []string{"1.25"}, PushedAt: pushedAt},
+		{Repository: "docker.io/library/redis", Digest: digestA, Tags: []string{"7"}, PushedAt: pushedAt},
+		{Repository: "docker.io/library/busybox", Digest: digestA, Tags: []string{"1.36"}, PushedAt: pushedAt},
+	}
+}
+
+func TestCollector_Collect(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	registryClient := &fakeRegistryClient{images: testImages(now.Add(-30 * 24 * time.Hour))}
+
+	inv := inventory.New()
+	inv.Record(queue.Job{SourceImage: "docker.io/library/busybox:1.36", TargetImage: "target.example.com/docker.io/library/busybox:1.36"}, nil)
+
+	collector := newCollector(t, registryClient, testPods(), GracePeriod(24*time.Hour), DeleteRepositories(true), Inventory(inv))
+	collector.started = now.Add(-7 * 24 * time.Hour)
+	collector.now = func() time.Time { return now }
+
+	report, err := collector.Collect(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, 5, report.Images)
+	assert.Equal(t, 3, report.Referenced)
+	assert.Equal(t, 0, report.Pending)
+	assert.Equal(t, []string{
+		"docker.io/library/nginx@" + digestC,
+		"docker.io/library/busybox@" + digestA,
+	}, registryClient.deletedImages)
+	assert.Equal(t, []string{"docker.io/library/busybox"}, registryClient.deletedRepositories, "repositories with kept images are not deleted")
+
+	require.Len(t, report.Deletions, 2)
+	assert.Equal(t, ResultDeleted, report.Deletions[0].Result)
+	assert.Equal(t, now.Add(-7*24*time.Hour), report.Deletions[0].UnreferencedSince, "references before the start are unknown")
+	assert.Equal(t, collector.Report(), report)
+
+	_, found := inv.Get("target.example.com/docker.io/library/busybox:1.36")
+	assert.False(t, found, "deleted images are removed from the inventory")
+}
+
+func TestCollector_CollectChildren(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	pushedAt := now.Add(-30 * 24 * time.Hour)
+	registryClient := &fakeRegistryClient{images: []registry.Image{
+		// stable is referenced and shares the image of a platform with the unreferenced 1.25
+		{Repository: "docker.io/library/nginx", Digest: digestA, Tags: []string{"stable"}, PushedAt: pushedAt, Children: []string{"sha256:amd64", "sha256:arm64"}},
+		{Repository: "docker.io/library/nginx", Digest: digestC, Tags: []string{"1.25"}, PushedAt: pushedAt, Children: []string{"sha256:amd64", "sha256:s390x"}},
+	}}
+
+	collector := newCollector(t, registryClient, testPods(), GracePeriod(24*time.Hour))
+	collector.started = now.Add(-7 * 24 * time.Hour)
+	collector.now = func() time.Time { return now }
+
+	report, err := collector.Collect(context.Background())
+	require.NoError(t, err)
+
+	require.Len(t, report.Deletions, 1)
+	assert.Equal(t, digestC, report.Deletions[0].Digest)
+	assert.Equal(t, []string{"sha256:s390x"}, report.Deletions[0].Children, "children of kept images are kept")
+}
+
+func TestCollector_CollectGracePeriod(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	images := testImages(now.Add(-30 * 24 * time.Hour))
+	// mirrored recently, pods using it may not be admitted yet
+	images[4].PushedAt = now.Add(-time.Hour)
+	registryClient := &fakeRegistryClient{images: images}
+
+	collector := newCollector(t, registryClient, testPods(), GracePeriod(24*time.Hour))
+	collector.started = now.Add(-7 * 24 * time.Hour)
+	collector.now = func() time.Time { return now }
+
+	// referenced by a pod deleted a moment ago
+	collector.lastReferenced["target.example.com/docker.io/library/nginx:1.25"] = now.Add(-time.Minute)
+
+	report, err := collector.Collect(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, report.Pending)
+	assert.Empty(t, report.Deletions)
+	assert.Empty(t, registryClient.deletedImages)
+}
+
+func TestCollector_CollectTemplates(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	registryClient := &fakeRegistryClient{images: testImages(now.Add(-30 * 24 * time.Hour))}
+
+	// e.g. a CronJob between its runs
+	templates := func(ctx context.Context) ([]*corev1.Pod, error) {
+		return []*corev1.Pod{{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cleanup"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "cleanup", Image: "busybox:1.36"}}},
+		}}, nil
+	}
+	collector := newCollector(t, registryClient, testPods(), GracePeriod(24*time.Hour), Templates(templates))
+	collector.started = now.Add(-7 * 24 * time.Hour)
+	collector.now = func() time.Time { return now }
+
+	report, err := collector.Collect(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Referenced)
+	assert.Equal(t, []string{"docker.io/library/nginx@" + digestC}, registryClient.deletedImages)
+
+	failing := newCollector(t, registryClient, testPods(), Templates(func(ctx context.Context) ([]*corev1.Pod, error) {
+		return nil, errors.New("forbidden")
+	}))
+	_, err = failing.Collect(context.Background())
+	assert.ErrorContains(t, err, "forbidden", "nothing is collected without the templates")
+}
+
+func TestCollector_CollectStore(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	registryClient := &fakeRegistryClient{images: testImages(now.Add(-30 * 24 * time.Hour))}
+	store := NewConfigMapStore(fake.NewClientset(), "k8s-image-swapper", "k8s-image-swapper-gc")
+
+	previous := newCollector(t, registryClient, testPods(), GracePeriod(24*time.Hour), DryRun(true), Store(store))
+	previous.started = now.Add(-7 * 24 * time.Hour)
+	previous.now = func() time.Time { return now }
+	// referenced by a pod deleted a moment ago, and too long ago to delay its deletion
+	previous.lastReferenced["target.example.com/docker.io/library/nginx:1.25"] = now.Add(-time.Minute)
+	previous.lastReferenced["target.example.com/docker.io/library/busybox:1.36"] = now.Add(-48 * time.Hour)
+
+	_, err := previous.Collect(context.Background())
+	require.NoError(t, err)
+
+	state, err := store.Load(context.Background())
+	require.NoError(t, err)
+	assert.True(t, now.Add(-7*24*time.Hour).Equal(state.Since))
+	assert.Contains(t, state.LastReferenced, "target.example.com/docker.io/library/nginx:1.25")
+	assert.NotContains(t, state.LastReferenced, "target.example.com/docker.io/library/busybox:1.36", "expired references are dropped")
+
+	// a new leader, or a restarted one, knows the references of the previous collections
+	collector := newCollector(t, registryClient, testPods(), GracePeriod(24*time.Hour), Store(store))
+	collector.now = func() time.Time { return now }
+
+	report, err := collector.Collect(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Pending)
+	assert.Equal(t, []string{"docker.io/library/busybox@" + digestA}, registryClient.deletedImages)
+}
+
+func TestCollector_CollectDryRun(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	registryClient := &fakeRegistryClient{images: testImages(now.Add(-30 * 24 * time.Hour)), failDelete: digestC}
+
+	collector := newCollector(t, registryClient, testPods(), GracePeriod(24*time.Hour), DryRun(true), DeleteRepositories(true))
+	collector.started = now.Add(-7 * 24 * time.Hour)
+	collector.now = func() time.Time { return now }
+
+	report, err := collector.Collect(context.Background())
+	require.NoError(t, err)
+
+	assert.True(t, report.DryRun)
+	require.Len(t, report.Deletions, 2)
+	for _, deletion := range report.Deletions {
+		assert.Equal(t, ResultDryRun, deletion.Result)
+	}
+	require.Len(t, report.RepositoryDeletions, 1)
+	assert.Equal(t, Deletion{Repository: "docker.io/library/busybox", Result: ResultDryRun}, report.RepositoryDeletions[0])
+	assert.Empty(t, registryClient.deletedImages)
+	assert.Empty(t, registryClient.deletedRepositories)
+}
+
+func TestCollector_CollectFailure(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	registryClient := &fakeRegistryClient{images: testImages(now.Add(-30 * 24 * time.Hour)), failDelete: digestA}
+
+	collector := newCollector(t, registryClient, testPods(), GracePeriod(24*time.Hour), DeleteRepositories(true))
+	collector.started = now.Add(-7 * 24 * time.Hour)
+	collector.now = func() time.Time { return now }
+
+	report, err := collector.Collect(context.Background())
+	require.NoError(t, err)
+
+	require.Len(t, report.Deletions, 2)
+	assert.Equal(t, ResultFailed, report.Deletions[1].Result)
+	assert.Equal(t, "denied", report.Deletions[1].Error)
+	assert.Empty(t, registryClient.deletedRepositories, "repositories with failed deletions are kept")
+}
+
+func TestCollector_ReportHandler(t *testing.T) {
+	registryClient := &fakeRegistryClient{images: []registry.Image{}}
+	collector := newCollector(t, registryClient, nil)
+
+	recorder := httptest.NewRecorder()
+	collector.ReportHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/gc", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	_, err := collector.Collect(context.Background())
+	require.NoError(t, err)
+
+	recorder = httptest.NewRecorder()
+	collector.ReportHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/gc", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"deletions":[]`)
+}
@@ -0,0 +1,104 @@
+package gc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// configMapReferencesKey is the key of the compressed references in the binary data of the ConfigMap
+const configMapReferencesKey = "references.json.gz"
+
+// ConfigMapStore persists the references in a ConfigMap, compressed to fit the references of many images
+type ConfigMapStore struct {
+	kubernetesClient kubernetes.Interface
+	namespace        string
+	name             string
+}
+
+// NewConfigMapStore initialises a store keeping the references in the named ConfigMap
+func NewConfigMapStore(clientset kubernetes.Interface, namespace string, name string) *ConfigMapStore {
+	return &ConfigMapStore{
+		kubernetesClient: clientset,
+		namespace:        namespace,
+		name:             name,
+	}
+}
+
+func (s *ConfigMapStore) Load(ctx context.Context) (ReferenceState, error) {
+	state := ReferenceState{}
+
+	configMap, err := s.kubernetesClient.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	data, found := configMap.BinaryData[configMapReferencesKey]
+	if !found {
+		return state, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return state, err
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return state, err
+	}
+
+	return state, json.Unmarshal(content, &state)
+}
+
+func (s *ConfigMapStore) Save(ctx context.Context, state ReferenceState) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+	writer := gzip.NewWriter(&data)
+	if _, err := writer.Write(content); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	configMaps := s.kubernetesClient.CoreV1().ConfigMaps(s.namespace)
+
+	// only the leader collects, so the ConfigMap is not written concurrently
+	configMap, err := configMaps.Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.name,
+				Namespace: s.namespace,
+				Labels:    map[string]string{"app.kubernetes.io/managed-by": "k8s-image-swapper"},
+			},
+			BinaryData: map[string][]byte{configMapReferencesKey: data.Bytes()},
+		}
+		_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	configMap.BinaryData = map[string][]byte{configMapReferencesKey: data.Bytes()}
+	_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+
+	return err
+}
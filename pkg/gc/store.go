@@ -0,0 +1,20 @@
+package gc
+
+import (
+	"context"
+	"time"
+)
+
+// ReferenceState is the state of the references tracked by a collector
+type ReferenceState struct {
+	// Since is the time the references are tracked since
+	Since time.Time `json:"since"`
+	// LastReferenced holds the last time a reference to the target registry was used by a pod
+	LastReferenced map[string]time.Time `json:"lastReferenced"`
+}
+
+// ReferenceStore persists the references tracked by a collector
+type ReferenceStore interface {
+	Load(ctx context.Context) (ReferenceState, error)
+	Save(ctx context.Context, state ReferenceState) error
+}
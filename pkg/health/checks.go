@@ -0,0 +1,130 @@
+package health
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/estahn/k8s-image-swapper/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// TokenCheck fails if the registry token expired, e.g. because its renewal failed
+func TokenCheck(renewer registry.TokenRenewer) CheckFunc {
+	return func(ctx context.Context) error {
+		expiry, renewalErr := renewer.TokenStatus()
+
+		if expiry.IsZero() {
+			return errors.New("no token acquired")
+		}
+
+		if time.Now().After(expiry) {
+			if renewalErr != nil {
+				return fmt.Errorf("token expired at %s, renewal failed: %w", expiry.Format(time.RFC3339), renewalErr)
+			}
+			return fmt.Errorf("token expired at %s", expiry.Format(time.RFC3339))
+		}
+
+		return nil
+	}
+}
+
+// TokensCheck fails if the token of one of the registries expired, the registries are looked up on every check
+func TokensCheck(registries func() []registry.Client) CheckFunc {
+	return func(ctx context.Context) error {
+		errs := []error{}
+		for _, client := range registries() {
+			renewer, ok := client.(registry.TokenRenewer)
+			if !ok {
+				continue
+			}
+
+			if err := TokenCheck(renewer)(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", client.Endpoint(), err))
+			}
+		}
+
+		return errors.Join(errs...)
+	}
+}
+
+// QueueCheck fails if the copy queue is saturated and admissions would be blocked while waiting for a free slot
+func QueueCheck(q *queue.Queue) CheckFunc {
+	return func(ctx context.Context) error {
+		if q.OverflowPolicy() == types.QueueOverflowPolicyBlock && q.Saturated() {
+			return fmt.Errorf("copy queue saturated with %d jobs", q.Len())
+		}
+
+		return nil
+	}
+}
+
+// KubernetesCheck fails if the Kubernetes API server is not reachable
+func KubernetesCheck(clientset kubernetes.Interface) CheckFunc {
+	return func(ctx context.Context) error {
+		result := make(chan error, 1)
+		go func() {
+			_, err := clientset.Discovery().ServerVersion()
+			result <- err
+		}()
+
+		select {
+		case err := <-result:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// CertificateCheck fails if the certificate expired or is not valid yet
+func CertificateCheck(certFile string) CheckFunc {
+	return func(ctx context.Context) error {
+		data, err := os.ReadFile(certFile)
+		if err != nil {
+			return err
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("no PEM data found in %s", certFile)
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+
+		return CertificateValidity(cert, time.Now())
+	}
+}
+
+// ServedCertificateCheck fails if the certificate currently served expired or is not valid yet
+func ServedCertificateCheck(leaf func() *x509.Certificate) CheckFunc {
+	return func(ctx context.Context) error {
+		cert := leaf()
+		if cert == nil {
+			return errors.New("no certificate loaded")
+		}
+
+		return CertificateValidity(cert, time.Now())
+	}
+}
+
+// CertificateValidity returns an error if the certificate is not valid at the given time
+func CertificateValidity(cert *x509.Certificate, now time.Time) error {
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate not valid before %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package health
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alitto/pond"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/estahn/k8s-image-swapper/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type fakeTokenRenewer struct {
+	expiry time.Time
+	err    error
+}
+
+func (f fakeTokenRenewer) TokenStatus() (time.Time, error) {
+	return f.expiry, f.err
+}
+
+func TestTokenCheck(t *testing.T) {
+	ctx := context.Background()
+
+	assert.Error(t, TokenCheck(fakeTokenRenewer{})(ctx))
+	assert.NoError(t, TokenCheck(fakeTokenRenewer{expiry: time.Now().Add(time.Hour)})(ctx))
+	// a failed renewal is tolerated while the current token is valid
+	assert.NoError(t, TokenCheck(fakeTokenRenewer{expiry: time.Now().Add(time.Hour), err: errors.New("throttled")})(ctx))
+
+	err := TokenCheck(fakeTokenRenewer{expiry: time.Now().Add(-time.Minute), err: errors.New("throttled")})(ctx)
+	assert.ErrorContains(t, err, "token expired")
+	assert.ErrorContains(t, err, "throttled")
+}
+
+func TestQueueCheck(t *testing.T) {
+	for _, policy := range []types.QueueOverflowPolicy{types.QueueOverflowPolicyBlock, types.QueueOverflowPolicyDrop} {
+		pool := pond.New(1, 10)
+		block := make(chan struct{})
+
+		q := queue.New(pool, func(ctx context.Context, job queue.Job) error {
+			<-block
+			return nil
+		}, queue.WithCapacity(1), queue.WithOverflowPolicy(policy))
+
+		check := QueueCheck(q)
+		assert.NoError(t, check(context.Background()))
+
+		assert.NoError(t, q.Submit(context.Background(), queue.Job{TargetImage: "example.com/a:latest"}))
+
+		// only a blocking queue holds up admissions
+		if policy == types.QueueOverflowPolicyBlock {
+			assert.Error(t, check(context.Background()), policy.String())
+		} else {
+			assert.NoError(t, check(context.Background()), policy.String())
+		}
+
+		close(block)
+		pool.StopAndWait()
+	}
+}
+
+func TestKubernetesCheck(t *testing.T) {
+	assert.NoError(t, KubernetesCheck(fake.NewSimpleClientset())(context.Background()))
+}
+
+func TestCertificateCheck(t *testing.T) {
+	dir := t.TempDir()
+
+	valid := writeCertificate(t, dir, "valid.pem", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	assert.NoError(t, CertificateCheck(valid)(context.Background()))
+
+	expired := writeCertificate(t, dir, "expired.pem", time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+	assert.ErrorContains(t, CertificateCheck(expired)(context.Background()), "certificate expired")
+
+	assert.Error(t, CertificateCheck(filepath.Join(dir, "missing.pem"))(context.Background()))
+
+	invalid := filepath.Join(dir, "invalid.pem")
+	assert.NoError(t, os.WriteFile(invalid, []byte("not a certificate"), 0600))
+	assert.Error(t, CertificateCheck(invalid)(context.Background()))
+}
+
+func TestServedCertificateCheck(t *testing.T) {
+	var served *x509.Certificate
+	check := ServedCertificateCheck(func() *x509.Certificate { return served })
+
+	assert.ErrorContains(t, check(context.Background()), "no certificate loaded")
+
+	served = &x509.Certificate{NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	assert.NoError(t, check(context.Background()))
+
+	served = &x509.Certificate{NotBefore: time.Now().Add(-2 * time.Hour), NotAfter: time.Now().Add(-time.Hour)}
+	assert.ErrorContains(t, check(context.Background()), "certificate expired")
+}
+
+func writeCertificate(t *testing.T, dir string, name string, notBefore time.Time, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "k8s-image-swapper"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	path := filepath.Join(dir, name)
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+
+	return path
+}
+
+// fakeRegistryClient is a registry client holding a token
+type fakeRegistryClient struct {
+	registry.Client
+	fakeTokenRenewer
+	endpoint string
+}
+
+func (f fakeRegistryClient) Endpoint() string { return f.endpoint }
+
+func TestTokensCheck(t *testing.T) {
+	registries := []registry.Client{
+		fakeRegistryClient{endpoint: "valid.example.com", fakeTokenRenewer: fakeTokenRenewer{expiry: time.Now().Add(time.Hour)}},
+	}
+	check := TokensCheck(func() []registry.Client { return registries })
+
+	assert.NoError(t, check(context.Background()))
+
+	// registries are looked up on every check, e.g. after a configuration reload
+	registries = append(registries, fakeRegistryClient{endpoint: "expired.example.com", fakeTokenRenewer: fakeTokenRenewer{expiry: time.Now().Add(-time.Minute)}})
+
+	err := check(context.Background())
+	assert.ErrorContains(t, err, "expired.example.com: token expired")
+	assert.NotContains(t, err.Error(), "valid.example.com")
+}
@@ -0,0 +1,194 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// checkTimeout bounds the duration of a single check
+const checkTimeout = 5 * time.Second
+
+// CheckFunc returns an error if the dependency it checks is not healthy
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name string
+	fn   CheckFunc
+	// degraded checks are reported without failing the probe
+	degraded bool
+}
+
+// Health collects checks of the dependencies required for liveness and readiness
+type Health struct {
+	mu        sync.RWMutex
+	liveness  []check
+	readiness []check
+
+	shuttingDown bool
+}
+
+// New returns an empty set of checks
+func New() *Health {
+	return &Health{}
+}
+
+// AddLivenessCheck adds a check failing if the process cannot recover without a restart,
+// liveness checks are part of the readiness as well
+func (h *Health) AddLivenessCheck(name string, fn CheckFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.liveness = append(h.liveness, check{name: name, fn: fn})
+	h.readiness = append(h.readiness, check{name: name, fn: fn})
+}
+
+// AddReadinessCheck adds a check failing if the webhook cannot do useful work at the moment
+func (h *Health) AddReadinessCheck(name string, fn CheckFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.readiness = append(h.readiness, check{name: name, fn: fn})
+}
+
+// AddDegradedCheck adds a check reported by the readiness without failing it,
+// e.g. for dependencies only part of the work relies on
+func (h *Health) AddDegradedCheck(name string, fn CheckFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.readiness = append(h.readiness, check{name: name, fn: fn, degraded: true})
+}
+
+// ShuttingDown marks the process as not ready anymore, e.g. once it started draining
+func (h *Health) ShuttingDown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.shuttingDown = true
+}
+
+// CheckResult is the outcome of a single check
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the outcome of all checks
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+const (
+	statusOK       = "ok"
+	statusFailed   = "failed"
+	statusDegraded = "degraded"
+)
+
+// Liveness runs the liveness checks
+func (h *Health) Liveness(ctx context.Context) Report {
+	h.mu.RLock()
+	checks := h.liveness
+	h.mu.RUnlock()
+
+	return run(ctx, checks)
+}
+
+// Readiness runs the readiness checks, it fails once the process is shutting down
+func (h *Health) Readiness(ctx context.Context) Report {
+	h.mu.RLock()
+	checks := h.readiness
+	shuttingDown := h.shuttingDown
+	h.mu.RUnlock()
+
+	report := run(ctx, checks)
+	if shuttingDown {
+		report.Status = statusFailed
+		report.Checks["shutdown"] = CheckResult{Status: statusFailed, Error: "shutting down"}
+	}
+
+	return report
+}
+
+// run executes the checks concurrently
+func run(ctx context.Context, checks []check) Report {
+	report := Report{Status: statusOK, Checks: map[string]CheckResult{}}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c check) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+
+			result := CheckResult{Status: statusOK}
+			if err := c.fn(checkCtx); err != nil {
+				result = CheckResult{Status: statusFailed, Error: err.Error()}
+				if c.degraded {
+					result.Status = statusDegraded
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[c.name] = result
+			if result.Status == statusFailed {
+				report.Status = statusFailed
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	return report
+}
+
+// LivenessHandler serves the liveness report, e.g. at /healthz
+func (h *Health) LivenessHandler() http.Handler {
+	return handler(h.Liveness)
+}
+
+// ReadinessHandler serves the readiness report, e.g. at /readyz
+func (h *Health) ReadinessHandler() http.Handler {
+	return handler(h.Readiness)
+}
+
+func handler(report func(ctx context.Context) Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := report(r.Context())
+
+		for name, c := range result.Checks {
+			if c.Status == statusDegraded {
+				log.Warn().Str("path", r.URL.Path).Str("check", name).Str("error", c.Error).Msg("health check degraded")
+			}
+		}
+
+		statusCode := http.StatusOK
+		if result.Status != statusOK {
+			statusCode = http.StatusServiceUnavailable
+
+			failed := []string{}
+			for name, c := range result.Checks {
+				if c.Status == statusFailed {
+					failed = append(failed, name)
+				}
+			}
+			sort.Strings(failed)
+			log.Debug().Str("path", r.URL.Path).Strs("failed", failed).Msg("health check failed")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Err(err).Msg("failed writing health report")
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ok(context.Context) error { return nil }
+
+func failing(context.Context) error { return errors.New("unavailable") }
+
+func TestHealth_Liveness(t *testing.T) {
+	h := New()
+	h.AddLivenessCheck("token", ok)
+	h.AddReadinessCheck("queue", failing)
+
+	report := h.Liveness(context.Background())
+	assert.Equal(t, Report{
+		Status: "ok",
+		Checks: map[string]CheckResult{"token": {Status: "ok"}},
+	}, report)
+}
+
+func TestHealth_Readiness(t *testing.T) {
+	h := New()
+	h.AddLivenessCheck("token", ok)
+	h.AddReadinessCheck("queue", failing)
+
+	report := h.Readiness(context.Background())
+	assert.Equal(t, Report{
+		Status: "failed",
+		Checks: map[string]CheckResult{
+			"token": {Status: "ok"},
+			"queue": {Status: "failed", Error: "unavailable"},
+		},
+	}, report)
+}
+
+func TestHealth_Degraded(t *testing.T) {
+	h := New()
+	h.AddLivenessCheck("token", ok)
+	h.AddDegradedCheck("source-tokens", failing)
+
+	assert.Equal(t, Report{
+		Status: "ok",
+		Checks: map[string]CheckResult{
+			"token":         {Status: "ok"},
+			"source-tokens": {Status: "degraded", Error: "unavailable"},
+		},
+	}, h.Readiness(context.Background()))
+
+	rec := httptest.NewRecorder()
+	h.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestHealth_ShuttingDown(t *testing.T) {
+	h := New()
+	h.AddLivenessCheck("token", ok)
+
+	assert.Equal(t, "ok", h.Readiness(context.Background()).Status)
+
+	h.ShuttingDown()
+
+	assert.Equal(t, "failed", h.Readiness(context.Background()).Status)
+	assert.Equal(t, "ok", h.Liveness(context.Background()).Status)
+}
+
+func TestHealth_Handlers(t *testing.T) {
+	h := New()
+	h.AddLivenessCheck("token", ok)
+	h.AddReadinessCheck("kubernetes", failing)
+
+	rec := httptest.NewRecorder()
+	h.LivenessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	rec = httptest.NewRecorder()
+	h.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	report := Report{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, CheckResult{Status: "failed", Error: "unavailable"}, report.Checks["kubernetes"])
+}
@@ -0,0 +1,171 @@
+package inventory
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+)
+
+// Image is an image mirrored to the target registry and the state of its re-sync
+type Image struct {
+	SourceImage string    `json:"sourceImage"`
+	TargetImage string    `json:"targetImage"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+
+	// LastAdmission is the latest admission of a pod referencing the image
+	LastAdmission *Admission `json:"lastAdmission,omitempty"`
+
+	// Copies counts the copies to the target registry, images found there already are not copied
+	Copies      int       `json:"copies,omitempty"`
+	FirstCopied time.Time `json:"firstCopied,omitempty"`
+	LastCopied  time.Time `json:"lastCopied,omitempty"`
+	// Size is the number of bytes received by the last copy
+	Size int64 `json:"size,omitempty"`
+
+	// Job mirrors the image again, it carries the details to look up the pull secrets of the last admitted pod
+	Job queue.Job `json:"-"`
+
+	// LastChecked is the time the digests were compared the last time
+	LastChecked  time.Time `json:"lastChecked,omitempty"`
+	SourceDigest string    `json:"sourceDigest,omitempty"`
+	TargetDigest string    `json:"targetDigest,omitempty"`
+
+	// Drifts counts the times the source was republished with a different digest
+	Drifts    int       `json:"drifts,omitempty"`
+	LastDrift time.Time `json:"lastDrift,omitempty"`
+}
+
+// Admission is an admission request of a pod referencing an image
+type Admission struct {
+	UID       string    `json:"uid"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Inventory keeps track of the images mirrored since the start, keyed by target image
+type Inventory struct {
+	mu     sync.Mutex
+	images map[string]*Image
+	now    func() time.Time
+}
+
+// New returns an empty inventory
+func New() *Inventory {
+	return &Inventory{
+		images: map[string]*Image{},
+		now:    time.Now,
+	}
+}
+
+// Record adds the image copied by the job or marks it as seen again.
+// The job is replaced, so the pull secrets of the latest pod are used to mirror it again.
+// The admission is kept if given.
+func (i *Inventory) Record(job queue.Job, admission *Admission) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := i.now().UTC()
+	image := i.image(job, now)
+	image.LastSeen = now
+	image.Job = job
+	if admission != nil {
+		image.LastAdmission = admission
+	}
+}
+
+// RecordCopy marks the image of the job as copied to the target registry
+func (i *Inventory) RecordCopy(job queue.Job) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := i.now().UTC()
+	image := i.image(job, now)
+	image.Copies++
+	if image.FirstCopied.IsZero() {
+		image.FirstCopied = now
+	}
+	image.LastCopied = now
+}
+
+// image returns the image of the job, it is added if unknown
+func (i *Inventory) image(job queue.Job, now time.Time) *Image {
+	image, found := i.images[job.TargetImage]
+	if !found {
+		image = &Image{
+			SourceImage: job.SourceImage,
+			TargetImage: job.TargetImage,
+			FirstSeen:   now,
+			LastSeen:    now,
+			Job:         job,
+		}
+		i.images[job.TargetImage] = image
+	}
+
+	return image
+}
+
+// Get returns a copy of the image with the target image name
+func (i *Inventory) Get(targetImage string) (Image, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	image, found := i.images[targetImage]
+	if !found {
+		return Image{}, false
+	}
+
+	return *image, true
+}
+
+// List returns copies of all images, ordered by target image name
+func (i *Inventory) List() []Image {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	images := make([]Image, 0, len(i.images))
+	for _, image := range i.images {
+		images = append(images, *image)
+	}
+	slices.SortFunc(images, func(a, b Image) int {
+		return strings.Compare(a.TargetImage, b.TargetImage)
+	})
+
+	return images
+}
+
+// Update modifies the image with the target image name in place, it returns false if the image is unknown
+func (i *Inventory) Update(targetImage string, update func(image *Image)) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	image, found := i.images[targetImage]
+	if !found {
+		return false
+	}
+
+	update(image)
+
+	return true
+}
+
+// Remove forgets the image with the target image name
+func (i *Inventory) Remove(targetImage string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	delete(i.images, targetImage)
+}
+
+// Len returns the number of images
+func (i *Inventory) Len() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return len(i.images)
+}
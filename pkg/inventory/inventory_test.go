@@ -0,0 +1,64 @@
+package inventory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInventory(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	inventory := New()
+	inventory.now = func() time.Time { return now }
+
+	inventory.Record(queue.Job{SourceImage: "docker.io/library/nginx:stable", TargetImage: "target.example.com/docker.io/library/nginx:stable", Namespace: "a"}, nil)
+	inventory.Record(queue.Job{SourceImage: "docker.io/library/busybox:1.36", TargetImage: "target.example.com/docker.io/library/busybox:1.36"}, nil)
+
+	now = now.Add(time.Hour)
+	inventory.Record(queue.Job{SourceImage: "docker.io/library/nginx:stable", TargetImage: "target.example.com/docker.io/library/nginx:stable", Namespace: "b"}, &Admission{UID: "abc", Namespace: "b", Pod: "nginx", Time: now})
+
+	images := inventory.List()
+	assert.Len(t, images, 2)
+	assert.Equal(t, 2, inventory.Len())
+	assert.Equal(t, "target.example.com/docker.io/library/busybox:1.36", images[0].TargetImage)
+
+	nginx := images[1]
+	assert.Equal(t, "docker.io/library/nginx:stable", nginx.SourceImage)
+	assert.Equal(t, now.Add(-time.Hour), nginx.FirstSeen)
+	assert.Equal(t, now, nginx.LastSeen)
+	assert.Equal(t, "b", nginx.Job.Namespace, "latest job is kept")
+	assert.Equal(t, &Admission{UID: "abc", Namespace: "b", Pod: "nginx", Time: now}, nginx.LastAdmission)
+	assert.Zero(t, nginx.Copies)
+
+	inventory.RecordCopy(queue.Job{SourceImage: "docker.io/library/nginx:stable", TargetImage: "target.example.com/docker.io/library/nginx:stable"})
+	now = now.Add(time.Hour)
+	inventory.RecordCopy(queue.Job{SourceImage: "docker.io/library/nginx:stable", TargetImage: "target.example.com/docker.io/library/nginx:stable"})
+	inventory.RecordCopy(queue.Job{SourceImage: "docker.io/library/redis:7", TargetImage: "target.example.com/docker.io/library/redis:7"})
+
+	nginx, _ = inventory.Get(nginx.TargetImage)
+	assert.Equal(t, 2, nginx.Copies)
+	assert.Equal(t, now.Add(-time.Hour), nginx.FirstCopied)
+	assert.Equal(t, now, nginx.LastCopied)
+	assert.Equal(t, "b", nginx.Job.Namespace, "job of the admission is kept")
+
+	redis, found := inventory.Get("target.example.com/docker.io/library/redis:7")
+	assert.True(t, found, "images copied without admission are added")
+	assert.Equal(t, 1, redis.Copies)
+	assert.Equal(t, 3, inventory.Len())
+
+	assert.True(t, inventory.Update(nginx.TargetImage, func(image *Image) {
+		image.Drifts++
+	}))
+	assert.False(t, inventory.Update("target.example.com/unknown:latest", func(image *Image) {}))
+
+	updated, found := inventory.Get(nginx.TargetImage)
+	assert.True(t, found)
+	assert.Equal(t, 1, updated.Drifts)
+
+	inventory.Remove(nginx.TargetImage)
+	_, found = inventory.Get(nginx.TargetImage)
+	assert.False(t, found)
+	assert.Equal(t, 2, inventory.Len())
+}
@@ -0,0 +1,144 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/metrics"
+	"github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Task is singleton background work started once the leadership is acquired, the returned function stops it
+type Task func() (stop func())
+
+// Elector runs the singleton background work only on the replica holding a Lease.
+// All replicas keep serving admissions, the others take over the work once the leader is gone.
+type Elector struct {
+	config leaderelection.LeaderElectionConfig
+	tasks  []Task
+
+	mu      sync.Mutex
+	stops   []func()
+	leading atomic.Bool
+}
+
+// New returns an elector competing for the Lease as identity, unset durations use the defaults
+func New(clientset kubernetes.Interface, leaderElection config.LeaderElection, identity string, tasks ...Task) (*Elector, error) {
+	leaseName := config.DefaultLeaderElectionLeaseName
+	if leaderElection.LeaseName != "" {
+		leaseName = leaderElection.LeaseName
+	}
+	leaseDuration := config.DefaultLeaderElectionLeaseDuration
+	if leaderElection.LeaseDuration != 0 {
+		leaseDuration = leaderElection.LeaseDuration
+	}
+	renewDeadline := config.DefaultLeaderElectionRenewDeadline
+	if leaderElection.RenewDeadline != 0 {
+		renewDeadline = leaderElection.RenewDeadline
+	}
+	retryPeriod := config.DefaultLeaderElectionRetryPeriod
+	if leaderElection.RetryPeriod != 0 {
+		retryPeriod = leaderElection.RetryPeriod
+	}
+
+	e := &Elector{tasks: tasks}
+	e.config = leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: leaderElection.Namespace, Name: leaseName},
+			Client:     clientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		// others take over right away on shutdown instead of waiting for the lease to expire
+		ReleaseOnCancel: true,
+		Name:            leaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: e.startTasks,
+			OnStoppedLeading: e.stopTasks,
+			OnNewLeader: func(leader string) {
+				log.Info().Str("leader", leader).Str("identity", identity).Msg("observed leader")
+			},
+		},
+	}
+
+	// validates the durations
+	if _, err := leaderelection.NewLeaderElector(e.config); err != nil {
+		return nil, err
+	}
+
+	metrics.Leader.Set(0)
+
+	return e, nil
+}
+
+// Run competes for the leadership until the context is done, a lost leadership is competed for again.
+// The tasks are stopped and the Lease is released before it returns.
+func (e *Elector) Run(ctx context.Context) {
+	for {
+		elector, err := leaderelection.NewLeaderElector(e.config)
+		if err != nil {
+			log.Err(err).Msg("failed creating leader elector")
+			return
+		}
+
+		elector.Run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Warn().Msg("lost leadership, competing again")
+	}
+}
+
+// IsLeader returns true if this replica holds the Lease and runs the tasks
+func (e *Elector) IsLeader() bool {
+	return e.leading.Load()
+}
+
+// startTasks is called asynchronously once the leadership is acquired, ctx is done when it is lost
+func (e *Elector) startTasks(ctx context.Context) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// the leadership was lost before the tasks were started
+	if ctx.Err() != nil {
+		return
+	}
+
+	log.Info().Int("tasks", len(e.tasks)).Msg("acquired leadership, starting singleton background work")
+
+	for _, task := range e.tasks {
+		e.stops = append(e.stops, task())
+	}
+	e.leading.Store(true)
+	metrics.Leader.Set(1)
+	metrics.LeaderTransitions.Inc()
+}
+
+// stopTasks is called once the leadership is lost or the election stopped, even if it was never acquired
+func (e *Elector) stopTasks() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.leading.Load() {
+		return
+	}
+
+	log.Info().Msg("stopping singleton background work")
+
+	for _, stop := range e.stops {
+		stop()
+	}
+	e.stops = nil
+	e.leading.Store(false)
+	metrics.Leader.Set(0)
+	metrics.LeaderTransitions.Inc()
+}
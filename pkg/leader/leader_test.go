@@ -0,0 +1,74 @@
+package leader
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestElector(t *testing.T) {
+	clientset := fake.NewClientset()
+	leaderElection := config.LeaderElection{
+		Namespace:     "k8s-image-swapper",
+		LeaseDuration: time.Second,
+		RenewDeadline: 500 * time.Millisecond,
+		RetryPeriod:   100 * time.Millisecond,
+	}
+
+	// running counts the replicas running the task
+	var running atomic.Int32
+	task := func() func() {
+		running.Add(1)
+		return func() { running.Add(-1) }
+	}
+
+	first, err := New(clientset, leaderElection, "first", task)
+	require.NoError(t, err)
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	firstDone := make(chan struct{})
+	go func() {
+		first.Run(firstCtx)
+		close(firstDone)
+	}()
+	require.Eventually(t, first.IsLeader, 5*time.Second, 10*time.Millisecond)
+
+	second, err := New(clientset, leaderElection, "second", task)
+	require.NoError(t, err)
+	secondCtx, stopSecond := context.WithCancel(context.Background())
+	secondDone := make(chan struct{})
+	go func() {
+		second.Run(secondCtx)
+		close(secondDone)
+	}()
+
+	lease, err := clientset.CoordinationV1().Leases("k8s-image-swapper").Get(context.Background(), "k8s-image-swapper", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "first", *lease.Spec.HolderIdentity)
+
+	time.Sleep(300 * time.Millisecond)
+	assert.False(t, second.IsLeader())
+	assert.Equal(t, int32(1), running.Load(), "only the leader runs the task")
+
+	// the lease is released on shutdown and taken over
+	stopFirst()
+	<-firstDone
+	assert.False(t, first.IsLeader())
+	require.Eventually(t, second.IsLeader, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), running.Load())
+
+	stopSecond()
+	<-secondDone
+	assert.Equal(t, int32(0), running.Load(), "tasks are stopped when the election stops")
+}
+
+func TestNew_InvalidDurations(t *testing.T) {
+	_, err := New(fake.NewClientset(), config.LeaderElection{Namespace: "default", LeaseDuration: time.Second, RenewDeadline: 2 * time.Second}, "first")
+	assert.Error(t, err)
+}
@@ -0,0 +1,355 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "k8s_image_swapper"
+
+var (
+	// Swaps counts the processed container images by outcome, e.g. swapped, not_found or filtered
+	Swaps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "swaps_total",
+		Help:      "Number of container images processed by the webhook by outcome.",
+	}, []string{"outcome"})
+
+	// FilterMatches counts the containers excluded by a filter
+	FilterMatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "filter_matches_total",
+		Help:      "Number of containers excluded from processing by filter.",
+	}, []string{"filter"})
+
+	// Copies counts the finished copy jobs by result and source registry
+	Copies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "copies_total",
+		Help:      "Number of image copy jobs by result and source registry.",
+	}, []string{"result", "source_registry"})
+
+	// CopyDuration observes the duration of copy jobs by result and source registry
+	CopyDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "copy_duration_seconds",
+		Help:      "Duration of image copy jobs by result and source registry.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"result", "source_registry"})
+
+	// CopyBytes counts the bytes received by successful copies by source registry
+	CopyBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "copy_bytes_total",
+		Help:      "Bytes received by successful copies by source registry.",
+	}, []string{"source_registry"})
+
+	// CopyQueueOverflows counts jobs which did not fit into the copy queue by overflow policy
+	CopyQueueOverflows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "copy_queue_overflows_total",
+		Help:      "Number of copy jobs exceeding the queue capacity by overflow policy.",
+	}, []string{"policy"})
+
+	// CopyRetries counts failed copy jobs by whether they are retried or dead-lettered
+	CopyRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "copy_retries_total",
+		Help:      "Number of failed copy jobs by action, either retry, throttled or dead_letter.",
+	}, []string{"action"})
+
+	// CopyThrottles counts the copies delayed by a limit of a registry by registry and reason
+	CopyThrottles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "copy_throttles_total",
+		Help:      "Number of copies delayed by a limit of the registry by registry and reason, either concurrency, rate or paused.",
+	}, []string{"registry", "reason"})
+
+	// CopiesInFlight holds the number of copies running against a registry
+	CopiesInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "copies_in_flight",
+		Help:      "Number of copies currently running against the registry.",
+	}, []string{"registry"})
+
+	// TooManyRequests counts the copies failing due to a 429 Too Many Requests response of a registry
+	TooManyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "too_many_requests_total",
+		Help:      "Number of copies rejected by the registry with 429 Too Many Requests by registry.",
+	}, []string{"registry"})
+
+	// TransferredBytes counts the bytes transferred by copies through the bandwidth limiter by direction
+	TransferredBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "copy_transferred_bytes_total",
+		Help:      "Number of bytes transferred by copies through the bandwidth limiter by direction, either received or sent.",
+	}, []string{"direction"})
+
+	// CopyThroughput observes the average rate copies received bytes at
+	CopyThroughput = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "copy_throughput_bytes_per_second",
+		Help:      "Average rate copies received bytes at through the bandwidth limiter.",
+		Buckets:   prometheus.ExponentialBuckets(64*1024, 4, 8),
+	})
+
+	// BandwidthLimit holds the bandwidth cap currently applied by scope, 0 if unlimited
+	BandwidthLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "bandwidth_limit_bytes_per_second",
+		Help:      "Bandwidth cap currently applied to each direction by scope, either global or per_job, 0 if unlimited.",
+	}, []string{"scope"})
+
+	// TokenRenewals counts the registry token renewals by registry and result
+	TokenRenewals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_renewals_total",
+		Help:      "Number of registry authentication token renewals by registry and result.",
+	}, []string{"registry", "result"})
+
+	// TokenExpiry holds the expiry of the current registry token
+	TokenExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "token_expiry_timestamp_seconds",
+		Help:      "Expiry of the current registry authentication token as unix timestamp.",
+	}, []string{"registry"})
+
+	// ConfigReloads counts the configuration reloads by result
+	ConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Number of configuration reloads by result, either success or failure.",
+	}, []string{"result"})
+
+	// ConfigLastReloadSuccess holds the time the configuration was applied successfully the last time
+	ConfigLastReloadSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Time of the last successfully applied configuration as unix timestamp.",
+	})
+
+	// ResyncChecks counts the digest comparisons of mirrored tags by result
+	ResyncChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "resync_checks_total",
+		Help:      "Number of digest comparisons of mirrored tags by result, either in_sync, drifted or failed.",
+	}, []string{"result"})
+
+	// Drifts counts the mirrored tags republished in the source registry with a different digest
+	Drifts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "drifts_total",
+		Help:      "Number of mirrored tags found republished with a different digest by source registry.",
+	}, []string{"source_registry"})
+
+	// GCDeletions counts the images and repositories deleted by the garbage collection by kind and result
+	GCDeletions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gc_deletions_total",
+		Help:      "Number of unreferenced images and repositories deleted by the garbage collection by kind and result, either deleted, dry_run or failed.",
+	}, []string{"kind", "result"})
+
+	// CacheWarmups counts the warm-ups of the registry caches by registry and result
+	CacheWarmups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_warmups_total",
+		Help:      "Number of warm-ups of the registry cache by registry and result, either success or failure.",
+	}, []string{"registry", "result"})
+
+	// CacheWarmupImages holds the number of images cached by the last warm-up
+	CacheWarmupImages = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_warmup_images",
+		Help:      "Number of images cached by the last warm-up of the registry cache by registry.",
+	}, []string{"registry"})
+
+	// Leader holds whether the replica is the leader running the singleton background work
+	Leader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leader",
+		Help:      "Whether the replica is the leader running the singleton background work, 1 or 0.",
+	})
+
+	// LeaderTransitions counts the times the replica acquired or lost the leadership
+	LeaderTransitions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "leader_transitions_total",
+		Help:      "Number of times the replica acquired or lost the leadership.",
+	})
+)
+
+// CopyQueue provides the state of the copy queue
+type CopyQueue interface {
+	Len() int
+	Capacity() int
+	DeadLetterCount() int
+	RunningWorkers() int
+	MaxWorkers() int
+}
+
+// RegisterCopyQueue exposes the depth of the copy queue and the utilisation of its workers
+func RegisterCopyQueue(registerer prometheus.Registerer, queue CopyQueue) error {
+	gauges := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "copy_queue_jobs",
+			Help:      "Number of copy jobs queued or in-flight.",
+		}, func() float64 { return float64(queue.Len()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "copy_queue_capacity",
+			Help:      "Maximum number of copy jobs queued or in-flight.",
+		}, func() float64 { return float64(queue.Capacity()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "copy_queue_dead_letters",
+			Help:      "Number of copy jobs in the dead-letter list.",
+		}, func() float64 { return float64(queue.DeadLetterCount()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "copy_workers_running",
+			Help:      "Number of running copy workers.",
+		}, func() float64 { return float64(queue.RunningWorkers()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "copy_workers_max",
+			Help:      "Maximum number of copy workers.",
+		}, func() float64 { return float64(queue.MaxWorkers()) }),
+	}
+
+	for _, gauge := range gauges {
+		if err := registerer.Register(gauge); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WorkerPool provides the utilisation of a worker pool, e.g. *pond.WorkerPool
+type WorkerPool interface {
+	RunningWorkers() int
+	MaxWorkers() int
+	WaitingTasks() uint64
+}
+
+// RegisterCopyLanes exposes the utilisation of the worker pools of the copy lanes by lane
+func RegisterCopyLanes(registerer prometheus.Registerer, lanes map[string]WorkerPool) error {
+	for lane, pool := range lanes {
+		labels := prometheus.Labels{"lane": lane}
+		gauges := []prometheus.Collector{
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "copy_lane_workers_running",
+				Help:        "Number of running copy workers by lane.",
+				ConstLabels: labels,
+			}, func() float64 { return float64(pool.RunningWorkers()) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "copy_lane_workers_max",
+				Help:        "Maximum number of copy workers by lane.",
+				ConstLabels: labels,
+			}, func() float64 { return float64(pool.MaxWorkers()) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Name:        "copy_lane_waiting",
+				Help:        "Number of copies waiting for a worker by lane.",
+				ConstLabels: labels,
+			}, func() float64 { return float64(pool.WaitingTasks()) }),
+		}
+
+		for _, gauge := range gauges {
+			if err := registerer.Register(gauge); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// CacheStats provides the statistics of a cache, e.g. *ristretto.Metrics
+type CacheStats interface {
+	Hits() uint64
+	Misses() uint64
+}
+
+// Caches exposes hits and misses of the registry caches
+var Caches = newCacheCollector()
+
+func init() {
+	prometheus.MustRegister(Caches)
+}
+
+type cacheCollector struct {
+	hits   *prometheus.Desc
+	misses *prometheus.Desc
+	ratio  *prometheus.Desc
+
+	// caches holds the registry of each cache, a reload replaces the client of a registry while the previous one still drains
+	mu     sync.Mutex
+	caches map[CacheStats]string
+}
+
+func newCacheCollector() *cacheCollector {
+	return &cacheCollector{
+		hits:   prometheus.NewDesc(namespace+"_cache_hits_total", "Number of cache hits by registry.", []string{"registry"}, nil),
+		misses: prometheus.NewDesc(namespace+"_cache_misses_total", "Number of cache misses by registry.", []string{"registry"}, nil),
+		ratio:  prometheus.NewDesc(namespace+"_cache_hit_ratio", "Ratio of cache hits to lookups by registry.", []string{"registry"}, nil),
+		caches: map[CacheStats]string{},
+	}
+}
+
+// Add starts exposing the statistics of the cache of a registry
+func (c *cacheCollector) Add(registry string, stats CacheStats) {
+	if stats == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.caches[stats] = registry
+}
+
+// Remove stops exposing the statistics of a cache, those of other caches of the same registry are kept
+func (c *cacheCollector) Remove(stats CacheStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.caches, stats)
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.ratio
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the caches of the same registry are summed up
+	hits, misses := map[string]uint64{}, map[string]uint64{}
+	for stats, registry := range c.caches {
+		hits[registry] += stats.Hits()
+		misses[registry] += stats.Misses()
+	}
+
+	for registry := range hits {
+		hits, misses := hits[registry], misses[registry]
+
+		ratio := 0.0
+		if hits+misses > 0 {
+			ratio = float64(hits) / float64(hits+misses)
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(hits), registry)
+		ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(misses), registry)
+		ch <- prometheus.MustNewConstMetric(c.ratio, prometheus.GaugeValue, ratio, registry)
+	}
+}
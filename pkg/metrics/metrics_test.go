@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCopyQueue struct{}
+
+func (fakeCopyQueue) Len() int             { return 3 }
+func (fakeCopyQueue) Capacity() int        { return 10 }
+func (fakeCopyQueue) DeadLetterCount() int { return 1 }
+func (fakeCopyQueue) RunningWorkers() int  { return 2 }
+func (fakeCopyQueue) MaxWorkers() int      { return 4 }
+
+func TestRegisterCopyQueue(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	assert.NoError(t, RegisterCopyQueue(registry, fakeCopyQueue{}))
+
+	expected := `
+# HELP k8s_image_swapper_copy_queue_jobs Number of copy jobs queued or in-flight.
+# TYPE k8s_image_swapper_copy_queue_jobs gauge
+k8s_image_swapper_copy_queue_jobs 3
+# HELP k8s_image_swapper_copy_workers_running Number of running copy workers.
+# TYPE k8s_image_swapper_copy_workers_running gauge
+k8s_image_swapper_copy_workers_running 2
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"k8s_image_swapper_copy_queue_jobs", "k8s_image_swapper_copy_workers_running"))
+
+	// registering twice is refused
+	assert.Error(t, RegisterCopyQueue(registry, fakeCopyQueue{}))
+}
+
+type fakeWorkerPool struct {
+	running int
+	waiting uint64
+}
+
+func (p fakeWorkerPool) RunningWorkers() int  { return p.running }
+func (p fakeWorkerPool) MaxWorkers() int      { return 10 }
+func (p fakeWorkerPool) WaitingTasks() uint64 { return p.waiting }
+
+func TestRegisterCopyLanes(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	assert.NoError(t, RegisterCopyLanes(registry, map[string]WorkerPool{
+		"immediate": fakeWorkerPool{running: 1},
+		"delayed":   fakeWorkerPool{running: 10, waiting: 25},
+	}))
+
+	expected := `
+# HELP k8s_image_swapper_copy_lane_waiting Number of copies waiting for a worker by lane.
+# TYPE k8s_image_swapper_copy_lane_waiting gauge
+k8s_image_swapper_copy_lane_waiting{lane="delayed"} 25
+k8s_image_swapper_copy_lane_waiting{lane="immediate"} 0
+# HELP k8s_image_swapper_copy_lane_workers_running Number of running copy workers by lane.
+# TYPE k8s_image_swapper_copy_lane_workers_running gauge
+k8s_image_swapper_copy_lane_workers_running{lane="delayed"} 10
+k8s_image_swapper_copy_lane_workers_running{lane="immediate"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"k8s_image_swapper_copy_lane_waiting", "k8s_image_swapper_copy_lane_workers_running"))
+}
+
+type fakeCacheStats struct {
+	hits, misses uint64
+}
+
+func (s fakeCacheStats) Hits() uint64   { return s.hits }
+func (s fakeCacheStats) Misses() uint64 { return s.misses }
+
+func TestCacheCollector(t *testing.T) {
+	collector := newCacheCollector()
+	replaced := &fakeCacheStats{hits: 1}
+	empty := &fakeCacheStats{}
+	collector.Add("example.com", replaced)
+	collector.Add("example.com", &fakeCacheStats{hits: 2, misses: 1})
+	collector.Add("empty.example.com", empty)
+
+	expected := `
+# HELP k8s_image_swapper_cache_hit_ratio Ratio of cache hits to lookups by registry.
+# TYPE k8s_image_swapper_cache_hit_ratio gauge
+k8s_image_swapper_cache_hit_ratio{registry="empty.example.com"} 0
+k8s_image_swapper_cache_hit_ratio{registry="example.com"} 0.75
+# HELP k8s_image_swapper_cache_hits_total Number of cache hits by registry.
+# TYPE k8s_image_swapper_cache_hits_total counter
+k8s_image_swapper_cache_hits_total{registry="empty.example.com"} 0
+k8s_image_swapper_cache_hits_total{registry="example.com"} 3
+# HELP k8s_image_swapper_cache_misses_total Number of cache misses by registry.
+# TYPE k8s_image_swapper_cache_misses_total counter
+k8s_image_swapper_cache_misses_total{registry="empty.example.com"} 0
+k8s_image_swapper_cache_misses_total{registry="example.com"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+
+	// closing a replaced client keeps exposing the cache of its successor
+	collector.Remove(replaced)
+	collector.Remove(empty)
+	assert.Equal(t, 3, testutil.CollectAndCount(collector))
+}
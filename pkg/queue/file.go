@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// FileStore persists each job as a JSON file in a directory, e.g. on a persistent volume
+type FileStore struct {
+	path string
+}
+
+// NewFileStore initialises a store in the given directory, creating it if necessary
+func NewFileStore(path string) (*FileStore, error) {
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &FileStore{path: path}, nil
+}
+
+func (s *FileStore) Put(ctx context.Context, job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a partial job behind
+	tmpfile, err := os.CreateTemp(s.path, ".job-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmpfile.Name())
+	}()
+
+	if _, err := tmpfile.Write(data); err != nil {
+		_ = tmpfile.Close()
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpfile.Name(), s.filename(job.ID))
+}
+
+func (s *FileStore) Delete(ctx context.Context, id string) error {
+	if err := os.Remove(s.filename(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileStore) List(ctx context.Context) ([]Job, error) {
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []Job{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		job := Job{}
+		if err := json.Unmarshal(data, &job); err != nil {
+			log.Ctx(ctx).Err(err).Str("file", entry.Name()).Msg("skipping unreadable copy job")
+			continue
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return sortJobs(jobs), nil
+}
+
+func (s *FileStore) filename(id string) string {
+	return filepath.Join(s.path, id+".json")
+}
@@ -0,0 +1,42 @@
+package queue
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "queue")
+
+	store, err := NewFileStore(dir)
+	assert.NoError(t, err)
+
+	older := Job{ID: "a", TargetImage: "example.com/a:latest", EnqueuedAt: time.Now().Add(-time.Minute).UTC()}
+	newer := Job{ID: "b", TargetImage: "example.com/b:latest", EnqueuedAt: time.Now().UTC()}
+
+	assert.NoError(t, store.Put(context.Background(), newer))
+	assert.NoError(t, store.Put(context.Background(), older))
+
+	// jobs survive a new store instance, e.g. after a restart
+	store, err = NewFileStore(dir)
+	assert.NoError(t, err)
+
+	jobs, err := store.List(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, []string{jobs[0].ID, jobs[1].ID})
+
+	assert.NoError(t, store.Delete(context.Background(), "a"))
+	assert.NoError(t, store.Delete(context.Background(), "does-not-exist"))
+
+	jobs, _ = store.List(context.Background())
+	assert.Len(t, jobs, 1)
+
+	// no temporary files are left behind
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 1)
+}
@@ -0,0 +1,219 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// configMapStoreLabel selects the ConfigMaps of the jobs of a store by its name
+	configMapStoreLabel = "k8s-image-swapper/copy-queue"
+	// configMapHolderAnnotation names the pod of the replica processing the job
+	configMapHolderAnnotation = "k8s-image-swapper/holder"
+	// configMapJobKey is the key of the job in the data of its ConfigMap
+	configMapJobKey = "job"
+	// holderCacheDuration is how long the liveness of another replica is trusted
+	holderCacheDuration = 10 * time.Second
+)
+
+// Holder identifies the pod of the replica processing the jobs it persisted in a shared store
+type Holder struct {
+	Namespace string
+	Name      string
+}
+
+// Claimer is implemented by stores shared between replicas.
+// A restored job is only processed by the replica which claimed it.
+type Claimer interface {
+	Claim(ctx context.Context, id string) (bool, error)
+}
+
+// ConfigMapStore persists each job in a ConfigMap of its own, sharing the backlog between replicas.
+// Jobs are held by the replica which persisted them, other replicas only resume them once its pod is gone.
+type ConfigMapStore struct {
+	kubernetesClient kubernetes.Interface
+	namespace        string
+	name             string
+	holder           Holder
+
+	mu      sync.Mutex
+	holders map[string]holderState
+}
+
+// holderState is the cached liveness of another replica
+type holderState struct {
+	alive     bool
+	checkedAt time.Time
+}
+
+// NewConfigMapStore initialises a store keeping the jobs in ConfigMaps prefixed with the given name.
+// Jobs are held by the holder, without a name every replica may claim any job.
+func NewConfigMapStore(clientset kubernetes.Interface, namespace string, name string, holder Holder) *ConfigMapStore {
+	return &ConfigMapStore{
+		kubernetesClient: clientset,
+		namespace:        namespace,
+		name:             name,
+		holder:           holder,
+		holders:          map[string]holderState{},
+	}
+}
+
+func (s *ConfigMapStore) Put(ctx context.Context, job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	configMaps := s.kubernetesClient.CoreV1().ConfigMaps(s.namespace)
+	name := s.configMapName(job.ID)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			configMap = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: s.namespace,
+					Labels: map[string]string{
+						"app.kubernetes.io/managed-by": "k8s-image-swapper",
+						configMapStoreLabel:            s.name,
+					},
+					Annotations: map[string]string{configMapHolderAnnotation: s.holder.Name},
+				},
+				Data: map[string]string{configMapJobKey: string(data)},
+			}
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// another replica created it in the meantime, retry as an update
+				return apierrors.NewConflict(corev1.Resource("configmaps"), name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if configMap.Annotations == nil {
+			configMap.Annotations = map[string]string{}
+		}
+		configMap.Annotations[configMapHolderAnnotation] = s.holder.Name
+		configMap.Data = map[string]string{configMapJobKey: string(data)}
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+
+		return err
+	})
+}
+
+func (s *ConfigMapStore) Delete(ctx context.Context, id string) error {
+	err := s.kubernetesClient.CoreV1().ConfigMaps(s.namespace).Delete(ctx, s.configMapName(id), metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *ConfigMapStore) List(ctx context.Context) ([]Job, error) {
+	selector := labels.SelectorFromSet(labels.Set{configMapStoreLabel: s.name}).String()
+	configMaps, err := s.kubernetesClient.CoreV1().ConfigMaps(s.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []Job{}
+	for _, configMap := range configMaps.Items {
+		job := Job{}
+		if err := json.Unmarshal([]byte(configMap.Data[configMapJobKey]), &job); err != nil {
+			log.Ctx(ctx).Err(err).Str("configMap", configMap.Name).Msg("skipping unreadable copy job")
+			continue
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return sortJobs(jobs), nil
+}
+
+// Claim takes over a job unless another replica holds it and is still running.
+// It returns false if the job is held by another replica or was claimed concurrently.
+func (s *ConfigMapStore) Claim(ctx context.Context, id string) (bool, error) {
+	configMaps := s.kubernetesClient.CoreV1().ConfigMaps(s.namespace)
+
+	configMap, err := configMaps.Get(ctx, s.configMapName(id), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	holder := configMap.Annotations[configMapHolderAnnotation]
+	if holder == s.holder.Name {
+		return true, nil
+	}
+	if holder != "" && s.holder.Name != "" {
+		alive, err := s.holderAlive(ctx, holder)
+		if err != nil {
+			return false, err
+		}
+		if alive {
+			return false, nil
+		}
+	}
+
+	log.Ctx(ctx).Info().Str("job", id).Str("holder", holder).Msg("taking over copy job of stopped replica")
+
+	if configMap.Annotations == nil {
+		configMap.Annotations = map[string]string{}
+	}
+	configMap.Annotations[configMapHolderAnnotation] = s.holder.Name
+	_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+		// another replica claimed or finished it first
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// holderAlive returns true if the pod of another replica still exists and has not terminated
+func (s *ConfigMapStore) holderAlive(ctx context.Context, holder string) (bool, error) {
+	s.mu.Lock()
+	state, found := s.holders[holder]
+	s.mu.Unlock()
+	if found && time.Since(state.checkedAt) < holderCacheDuration {
+		return state.alive, nil
+	}
+
+	alive := true
+	pod, err := s.kubernetesClient.CoreV1().Pods(s.holder.Namespace).Get(ctx, holder, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		alive = false
+	case err != nil:
+		return false, err
+	case pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed:
+		alive = false
+	}
+
+	s.mu.Lock()
+	s.holders[holder] = holderState{alive: alive, checkedAt: time.Now()}
+	s.mu.Unlock()
+
+	return alive, nil
+}
+
+// configMapName returns the name of the ConfigMap of a job, job IDs are lowercase hex
+func (s *ConfigMapStore) configMapName(id string) string {
+	return s.name + "-" + id
+}
@@ -0,0 +1,107 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alitto/pond"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigMapStore(t *testing.T) {
+	clientSet := fake.NewSimpleClientset()
+	store := NewConfigMapStore(clientSet, "k8s-image-swapper", "copy-queue", Holder{Namespace: "k8s-image-swapper", Name: "swapper-a"})
+
+	jobs, err := store.List(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	job := Job{ID: JobID("example.com/a:latest"), SourceImage: "docker.io/library/a:latest", TargetImage: "example.com/a:latest", Namespace: "test-ns"}
+	assert.NoError(t, store.Put(context.Background(), job))
+
+	// each job is kept in a ConfigMap of its own
+	configMap, err := clientSet.CoreV1().ConfigMaps("k8s-image-swapper").Get(context.Background(), "copy-queue-"+job.ID, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, configMap.Data, "job")
+	assert.Equal(t, "swapper-a", configMap.Annotations["k8s-image-swapper/holder"])
+
+	// a second store, e.g. another replica, sees the same backlog
+	jobs, err = NewConfigMapStore(clientSet, "k8s-image-swapper", "copy-queue", Holder{}).List(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []Job{job}, jobs)
+
+	assert.NoError(t, store.Delete(context.Background(), job.ID))
+	assert.NoError(t, store.Delete(context.Background(), job.ID), "deleted jobs are ignored")
+	jobs, _ = store.List(context.Background())
+	assert.Empty(t, jobs)
+}
+
+func TestConfigMapStore_Claim(t *testing.T) {
+	ctx := context.Background()
+	clientSet := fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "k8s-image-swapper", Name: "swapper-a"}})
+	storeA := NewConfigMapStore(clientSet, "k8s-image-swapper", "copy-queue", Holder{Namespace: "k8s-image-swapper", Name: "swapper-a"})
+	storeB := NewConfigMapStore(clientSet, "k8s-image-swapper", "copy-queue", Holder{Namespace: "k8s-image-swapper", Name: "swapper-b"})
+
+	job := Job{ID: JobID("example.com/a:latest"), TargetImage: "example.com/a:latest"}
+	assert.NoError(t, storeA.Put(ctx, job))
+
+	claimed, err := storeA.Claim(ctx, job.ID)
+	assert.NoError(t, err)
+	assert.True(t, claimed, "jobs are held by the replica persisting them")
+
+	claimed, err = storeB.Claim(ctx, job.ID)
+	assert.NoError(t, err)
+	assert.False(t, claimed, "jobs of running replicas are skipped")
+
+	// the replica is gone, its jobs are taken over once the cached liveness expired
+	assert.NoError(t, clientSet.CoreV1().Pods("k8s-image-swapper").Delete(ctx, "swapper-a", metav1.DeleteOptions{}))
+	storeB.holders = map[string]holderState{}
+
+	claimed, err = storeB.Claim(ctx, job.ID)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	configMap, err := clientSet.CoreV1().ConfigMaps("k8s-image-swapper").Get(ctx, "copy-queue-"+job.ID, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "swapper-b", configMap.Annotations["k8s-image-swapper/holder"])
+
+	claimed, err = storeB.Claim(ctx, JobID("example.com/missing:latest"))
+	assert.NoError(t, err)
+	assert.False(t, claimed, "finished jobs are not claimed")
+}
+
+func TestQueue_RestoreSkipsJobsOfOtherReplicas(t *testing.T) {
+	ctx := context.Background()
+	clientSet := fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "k8s-image-swapper", Name: "swapper-a"}})
+	storeA := NewConfigMapStore(clientSet, "k8s-image-swapper", "copy-queue", Holder{Namespace: "k8s-image-swapper", Name: "swapper-a"})
+	storeB := NewConfigMapStore(clientSet, "k8s-image-swapper", "copy-queue", Holder{Namespace: "k8s-image-swapper", Name: "swapper-b"})
+
+	assert.NoError(t, storeA.Put(ctx, Job{ID: JobID("example.com/a:latest"), TargetImage: "example.com/a:latest"}))
+	assert.NoError(t, storeB.Put(ctx, Job{ID: JobID("example.com/b:latest"), TargetImage: "example.com/b:latest"}))
+
+	pool := pond.New(1, 10)
+	processed := make(chan string, 2)
+	q := New(pool, func(ctx context.Context, job Job) error {
+		processed <- job.TargetImage
+		return nil
+	}, WithStore(storeB))
+	defer q.Stop(ctx)
+
+	assert.NoError(t, q.Restore(ctx))
+
+	select {
+	case target := <-processed:
+		assert.Equal(t, "example.com/b:latest", target)
+	case <-time.After(time.Second):
+		assert.Fail(t, "job of the replica not restored")
+	}
+	select {
+	case target := <-processed:
+		assert.Fail(t, "job of another running replica restored", target)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
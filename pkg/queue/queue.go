@@ -0,0 +1,701 @@
+package queue
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/alitto/pond"
+	"github.com/estahn/k8s-image-swapper/pkg/metrics"
+	"github.com/estahn/k8s-image-swapper/pkg/types"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ErrQueueFull is returned when a job is rejected because the queue reached its capacity
+var ErrQueueFull = errors.New("copy queue is full")
+
+// yieldInterval is how often a backfill job checks whether delayed jobs are still waiting for a worker
+const yieldInterval = time.Second
+
+// Lane selects the worker pool a job is processed on
+type Lane string
+
+const (
+	// LaneDelayed processes the copies of admissions, jobs without a lane are processed on it
+	LaneDelayed Lane = "delayed"
+	// LaneBackfill processes background copies, e.g. of drifted tags, once no delayed job is waiting for a worker
+	LaneBackfill Lane = "backfill"
+)
+
+// Job describes an image copy which has been accepted but not completed yet.
+// It carries everything required to rebuild the copy after a restart.
+type Job struct {
+	ID                 string            `json:"id"`
+	SourceImage        string            `json:"sourceImage"`
+	TargetImage        string            `json:"targetImage"`
+	ImagePullPolicy    corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+	Namespace          string            `json:"namespace,omitempty"`
+	PodName            string            `json:"podName,omitempty"`
+	ServiceAccountName string            `json:"serviceAccountName,omitempty"`
+	ImagePullSecrets   []string          `json:"imagePullSecrets,omitempty"`
+	EnqueuedAt         time.Time         `json:"enqueuedAt"`
+	Lane               Lane              `json:"lane,omitempty"`
+
+	// EventTarget is the object events about the copy are recorded on, e.g. the pod's controller
+	EventTarget *corev1.ObjectReference `json:"eventTarget,omitempty"`
+
+	// TraceContext links the copy to the trace of the admission request which queued it
+	TraceContext map[string]string `json:"traceContext,omitempty"`
+
+	// Attempts counts the failed attempts, LastError holds the reason of the last one
+	Attempts      int       `json:"attempts,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+	NextAttemptAt time.Time `json:"nextAttemptAt,omitempty"`
+
+	// TooManyRequests counts the responses of registries rejecting the copy with 429 Too Many Requests
+	TooManyRequests int `json:"tooManyRequests,omitempty"`
+
+	// DeadLetter marks a job which failed permanently or exhausted its attempts
+	DeadLetter bool `json:"deadLetter,omitempty"`
+}
+
+// JobID returns a stable identifier for the copy of an image, so the same target is only queued once
+func JobID(targetImage string) string {
+	sum := sha256.Sum256([]byte(targetImage))
+	return hex.EncodeToString(sum[:16])
+}
+
+// ProcessFunc executes a job, returning an error schedules a retry unless it is marked as permanent.
+// The context is canceled if the queue is stopped before the job completed.
+type ProcessFunc func(ctx context.Context, job Job) error
+
+// Option represents an option that can be passed when instantiating the queue to customize it
+type Option func(*Queue)
+
+// WithStore allows to pass the store persisting queued jobs
+func WithStore(store Store) Option {
+	return func(q *Queue) {
+		q.store = store
+	}
+}
+
+// WithCapacity allows to pass the maximum number of jobs queued or in-flight
+func WithCapacity(capacity int) Option {
+	return func(q *Queue) {
+		q.capacity = capacity
+	}
+}
+
+// WithOverflowPolicy allows to pass the behaviour once the capacity is reached
+func WithOverflowPolicy(policy types.QueueOverflowPolicy) Option {
+	return func(q *Queue) {
+		q.overflowPolicy = policy
+	}
+}
+
+// WithRetryPolicy allows to pass the policy for attempting failed jobs again
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(q *Queue) {
+		q.retryPolicy = policy
+	}
+}
+
+// WithBackfillPool allows to pass the worker pool processing the jobs of the backfill lane,
+// they are processed on the pool of the delayed lane otherwise
+func WithBackfillPool(pool *pond.WorkerPool) Option {
+	return func(q *Queue) {
+		q.backfillPool = pool
+	}
+}
+
+// Queue schedules jobs on a worker pool and persists them in a store until they are processed,
+// providing at-least-once semantics for stores surviving a restart.
+type Queue struct {
+	pool    *pond.WorkerPool
+	process ProcessFunc
+	store   Store
+
+	capacity       int
+	overflowPolicy types.QueueOverflowPolicy
+	retryPolicy    RetryPolicy
+
+	// slots limits the number of jobs scheduled on the pool
+	slots chan struct{}
+
+	// backfillPool processes the jobs of the backfill lane, limited by backfillSlots
+	backfillPool  *pond.WorkerPool
+	backfillSlots chan struct{}
+
+	// ctx is passed to jobs and canceled once the queue stopped draining
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// stopMu prevents submissions to the pool while it is being stopped
+	stopMu sync.RWMutex
+
+	mu          sync.Mutex
+	stopped     bool
+	pending     map[string]struct{}
+	deadLetters map[string]struct{}
+	retries     map[string]*time.Timer
+}
+
+// New returns a queue processing jobs with the given function on the worker pool
+func New(pool *pond.WorkerPool, process ProcessFunc, opts ...Option) *Queue {
+	q := &Queue{
+		pool:           pool,
+		process:        process,
+		store:          NewMemoryStore(),
+		capacity:       pool.MaxCapacity() + pool.MaxWorkers(),
+		overflowPolicy: types.QueueOverflowPolicyBlock,
+		retryPolicy:    RetryPolicy{MaxAttempts: 1},
+		pending:        map[string]struct{}{},
+		deadLetters:    map[string]struct{}{},
+		retries:        map[string]*time.Timer{},
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+
+	for _, opt := range opts {
+		opt(q)
+	}
+
+	// scheduling more jobs than the pool can hold would block its workers
+	poolCapacity := pool.MaxCapacity() + pool.MaxWorkers()
+	if q.capacity > poolCapacity {
+		log.Warn().Int("capacity", q.capacity).Int("poolCapacity", poolCapacity).Msg("copy queue capacity exceeds worker pool, using pool capacity")
+		q.capacity = poolCapacity
+	} else if q.capacity <= 0 {
+		q.capacity = poolCapacity
+	}
+
+	q.slots = make(chan struct{}, q.capacity)
+
+	if q.backfillPool == nil {
+		q.backfillPool = pool
+		q.backfillSlots = q.slots
+	} else {
+		q.backfillSlots = make(chan struct{}, q.backfillPool.MaxCapacity()+q.backfillPool.MaxWorkers())
+	}
+
+	return q
+}
+
+// lane returns the worker pool and the slots of the lane of a job
+func (q *Queue) lane(job Job) (*pond.WorkerPool, chan struct{}) {
+	if job.Lane == LaneBackfill {
+		return q.backfillPool, q.backfillSlots
+	}
+
+	return q.pool, q.slots
+}
+
+// Submit persists a job and schedules it for processing.
+// Jobs for a target which is already queued are ignored, a dead-lettered job of the target is replaced.
+func (q *Queue) Submit(ctx context.Context, job Job) error {
+	if job.ID == "" {
+		job.ID = JobID(job.TargetImage)
+	}
+	if job.EnqueuedAt.IsZero() {
+		job.EnqueuedAt = time.Now().UTC()
+	}
+
+	if !q.reserve(job.ID) {
+		log.Ctx(ctx).Trace().Str("job", job.ID).Msg("copy job already queued")
+		return nil
+	}
+
+	if err := q.store.Put(ctx, job); err != nil {
+		q.release(job.ID)
+		return err
+	}
+
+	return q.schedule(ctx, job)
+}
+
+// reserve marks a job as pending and removes it from the dead-letter list,
+// returns false if it is pending already or the queue has been stopped
+func (q *Queue) reserve(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.stopped {
+		return false
+	}
+	if _, exists := q.pending[id]; exists {
+		return false
+	}
+	// the dead-letter list only reports failed jobs, new submissions of the target are attempted again
+	delete(q.deadLetters, id)
+	q.pending[id] = struct{}{}
+
+	return true
+}
+
+// release removes the pending mark of a job
+func (q *Queue) release(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.pending, id)
+}
+
+// schedule submits a reserved and persisted job to the worker pool honouring the overflow policy
+func (q *Queue) schedule(ctx context.Context, job Job) error {
+	pool, slots := q.lane(job)
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		metrics.CopyQueueOverflows.WithLabelValues(q.overflowPolicy.String()).Inc()
+
+		switch q.overflowPolicy {
+		case types.QueueOverflowPolicyBlock:
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				// the job is attempted again on its next submission
+				q.release(job.ID)
+				if err := q.store.Delete(context.WithoutCancel(ctx), job.ID); err != nil {
+					log.Ctx(ctx).Err(err).Str("job", job.ID).Msg("failed removing abandoned job from store")
+				}
+				return ctx.Err()
+			}
+		case types.QueueOverflowPolicyDrop:
+			q.release(job.ID)
+			log.Ctx(ctx).Warn().Str("job", job.ID).Str("target-image", job.TargetImage).Msg("copy queue full, dropping job")
+			if err := q.store.Delete(ctx, job.ID); err != nil {
+				log.Ctx(ctx).Err(err).Str("job", job.ID).Msg("failed removing dropped job from store")
+			}
+			return ErrQueueFull
+		case types.QueueOverflowPolicyDefer:
+			// the job stays in the store and is picked up once capacity is available
+			q.release(job.ID)
+			log.Ctx(ctx).Debug().Str("job", job.ID).Str("target-image", job.TargetImage).Msg("copy queue full, deferring job")
+			return nil
+		}
+	}
+
+	q.stopMu.RLock()
+	defer q.stopMu.RUnlock()
+
+	// a stopped pool does not accept tasks anymore, the job is kept in the store
+	if q.isStopped() {
+		<-slots
+		return nil
+	}
+
+	pool.Submit(func() {
+		q.run(job)
+	})
+
+	return nil
+}
+
+// run processes a job and removes it from the store once done, failed jobs are retried
+func (q *Queue) run(job Job) {
+	defer q.fill()
+
+	_, slots := q.lane(job)
+	if job.Lane == LaneBackfill && q.backfillPool != q.pool {
+		q.yield()
+	}
+
+	err := q.process(q.ctx, job)
+
+	// free the slot before waiting for a retry
+	<-slots
+
+	if err != nil {
+		q.fail(job, err)
+		return
+	}
+
+	if err := q.store.Delete(context.Background(), job.ID); err != nil {
+		log.Err(err).Str("job", job.ID).Msg("failed removing completed job from store")
+	}
+
+	q.release(job.ID)
+}
+
+// yield waits while delayed jobs are waiting for a worker, so backfill jobs never delay them
+func (q *Queue) yield() {
+	for q.pool.WaitingTasks() > 0 {
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-time.After(yieldInterval):
+		}
+	}
+}
+
+// fail schedules a retry of a failed job or moves it to the dead-letter list
+func (q *Queue) fail(job Job, err error) {
+	job.Attempts++
+	job.LastError = err.Error()
+
+	logger := log.With().Str("job", job.ID).Str("target-image", job.TargetImage).Int("attempts", job.Attempts).Logger()
+
+	// jobs interrupted by a shutdown are kept for the next start without counting the attempt
+	if q.ctx.Err() != nil {
+		job.Attempts--
+		logger.Debug().Err(err).Msg("copy job interrupted by shutdown")
+		return
+	}
+
+	// jobs waiting for a limit of the registry are scheduled again without counting the attempt,
+	// unless the registry keeps rejecting them
+	throttleDelay, throttled := IsThrottled(err)
+	if throttled && isTooManyRequests(err) {
+		job.TooManyRequests++
+		throttled = job.TooManyRequests <= q.retryPolicy.MaxTooManyRequests
+	}
+	if throttled {
+		job.Attempts--
+		job.NextAttemptAt = time.Now().UTC().Add(throttleDelay)
+		if err := q.store.Put(context.Background(), job); err != nil {
+			logger.Err(err).Msg("failed persisting throttled job")
+		}
+
+		logger.Debug().Err(err).Time("nextAttemptAt", job.NextAttemptAt).Msg("copy job throttled, scheduling retry")
+		metrics.CopyRetries.WithLabelValues("throttled").Inc()
+		q.retryAfter(job, throttleDelay)
+		return
+	}
+
+	if IsPermanent(err) || job.Attempts >= q.retryPolicy.MaxAttempts {
+		logger.Warn().Err(err).Bool("permanent", IsPermanent(err)).Msg("copy job failed, moving to dead-letter list")
+		metrics.CopyRetries.WithLabelValues("dead_letter").Inc()
+
+		job.DeadLetter = true
+		job.NextAttemptAt = time.Time{}
+		if err := q.store.Put(context.Background(), job); err != nil {
+			logger.Err(err).Msg("failed persisting dead-lettered job")
+		}
+
+		q.mu.Lock()
+		delete(q.pending, job.ID)
+		q.deadLetters[job.ID] = struct{}{}
+		q.mu.Unlock()
+
+		return
+	}
+
+	// a registry rejecting too many requests is not asked again before it allows it
+	delay := max(q.retryPolicy.backoff(job.Attempts), throttleDelay)
+	job.NextAttemptAt = time.Now().UTC().Add(delay)
+	if err := q.store.Put(context.Background(), job); err != nil {
+		logger.Err(err).Msg("failed persisting job retry")
+	}
+
+	logger.Info().Err(err).Time("nextAttemptAt", job.NextAttemptAt).Msg("copy job failed, scheduling retry")
+	metrics.CopyRetries.WithLabelValues("retry").Inc()
+	q.retryAfter(job, delay)
+}
+
+// retryAfter schedules a reserved job once the delay has passed, it keeps its pending mark while waiting
+func (q *Queue) retryAfter(job Job, delay time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.stopped {
+		return
+	}
+
+	q.retries[job.ID] = time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		delete(q.retries, job.ID)
+		q.mu.Unlock()
+
+		if err := q.schedule(q.ctx, job); err != nil {
+			log.Err(err).Str("job", job.ID).Msg("failed scheduling copy job retry")
+		}
+	})
+}
+
+// Stop stops accepting jobs and waits for queued and in-flight jobs to complete until the context is done,
+// remaining jobs are canceled. Returns the jobs which have not been completed, these are resumed on the
+// next start if the store is persistent.
+func (q *Queue) Stop(ctx context.Context) []Job {
+	q.stopMu.Lock()
+	q.mu.Lock()
+	q.stopped = true
+	for id, timer := range q.retries {
+		timer.Stop()
+		delete(q.retries, id)
+	}
+	q.mu.Unlock()
+	q.stopMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.pool.StopAndWait()
+		if q.backfillPool != q.pool {
+			q.backfillPool.StopAndWait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// cancel in-flight jobs and wait for queued jobs to return early
+		q.cancel()
+		<-done
+	}
+	q.cancel()
+
+	jobs, err := q.store.List(context.Background())
+	if err != nil {
+		log.Err(err).Msg("failed listing incomplete copy jobs")
+		return nil
+	}
+
+	abandoned := []Job{}
+	for _, job := range jobs {
+		if !job.DeadLetter {
+			abandoned = append(abandoned, job)
+		}
+	}
+
+	return abandoned
+}
+
+func (q *Queue) isStopped() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.stopped
+}
+
+// Persistent returns true if jobs survive a restart
+func (q *Queue) Persistent() bool {
+	_, inMemory := q.store.(*MemoryStore)
+	return !inMemory
+}
+
+// fill schedules deferred jobs from the store while capacity is available
+func (q *Queue) fill() {
+	if q.overflowPolicy != types.QueueOverflowPolicyDefer || len(q.slots) >= q.capacity {
+		return
+	}
+
+	if err := q.Restore(context.Background()); err != nil {
+		log.Err(err).Msg("failed scheduling deferred copy jobs")
+	}
+}
+
+// Restore schedules all jobs found in the store which are not being processed yet,
+// e.g. jobs persisted before a restart. Jobs held by another replica of a shared store are skipped.
+func (q *Queue) Restore(ctx context.Context) error {
+	jobs, err := q.store.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if q.overflowPolicy == types.QueueOverflowPolicyDefer && len(q.slots) >= q.capacity {
+			return nil
+		}
+
+		if job.DeadLetter {
+			q.mu.Lock()
+			q.deadLetters[job.ID] = struct{}{}
+			q.mu.Unlock()
+			continue
+		}
+
+		if !q.reserve(job.ID) {
+			continue
+		}
+
+		// jobs of a shared store may be processed by another replica
+		if claimer, ok := q.store.(Claimer); ok {
+			claimed, err := claimer.Claim(ctx, job.ID)
+			if err != nil {
+				log.Ctx(ctx).Err(err).Str("job", job.ID).Msg("failed claiming copy job")
+			}
+			if !claimed {
+				q.release(job.ID)
+				continue
+			}
+		}
+
+		if delay := time.Until(job.NextAttemptAt); delay > 0 {
+			log.Ctx(ctx).Debug().Str("job", job.ID).Str("target-image", job.TargetImage).Time("nextAttemptAt", job.NextAttemptAt).Msg("restoring copy job retry")
+			q.retryAfter(job, delay)
+			continue
+		}
+
+		log.Ctx(ctx).Debug().Str("job", job.ID).Str("target-image", job.TargetImage).Msg("restoring copy job")
+		if err := q.schedule(ctx, job); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Len returns the number of jobs queued or in-flight
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.pending)
+}
+
+// Capacity returns the maximum number of jobs queued or in-flight
+func (q *Queue) Capacity() int {
+	return q.capacity
+}
+
+// Saturated returns true if all slots are taken, further jobs are subject to the overflow policy
+func (q *Queue) Saturated() bool {
+	return len(q.slots) >= cap(q.slots)
+}
+
+// OverflowPolicy returns the behaviour once the capacity is reached
+func (q *Queue) OverflowPolicy() types.QueueOverflowPolicy {
+	return q.overflowPolicy
+}
+
+// DeadLetterCount returns the number of jobs in the dead-letter list
+func (q *Queue) DeadLetterCount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.deadLetters)
+}
+
+// RunningWorkers returns the number of workers of the pool currently running
+func (q *Queue) RunningWorkers() int {
+	return q.pool.RunningWorkers()
+}
+
+// MaxWorkers returns the maximum number of workers of the pool
+func (q *Queue) MaxWorkers() int {
+	return q.pool.MaxWorkers()
+}
+
+// Backlog returns all jobs which have not been completed yet, including deferred ones
+func (q *Queue) Backlog(ctx context.Context) ([]Job, error) {
+	return q.store.List(ctx)
+}
+
+// DeadLetters returns all jobs which failed permanently or exhausted their attempts
+func (q *Queue) DeadLetters(ctx context.Context) ([]Job, error) {
+	jobs, err := q.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetters := []Job{}
+	for _, job := range jobs {
+		if job.DeadLetter {
+			deadLetters = append(deadLetters, job)
+		}
+	}
+
+	return deadLetters, nil
+}
+
+// Retry resets dead-lettered jobs and schedules them again, all are retried if no id is given.
+// Returns the number of jobs scheduled.
+func (q *Queue) Retry(ctx context.Context, ids ...string) (int, error) {
+	deadLetters, err := q.DeadLetters(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	selected := map[string]bool{}
+	for _, id := range ids {
+		selected[id] = true
+	}
+
+	retried := 0
+	for _, job := range deadLetters {
+		if len(ids) > 0 && !selected[job.ID] {
+			continue
+		}
+
+		job.DeadLetter = false
+		job.Attempts = 0
+		job.TooManyRequests = 0
+		job.LastError = ""
+
+		log.Ctx(ctx).Info().Str("job", job.ID).Str("target-image", job.TargetImage).Msg("retrying dead-lettered copy job")
+		if err := q.Submit(ctx, job); err != nil {
+			return retried, err
+		}
+		retried++
+	}
+
+	return retried, nil
+}
+
+// DeadLetterHandler lists dead-lettered jobs on GET and retries them on POST,
+// optionally limited to the jobs given by the query parameter "id".
+func (q *Queue) DeadLetterHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var response interface{}
+
+		switch r.Method {
+		case http.MethodGet:
+			jobs, err := q.DeadLetters(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			response = struct {
+				Jobs []Job `json:"jobs"`
+			}{Jobs: jobs}
+		case http.MethodPost:
+			retried, err := q.Retry(r.Context(), r.URL.Query()["id"]...)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			response = struct {
+				Retried int `json:"retried"`
+			}{Retried: retried}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Err(err).Msg("failed writing dead-lettered copy jobs")
+		}
+	})
+}
+
+// BacklogHandler exposes the backlog as JSON
+func (q *Queue) BacklogHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jobs, err := q.Backlog(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct {
+			Capacity int   `json:"capacity"`
+			InFlight int   `json:"inFlight"`
+			Jobs     []Job `json:"jobs"`
+		}{
+			Capacity: q.Capacity(),
+			InFlight: q.Len(),
+			Jobs:     jobs,
+		}); err != nil {
+			log.Err(err).Msg("failed writing copy queue backlog")
+		}
+	})
+}
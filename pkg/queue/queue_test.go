@@ -0,0 +1,411 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alitto/pond"
+	"github.com/estahn/k8s-image-swapper/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue_Submit(t *testing.T) {
+	store := NewMemoryStore()
+	pool := pond.New(1, 10)
+
+	var mu sync.Mutex
+	processed := []string{}
+	q := New(pool, func(ctx context.Context, job Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, job.TargetImage)
+		return nil
+	}, WithStore(store))
+
+	assert.NoError(t, q.Submit(context.Background(), Job{TargetImage: "example.com/docker.io/library/nginx:latest"}))
+	assert.NoError(t, q.Submit(context.Background(), Job{TargetImage: "example.com/docker.io/library/redis:latest"}))
+
+	pool.StopAndWait()
+
+	assert.ElementsMatch(t, []string{"example.com/docker.io/library/nginx:latest", "example.com/docker.io/library/redis:latest"}, processed)
+	assert.Equal(t, 0, q.Len())
+
+	// completed jobs are removed from the store
+	jobs, err := store.List(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, jobs)
+}
+
+func TestQueue_SubmitDeduplicates(t *testing.T) {
+	pool := pond.New(1, 10)
+	block := make(chan struct{})
+
+	count := 0
+	q := New(pool, func(ctx context.Context, job Job) error {
+		<-block
+		count++
+		return nil
+	})
+
+	job := Job{TargetImage: "example.com/docker.io/library/nginx:latest"}
+	assert.NoError(t, q.Submit(context.Background(), job))
+	assert.NoError(t, q.Submit(context.Background(), job))
+	assert.Equal(t, 1, q.Len())
+
+	close(block)
+	pool.StopAndWait()
+
+	assert.Equal(t, 1, count)
+}
+
+func TestQueue_OverflowPolicyDrop(t *testing.T) {
+	store := NewMemoryStore()
+	pool := pond.New(1, 10)
+	block := make(chan struct{})
+
+	q := New(pool, func(ctx context.Context, job Job) error {
+		<-block
+		return nil
+	}, WithStore(store), WithCapacity(1), WithOverflowPolicy(types.QueueOverflowPolicyDrop))
+
+	assert.NoError(t, q.Submit(context.Background(), Job{TargetImage: "example.com/a:latest"}))
+	assert.ErrorIs(t, q.Submit(context.Background(), Job{TargetImage: "example.com/b:latest"}), ErrQueueFull)
+
+	jobs, _ := store.List(context.Background())
+	assert.Len(t, jobs, 1)
+
+	close(block)
+	pool.StopAndWait()
+}
+
+func TestQueue_OverflowPolicyBlock(t *testing.T) {
+	store := NewMemoryStore()
+	pool := pond.New(1, 10)
+	block := make(chan struct{})
+
+	q := New(pool, func(ctx context.Context, job Job) error {
+		<-block
+		return nil
+	}, WithStore(store), WithCapacity(1))
+
+	assert.NoError(t, q.Submit(context.Background(), Job{TargetImage: "example.com/a:latest"}))
+
+	// the wait for a free slot ends with the context of the submission
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, q.Submit(ctx, Job{TargetImage: "example.com/b:latest"}), context.DeadlineExceeded)
+
+	jobs, _ := store.List(context.Background())
+	assert.Len(t, jobs, 1)
+
+	close(block)
+	pool.StopAndWait()
+}
+
+func TestQueue_OverflowPolicyDefer(t *testing.T) {
+	store := NewMemoryStore()
+	pool := pond.New(1, 10)
+	block := make(chan struct{})
+
+	var mu sync.Mutex
+	processed := []string{}
+	q := New(pool, func(ctx context.Context, job Job) error {
+		<-block
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, job.TargetImage)
+		return nil
+	}, WithStore(store), WithCapacity(1), WithOverflowPolicy(types.QueueOverflowPolicyDefer))
+
+	assert.NoError(t, q.Submit(context.Background(), Job{TargetImage: "example.com/a:latest"}))
+	assert.NoError(t, q.Submit(context.Background(), Job{TargetImage: "example.com/b:latest"}))
+
+	// the deferred job is visible in the backlog but not scheduled
+	backlog, _ := q.Backlog(context.Background())
+	assert.Len(t, backlog, 2)
+	assert.Equal(t, 1, q.Len())
+
+	close(block)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(processed) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	pool.StopAndWait()
+}
+
+func TestQueue_Restore(t *testing.T) {
+	store := NewMemoryStore()
+	_ = store.Put(context.Background(), Job{ID: JobID("example.com/a:latest"), TargetImage: "example.com/a:latest"})
+
+	pool := pond.New(1, 10)
+	processed := []string{}
+	q := New(pool, func(ctx context.Context, job Job) error {
+		processed = append(processed, job.TargetImage)
+		return nil
+	}, WithStore(store))
+
+	assert.NoError(t, q.Restore(context.Background()))
+	pool.StopAndWait()
+
+	assert.Equal(t, []string{"example.com/a:latest"}, processed)
+}
+
+func TestQueue_Retry(t *testing.T) {
+	store := NewMemoryStore()
+	pool := pond.New(1, 10)
+
+	var mu sync.Mutex
+	attempts := 0
+	q := New(pool, func(ctx context.Context, job Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts < 3 {
+			return errors.New("toomanyrequests")
+		}
+		return nil
+	}, WithStore(store), WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}))
+
+	assert.NoError(t, q.Submit(context.Background(), Job{TargetImage: "example.com/a:latest"}))
+
+	assert.Eventually(t, func() bool {
+		return q.Len() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, 3, attempts)
+	mu.Unlock()
+
+	jobs, _ := store.List(context.Background())
+	assert.Empty(t, jobs)
+
+	pool.StopAndWait()
+}
+
+func TestQueue_Throttled(t *testing.T) {
+	store := NewMemoryStore()
+	pool := pond.New(1, 10)
+
+	var mu sync.Mutex
+	attempts := 0
+	q := New(pool, func(ctx context.Context, job Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts < 4 {
+			return Throttled(errors.New("concurrency limit reached"), time.Millisecond)
+		}
+		return nil
+	}, WithStore(store), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+
+	assert.NoError(t, q.Submit(context.Background(), Job{TargetImage: "example.com/a:latest"}))
+
+	// throttled attempts do not count towards the maximum
+	assert.Eventually(t, func() bool {
+		return q.Len() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, 4, attempts)
+	mu.Unlock()
+	assert.Equal(t, 0, q.DeadLetterCount())
+
+	pool.StopAndWait()
+}
+
+func TestQueue_TooManyRequests(t *testing.T) {
+	store := NewMemoryStore()
+	pool := pond.New(1, 10)
+
+	var mu sync.Mutex
+	attempts := 0
+	q := New(pool, func(ctx context.Context, job Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		return TooManyRequests(errors.New("toomanyrequests"), time.Millisecond)
+	}, WithStore(store), WithRetryPolicy(RetryPolicy{MaxAttempts: 2, MaxTooManyRequests: 3}))
+
+	assert.NoError(t, q.Submit(context.Background(), Job{TargetImage: "example.com/a:latest"}))
+
+	// responses beyond the maximum count as attempts, so a registry rejecting the job for good dead-letters it
+	assert.Eventually(t, func() bool {
+		return q.DeadLetterCount() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, 5, attempts)
+	mu.Unlock()
+
+	jobs, _ := store.List(context.Background())
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, 2, jobs[0].Attempts)
+	assert.Equal(t, 5, jobs[0].TooManyRequests)
+
+	pool.StopAndWait()
+}
+
+func TestQueue_BackfillLane(t *testing.T) {
+	pool := pond.New(1, 10)
+	backfillPool := pond.New(1, 10)
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	processed := []string{}
+	q := New(pool, func(ctx context.Context, job Job) error {
+		if job.TargetImage == "example.com/a:latest" {
+			<-release
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, job.TargetImage)
+		return nil
+	}, WithBackfillPool(backfillPool))
+
+	// a is processed while b is waiting for the worker of the delayed lane
+	assert.NoError(t, q.Submit(context.Background(), Job{TargetImage: "example.com/a:latest"}))
+	assert.NoError(t, q.Submit(context.Background(), Job{TargetImage: "example.com/b:latest"}))
+	assert.NoError(t, q.Submit(context.Background(), Job{TargetImage: "example.com/c:latest", Lane: LaneBackfill}))
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	assert.Empty(t, processed, "backfill jobs yield to waiting delayed jobs")
+	mu.Unlock()
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		return q.Len() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, []string{"example.com/a:latest", "example.com/b:latest", "example.com/c:latest"}, processed)
+	mu.Unlock()
+
+	q.Stop(context.Background())
+}
+
+func TestQueue_DeadLetter(t *testing.T) {
+	store := NewMemoryStore()
+	pool := pond.New(1, 10)
+
+	var mu sync.Mutex
+	attempts := 0
+	fail := true
+	q := New(pool, func(ctx context.Context, job Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if fail {
+			return Permanent(errors.New("manifest unknown"))
+		}
+		return nil
+	}, WithStore(store), WithRetryPolicy(RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+
+	job := Job{TargetImage: "example.com/a:latest"}
+	assert.NoError(t, q.Submit(context.Background(), job))
+
+	assert.Eventually(t, func() bool {
+		deadLetters, _ := q.DeadLetters(context.Background())
+		return len(deadLetters) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// permanent errors are not retried
+	deadLetters, _ := q.DeadLetters(context.Background())
+	assert.Equal(t, 1, deadLetters[0].Attempts)
+	assert.Equal(t, "manifest unknown", deadLetters[0].LastError)
+
+	retried, err := q.Retry(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, retried)
+
+	assert.Eventually(t, func() bool {
+		deadLetters, _ := q.DeadLetters(context.Background())
+		return len(deadLetters) == 1 && deadLetters[0].Attempts == 1
+	}, time.Second, 10*time.Millisecond, "retried jobs start over")
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+
+	// new submissions replace the dead-lettered job
+	assert.NoError(t, q.Submit(context.Background(), job))
+
+	assert.Eventually(t, func() bool {
+		jobs, _ := store.List(context.Background())
+		return len(jobs) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, q.DeadLetterCount())
+
+	pool.StopAndWait()
+}
+
+func TestQueue_DeadLetterHandler(t *testing.T) {
+	store := NewMemoryStore()
+	_ = store.Put(context.Background(), Job{ID: "a", TargetImage: "example.com/a:latest", DeadLetter: true, Attempts: 5})
+	_ = store.Put(context.Background(), Job{ID: "b", TargetImage: "example.com/b:latest"})
+
+	pool := pond.New(1, 10)
+	q := New(pool, func(ctx context.Context, job Job) error {
+		return nil
+	}, WithStore(store))
+
+	recorder := httptest.NewRecorder()
+	q.DeadLetterHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/queue/dead-letters", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"jobs":[{"id":"a","sourceImage":"","targetImage":"example.com/a:latest","enqueuedAt":"0001-01-01T00:00:00Z","attempts":5,"nextAttemptAt":"0001-01-01T00:00:00Z","deadLetter":true}]}`, recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	q.DeadLetterHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/queue/dead-letters?id=a", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"retried":1}`, recorder.Body.String())
+
+	pool.StopAndWait()
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	for attempts, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 10 * time.Second} {
+		delay := policy.backoff(attempts)
+		assert.GreaterOrEqual(t, delay, max/2)
+		assert.LessOrEqual(t, delay, max)
+	}
+}
+
+func TestQueue_Stop(t *testing.T) {
+	store := NewMemoryStore()
+	pool := pond.New(1, 10)
+
+	started := make(chan struct{})
+	q := New(pool, func(ctx context.Context, job Job) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}, WithStore(store), WithRetryPolicy(RetryPolicy{MaxAttempts: 5}))
+
+	assert.NoError(t, q.Submit(context.Background(), Job{TargetImage: "example.com/a:latest"}))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	abandoned := q.Stop(ctx)
+	assert.Len(t, abandoned, 1)
+	assert.Equal(t, "example.com/a:latest", abandoned[0].TargetImage)
+	assert.Equal(t, 0, abandoned[0].Attempts)
+	assert.False(t, q.Persistent())
+
+	// jobs submitted after stopping are ignored
+	assert.NoError(t, q.Submit(context.Background(), Job{TargetImage: "example.com/b:latest"}))
+	jobs, _ := store.List(context.Background())
+	assert.Len(t, jobs, 1)
+}
@@ -0,0 +1,116 @@
+package queue
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy defines how often and when failed jobs are attempted again
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts before a job is moved to the dead-letter list
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// MaxTooManyRequests is the number of 429 Too Many Requests responses a job is scheduled again after
+	// without counting the attempt, every further response counts
+	MaxTooManyRequests int
+}
+
+// backoff returns the delay before the next attempt using exponential backoff with jitter
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < attempts && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	// spread retries of jobs failing at the same time, e.g. due to a registry outage
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// permanentError marks an error which will not be resolved by retrying
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent wraps an error to move the job to the dead-letter list without further attempts
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &permanentError{err: err}
+}
+
+// IsPermanent returns true if the error has been marked as permanent
+func IsPermanent(err error) bool {
+	var permanentErr *permanentError
+	return errors.As(err, &permanentErr)
+}
+
+// throttledError marks a job which has to wait for a limit of the registry before it is attempted again
+type throttledError struct {
+	err   error
+	delay time.Duration
+
+	// tooManyRequests marks a job rejected by the registry instead of waiting for a limit of its own
+	tooManyRequests bool
+}
+
+func (e *throttledError) Error() string {
+	return e.err.Error()
+}
+
+func (e *throttledError) Unwrap() error {
+	return e.err
+}
+
+// Throttled wraps an error to schedule the job again after the delay without counting the attempt
+func Throttled(err error, delay time.Duration) error {
+	if err == nil {
+		return nil
+	}
+
+	return &throttledError{err: err, delay: delay}
+}
+
+// TooManyRequests wraps an error of a registry responding with 429 Too Many Requests to schedule the job again after the delay,
+// the attempt is only counted once the job exceeded the MaxTooManyRequests of the retry policy
+func TooManyRequests(err error, delay time.Duration) error {
+	if err == nil {
+		return nil
+	}
+
+	return &throttledError{err: err, delay: delay, tooManyRequests: true}
+}
+
+// IsThrottled returns true and the delay if the error has been marked as throttled
+func IsThrottled(err error) (time.Duration, bool) {
+	var throttledErr *throttledError
+	if !errors.As(err, &throttledErr) {
+		return 0, false
+	}
+
+	return throttledErr.delay, true
+}
+
+// isTooManyRequests returns true if the error has been marked by TooManyRequests
+func isTooManyRequests(err error) bool {
+	var throttledErr *throttledError
+	return errors.As(err, &throttledErr) && throttledErr.tooManyRequests
+}
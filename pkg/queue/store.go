@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Store persists jobs until they have been processed
+type Store interface {
+	Put(ctx context.Context, job Job) error
+	Delete(ctx context.Context, id string) error
+	List(ctx context.Context) ([]Job, error)
+}
+
+// MemoryStore keeps jobs in memory, jobs are lost on restart
+type MemoryStore struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+// NewMemoryStore initialises an in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		jobs: map[string]Job{},
+	}
+}
+
+func (s *MemoryStore) Put(ctx context.Context, job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[job.ID] = job
+
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.jobs, id)
+
+	return nil
+}
+
+func (s *MemoryStore) List(ctx context.Context) ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+
+	return sortJobs(jobs), nil
+}
+
+// sortJobs orders jobs by their enqueue time, oldest first
+func sortJobs(jobs []Job) []Job {
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].EnqueuedAt.Before(jobs[j].EnqueuedAt)
+	})
+
+	return jobs
+}
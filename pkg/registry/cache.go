@@ -0,0 +1,341 @@
+package registry
+
+import (
+	"context"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// CacheEntry is a repository or image known to exist in a registry, or known to be missing
+type CacheEntry struct {
+	Key string `json:"key"`
+	// Value is the value stored by the backend, it tells apart missing images
+	Value   string    `json:"-"`
+	Missing bool      `json:"missing,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// CacheLister is implemented by clients caching the repositories and images known to exist
+type CacheLister interface {
+	// CacheEntries returns the entries which have not expired, ordered by key
+	CacheEntries(ctx context.Context) ([]CacheEntry, error)
+}
+
+// CachePurger is implemented by clients caching the repositories and images known to exist
+type CachePurger interface {
+	// PurgeCache deletes the entries with keys starting with the prefix, all entries if it is empty, and returns their number
+	PurgeCache(ctx context.Context, prefix string) (int, error)
+}
+
+// Cache stores the repositories and images known to exist in a registry, e.g. in memory or shared by all replicas
+type Cache interface {
+	Get(ctx context.Context, key string) (string, bool, error)
+	Set(ctx context.Context, key string, value string, ttl time.Duration) error
+	Del(ctx context.Context, key string) error
+	// Purge deletes the entries with keys starting with the prefix and returns their number
+	Purge(ctx context.Context, prefix string) (int, error)
+	// Entries returns the entries which have not expired, ordered by key
+	Entries(ctx context.Context) ([]CacheEntry, error)
+	Close() error
+}
+
+// CacheFactory creates the cache of the registry with the endpoint
+type CacheFactory func(endpoint string) (Cache, error)
+
+// cacheValueMissing is the value of images known to be missing, any other value is an existing repository or image
+const cacheValueMissing = "missing"
+
+// cache is the cache of a registry client counting hits and misses.
+// Failures of the backend are logged and treated as misses, the registry is asked instead.
+// Like ristretto, a nil cache is usable and never holds an entry.
+type cache struct {
+	backend Cache
+
+	ttl         time.Duration
+	jitter      time.Duration
+	negativeTTL time.Duration
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// newCache creates the cache of the registry with the endpoint, in memory unless another factory is given
+func newCache(options clientOptions, endpoint string) (*cache, error) {
+	c := &cache{
+		ttl:         options.cache.TTL,
+		jitter:      options.cache.Jitter,
+		negativeTTL: options.cache.NegativeTTL,
+	}
+	if c.ttl == 0 {
+		c.ttl = config.DefaultRegistryCacheTTL
+	}
+	if c.jitter == 0 {
+		c.jitter = config.DefaultRegistryCacheJitter
+	}
+	if c.negativeTTL == 0 {
+		c.negativeTTL = config.DefaultRegistryCacheNegativeTTL
+	}
+
+	newBackend := options.newCache
+	if newBackend == nil {
+		size := options.cache.Size
+		if size == 0 {
+			size = config.DefaultRegistryCacheSize
+		}
+		newBackend = NewMemoryCacheFactory(size)
+	}
+
+	backend, err := newBackend(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	c.backend = backend
+
+	return c, nil
+}
+
+// Lookup returns whether the repository or image exists, found is false if the registry needs to be asked
+func (c *cache) Lookup(ctx context.Context, key string) (exists bool, found bool) {
+	if c == nil {
+		return false, false
+	}
+
+	value, found, err := c.backend.Get(ctx, key)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("key", key).Msg("failed reading from cache")
+	}
+	if found {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+
+	return found && value != cacheValueMissing, found
+}
+
+// SetExists remembers the repository or image exists, replacing an entry of a missing image.
+// The expiry is spread by the jitter, so entries cached at once are not checked again at once.
+func (c *cache) SetExists(ctx context.Context, key string) {
+	if c == nil {
+		return
+	}
+
+	c.set(ctx, key, "", c.ttl+time.Duration(rand.Int63n(int64(c.jitter)+1)))
+}
+
+// SetMissing remembers the image is missing until it is copied or the negative TTL passes
+func (c *cache) SetMissing(ctx context.Context, key string) {
+	if c == nil {
+		return
+	}
+
+	c.set(ctx, key, cacheValueMissing, c.negativeTTL)
+}
+
+func (c *cache) set(ctx context.Context, key string, value string, ttl time.Duration) {
+	if err := c.backend.Set(ctx, key, value, ttl); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("key", key).Msg("failed writing to cache")
+	}
+}
+
+func (c *cache) Del(ctx context.Context, key string) {
+	if c == nil {
+		return
+	}
+
+	if err := c.backend.Del(ctx, key); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("key", key).Msg("failed deleting from cache")
+	}
+}
+
+func (c *cache) Purge(ctx context.Context, prefix string) (int, error) {
+	if c == nil {
+		return 0, nil
+	}
+
+	return c.backend.Purge(ctx, prefix)
+}
+
+func (c *cache) Entries(ctx context.Context) ([]CacheEntry, error) {
+	if c == nil {
+		return []CacheEntry{}, nil
+	}
+
+	entries, err := c.backend.Entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Missing = entries[i].Value == cacheValueMissing
+	}
+
+	return entries, nil
+}
+
+func (c *cache) Close() {
+	if c == nil {
+		return
+	}
+
+	if err := c.backend.Close(); err != nil {
+		log.Warn().Err(err).Msg("failed closing cache")
+	}
+}
+
+// Hits returns the number of lookups finding an entry
+func (c *cache) Hits() uint64 {
+	return c.hits.Load()
+}
+
+// Misses returns the number of lookups not finding an entry
+func (c *cache) Misses() uint64 {
+	return c.misses.Load()
+}
+
+// memoryCache keeps the entries in memory of the replica, they are lost on restart.
+// Ristretto does not list its keys, so they are tracked alongside and dropped when ristretto evicts or rejects them.
+type memoryCache struct {
+	*ristretto.Cache
+
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+type memoryEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+// NewMemoryCacheFactory returns a factory of caches in memory holding up to size entries each
+func NewMemoryCacheFactory(size int) CacheFactory {
+	return func(endpoint string) (Cache, error) {
+		c := &memoryCache{entries: map[string]*memoryEntry{}}
+
+		var err error
+		c.Cache, err = ristretto.NewCache(&ristretto.Config{
+			NumCounters:        10 * int64(size), // number of keys to track frequency of, 10x the entries as recommended.
+			MaxCost:            int64(size),      // maximum number of entries, each costs 1.
+			BufferItems:        64,               // number of keys per Get buffer.
+			IgnoreInternalCost: true,
+			OnEvict:            c.forget,
+			OnReject:           c.forget,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	}
+}
+
+// forget stops tracking an entry ristretto dropped, unless it was replaced meanwhile
+func (c *memoryCache) forget(item *ristretto.Item) {
+	entry, ok := item.Value.(*memoryEntry)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[entry.key] == entry {
+		delete(c.entries, entry.key)
+	}
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string) (string, bool, error) {
+	value, found := c.Cache.Get(key)
+	if !found {
+		return "", false, nil
+	}
+
+	entry, ok := value.(*memoryEntry)
+	if !ok {
+		return "", false, nil
+	}
+
+	return entry.value, true, nil
+}
+
+func (c *memoryCache) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	entry := &memoryEntry{key: key, value: value, expires: time.Now().Add(ttl)}
+
+	c.mu.Lock()
+	c.entries[key] = entry
+	c.mu.Unlock()
+
+	c.Cache.SetWithTTL(key, entry, 1, ttl)
+
+	return nil
+}
+
+func (c *memoryCache) Del(ctx context.Context, key string) error {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+
+	c.Cache.Del(key)
+
+	return nil
+}
+
+func (c *memoryCache) Purge(ctx context.Context, prefix string) (int, error) {
+	c.mu.Lock()
+	now := time.Now()
+	keys := []string{}
+	purged := 0
+	for key, entry := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+			delete(c.entries, key)
+			if entry.expires.After(now) {
+				purged++
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	for _, key := range keys {
+		c.Cache.Del(key)
+	}
+
+	return purged, nil
+}
+
+func (c *memoryCache) Entries(ctx context.Context) ([]CacheEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	entries := []CacheEntry{}
+	for key, entry := range c.entries {
+		if !entry.expires.After(now) {
+			delete(c.entries, key)
+			continue
+		}
+		entries = append(entries, CacheEntry{Key: key, Value: entry.value, Expires: entry.expires})
+	}
+	sortEntries(entries)
+
+	return entries, nil
+}
+
+func (c *memoryCache) Close() error {
+	c.Cache.Close()
+
+	return nil
+}
+
+func sortEntries(entries []CacheEntry) {
+	slices.SortFunc(entries, func(a, b CacheEntry) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+}
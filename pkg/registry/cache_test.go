@@ -0,0 +1,155 @@
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCache(t *testing.T) {
+	ctx := context.Background()
+	c, err := NewMemoryCacheFactory(100)("target.example.com")
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Set(ctx, "docker.io/library/nginx", "", time.Hour))
+	require.NoError(t, c.Set(ctx, "docker.io/library/busybox", "", time.Hour))
+	require.NoError(t, c.Set(ctx, "docker.io/library/redis", "", time.Hour))
+	require.NoError(t, c.Set(ctx, "docker.io/library/alpine", "", -time.Second))
+	require.NoError(t, c.Set(ctx, "quay.io/prometheus/prometheus", "missing", time.Minute))
+	require.NoError(t, c.Del(ctx, "docker.io/library/redis"))
+
+	entries, err := c.Entries(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 3, "deleted and expired keys are not listed")
+	assert.Equal(t, "docker.io/library/busybox", entries[0].Key)
+	assert.Equal(t, "docker.io/library/nginx", entries[1].Key)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), entries[1].Expires, time.Minute)
+	assert.Equal(t, "missing", entries[2].Value)
+
+	purged, err := c.Purge(ctx, "docker.io/")
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged)
+	entries, err = c.Entries(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "quay.io/prometheus/prometheus", entries[0].Key)
+}
+
+func TestRedisCache(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	newCache := NewRedisCacheFactory(client, "k8s-image-swapper/")
+	target, err := newCache("target.example.com")
+	require.NoError(t, err)
+	source, err := newCache("source.example.com")
+	require.NoError(t, err)
+
+	require.NoError(t, target.Set(ctx, "docker.io/library/nginx:stable", "", time.Hour))
+	require.NoError(t, target.Set(ctx, "docker.io/library/busybox", "", time.Hour))
+	require.NoError(t, target.Set(ctx, "docker.io/library/redis", "", time.Hour))
+	require.NoError(t, target.Del(ctx, "docker.io/library/redis"))
+	require.NoError(t, source.Set(ctx, "library/nginx", "", time.Hour))
+
+	assert.True(t, server.Exists("k8s-image-swapper/target.example.com/docker.io/library/nginx:stable"))
+
+	_, found, err := target.Get(ctx, "docker.io/library/nginx:stable")
+	require.NoError(t, err)
+	assert.True(t, found)
+	_, found, err = target.Get(ctx, "library/nginx")
+	require.NoError(t, err)
+	assert.False(t, found, "registries do not share entries")
+
+	entries, err := target.Entries(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "docker.io/library/busybox", entries[0].Key)
+	assert.Equal(t, "docker.io/library/nginx:stable", entries[1].Key)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), entries[1].Expires, time.Minute)
+
+	purged, err := target.Purge(ctx, "docker.io/library/busy")
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.True(t, server.Exists("k8s-image-swapper/source.example.com/library/nginx"), "registries are purged separately")
+
+	server.FastForward(2 * time.Hour)
+	_, found, err = target.Get(ctx, "docker.io/library/nginx:stable")
+	require.NoError(t, err)
+	assert.False(t, found, "entries expire")
+}
+
+func TestCache_Stats(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+	defer client.Close()
+
+	c, err := newCache(clientOptions{newCache: NewRedisCacheFactory(client, "")}, "target.example.com")
+	require.NoError(t, err)
+
+	c.SetExists(ctx, "docker.io/library/nginx")
+	exists, found := c.Lookup(ctx, "docker.io/library/nginx")
+	assert.True(t, exists)
+	assert.True(t, found)
+	_, found = c.Lookup(ctx, "docker.io/library/busybox")
+	assert.False(t, found)
+
+	// failures are treated as misses
+	server.Close()
+	_, found = c.Lookup(ctx, "docker.io/library/nginx")
+	assert.False(t, found)
+
+	assert.Equal(t, uint64(1), c.Hits())
+	assert.Equal(t, uint64(2), c.Misses())
+
+	var nilCache *cache
+	_, found = nilCache.Lookup(ctx, "docker.io/library/nginx")
+	assert.False(t, found)
+}
+
+func TestCache_Missing(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	c, err := newCache(clientOptions{
+		newCache: NewRedisCacheFactory(client, ""),
+		cache:    config.RegistryCache{TTL: time.Hour, Jitter: time.Minute, NegativeTTL: 30 * time.Second},
+	}, "target.example.com")
+	require.NoError(t, err)
+
+	c.SetMissing(ctx, "docker.io/library/nginx:stable")
+	exists, found := c.Lookup(ctx, "docker.io/library/nginx:stable")
+	assert.False(t, exists)
+	assert.True(t, found, "missing images are not inspected again")
+
+	entries, err := c.Entries(ctx)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.True(t, entries[0].Missing)
+	assert.WithinDuration(t, time.Now().Add(30*time.Second), entries[0].Expires, time.Second)
+
+	// a completed copy replaces the negative entry
+	c.SetExists(ctx, "docker.io/library/nginx:stable")
+	exists, found = c.Lookup(ctx, "docker.io/library/nginx:stable")
+	assert.True(t, exists)
+	assert.True(t, found)
+	ttl := server.TTL("target.example.com/docker.io/library/nginx:stable")
+	assert.GreaterOrEqual(t, ttl, time.Hour)
+	assert.LessOrEqual(t, ttl, time.Hour+time.Minute)
+
+	c.SetMissing(ctx, "docker.io/library/busybox:1.36")
+	server.FastForward(time.Minute)
+	_, found = c.Lookup(ctx, "docker.io/library/busybox:1.36")
+	assert.False(t, found, "negative entries expire after their TTL")
+}
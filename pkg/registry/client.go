@@ -2,9 +2,20 @@ package registry
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/estahn/k8s-image-swapper/pkg/config"
 	"github.com/estahn/k8s-image-swapper/pkg/types"
@@ -21,12 +32,232 @@ type Client interface {
 	PutImage() error
 	ImageExists(ctx context.Context, ref ctypes.ImageReference) bool
 
+	// ListImages returns the images stored in the mirrored repositories of the registry, see IsMirroredRepository.
+	// The images per platform of a multi-arch image are listed as its children only.
+	ListImages(ctx context.Context) ([]Image, error)
+	// DeleteImage deletes an image with all its tags
+	DeleteImage(ctx context.Context, image Image) error
+	// DeleteRepository deletes a repository, it must not contain images anymore
+	DeleteRepository(ctx context.Context, name string) error
+
 	// Endpoint returns the domain of the registry
 	Endpoint() string
 	Credentials() string
 
 	// IsOrigin returns true if the imageRef originates from this registry
 	IsOrigin(imageRef ctypes.ImageReference) bool
+
+	// Close stops background work, e.g. the token renewal
+	Close()
+}
+
+// Image is an image stored in a registry, identified by its repository and digest
+type Image struct {
+	// Repository is the name of the repository within the registry, e.g. docker.io/library/nginx
+	Repository string    `json:"repository"`
+	Digest     string    `json:"digest"`
+	Tags       []string  `json:"tags,omitempty"`
+	PushedAt   time.Time `json:"pushedAt"`
+	// Children are the digests of the images per platform of a multi-arch image, they are deleted along with it
+	Children []string `json:"children,omitempty"`
+}
+
+// References returns the references of the image in the registry, by digest and by each tag
+func (i Image) References(endpoint string) []string {
+	references := []string{fmt.Sprintf("%s/%s@%s", endpoint, i.Repository, i.Digest)}
+	for _, tag := range i.Tags {
+		references = append(references, fmt.Sprintf("%s/%s:%s", endpoint, i.Repository, tag))
+	}
+
+	return references
+}
+
+// IsMirroredRepository returns true if the repository is named after an image of a source registry, e.g. docker.io/library/nginx.
+// Copies create repositories named after the normalized source image, which always starts with the domain of its registry,
+// repositories of images pushed by others, e.g. team/app, are never listed nor deleted.
+func IsMirroredRepository(name string) bool {
+	domain, _, found := strings.Cut(name, "/")
+
+	return found && (strings.ContainsAny(domain, ".:") || domain == "localhost")
+}
+
+// withoutChildren drops the images which are children of a multi-arch image of the same repository
+func withoutChildren(images []Image) []Image {
+	isChild := map[string]bool{}
+	for _, image := range images {
+		for _, child := range image.Children {
+			isChild[image.Repository+"@"+child] = true
+		}
+	}
+
+	parents := []Image{}
+	for _, image := range images {
+		if !isChild[image.Repository+"@"+image.Digest] {
+			parents = append(parents, image)
+		}
+	}
+
+	return parents
+}
+
+// manifestListMediaTypes are the media types of multi-arch images referencing an image per platform
+var manifestListMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// isManifestList returns true if the media type is the one of a multi-arch image
+func isManifestList(mediaType string) bool {
+	return slices.Contains(manifestListMediaTypes, mediaType)
+}
+
+// TokenRenewer is implemented by clients authenticating with short-lived tokens renewed in background
+type TokenRenewer interface {
+	// TokenStatus returns the expiry of the current token and the error of the last renewal, if it failed
+	TokenStatus() (time.Time, error)
+}
+
+// tokenRenewalRetryInterval is the wait before a failed token renewal is retried
+const tokenRenewalRetryInterval = time.Minute
+
+// tokenStatus tracks the renewal of a short-lived token
+type tokenStatus struct {
+	tokenMu         sync.RWMutex
+	tokenExpiry     time.Time
+	tokenRenewalErr error
+}
+
+func (s *tokenStatus) tokenRenewed(expiry time.Time) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	s.tokenExpiry = expiry
+	s.tokenRenewalErr = nil
+}
+
+func (s *tokenStatus) tokenRenewalFailed(err error) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	s.tokenRenewalErr = err
+}
+
+func (s *tokenStatus) TokenStatus() (time.Time, error) {
+	s.tokenMu.RLock()
+	defer s.tokenMu.RUnlock()
+
+	return s.tokenExpiry, s.tokenRenewalErr
+}
+
+// commandEnvKey holds the environment variables added to the commands run with the context
+type commandEnvKey struct{}
+
+// WithEnv returns a context adding the environment variables, e.g. a proxy, to the copy commands run with it
+func WithEnv(ctx context.Context, env ...string) context.Context {
+	return context.WithValue(ctx, commandEnvKey{}, env)
+}
+
+// commandEnv returns the environment of a command run with the context, nil inherits the environment of the process
+func commandEnv(ctx context.Context) []string {
+	env, _ := ctx.Value(commandEnvKey{}).([]string)
+	if len(env) == 0 {
+		return nil
+	}
+
+	return append(os.Environ(), env...)
+}
+
+// CommandError is returned when an external command, e.g. skopeo, fails
+type CommandError struct {
+	Err    error
+	Output string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("Command error, stderr: %s, stdout: %s", e.Err.Error(), e.Output)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// permanentErrorMessages are reported by registries for requests which will not succeed when repeated.
+// Denied access is not permanent, pull secrets and tokens may be added or renewed, and registries
+// commonly answer requests lacking credentials with "not found".
+var permanentErrorMessages = []string{
+	"manifest unknown",
+	"name unknown",
+	"invalid reference format",
+	"repository name must",
+}
+
+// IsPermanentError returns true if an operation failed for a reason retrying will not resolve,
+// e.g. the source image does not exist. Denied access, rate limits, timeouts and server errors are transient.
+func IsPermanentError(err error) bool {
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+
+	output := strings.ToLower(cmdErr.Output)
+	for _, message := range permanentErrorMessages {
+		if strings.Contains(output, message) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tooManyRequestsMessages are reported by registries rate limiting the requests, e.g. the pull limit of Docker Hub
+var tooManyRequestsMessages = []string{
+	"toomanyrequests",
+	"too many requests",
+}
+
+// IsTooManyRequests returns true if an operation failed because the registry responded with 429 Too Many Requests.
+// Skopeo retries such responses honouring Retry-After already, the error is returned once it gave up.
+func IsTooManyRequests(err error) bool {
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+
+	output := strings.ToLower(cmdErr.Output)
+	for _, message := range tooManyRequestsMessages {
+		if strings.Contains(output, message) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryAfterPattern matches the Retry-After header quoted in the output, in seconds or as an HTTP date
+var retryAfterPattern = regexp.MustCompile(`(?i)retry-after"?\s*[:=]\s*"?([^"\n\]]+)`)
+
+// RetryAfter returns the wait requested by the Retry-After header of a 429 Too Many Requests response,
+// false if the output of skopeo does not contain it
+func RetryAfter(err error) (time.Duration, bool) {
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		return 0, false
+	}
+
+	match := retryAfterPattern.FindStringSubmatch(cmdErr.Output)
+	if match == nil {
+		return 0, false
+	}
+
+	value := strings.TrimSpace(match[1])
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
+	}
+
+	return 0, false
 }
 
 type DockerConfig struct {
@@ -34,11 +265,44 @@ type DockerConfig struct {
 }
 
 type AuthConfig struct {
-	Auth string `json:"auth,omitempty"`
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// clientOptions are the settings shared by all registry client implementations
+type clientOptions struct {
+	newCache CacheFactory
+	cache    config.RegistryCache
+}
+
+// ClientOption configures a registry client
+type ClientOption func(*clientOptions)
+
+// WithCache keeps the repositories and images known to exist in the caches created by the factory instead of memory
+func WithCache(newCache CacheFactory) ClientOption {
+	return func(o *clientOptions) {
+		o.newCache = newCache
+	}
+}
+
+// WithCacheConfig sets the TTLs of the cache and its size in memory, unset fields use the defaults
+func WithCacheConfig(cache config.RegistryCache) ClientOption {
+	return func(o *clientOptions) {
+		o.cache = cache
+	}
+}
+
+func newClientOptions(opts []ClientOption) clientOptions {
+	options := clientOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
 }
 
 // NewClient returns a registry client ready for use without the need to specify an implementation
-func NewClient(r config.Registry) (Client, error) {
+func NewClient(r config.Registry, opts ...ClientOption) (Client, error) {
 	if err := config.CheckRegistryConfiguration(r); err != nil {
 		return nil, err
 	}
@@ -48,16 +312,65 @@ func NewClient(r config.Registry) (Client, error) {
 		return nil, err
 	}
 
+	// options given by the caller take precedence over the configuration of the registry
+	opts = append([]ClientOption{WithCacheConfig(r.Cache)}, opts...)
+
 	switch registry {
 	case types.RegistryAWS:
-		return NewECRClient(r.AWS)
+		return NewECRClient(r.AWS, opts...)
 	case types.RegistryGCP:
-		return NewGARClient(r.GCP)
+		return NewGARClient(r.GCP, opts...)
 	default:
 		return nil, fmt.Errorf(`registry of type "%s" is not supported`, r.Type)
 	}
 }
 
+// ImageDigest returns the digest of the manifest an image reference resolves to in a registry.
+// Multi-arch images resolve to their manifest list, which is copied unchanged, so source and target digests are comparable.
+// Credentials are read from the auth file if given, otherwise from creds.
+func ImageDigest(ctx context.Context, imageRef ctypes.ImageReference, authFile string, creds string) (string, error) {
+	app := "skopeo"
+	args := []string{
+		"inspect",
+		"--raw",
+		"--retry-times", "3",
+		"docker://" + imageRef.DockerReference().String(),
+	}
+
+	switch {
+	case len(authFile) > 0:
+		args = append(args, "--authfile", authFile)
+	case len(creds) > 0:
+		args = append(args, "--creds", creds)
+	default:
+		args = append(args, "--no-creds")
+	}
+
+	output, err := exec.CommandContext(ctx, app, args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", &CommandError{Err: err, Output: string(exitErr.Stderr)}
+		}
+		return "", &CommandError{Err: err, Output: string(output)}
+	}
+
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(output)), nil
+}
+
+// sourceCredentialArgs returns the skopeo arguments authenticating at the source registry of a copy.
+// Images originating from the registry of the client are copied with its own credentials, others with the auth file.
+func sourceCredentialArgs(c Client, srcRef ctypes.ImageReference, srcAuthFile string) []string {
+	if c.IsOrigin(srcRef) {
+		return []string{"--src-creds", c.Credentials()}
+	}
+	if len(srcAuthFile) > 0 {
+		return []string{"--src-authfile", srcAuthFile}
+	}
+
+	return []string{"--src-no-creds"}
+}
+
 func GenerateDockerConfig(c Client) ([]byte, error) {
 	dockerConfig := DockerConfig{
 		AuthConfigs: map[string]AuthConfig{
@@ -0,0 +1,138 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPermanentError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "manifest unknown",
+			err:  &CommandError{Err: errors.New("exit status 1"), Output: "reading manifest 1.0 in docker.io/library/nginx: manifest unknown"},
+			want: true,
+		},
+		{
+			name: "access denied",
+			err:  &CommandError{Err: errors.New("exit status 1"), Output: "requested access to the resource is denied"},
+			want: false,
+		},
+		{
+			name: "unauthorized",
+			err:  &CommandError{Err: errors.New("exit status 1"), Output: "reading manifest latest in ghcr.io/org/private: unauthorized: authentication required"},
+			want: false,
+		},
+		{
+			name: "rate limited",
+			err:  &CommandError{Err: errors.New("exit status 1"), Output: "toomanyrequests: You have reached your pull rate limit"},
+			want: false,
+		},
+		{
+			name: "server error",
+			err:  &CommandError{Err: errors.New("exit status 1"), Output: "received unexpected HTTP status: 503 Service Unavailable"},
+			want: false,
+		},
+		{
+			name: "wrapped",
+			err:  fmt.Errorf("copy failed: %w", &CommandError{Err: errors.New("exit status 1"), Output: "name unknown"}),
+			want: true,
+		},
+		{
+			name: "timeout",
+			err:  context.DeadlineExceeded,
+			want: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, IsPermanentError(test.err))
+		})
+	}
+}
+
+func TestIsTooManyRequests(t *testing.T) {
+	assert.True(t, IsTooManyRequests(&CommandError{Err: errors.New("exit status 1"), Output: "toomanyrequests: You have reached your pull rate limit"}))
+	assert.True(t, IsTooManyRequests(fmt.Errorf("copy failed: %w", &CommandError{Err: errors.New("exit status 1"), Output: "received unexpected HTTP status: 429 Too Many Requests"})))
+	assert.False(t, IsTooManyRequests(&CommandError{Err: errors.New("exit status 1"), Output: "manifest unknown"}))
+	assert.False(t, IsTooManyRequests(errors.New("toomanyrequests")), "only errors of skopeo are detected")
+}
+
+func TestRetryAfter(t *testing.T) {
+	retryAfter, ok := RetryAfter(&CommandError{Err: errors.New("exit status 1"), Output: "toomanyrequests: rate limit exceeded, Retry-After: 120"})
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, retryAfter)
+
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	retryAfter, ok = RetryAfter(&CommandError{Err: errors.New("exit status 1"), Output: `429 Too Many Requests {"Retry-After": "` + date + `"}`})
+	assert.True(t, ok)
+	assert.InDelta(t, time.Hour, retryAfter, float64(2*time.Second))
+
+	_, ok = RetryAfter(&CommandError{Err: errors.New("exit status 1"), Output: "toomanyrequests: You have reached your pull rate limit"})
+	assert.False(t, ok, "the backoff applies without Retry-After")
+	_, ok = RetryAfter(&CommandError{Err: errors.New("exit status 1"), Output: "Retry-After: soon"})
+	assert.False(t, ok)
+}
+
+func TestTokenStatus(t *testing.T) {
+	var client TokenRenewer = &ECRClient{}
+
+	expiry, err := client.TokenStatus()
+	assert.True(t, expiry.IsZero())
+	assert.NoError(t, err)
+
+	ecrClient := client.(*ECRClient)
+	renewedAt := time.Now().Add(12 * time.Hour)
+	ecrClient.tokenRenewed(renewedAt)
+	ecrClient.tokenRenewalFailed(errors.New("throttled"))
+
+	// the expiry of the current token is kept while renewals fail
+	expiry, err = client.TokenStatus()
+	assert.Equal(t, renewedAt, expiry)
+	assert.EqualError(t, err, "throttled")
+
+	ecrClient.tokenRenewed(renewedAt.Add(time.Hour))
+	expiry, err = client.TokenStatus()
+	assert.Equal(t, renewedAt.Add(time.Hour), expiry)
+	assert.NoError(t, err)
+
+	var _ TokenRenewer = &GARClient{}
+}
+
+func TestCommandEnv(t *testing.T) {
+	assert.Nil(t, commandEnv(context.Background()))
+	assert.Nil(t, commandEnv(WithEnv(context.Background())))
+
+	env := commandEnv(WithEnv(context.Background(), "HTTPS_PROXY=http://127.0.0.1:8080"))
+	assert.Equal(t, "HTTPS_PROXY=http://127.0.0.1:8080", env[len(env)-1])
+	assert.Greater(t, len(env), 1, "inherits the environment of the process")
+}
+
+func TestIsMirroredRepository(t *testing.T) {
+	assert.True(t, IsMirroredRepository("docker.io/library/nginx"))
+	assert.True(t, IsMirroredRepository("registry.example.com:5000/app"))
+	assert.True(t, IsMirroredRepository("localhost/app"))
+	assert.False(t, IsMirroredRepository("team/app"))
+	assert.False(t, IsMirroredRepository("nginx"))
+}
+
+func TestWithoutChildren(t *testing.T) {
+	images := []Image{
+		{Repository: "docker.io/library/nginx", Digest: "sha256:list", Children: []string{"sha256:amd64"}},
+		{Repository: "docker.io/library/nginx", Digest: "sha256:amd64"},
+		// the same image in another repository is not a child
+		{Repository: "docker.io/library/busybox", Digest: "sha256:amd64"},
+	}
+
+	assert.Equal(t, []Image{images[0], images[2]}, withoutChildren(images))
+}
@@ -0,0 +1,93 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/types"
+
+	ctypes "github.com/containers/image/v5/types"
+)
+
+// DryRunClient names images like the configured registry without connecting to it, e.g. to explain admissions.
+// Repositories and images are never created, images exist as configured.
+type DryRunClient struct {
+	// registry is a client of the configured type which is never connected, it only provides the naming
+	registry    Client
+	imageExists bool
+}
+
+// NewDryRunClient returns a client of the registry without side effects, imageExists is the answer to ImageExists
+func NewDryRunClient(r config.Registry, imageExists bool) (*DryRunClient, error) {
+	if err := config.CheckRegistryConfiguration(r); err != nil {
+		return nil, err
+	}
+
+	registry, err := types.ParseRegistry(r.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &DryRunClient{imageExists: imageExists}
+	switch registry {
+	case types.RegistryAWS:
+		client.registry = &ECRClient{ecrDomain: r.AWS.EcrDomain()}
+	case types.RegistryGCP:
+		client.registry = &GARClient{garDomain: r.GCP.GarDomain()}
+	default:
+		return nil, fmt.Errorf(`registry of type "%s" is not supported`, r.Type)
+	}
+
+	return client, nil
+}
+
+func (c *DryRunClient) CreateRepository(ctx context.Context, name string) error {
+	return nil
+}
+
+func (c *DryRunClient) RepositoryExists() bool {
+	return c.imageExists
+}
+
+func (c *DryRunClient) CopyImage(ctx context.Context, src ctypes.ImageReference, srcCreds string, dest ctypes.ImageReference, destCreds string) error {
+	return nil
+}
+
+func (c *DryRunClient) PullImage() error {
+	return nil
+}
+
+func (c *DryRunClient) PutImage() error {
+	return nil
+}
+
+func (c *DryRunClient) ImageExists(ctx context.Context, ref ctypes.ImageReference) bool {
+	return c.imageExists
+}
+
+func (c *DryRunClient) ListImages(ctx context.Context) ([]Image, error) {
+	return []Image{}, nil
+}
+
+func (c *DryRunClient) DeleteImage(ctx context.Context, image Image) error {
+	return nil
+}
+
+func (c *DryRunClient) DeleteRepository(ctx context.Context, name string) error {
+	return nil
+}
+
+func (c *DryRunClient) Endpoint() string {
+	return c.registry.Endpoint()
+}
+
+func (c *DryRunClient) Credentials() string {
+	return ""
+}
+
+func (c *DryRunClient) IsOrigin(imageRef ctypes.ImageReference) bool {
+	return c.registry.IsOrigin(imageRef)
+}
+
+func (c *DryRunClient) Close() {}
@@ -0,0 +1,32 @@
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRunClient(t *testing.T) {
+	client, err := NewDryRunClient(config.Registry{Type: "aws", AWS: config.AWS{AccountID: "123456789", Region: "ap-southeast-2"}}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "123456789.dkr.ecr.ap-southeast-2.amazonaws.com", client.Endpoint())
+
+	targetRef, _ := alltransports.ParseImageName("docker://123456789.dkr.ecr.ap-southeast-2.amazonaws.com/docker.io/library/nginx:latest")
+	sourceRef, _ := alltransports.ParseImageName("docker://nginx:latest")
+	assert.True(t, client.IsOrigin(targetRef))
+	assert.False(t, client.IsOrigin(sourceRef))
+	assert.False(t, client.ImageExists(context.Background(), targetRef))
+	assert.NoError(t, client.CreateRepository(context.Background(), "docker.io/library/nginx"))
+	assert.NoError(t, client.CopyImage(context.Background(), sourceRef, "", targetRef, ""))
+
+	client, err = NewDryRunClient(config.Registry{Type: "gcp", GCP: config.GCP{Location: "us-central1", ProjectID: "gcp-project-123", RepositoryID: "main"}}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "us-central1-docker.pkg.dev/gcp-project-123/main", client.Endpoint())
+	assert.True(t, client.ImageExists(context.Background(), sourceRef))
+
+	_, err = NewDryRunClient(config.Registry{Type: "aws"}, false)
+	assert.Error(t, err)
+}
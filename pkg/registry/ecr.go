@@ -3,10 +3,12 @@ package registry
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"os/exec"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/containers/image/v5/docker/reference"
@@ -18,23 +20,29 @@ import (
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
 	ctypes "github.com/containers/image/v5/types"
-	"github.com/dgraph-io/ristretto"
 	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/metrics"
+	"github.com/estahn/k8s-image-swapper/pkg/tracing"
 	"github.com/go-co-op/gocron"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ECRClient struct {
 	client        ecriface.ECRAPI
 	ecrDomain     string
 	authToken     []byte
-	cache         *ristretto.Cache
+	cache         *cache
 	scheduler     *gocron.Scheduler
 	targetAccount string
 	options       config.ECROptions
+
+	tokenStatus
 }
 
-func NewECRClient(clientConfig config.AWS) (*ECRClient, error) {
+func NewECRClient(clientConfig config.AWS, opts ...ClientOption) (*ECRClient, error) {
+	options := newClientOptions(opts)
 	ecrDomain := clientConfig.EcrDomain()
 
 	var sess *session.Session
@@ -65,13 +73,9 @@ func NewECRClient(clientConfig config.AWS) (*ECRClient, error) {
 	}))
 	ecrClient := ecr.New(sess, cfg)
 
-	cache, err := ristretto.NewCache(&ristretto.Config{
-		NumCounters: 1e7,     // number of keys to track frequency of (10M).
-		MaxCost:     1 << 30, // maximum cost of cache (1GB).
-		BufferItems: 64,      // number of keys per Get buffer.
-	})
+	cache, err := newCache(options, ecrDomain)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	scheduler := gocron.NewScheduler(time.UTC)
@@ -90,6 +94,8 @@ func NewECRClient(clientConfig config.AWS) (*ECRClient, error) {
 		return nil, err
 	}
 
+	metrics.Caches.Add(client.Endpoint(), cache)
+
 	return client, nil
 }
 
@@ -97,8 +103,12 @@ func (e *ECRClient) Credentials() string {
 	return string(e.authToken)
 }
 
-func (e *ECRClient) CreateRepository(ctx context.Context, name string) error {
-	if _, found := e.cache.Get(name); found {
+func (e *ECRClient) CreateRepository(ctx context.Context, name string) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ECRClient.CreateRepository", trace.WithAttributes(attribute.String("repository", name)))
+	defer func() { tracing.End(span, err) }()
+
+	if exists, _ := e.cache.Lookup(ctx, name); exists {
+		span.SetAttributes(attribute.Bool("cache.hit", true))
 		return nil
 	}
 
@@ -112,7 +122,7 @@ func (e *ECRClient) CreateRepository(ctx context.Context, name string) error {
 		encryptionConfiguration.KmsKey = aws.String(e.options.EncryptionConfiguration.KmsKey)
 	}
 
-	_, err := e.client.CreateRepositoryWithContext(ctx, &ecr.CreateRepositoryInput{
+	_, err = e.client.CreateRepositoryWithContext(ctx, &ecr.CreateRepositoryInput{
 		RepositoryName:          aws.String(name),
 		EncryptionConfiguration: encryptionConfiguration,
 		ImageScanningConfiguration: &ecr.ImageScanningConfiguration{
@@ -166,7 +176,7 @@ func (e *ECRClient) CreateRepository(ctx context.Context, name string) error {
 		}
 	}
 
-	e.cache.SetWithTTL(name, "", 1, time.Duration(24*time.Hour))
+	e.cache.SetExists(ctx, name)
 
 	return nil
 }
@@ -186,9 +196,15 @@ func (e *ECRClient) RepositoryExists() bool {
 	panic("implement me")
 }
 
-func (e *ECRClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference, srcCreds string, destRef ctypes.ImageReference, destCreds string) error {
+func (e *ECRClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference, srcCreds string, destRef ctypes.ImageReference, destCreds string) (err error) {
 	src := srcRef.DockerReference().String()
 	dest := destRef.DockerReference().String()
+
+	ctx, span := tracing.Tracer().Start(ctx, "ECRClient.CopyImage", trace.WithAttributes(
+		attribute.String("source.image", src),
+		attribute.String("target.image", dest),
+	))
+	defer func() { tracing.End(span, err) }()
 	app := "skopeo"
 	args := []string{
 		"--override-os", "linux",
@@ -199,11 +215,7 @@ func (e *ECRClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference,
 		"docker://" + dest,
 	}
 
-	if len(srcCreds) > 0 {
-		args = append(args, "--src-authfile", srcCreds)
-	} else {
-		args = append(args, "--src-no-creds")
-	}
+	args = append(args, sourceCredentialArgs(e, srcRef, srcCreds)...)
 
 	if len(destCreds) > 0 {
 		args = append(args, "--dest-creds", destCreds)
@@ -217,7 +229,9 @@ func (e *ECRClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference,
 		Strs("args", args).
 		Msg("execute command to copy image")
 
-	output, cmdErr := exec.CommandContext(ctx, app, args...).CombinedOutput()
+	cmd := exec.CommandContext(ctx, app, args...)
+	cmd.Env = commandEnv(ctx)
+	output, cmdErr := cmd.CombinedOutput()
 
 	// check if the command timed out during execution for proper logging
 	if err := ctx.Err(); err != nil {
@@ -226,9 +240,12 @@ func (e *ECRClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference,
 
 	// enrich error with output from the command which may contain the actual reason
 	if cmdErr != nil {
-		return fmt.Errorf("Command error, stderr: %s, stdout: %s", cmdErr.Error(), string(output))
+		return &CommandError{Err: cmdErr, Output: string(output)}
 	}
 
+	// replaces the entry of the image known to be missing
+	e.cache.SetExists(ctx, dest)
+
 	return nil
 }
 
@@ -240,11 +257,19 @@ func (e *ECRClient) PutImage() error {
 	panic("implement me")
 }
 
-func (e *ECRClient) ImageExists(ctx context.Context, imageRef ctypes.ImageReference) bool {
+func (e *ECRClient) ImageExists(ctx context.Context, imageRef ctypes.ImageReference) (exists bool) {
 	ref := imageRef.DockerReference().String()
-	if _, found := e.cache.Get(ref); found {
-		log.Ctx(ctx).Trace().Str("ref", ref).Msg("found in cache")
-		return true
+
+	ctx, span := tracing.Tracer().Start(ctx, "ECRClient.ImageExists", trace.WithAttributes(attribute.String("image", ref)))
+	defer func() {
+		span.SetAttributes(attribute.Bool("image.exists", exists))
+		span.End()
+	}()
+
+	if exists, found := e.cache.Lookup(ctx, ref); found {
+		log.Ctx(ctx).Trace().Str("ref", ref).Bool("exists", exists).Msg("found in cache")
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		return exists
 	}
 
 	app := "skopeo"
@@ -258,16 +283,252 @@ func (e *ECRClient) ImageExists(ctx context.Context, imageRef ctypes.ImageRefere
 	log.Ctx(ctx).Trace().Str("app", app).Strs("args", args).Msg("executing command to inspect image")
 	if err := exec.CommandContext(ctx, app, args...).Run(); err != nil {
 		log.Ctx(ctx).Trace().Str("ref", ref).Msg("not found in target repository")
+		// a failure caused by the deadline says nothing about the image
+		if ctx.Err() == nil {
+			e.cache.SetMissing(ctx, ref)
+		}
 		return false
 	}
 
 	log.Ctx(ctx).Trace().Str("ref", ref).Msg("found in target repository")
 
-	e.cache.SetWithTTL(ref, "", 1, 24*time.Hour+time.Duration(rand.Intn(180))*time.Minute)
+	e.cache.SetExists(ctx, ref)
 
 	return true
 }
 
+// ListImages returns the images of the mirrored repositories in the registry
+func (e *ECRClient) ListImages(ctx context.Context) (images []Image, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ECRClient.ListImages")
+	defer func() { tracing.End(span, err) }()
+
+	repositories := []string{}
+	err = e.client.DescribeRepositoriesPagesWithContext(ctx, &ecr.DescribeRepositoriesInput{
+		RegistryId: &e.targetAccount,
+	}, func(page *ecr.DescribeRepositoriesOutput, lastPage bool) bool {
+		for _, repository := range page.Repositories {
+			if name := aws.StringValue(repository.RepositoryName); IsMirroredRepository(name) {
+				repositories = append(repositories, name)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	images = []Image{}
+	for _, repository := range repositories {
+		repositoryImages := []Image{}
+		manifestLists := []*ecr.ImageIdentifier{}
+		err := e.client.DescribeImagesPagesWithContext(ctx, &ecr.DescribeImagesInput{
+			RegistryId:     &e.targetAccount,
+			RepositoryName: aws.String(repository),
+		}, func(page *ecr.DescribeImagesOutput, lastPage bool) bool {
+			for _, detail := range page.ImageDetails {
+				repositoryImages = append(repositoryImages, Image{
+					Repository: repository,
+					Digest:     aws.StringValue(detail.ImageDigest),
+					Tags:       aws.StringValueSlice(detail.ImageTags),
+					PushedAt:   aws.TimeValue(detail.ImagePushedAt),
+				})
+				if isManifestList(aws.StringValue(detail.ImageManifestMediaType)) {
+					manifestLists = append(manifestLists, &ecr.ImageIdentifier{ImageDigest: detail.ImageDigest})
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// the images of the platforms of a multi-arch image are listed untagged, they belong to the manifest list
+		children, err := e.platformImages(ctx, repository, manifestLists)
+		if err != nil {
+			return nil, err
+		}
+		for index := range repositoryImages {
+			repositoryImages[index].Children = children[repositoryImages[index].Digest]
+		}
+		images = append(images, withoutChildren(repositoryImages)...)
+	}
+
+	span.SetAttributes(attribute.Int("repositories", len(repositories)), attribute.Int("images", len(images)))
+
+	return images, nil
+}
+
+// WarmCache caches the repositories and the tagged images of the registry, bounded by the limits.
+// Images are listed by ListImages, which is cheaper than DescribeImages as no details are returned.
+func (e *ECRClient) WarmCache(ctx context.Context, limits WarmupLimits) (images int, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ECRClient.WarmCache")
+	defer func() {
+		span.SetAttributes(attribute.Int("images", images))
+		tracing.End(span, err)
+	}()
+
+	repositories := []string{}
+	err = e.client.DescribeRepositoriesPagesWithContext(ctx, &ecr.DescribeRepositoriesInput{
+		RegistryId: &e.targetAccount,
+	}, func(page *ecr.DescribeRepositoriesOutput, lastPage bool) bool {
+		for _, repository := range page.Repositories {
+			if len(repositories) >= limits.MaxRepositories {
+				return false
+			}
+			repositories = append(repositories, aws.StringValue(repository.RepositoryName))
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, repository := range repositories {
+		if images >= limits.MaxImages {
+			break
+		}
+
+		e.cache.SetExists(ctx, repository)
+
+		err := e.client.ListImagesPagesWithContext(ctx, &ecr.ListImagesInput{
+			RegistryId:     &e.targetAccount,
+			RepositoryName: aws.String(repository),
+			Filter:         &ecr.ListImagesFilter{TagStatus: aws.String(ecr.TagStatusTagged)},
+		}, func(page *ecr.ListImagesOutput, lastPage bool) bool {
+			for _, imageID := range page.ImageIds {
+				if images >= limits.MaxImages {
+					return false
+				}
+				e.cache.SetExists(ctx, fmt.Sprintf("%s/%s:%s", e.ecrDomain, repository, aws.StringValue(imageID.ImageTag)))
+				e.cache.SetExists(ctx, fmt.Sprintf("%s/%s@%s", e.ecrDomain, repository, aws.StringValue(imageID.ImageDigest)))
+				images++
+			}
+			return true
+		})
+		if err != nil {
+			return images, err
+		}
+	}
+
+	return images, nil
+}
+
+// platformImages returns the digests of the images the manifest lists consist of, by the digest of the manifest list
+func (e *ECRClient) platformImages(ctx context.Context, repository string, manifestLists []*ecr.ImageIdentifier) (map[string][]string, error) {
+	children := map[string][]string{}
+
+	// BatchGetImage accepts up to 100 images per request
+	for batch := range slices.Chunk(manifestLists, 100) {
+		output, err := e.client.BatchGetImageWithContext(ctx, &ecr.BatchGetImageInput{
+			RegistryId:         &e.targetAccount,
+			RepositoryName:     aws.String(repository),
+			ImageIds:           batch,
+			AcceptedMediaTypes: aws.StringSlice(manifestListMediaTypes),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, image := range output.Images {
+			var manifestList struct {
+				Manifests []struct {
+					Digest string `json:"digest"`
+				} `json:"manifests"`
+			}
+			if err := json.Unmarshal([]byte(aws.StringValue(image.ImageManifest)), &manifestList); err != nil {
+				return nil, err
+			}
+			for _, manifest := range manifestList.Manifests {
+				digest := aws.StringValue(image.ImageId.ImageDigest)
+				children[digest] = append(children[digest], manifest.Digest)
+			}
+		}
+	}
+
+	return children, nil
+}
+
+// DeleteImage deletes an image by digest, removing all its tags
+func (e *ECRClient) DeleteImage(ctx context.Context, image Image) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ECRClient.DeleteImage", trace.WithAttributes(
+		attribute.String("repository", image.Repository),
+		attribute.String("digest", image.Digest),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	log.Ctx(ctx).Debug().Str("repository", image.Repository).Str("digest", image.Digest).Strs("children", image.Children).Msg("delete image")
+
+	// the multi-arch image is deleted before its children, it must not reference missing images
+	if err := e.batchDeleteImages(ctx, image.Repository, []string{image.Digest}); err != nil {
+		return err
+	}
+	for batch := range slices.Chunk(image.Children, 100) {
+		if err := e.batchDeleteImages(ctx, image.Repository, batch); err != nil {
+			return err
+		}
+	}
+
+	for _, ref := range image.References(e.ecrDomain) {
+		e.cache.Del(ctx, ref)
+	}
+
+	return nil
+}
+
+// batchDeleteImages deletes up to 100 images of the repository by digest
+func (e *ECRClient) batchDeleteImages(ctx context.Context, repository string, digests []string) error {
+	imageIds := []*ecr.ImageIdentifier{}
+	for _, digest := range digests {
+		imageIds = append(imageIds, &ecr.ImageIdentifier{ImageDigest: aws.String(digest)})
+	}
+
+	output, err := e.client.BatchDeleteImageWithContext(ctx, &ecr.BatchDeleteImageInput{
+		RegistryId:     &e.targetAccount,
+		RepositoryName: aws.String(repository),
+		ImageIds:       imageIds,
+	})
+	if err != nil {
+		return err
+	}
+
+	// a missing image is deleted already
+	for _, failure := range output.Failures {
+		if aws.StringValue(failure.FailureCode) != ecr.ImageFailureCodeImageNotFound {
+			digest := strings.Join(digests, ",")
+			if failure.ImageId != nil {
+				digest = aws.StringValue(failure.ImageId.ImageDigest)
+			}
+			return fmt.Errorf("failed deleting image %s@%s: %s", repository, digest, aws.StringValue(failure.FailureReason))
+		}
+	}
+
+	return nil
+}
+
+// DeleteRepository deletes an empty repository
+func (e *ECRClient) DeleteRepository(ctx context.Context, name string) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ECRClient.DeleteRepository", trace.WithAttributes(attribute.String("repository", name)))
+	defer func() { tracing.End(span, err) }()
+
+	log.Ctx(ctx).Debug().Str("repository", name).Msg("delete repository")
+
+	_, err = e.client.DeleteRepositoryWithContext(ctx, &ecr.DeleteRepositoryInput{
+		RegistryId:     &e.targetAccount,
+		RepositoryName: aws.String(name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeRepositoryNotFoundException {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the repository is created again by the next copy
+	e.cache.Del(ctx, name)
+
+	return nil
+}
+
 func (e *ECRClient) Endpoint() string {
 	return e.ecrDomain
 }
@@ -278,6 +539,27 @@ func (e *ECRClient) IsOrigin(imageRef ctypes.ImageReference) bool {
 	return domain == e.Endpoint()
 }
 
+// Close stops the token renewal
+func (e *ECRClient) Close() {
+	if e.scheduler != nil {
+		e.scheduler.Stop()
+	}
+	if e.cache != nil {
+		metrics.Caches.Remove(e.cache)
+		e.cache.Close()
+	}
+}
+
+// PurgeCache deletes the cached repositories and images starting with the prefix
+func (e *ECRClient) PurgeCache(ctx context.Context, prefix string) (int, error) {
+	return e.cache.Purge(ctx, prefix)
+}
+
+// CacheEntries returns the repositories and images known to exist
+func (e *ECRClient) CacheEntries(ctx context.Context) ([]CacheEntry, error) {
+	return e.cache.Entries(ctx)
+}
+
 // requestAuthToken requests and returns an authentication token from ECR with its expiration date
 func (e *ECRClient) requestAuthToken() ([]byte, time.Time, error) {
 	getAuthTokenOutput, err := e.client.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{
@@ -300,20 +582,35 @@ func (e *ECRClient) requestAuthToken() ([]byte, time.Time, error) {
 func (e *ECRClient) scheduleTokenRenewal() error {
 	token, expiryAt, err := e.requestAuthToken()
 	if err != nil {
+		metrics.TokenRenewals.WithLabelValues(e.ecrDomain, "failure").Inc()
+		e.tokenRenewalFailed(err)
 		return err
 	}
 
+	metrics.TokenRenewals.WithLabelValues(e.ecrDomain, "success").Inc()
+	metrics.TokenExpiry.WithLabelValues(e.ecrDomain).Set(float64(expiryAt.Unix()))
+
 	renewalAt := expiryAt.Add(-2 * time.Minute)
 	e.authToken = token
+	e.tokenRenewed(expiryAt)
 
 	log.Debug().Time("expiryAt", expiryAt).Time("renewalAt", renewalAt).Msg("auth token set, schedule next token renewal")
 
-	j, _ := e.scheduler.Every(1).StartAt(renewalAt).Do(e.scheduleTokenRenewal)
+	j, _ := e.scheduler.Every(1).StartAt(renewalAt).Do(e.renewToken)
 	j.LimitRunsTo(1)
 
 	return nil
 }
 
+// renewToken renews the token in background, a failed renewal is retried until it succeeds
+func (e *ECRClient) renewToken() {
+	if err := e.scheduleTokenRenewal(); err != nil {
+		log.Err(err).Dur("retryIn", tokenRenewalRetryInterval).Msg("token renewal failed")
+		j, _ := e.scheduler.Every(1).StartAt(time.Now().Add(tokenRenewalRetryInterval)).Do(e.renewToken)
+		j.LimitRunsTo(1)
+	}
+}
+
 // For testing purposes
 func NewDummyECRClient(region string, targetAccount string, role string, options config.ECROptions, authToken []byte) *ECRClient {
 	return &ECRClient{
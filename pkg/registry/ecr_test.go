@@ -1,9 +1,16 @@
 package registry
 
 import (
+	"context"
 	"encoding/base64"
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
 	"github.com/containers/image/v5/transports/alltransports"
 
 	"github.com/estahn/k8s-image-swapper/pkg/config"
@@ -51,3 +58,144 @@ func TestECRIsOrigin(t *testing.T) {
 		assert.Equal(t, testcase.expected, result)
 	}
 }
+
+// fakeECR serves a registry with a single repository and records deleted images
+type fakeECR struct {
+	ecriface.ECRAPI
+	deleted []string
+}
+
+func (f *fakeECR) DescribeRepositoriesPagesWithContext(ctx aws.Context, input *ecr.DescribeRepositoriesInput, fn func(*ecr.DescribeRepositoriesOutput, bool) bool, opts ...request.Option) error {
+	fn(&ecr.DescribeRepositoriesOutput{Repositories: []*ecr.Repository{
+		{RepositoryName: aws.String("docker.io/library/nginx")},
+		// pushed by others, never listed
+		{RepositoryName: aws.String("team/app")},
+	}}, true)
+	return nil
+}
+
+func (f *fakeECR) DescribeImagesPagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, fn func(*ecr.DescribeImagesOutput, bool) bool, opts ...request.Option) error {
+	if aws.StringValue(input.RepositoryName) != "docker.io/library/nginx" {
+		return fmt.Errorf("unexpected repository %s", aws.StringValue(input.RepositoryName))
+	}
+	pushedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fn(&ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{
+		{ImageDigest: aws.String("sha256:a"), ImageTags: aws.StringSlice([]string{"stable", "1.25"}), ImagePushedAt: &pushedAt},
+	}}, false)
+	fn(&ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{
+		{ImageDigest: aws.String("sha256:b"), ImagePushedAt: &pushedAt},
+		{ImageDigest: aws.String("sha256:list"), ImageTags: aws.StringSlice([]string{"latest"}), ImagePushedAt: &pushedAt, ImageManifestMediaType: aws.String("application/vnd.oci.image.index.v1+json")},
+		{ImageDigest: aws.String("sha256:amd64"), ImagePushedAt: &pushedAt},
+	}}, true)
+	return nil
+}
+
+func (f *fakeECR) BatchGetImageWithContext(ctx aws.Context, input *ecr.BatchGetImageInput, opts ...request.Option) (*ecr.BatchGetImageOutput, error) {
+	return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+		ImageId:       input.ImageIds[0],
+		ImageManifest: aws.String(`{"schemaVersion":2,"manifests":[{"digest":"sha256:amd64","platform":{"os":"linux","architecture":"amd64"}}]}`),
+	}}}, nil
+}
+
+func (f *fakeECR) BatchDeleteImageWithContext(ctx aws.Context, input *ecr.BatchDeleteImageInput, opts ...request.Option) (*ecr.BatchDeleteImageOutput, error) {
+	if len(input.ImageIds) > 1 {
+		for _, imageID := range input.ImageIds {
+			f.deleted = append(f.deleted, aws.StringValue(input.RepositoryName)+"@"+aws.StringValue(imageID.ImageDigest))
+		}
+		return &ecr.BatchDeleteImageOutput{}, nil
+	}
+
+	digest := aws.StringValue(input.ImageIds[0].ImageDigest)
+	switch digest {
+	case "sha256:missing":
+		return &ecr.BatchDeleteImageOutput{Failures: []*ecr.ImageFailure{{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)}}}, nil
+	case "sha256:referenced":
+		return &ecr.BatchDeleteImageOutput{Failures: []*ecr.ImageFailure{{FailureCode: aws.String(ecr.ImageFailureCodeImageReferencedByManifestList), FailureReason: aws.String("referenced by manifest list")}}}, nil
+	}
+
+	f.deleted = append(f.deleted, aws.StringValue(input.RepositoryName)+"@"+digest)
+	return &ecr.BatchDeleteImageOutput{}, nil
+}
+
+func TestECRListAndDeleteImages(t *testing.T) {
+	fake := &fakeECR{}
+	client, _ := NewMockECRClient(fake, "us-east-1", "12345678912.dkr.ecr.us-east-1.amazonaws.com", "12345678912", "")
+
+	images, err := client.ListImages(context.Background())
+	assert.NoError(t, err)
+	pushedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, []Image{
+		{Repository: "docker.io/library/nginx", Digest: "sha256:a", Tags: []string{"stable", "1.25"}, PushedAt: pushedAt},
+		{Repository: "docker.io/library/nginx", Digest: "sha256:b", Tags: []string{}, PushedAt: pushedAt},
+		{Repository: "docker.io/library/nginx", Digest: "sha256:list", Tags: []string{"latest"}, PushedAt: pushedAt, Children: []string{"sha256:amd64"}},
+	}, images, "images of the platforms of a multi-arch image are listed as children")
+	assert.Equal(t, []string{
+		"12345678912.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx@sha256:a",
+		"12345678912.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx:stable",
+		"12345678912.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx:1.25",
+	}, images[0].References(client.Endpoint()))
+
+	assert.NoError(t, client.DeleteImage(context.Background(), images[0]))
+	assert.NoError(t, client.DeleteImage(context.Background(), Image{Repository: "docker.io/library/nginx", Digest: "sha256:missing"}))
+	assert.Error(t, client.DeleteImage(context.Background(), Image{Repository: "docker.io/library/nginx", Digest: "sha256:referenced"}))
+	assert.NoError(t, client.DeleteImage(context.Background(), images[2]))
+	assert.Equal(t, []string{
+		"docker.io/library/nginx@sha256:a",
+		"docker.io/library/nginx@sha256:list",
+		"docker.io/library/nginx@sha256:amd64",
+	}, fake.deleted, "children are deleted after the multi-arch image")
+}
+
+func (f *fakeECR) ListImagesPagesWithContext(ctx aws.Context, input *ecr.ListImagesInput, fn func(*ecr.ListImagesOutput, bool) bool, opts ...request.Option) error {
+	fn(&ecr.ListImagesOutput{ImageIds: []*ecr.ImageIdentifier{
+		{ImageDigest: aws.String("sha256:a"), ImageTag: aws.String("stable")},
+		{ImageDigest: aws.String("sha256:a"), ImageTag: aws.String("1.25")},
+	}}, false)
+	fn(&ecr.ListImagesOutput{ImageIds: []*ecr.ImageIdentifier{
+		{ImageDigest: aws.String("sha256:list"), ImageTag: aws.String("latest")},
+	}}, true)
+	return nil
+}
+
+func TestECRWarmCache(t *testing.T) {
+	ctx := context.Background()
+	client, _ := NewMockECRClient(&fakeECR{}, "us-east-1", "12345678912.dkr.ecr.us-east-1.amazonaws.com", "12345678912", "")
+	cache, err := newCache(clientOptions{}, client.Endpoint())
+	assert.NoError(t, err)
+	client.cache = cache
+	defer client.Close()
+
+	images, err := client.WarmCache(ctx, WarmupLimits{MaxRepositories: 10, MaxImages: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, images, "listing stops at the limit")
+
+	entries, err := client.CacheEntries(ctx)
+	assert.NoError(t, err)
+	keys := []string{}
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	assert.Equal(t, []string{
+		"12345678912.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx:1.25",
+		"12345678912.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx:stable",
+		"12345678912.dkr.ecr.us-east-1.amazonaws.com/docker.io/library/nginx@sha256:a",
+		"docker.io/library/nginx",
+	}, keys)
+
+	images, err = client.WarmCache(ctx, WarmupLimits{MaxRepositories: 0, MaxImages: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, images, "no repositories are listed")
+}
+
+func TestSourceCredentialArgs(t *testing.T) {
+	client := NewDummyECRClient("us-east-1", "12345678912", "", config.ECROptions{}, []byte("AWS:token"))
+
+	origin, err := alltransports.ParseImageName("docker://12345678912.dkr.ecr.us-east-1.amazonaws.com/nginx:latest")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--src-creds", "AWS:token"}, sourceCredentialArgs(client, origin, "/tmp/auth"))
+
+	other, err := alltransports.ParseImageName("docker://docker.io/library/nginx:latest")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--src-authfile", "/tmp/auth"}, sourceCredentialArgs(client, other, "/tmp/auth"))
+	assert.Equal(t, []string{"--src-no-creds"}, sourceCredentialArgs(client, other, ""))
+}
@@ -4,22 +4,29 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
+	"net/url"
 	"os/exec"
 	"strings"
 	"time"
 
 	artifactregistry "cloud.google.com/go/artifactregistry/apiv1"
-	"github.com/containers/image/v5/docker/reference"
+	"cloud.google.com/go/artifactregistry/apiv1/artifactregistrypb"
 	ctypes "github.com/containers/image/v5/types"
-	"github.com/dgraph-io/ristretto"
 	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/metrics"
+	"github.com/estahn/k8s-image-swapper/pkg/tracing"
 	"github.com/go-co-op/gocron"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"google.golang.org/api/transport"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type GARAPI interface{}
@@ -27,35 +34,39 @@ type GARAPI interface{}
 type GARClient struct {
 	client    GARAPI
 	garDomain string
-	cache     *ristretto.Cache
-	scheduler *gocron.Scheduler
-	authToken []byte
+	// repository is the resource name of the repository in the artifact registry API
+	repository string
+	cache      *cache
+	scheduler  *gocron.Scheduler
+	authToken  []byte
+
+	tokenStatus
 }
 
-func NewGARClient(clientConfig config.GCP) (*GARClient, error) {
-	cache, err := ristretto.NewCache(&ristretto.Config{
-		NumCounters: 1e7,     // number of keys to track frequency of (10M).
-		MaxCost:     1 << 30, // maximum cost of cache (1GB).
-		BufferItems: 64,      // number of keys per Get buffer.
-	})
+func NewGARClient(clientConfig config.GCP, opts ...ClientOption) (*GARClient, error) {
+	options := newClientOptions(opts)
+	cache, err := newCache(options, clientConfig.GarDomain())
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	scheduler := gocron.NewScheduler(time.UTC)
 	scheduler.StartAsync()
 
 	client := &GARClient{
-		client:    nil,
-		garDomain: clientConfig.GarDomain(),
-		cache:     cache,
-		scheduler: scheduler,
+		client:     nil,
+		garDomain:  clientConfig.GarDomain(),
+		repository: fmt.Sprintf("projects/%s/locations/%s/repositories/%s", clientConfig.ProjectID, clientConfig.Location, clientConfig.RepositoryID),
+		cache:      cache,
+		scheduler:  scheduler,
 	}
 
 	if err := client.scheduleTokenRenewal(); err != nil {
 		return nil, err
 	}
 
+	metrics.Caches.Add(client.Endpoint(), cache)
+
 	return client, nil
 }
 
@@ -68,16 +79,15 @@ func (e *GARClient) RepositoryExists() bool {
 	panic("implement me")
 }
 
-func (e *GARClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference, srcCreds string, destRef ctypes.ImageReference, destCreds string) error {
+func (e *GARClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference, srcCreds string, destRef ctypes.ImageReference, destCreds string) (err error) {
 	src := srcRef.DockerReference().String()
 	dest := destRef.DockerReference().String()
 
-	creds := []string{"--src-authfile", srcCreds}
-
-	// use client credentials for any source GAR repositories
-	if strings.HasSuffix(reference.Domain(srcRef.DockerReference()), "-docker.pkg.dev") {
-		creds = []string{"--src-creds", e.Credentials()}
-	}
+	ctx, span := tracing.Tracer().Start(ctx, "GARClient.CopyImage", trace.WithAttributes(
+		attribute.String("source.image", src),
+		attribute.String("target.image", dest),
+	))
+	defer func() { tracing.End(span, err) }()
 
 	app := "skopeo"
 	args := []string{
@@ -89,11 +99,7 @@ func (e *GARClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference,
 		"docker://" + dest,
 	}
 
-	if len(creds[1]) > 0 {
-		args = append(args, creds...)
-	} else {
-		args = append(args, "--src-no-creds")
-	}
+	args = append(args, sourceCredentialArgs(e, srcRef, srcCreds)...)
 
 	if len(destCreds) > 0 {
 		args = append(args, "--dest-creds", destCreds)
@@ -107,7 +113,9 @@ func (e *GARClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference,
 		Strs("args", args).
 		Msg("execute command to copy image")
 
-	output, cmdErr := exec.CommandContext(ctx, app, args...).CombinedOutput()
+	cmd := exec.CommandContext(ctx, app, args...)
+	cmd.Env = commandEnv(ctx)
+	output, cmdErr := cmd.CombinedOutput()
 
 	// check if the command timed out during execution for proper logging
 	if err := ctx.Err(); err != nil {
@@ -116,9 +124,12 @@ func (e *GARClient) CopyImage(ctx context.Context, srcRef ctypes.ImageReference,
 
 	// enrich error with output from the command which may contain the actual reason
 	if cmdErr != nil {
-		return fmt.Errorf("Command error, stderr: %s, stdout: %s", cmdErr.Error(), string(output))
+		return &CommandError{Err: cmdErr, Output: string(output)}
 	}
 
+	// replaces the entry of the image known to be missing
+	e.cache.SetExists(ctx, dest)
+
 	return nil
 }
 
@@ -130,11 +141,19 @@ func (e *GARClient) PutImage() error {
 	panic("implement me")
 }
 
-func (e *GARClient) ImageExists(ctx context.Context, imageRef ctypes.ImageReference) bool {
+func (e *GARClient) ImageExists(ctx context.Context, imageRef ctypes.ImageReference) (exists bool) {
 	ref := imageRef.DockerReference().String()
-	if _, found := e.cache.Get(ref); found {
-		log.Ctx(ctx).Trace().Str("ref", ref).Msg("found in cache")
-		return true
+
+	ctx, span := tracing.Tracer().Start(ctx, "GARClient.ImageExists", trace.WithAttributes(attribute.String("image", ref)))
+	defer func() {
+		span.SetAttributes(attribute.Bool("image.exists", exists))
+		span.End()
+	}()
+
+	if exists, found := e.cache.Lookup(ctx, ref); found {
+		log.Ctx(ctx).Trace().Str("ref", ref).Bool("exists", exists).Msg("found in cache")
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		return exists
 	}
 
 	app := "skopeo"
@@ -148,23 +167,203 @@ func (e *GARClient) ImageExists(ctx context.Context, imageRef ctypes.ImageRefere
 	log.Ctx(ctx).Trace().Str("app", app).Strs("args", args).Msg("executing command to inspect image")
 	if err := exec.CommandContext(ctx, app, args...).Run(); err != nil {
 		log.Trace().Str("ref", ref).Msg("not found in target repository")
+		// a failure caused by the deadline says nothing about the image
+		if ctx.Err() == nil {
+			e.cache.SetMissing(ctx, ref)
+		}
 		return false
 	}
 
 	log.Ctx(ctx).Trace().Str("ref", ref).Msg("found in target repository")
 
-	e.cache.SetWithTTL(ref, "", 1, 24*time.Hour+time.Duration(rand.Intn(180))*time.Minute)
+	e.cache.SetExists(ctx, ref)
 
 	return true
 }
 
+// ListImages returns the images of all packages in the repository
+func (e *GARClient) ListImages(ctx context.Context) (images []Image, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "GARClient.ListImages")
+	defer func() { tracing.End(span, err) }()
+
+	images = []Image{}
+	err = e.eachImage(ctx, func(image Image) bool {
+		if IsMirroredRepository(image.Repository) {
+			images = append(images, image)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the images of the platforms of a multi-arch image are listed as well, they belong to the manifest list
+	images = withoutChildren(images)
+
+	span.SetAttributes(attribute.Int("images", len(images)))
+
+	return images, nil
+}
+
+// WarmCache caches the images of all packages in the repository by digest and tag, bounded by the limits.
+// Packages are created along with their images, so there are no repositories to cache.
+func (e *GARClient) WarmCache(ctx context.Context, limits WarmupLimits) (images int, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "GARClient.WarmCache")
+	defer func() {
+		span.SetAttributes(attribute.Int("images", images))
+		tracing.End(span, err)
+	}()
+
+	err = e.eachImage(ctx, func(image Image) bool {
+		if images >= limits.MaxImages {
+			return false
+		}
+		for _, ref := range image.References(e.garDomain) {
+			e.cache.SetExists(ctx, ref)
+		}
+		images++
+		return true
+	})
+
+	return images, err
+}
+
+// eachImage calls fn with the images of all packages in the repository until it returns false
+func (e *GARClient) eachImage(ctx context.Context, fn func(Image) bool) error {
+	client, err := artifactregistry.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	it := client.ListDockerImages(ctx, &artifactregistrypb.ListDockerImagesRequest{Parent: e.repository})
+	for {
+		dockerImage, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// the uri references the image by digest, e.g. us-docker.pkg.dev/project/repository/docker.io/library/nginx@sha256:...
+		repository, digest, found := strings.Cut(strings.TrimPrefix(dockerImage.GetUri(), e.garDomain+"/"), "@")
+		if !found {
+			log.Ctx(ctx).Warn().Str("uri", dockerImage.GetUri()).Msg("skip image without digest")
+			continue
+		}
+
+		var children []string
+		for _, manifest := range dockerImage.GetImageManifests() {
+			children = append(children, manifest.GetDigest())
+		}
+
+		if !fn(Image{
+			Repository: repository,
+			Digest:     digest,
+			Tags:       dockerImage.GetTags(),
+			PushedAt:   dockerImage.GetUploadTime().AsTime(),
+			Children:   children,
+		}) {
+			return nil
+		}
+	}
+}
+
+// DeleteImage deletes the version of the package by digest, removing all its tags
+func (e *GARClient) DeleteImage(ctx context.Context, image Image) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "GARClient.DeleteImage", trace.WithAttributes(
+		attribute.String("repository", image.Repository),
+		attribute.String("digest", image.Digest),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	log.Ctx(ctx).Debug().Str("repository", image.Repository).Str("digest", image.Digest).Strs("children", image.Children).Msg("delete image")
+
+	client, err := artifactregistry.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// the multi-arch image is deleted before its children, it must not reference missing images
+	for _, digest := range append([]string{image.Digest}, image.Children...) {
+		operation, err := client.DeleteVersion(ctx, &artifactregistrypb.DeleteVersionRequest{
+			Name:  fmt.Sprintf("%s/versions/%s", e.packageName(image.Repository), digest),
+			Force: true,
+		})
+		if err == nil {
+			err = operation.Wait(ctx)
+		}
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+	}
+
+	for _, ref := range image.References(e.garDomain) {
+		e.cache.Del(ctx, ref)
+	}
+
+	return nil
+}
+
+// DeleteRepository deletes the package of the image repository
+func (e *GARClient) DeleteRepository(ctx context.Context, name string) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "GARClient.DeleteRepository", trace.WithAttributes(attribute.String("repository", name)))
+	defer func() { tracing.End(span, err) }()
+
+	log.Ctx(ctx).Debug().Str("repository", name).Msg("delete repository")
+
+	client, err := artifactregistry.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	operation, err := client.DeletePackage(ctx, &artifactregistrypb.DeletePackageRequest{Name: e.packageName(name)})
+	if err == nil {
+		err = operation.Wait(ctx)
+	}
+	if err != nil && status.Code(err) != codes.NotFound {
+		return err
+	}
+
+	return nil
+}
+
+// packageName returns the resource name of the package holding the images of a repository, slashes are escaped
+func (e *GARClient) packageName(repository string) string {
+	return fmt.Sprintf("%s/packages/%s", e.repository, url.PathEscape(repository))
+}
+
 func (e *GARClient) Endpoint() string {
 	return e.garDomain
 }
 
-// IsOrigin returns true if the references origin is from this registry
+// IsOrigin returns true if the references origin is from this registry, i.e. from its repository
 func (e *GARClient) IsOrigin(imageRef ctypes.ImageReference) bool {
-	return strings.HasPrefix(imageRef.DockerReference().String(), e.Endpoint())
+	return strings.HasPrefix(imageRef.DockerReference().String(), e.Endpoint()+"/")
+}
+
+// Close stops the token renewal
+func (e *GARClient) Close() {
+	if e.scheduler != nil {
+		e.scheduler.Stop()
+	}
+	if e.cache != nil {
+		metrics.Caches.Remove(e.cache)
+		e.cache.Close()
+	}
+}
+
+// PurgeCache deletes the cached repositories and images starting with the prefix
+func (e *GARClient) PurgeCache(ctx context.Context, prefix string) (int, error) {
+	return e.cache.Purge(ctx, prefix)
+}
+
+// CacheEntries returns the repositories and images known to exist
+func (e *GARClient) CacheEntries(ctx context.Context) ([]CacheEntry, error) {
+	return e.cache.Entries(ctx)
 }
 
 // requestAuthToken requests and returns an authentication token from GAR with its expiration date
@@ -188,20 +387,35 @@ func (e *GARClient) requestAuthToken() ([]byte, time.Time, error) {
 func (e *GARClient) scheduleTokenRenewal() error {
 	token, expiryAt, err := e.requestAuthToken()
 	if err != nil {
+		metrics.TokenRenewals.WithLabelValues(e.garDomain, "failure").Inc()
+		e.tokenRenewalFailed(err)
 		return err
 	}
 
+	metrics.TokenRenewals.WithLabelValues(e.garDomain, "success").Inc()
+	metrics.TokenExpiry.WithLabelValues(e.garDomain).Set(float64(expiryAt.Unix()))
+
 	renewalAt := expiryAt.Add(-2 * time.Minute)
 	e.authToken = token
+	e.tokenRenewed(expiryAt)
 
 	log.Debug().Time("expiryAt", expiryAt).Time("renewalAt", renewalAt).Msg("auth token set, schedule next token renewal")
 
-	j, _ := e.scheduler.Every(1).StartAt(renewalAt).Do(e.scheduleTokenRenewal)
+	j, _ := e.scheduler.Every(1).StartAt(renewalAt).Do(e.renewToken)
 	j.LimitRunsTo(1)
 
 	return nil
 }
 
+// renewToken renews the token in background, a failed renewal is retried until it succeeds
+func (e *GARClient) renewToken() {
+	if err := e.scheduleTokenRenewal(); err != nil {
+		log.Err(err).Dur("retryIn", tokenRenewalRetryInterval).Msg("token renewal failed")
+		j, _ := e.scheduler.Every(1).StartAt(time.Now().Add(tokenRenewalRetryInterval)).Do(e.renewToken)
+		j.LimitRunsTo(1)
+	}
+}
+
 func (e *GARClient) Credentials() string {
 	return string(e.authToken)
 }
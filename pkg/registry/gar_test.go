@@ -22,6 +22,10 @@ func TestGARIsOrigin(t *testing.T) {
 			input:    "us-central1-docker.pkg.dev/gcp-project-123/main/k8s.gcr.io/ingress-nginx/controller@sha256:9bba603b99bf25f6d117cf1235b6598c16033ad027b143c90fa5b3cc583c5713",
 			expected: true,
 		},
+		{
+			input:    "us-central1-docker.pkg.dev/gcp-project-123/main-mirror/ingress-nginx/controller:v1.8.1",
+			expected: false,
+		},
 	}
 
 	fakeRegistry, _ := NewMockGARClient(nil, "us-central1-docker.pkg.dev/gcp-project-123/main")
@@ -36,3 +40,17 @@ func TestGARIsOrigin(t *testing.T) {
 		assert.Equal(t, testcase.expected, result)
 	}
 }
+
+func TestGARSourceCredentialArgs(t *testing.T) {
+	client, _ := NewMockGARClient(nil, "us-central1-docker.pkg.dev/gcp-project-123/main")
+
+	origin, err := alltransports.ParseImageName("docker://us-central1-docker.pkg.dev/gcp-project-123/main/nginx:latest")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--src-creds", "oauth2accesstoken:mock-gar-client-fake-auth-token"}, sourceCredentialArgs(client, origin, "/tmp/auth"))
+
+	// other repositories are read with the credentials of the source registries they are declared as
+	other, err := alltransports.ParseImageName("docker://us-central1-docker.pkg.dev/gcp-project-456/base-images/nginx:latest")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--src-authfile", "/tmp/auth"}, sourceCredentialArgs(client, other, "/tmp/auth"))
+	assert.Equal(t, []string{"--src-no-creds"}, sourceCredentialArgs(client, other, ""))
+}
@@ -0,0 +1,126 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisScanCount is the number of keys requested per SCAN iteration when listing entries
+const redisScanCount = 1000
+
+// redisCache keeps the entries in Redis, so they are shared by all replicas and survive restarts.
+// Keys are prefixed with the endpoint of the registry, the clients of all registries share one server.
+type redisCache struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedisCacheFactory returns a factory of caches stored in Redis with keys prefixed by keyPrefix and the endpoint of the registry.
+// The client is shared, closing a cache keeps it open.
+func NewRedisCacheFactory(client redis.UniversalClient, keyPrefix string) CacheFactory {
+	return func(endpoint string) (Cache, error) {
+		return &redisCache{client: client, prefix: keyPrefix + endpoint + "/"}, nil
+	}
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) (string, bool, error) {
+	value, err := c.client.Get(ctx, c.prefix+key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	return value, true, nil
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return c.client.Set(ctx, c.prefix+key, value, ttl).Err()
+}
+
+func (c *redisCache) Del(ctx context.Context, key string) error {
+	return c.client.Del(ctx, c.prefix+key).Err()
+}
+
+// Purge deletes the keys found by SCAN in batches, the number of deleted keys excludes keys expired meanwhile
+func (c *redisCache) Purge(ctx context.Context, prefix string) (int, error) {
+	keys, err := c.scan(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for batch := range slices.Chunk(keys, redisScanCount) {
+		deleted, err := c.client.Del(ctx, batch...).Result()
+		purged += int(deleted)
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+func (c *redisCache) Entries(ctx context.Context) ([]CacheEntry, error) {
+	keys, err := c.scan(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := c.client.Pipeline()
+	ttls := make([]*redis.DurationCmd, len(keys))
+	values := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		ttls[i] = pipeline.PTTL(ctx, key)
+		values[i] = pipeline.Get(ctx, key)
+	}
+	if len(keys) > 0 {
+		// keys expired meanwhile fail the GET with redis.Nil
+		if _, err := pipeline.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	entries := []CacheEntry{}
+	for i, key := range keys {
+		// keys expired meanwhile are reported with a negative duration
+		ttl := ttls[i].Val()
+		if ttl <= 0 {
+			continue
+		}
+		entries = append(entries, CacheEntry{Key: strings.TrimPrefix(key, c.prefix), Value: values[i].Val(), Expires: now.Add(ttl)})
+	}
+	sortEntries(entries)
+
+	return entries, nil
+}
+
+// scan returns the keys of the cache starting with the prefix, including the prefix of the cache
+func (c *redisCache) scan(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	iter := c.client.Scan(ctx, 0, escapeRedisPattern(c.prefix+prefix)+"*", redisScanCount).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (c *redisCache) Close() error {
+	return nil
+}
+
+// escapeRedisPattern escapes the characters with a meaning in patterns of SCAN MATCH
+func escapeRedisPattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
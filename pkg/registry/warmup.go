@@ -0,0 +1,66 @@
+package registry
+
+import (
+	"context"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// WarmupLimits bound the listing of a registry when warming its cache
+type WarmupLimits struct {
+	MaxRepositories int
+	MaxImages       int
+}
+
+// CacheWarmer is implemented by clients able to fill their cache by listing the registry
+type CacheWarmer interface {
+	// WarmCache caches the repositories and images found in the registry up to the limits and returns the number of images
+	WarmCache(ctx context.Context, limits WarmupLimits) (int, error)
+}
+
+// RunWarmup warms the cache of the registry client right away and then at the interval until the context is done
+func RunWarmup(ctx context.Context, client Client, interval time.Duration, limits WarmupLimits) {
+	Warmup(ctx, client, limits)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			Warmup(ctx, client, limits)
+		}
+	}
+}
+
+// Warmup warms the cache of the registry client if it keeps one and records the result.
+// Failures are logged only, the cache is filled by admissions instead.
+func Warmup(ctx context.Context, client Client, limits WarmupLimits) {
+	warmer, ok := client.(CacheWarmer)
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	images, err := warmer.WarmCache(ctx, limits)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Ctx(ctx).Warn().Err(err).Str("registry", client.Endpoint()).Int("images", images).Msg("failed warming cache")
+			metrics.CacheWarmups.WithLabelValues(client.Endpoint(), "failure").Inc()
+		}
+		return
+	}
+
+	metrics.CacheWarmups.WithLabelValues(client.Endpoint(), "success").Inc()
+	metrics.CacheWarmupImages.WithLabelValues(client.Endpoint()).Set(float64(images))
+
+	log.Ctx(ctx).Info().
+		Str("registry", client.Endpoint()).
+		Int("images", images).
+		Dur("duration", time.Since(start)).
+		Msg("warmed cache")
+}
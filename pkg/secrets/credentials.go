@@ -0,0 +1,165 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/rs/zerolog/log"
+)
+
+// credentialHelperPrefix is the prefix of the docker credential helper binaries, e.g. docker-credential-gcloud
+const credentialHelperPrefix = "docker-credential-"
+
+// identityTokenUsername is returned by credential helpers instead of a username if the secret is an identity token
+const identityTokenUsername = "<token>"
+
+// dockerConfigFile is the part of a docker config.json file holding credentials
+type dockerConfigFile struct {
+	AuthConfigs map[string]json.RawMessage `json:"auths"`
+	CredHelpers map[string]string          `json:"credHelpers"`
+}
+
+// credentialHelperOutput is printed by a credential helper on a get request
+type credentialHelperOutput struct {
+	Username string `json:"Username"`
+	Secret   string `json:"Secret"`
+}
+
+// addSourceCredentials resolves the credentials of the source registries and adds them to the result.
+// Secrets are read on each copy, so rotated files and environment variables apply without a restart.
+// Credentials failing to resolve are skipped.
+func (r *ImagePullSecretsResult) addSourceCredentials(ctx context.Context, credentials []config.SourceCredential) {
+	for _, credential := range credentials {
+		dockerConfig, err := resolveSourceCredential(ctx, credential)
+		if err != nil {
+			log.Ctx(ctx).Err(err).
+				Str("registry", credential.Registry).
+				Str("dockerConfig", credential.DockerConfig).
+				Msg("failed resolving source registry credentials, continue without them")
+			continue
+		}
+
+		if credential.DockerConfig != "" {
+			r.Add(sourceDockerConfigLabel+credential.DockerConfig, dockerConfig)
+		} else {
+			r.Add(sourceCredentialsLabel+credential.Registry, dockerConfig)
+		}
+	}
+}
+
+// resolveSourceCredential returns the credentials as docker config.json
+func resolveSourceCredential(ctx context.Context, credential config.SourceCredential) ([]byte, error) {
+	if credential.DockerConfig != "" {
+		return readDockerConfig(ctx, credential.DockerConfig)
+	}
+
+	var authConfig registry.AuthConfig
+	switch {
+	case credential.CredentialHelper != "":
+		helperAuthConfig, err := runCredentialHelper(ctx, credential.CredentialHelper, credential.Registry)
+		if err != nil {
+			return nil, err
+		}
+		authConfig = helperAuthConfig
+	case credential.TokenFile != "" || credential.TokenEnv != "":
+		token, err := readSecret(credential.TokenFile, credential.TokenEnv)
+		if err != nil {
+			return nil, err
+		}
+		authConfig.IdentityToken = token
+	default:
+		password, err := readSecret(credential.PasswordFile, credential.PasswordEnv)
+		if err != nil {
+			return nil, err
+		}
+		authConfig.Auth = base64.StdEncoding.EncodeToString([]byte(credential.Username + ":" + password))
+	}
+
+	return json.Marshal(registry.DockerConfig{
+		AuthConfigs: map[string]registry.AuthConfig{credential.Registry: authConfig},
+	})
+}
+
+// readDockerConfig returns the credentials of a docker config.json file,
+// the credential helpers configured per registry in the file are resolved
+func readDockerConfig(ctx context.Context, path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file dockerConfigFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed parsing docker config %s: %w", path, err)
+	}
+
+	authConfigs := map[string]json.RawMessage{}
+	for registryName, authConfig := range file.AuthConfigs {
+		authConfigs[registryName] = authConfig
+	}
+
+	for registryName, helper := range file.CredHelpers {
+		authConfig, err := runCredentialHelper(ctx, helper, registryName)
+		if err != nil {
+			return nil, err
+		}
+
+		authConfigs[registryName], err = json.Marshal(authConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(map[string]map[string]json.RawMessage{"auths": authConfigs})
+}
+
+// runCredentialHelper asks the docker credential helper for the credentials of the registry
+func runCredentialHelper(ctx context.Context, helper string, registryName string) (registry.AuthConfig, error) {
+	cmd := exec.CommandContext(ctx, credentialHelperPrefix+helper, "get")
+	cmd.Stdin = strings.NewReader(registryName)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return registry.AuthConfig{}, &registry.CommandError{Err: err, Output: strings.TrimSpace(string(output))}
+	}
+
+	var credentials credentialHelperOutput
+	if err := json.Unmarshal(output, &credentials); err != nil {
+		return registry.AuthConfig{}, fmt.Errorf("failed parsing output of credential helper %s: %w", helper, err)
+	}
+
+	if credentials.Username == identityTokenUsername {
+		return registry.AuthConfig{IdentityToken: credentials.Secret}, nil
+	}
+
+	return registry.AuthConfig{
+		Auth: base64.StdEncoding.EncodeToString([]byte(credentials.Username + ":" + credentials.Secret)),
+	}, nil
+}
+
+// readSecret returns the secret of the file, or of the environment variable if no file is given
+func readSecret(file string, env string) (string, error) {
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+
+		// files created by editors or kubectl often end with a newline
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	secret, exists := os.LookupEnv(env)
+	if !exists || secret == "" {
+		return "", fmt.Errorf("environment variable %s is not set", env)
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,80 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCredentialHelper installs docker-credential-fake on the PATH, it returns a token for token.example.com
+func fakeCredentialHelper(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	script := `#!/bin/sh
+read server
+case "$server" in
+  token.example.com) echo '{"ServerURL":"token.example.com","Username":"<token>","Secret":"helper-token"}' ;;
+  helper.example.com) echo '{"ServerURL":"helper.example.com","Username":"helper","Secret":"helper-secret"}' ;;
+  *) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docker-credential-fake"), []byte(script), 0o755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func auth(username string, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+func TestImagePullSecretsResult_addSourceCredentials(t *testing.T) {
+	fakeCredentialHelper(t)
+	t.Setenv("REGISTRY_PASSWORD", "env-password")
+
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("file-password\n"), 0o600))
+	dockerConfig := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(dockerConfig, []byte(`{
+		"auths": {"config.example.com": {"auth": "Y29uZmlnOnNlY3JldA=="}},
+		"credHelpers": {"helper.example.com": "fake"}
+	}`), 0o600))
+
+	result := NewImagePullSecretsResult()
+	result.addSourceCredentials(context.Background(), []config.SourceCredential{
+		{Registry: "env.example.com", Username: "env", PasswordEnv: "REGISTRY_PASSWORD"},
+		{Registry: "file.example.com", Username: "file", PasswordFile: passwordFile},
+		{DockerConfig: dockerConfig},
+		{Registry: "token.example.com", CredentialHelper: "fake"},
+		// skipped as they fail to resolve
+		{Registry: "missing.example.com", Username: "missing", PasswordEnv: "MISSING_PASSWORD"},
+		{Registry: "unknown.example.com", CredentialHelper: "fake"},
+	})
+
+	assert.Len(t, result.Secrets, 4)
+	assert.Contains(t, result.Secrets, "source-credentials/env.example.com")
+	assert.Contains(t, result.Secrets, "source-docker-config/"+dockerConfig)
+	assert.JSONEq(t, `{"auths":{
+		"env.example.com":{"auth":"`+auth("env", "env-password")+`"},
+		"file.example.com":{"auth":"`+auth("file", "file-password")+`"},
+		"config.example.com":{"auth":"Y29uZmlnOnNlY3JldA=="},
+		"helper.example.com":{"auth":"`+auth("helper", "helper-secret")+`"},
+		"token.example.com":{"identitytoken":"helper-token"}
+	}}`, string(result.Aggregate))
+}
+
+func TestReadSecret(t *testing.T) {
+	t.Setenv("EMPTY_SECRET", "")
+
+	_, err := readSecret("", "EMPTY_SECRET")
+	assert.Error(t, err)
+
+	_, err = readSecret(filepath.Join(t.TempDir(), "missing"), "")
+	assert.Error(t, err)
+}
@@ -3,6 +3,7 @@ package secrets
 import (
 	"context"
 
+	"github.com/estahn/k8s-image-swapper/pkg/config"
 	"github.com/estahn/k8s-image-swapper/pkg/registry"
 	v1 "k8s.io/api/core/v1"
 )
@@ -19,6 +20,9 @@ func NewDummyImagePullSecretsProvider() ImagePullSecretsProvider {
 func (p *DummyImagePullSecretsProvider) SetAuthenticatedRegistries(registries []registry.Client) {
 }
 
+func (p *DummyImagePullSecretsProvider) SetSourceCredentials(credentials []config.SourceCredential) {
+}
+
 // GetImagePullSecrets returns an empty ImagePullSecretsResult
 func (p *DummyImagePullSecretsProvider) GetImagePullSecrets(ctx context.Context, pod *v1.Pod) (*ImagePullSecretsResult, error) {
 	return NewImagePullSecretsResult(), nil
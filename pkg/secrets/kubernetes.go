@@ -2,9 +2,10 @@ package secrets
 
 import (
 	"context"
-	"fmt"
 	"os"
+	"sync"
 
+	"github.com/estahn/k8s-image-swapper/pkg/config"
 	"github.com/estahn/k8s-image-swapper/pkg/registry"
 	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/rs/zerolog/log"
@@ -16,8 +17,12 @@ import (
 // KubernetesImagePullSecretsProvider retrieves the secrets holding docker auth information from Kubernetes and merges
 // them if necessary. Supports Pod secrets as well as ServiceAccount secrets.
 type KubernetesImagePullSecretsProvider struct {
-	kubernetesClient        kubernetes.Interface
+	kubernetesClient kubernetes.Interface
+
+	// mu guards the authenticated registries and source credentials which are replaced on a configuration reload
+	mu                      sync.RWMutex
 	authenticatedRegistries []registry.Client
+	sourceCredentials       []config.SourceCredential
 }
 
 // ImagePullSecretsResult contains the result of GetImagePullSecrets
@@ -34,15 +39,24 @@ func NewImagePullSecretsResult() *ImagePullSecretsResult {
 	}
 }
 
-// Initialiaze an ImagePullSecretsResult and registers image pull secrets from the given registries
+// Labels prefixing the names of the secrets added for source registries and credentials.
+// Names of Kubernetes secrets cannot contain a slash, so they never replace an image pull secret of the pod.
+const (
+	sourceRegistryLabel     = "source-registry/"
+	sourceCredentialsLabel  = "source-credentials/"
+	sourceDockerConfigLabel = "source-docker-config/"
+)
+
+// Initialiaze an ImagePullSecretsResult and registers image pull secrets from the given registries,
+// labelled by the endpoint of the registry, e.g. "source-registry/123456789.dkr.ecr.us-east-1.amazonaws.com"
 func NewImagePullSecretsResultWithDefaults(defaultImagePullSecrets []registry.Client) *ImagePullSecretsResult {
 	imagePullSecretsResult := NewImagePullSecretsResult()
-	for index, reg := range defaultImagePullSecrets {
+	for _, reg := range defaultImagePullSecrets {
 		dockerConfig, err := registry.GenerateDockerConfig(reg)
 		if err != nil {
-			log.Err(err)
+			log.Err(err).Str("registry", reg.Endpoint()).Msg("failed generating docker config of source registry")
 		} else {
-			imagePullSecretsResult.Add(fmt.Sprintf("source-ecr-%d", index), dockerConfig)
+			imagePullSecretsResult.Add(sourceRegistryLabel+reg.Endpoint(), dockerConfig)
 		}
 	}
 	return imagePullSecretsResult
@@ -79,9 +93,27 @@ func NewKubernetesImagePullSecretsProvider(clientset kubernetes.Interface) Image
 }
 
 func (p *KubernetesImagePullSecretsProvider) SetAuthenticatedRegistries(registries []registry.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.authenticatedRegistries = registries
 }
 
+func (p *KubernetesImagePullSecretsProvider) SetSourceCredentials(credentials []config.SourceCredential) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sourceCredentials = credentials
+}
+
+// sources returns the current authenticated registries and source credentials
+func (p *KubernetesImagePullSecretsProvider) sources() ([]registry.Client, []config.SourceCredential) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.authenticatedRegistries, p.sourceCredentials
+}
+
 // GetImagePullSecrets returns all secrets with their respective content
 func (p *KubernetesImagePullSecretsProvider) GetImagePullSecrets(ctx context.Context, pod *v1.Pod) (*ImagePullSecretsResult, error) {
 	var secrets = make(map[string][]byte)
@@ -100,7 +132,9 @@ func (p *KubernetesImagePullSecretsProvider) GetImagePullSecrets(ctx context.Con
 		imagePullSecrets = append(imagePullSecrets, serviceAccount.ImagePullSecrets...)
 	}
 
-	result := NewImagePullSecretsResultWithDefaults(p.authenticatedRegistries)
+	registries, credentials := p.sources()
+	result := NewImagePullSecretsResultWithDefaults(registries)
+	result.addSourceCredentials(ctx, credentials)
 	for _, imagePullSecret := range imagePullSecrets {
 		// fetch a secret only once
 		if _, exists := secrets[imagePullSecret.Name]; exists {
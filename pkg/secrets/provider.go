@@ -3,6 +3,7 @@ package secrets
 import (
 	"context"
 
+	"github.com/estahn/k8s-image-swapper/pkg/config"
 	"github.com/estahn/k8s-image-swapper/pkg/registry"
 	v1 "k8s.io/api/core/v1"
 )
@@ -10,4 +11,5 @@ import (
 type ImagePullSecretsProvider interface {
 	GetImagePullSecrets(ctx context.Context, pod *v1.Pod) (*ImagePullSecretsResult, error)
 	SetAuthenticatedRegistries(privateRegistries []registry.Client)
+	SetSourceCredentials(credentials []config.SourceCredential)
 }
@@ -0,0 +1,51 @@
+package secrets
+
+import (
+	"context"
+	"sync"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	v1 "k8s.io/api/core/v1"
+)
+
+// RegistriesImagePullSecretsProvider provides the credentials of the authenticated source registries
+// and the configured source credentials only,
+// e.g. to copy images without access to a cluster
+type RegistriesImagePullSecretsProvider struct {
+	mu                      sync.RWMutex
+	authenticatedRegistries []registry.Client
+	sourceCredentials       []config.SourceCredential
+}
+
+// NewRegistriesImagePullSecretsProvider initialises a provider of the source registry credentials
+func NewRegistriesImagePullSecretsProvider() ImagePullSecretsProvider {
+	return &RegistriesImagePullSecretsProvider{
+		authenticatedRegistries: []registry.Client{},
+	}
+}
+
+func (p *RegistriesImagePullSecretsProvider) SetAuthenticatedRegistries(registries []registry.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.authenticatedRegistries = registries
+}
+
+func (p *RegistriesImagePullSecretsProvider) SetSourceCredentials(credentials []config.SourceCredential) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sourceCredentials = credentials
+}
+
+// GetImagePullSecrets returns the credentials of the authenticated registries and the source credentials regardless of the pod
+func (p *RegistriesImagePullSecretsProvider) GetImagePullSecrets(ctx context.Context, pod *v1.Pod) (*ImagePullSecretsResult, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	result := NewImagePullSecretsResultWithDefaults(p.authenticatedRegistries)
+	result.addSourceCredentials(ctx, p.sourceCredentials)
+
+	return result, nil
+}
@@ -0,0 +1,35 @@
+package secrets
+
+import (
+	"context"
+	"testing"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestRegistriesImagePullSecretsProvider_GetImagePullSecrets(t *testing.T) {
+	provider := NewRegistriesImagePullSecretsProvider()
+
+	result, err := provider.GetImagePullSecrets(context.Background(), &corev1.Pod{})
+	assert.NoError(t, err)
+	assert.Equal(t, NewImagePullSecretsResult(), result)
+
+	registries := []registry.Client{registry.NewDummyECRClient("us-east-1", "12345678912", "", config.ECROptions{}, []byte("fake-token"))}
+	provider.SetAuthenticatedRegistries(registries)
+
+	result, err = provider.GetImagePullSecrets(context.Background(), &corev1.Pod{})
+	assert.NoError(t, err)
+	assert.Equal(t, NewImagePullSecretsResultWithDefaults(registries), result)
+	assert.Len(t, result.Secrets, 1)
+
+	t.Setenv("REGISTRY_PASSWORD", "secret")
+	provider.SetSourceCredentials([]config.SourceCredential{{Registry: "docker.io", Username: "mirror", PasswordEnv: "REGISTRY_PASSWORD"}})
+
+	result, err = provider.GetImagePullSecrets(context.Background(), &corev1.Pod{})
+	assert.NoError(t, err)
+	assert.Len(t, result.Secrets, 2)
+	assert.Contains(t, string(result.Aggregate), `"docker.io"`)
+}
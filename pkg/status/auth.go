@@ -0,0 +1,114 @@
+package status
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Middleware wraps a handler to authenticate its requests
+type Middleware func(next http.Handler) http.Handler
+
+// BasicAuth allows requests with the username and the password read from the file.
+// The file is read per request, so a rotated secret is picked up without a restart.
+func BasicAuth(username string, passwordFile string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			password, err := os.ReadFile(passwordFile)
+			if err != nil {
+				log.Err(err).Str("file", passwordFile).Msg("failed reading status password")
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			user, pass, ok := r.BasicAuth()
+			validUser := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+			validPass := subtle.ConstantTimeCompare([]byte(pass), []byte(strings.TrimRight(string(password), "\r\n"))) == 1
+			if !ok || !validUser || !validPass {
+				w.Header().Set("WWW-Authenticate", `Basic realm="k8s-image-swapper", charset="UTF-8"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// KubernetesAuth allows requests with a bearer token of a user or service account which may access the path,
+// e.g. granted by a cluster role with the rule `nonResourceURLs: ["/", "/api/v1/*"], verbs: ["get"]`.
+// The token is reviewed by the API server, which then checks the access to the path as a non-resource URL.
+func KubernetesAuth(clientset kubernetes.Interface) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || token == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="k8s-image-swapper"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			tokenReview, err := clientset.AuthenticationV1().TokenReviews().Create(r.Context(), &authenticationv1.TokenReview{
+				Spec: authenticationv1.TokenReviewSpec{Token: token},
+			}, metav1.CreateOptions{})
+			if err != nil {
+				log.Err(err).Msg("failed reviewing token of status request")
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if !tokenReview.Status.Authenticated {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="k8s-image-swapper", error="invalid_token"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			// verbs of non-resource URLs are the lowercase methods, the API server authorizes HEAD as get as well
+			verb := strings.ToLower(r.Method)
+			if r.Method == http.MethodHead {
+				verb = "get"
+			}
+
+			user := tokenReview.Status.User
+			extra := map[string]authorizationv1.ExtraValue{}
+			for key, value := range user.Extra {
+				extra[key] = authorizationv1.ExtraValue(value)
+			}
+
+			accessReview, err := clientset.AuthorizationV1().SubjectAccessReviews().Create(r.Context(), &authorizationv1.SubjectAccessReview{
+				Spec: authorizationv1.SubjectAccessReviewSpec{
+					User:   user.Username,
+					UID:    user.UID,
+					Groups: user.Groups,
+					Extra:  extra,
+					NonResourceAttributes: &authorizationv1.NonResourceAttributes{
+						Path: r.URL.Path,
+						Verb: verb,
+					},
+				},
+			}, metav1.CreateOptions{})
+			if err != nil {
+				log.Err(err).Msg("failed reviewing access of status request")
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if !accessReview.Status.Allowed {
+				log.Debug().
+					Str("user", user.Username).
+					Str("path", r.URL.Path).
+					Str("reason", accessReview.Status.Reason).
+					Msg("status request denied")
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package status
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/inventory"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/rs/zerolog/log"
+)
+
+//go:embed status.html
+var page string
+
+var pageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"time":  formatTime,
+	"bytes": formatBytes,
+}).Parse(page))
+
+// Server serves the state of the mirrored images, the copy queue and the caches of the registry clients
+type Server struct {
+	inventory       *inventory.Inventory
+	queue           *queue.Queue
+	registryClients func() []registry.Client
+}
+
+// Jobs are the copy jobs which have not been completed yet
+type Jobs struct {
+	Queued []queue.Job `json:"queued"`
+	Failed []queue.Job `json:"failed"`
+}
+
+// Cache is the content of the cache of a registry client
+type Cache struct {
+	Registry string                `json:"registry"`
+	Entries  []registry.CacheEntry `json:"entries"`
+	// Error is the reason the entries could not be listed, e.g. a shared cache is unreachable
+	Error string `json:"error,omitempty"`
+}
+
+// New returns a server for the inventory, the copy queue and the registry clients, which are looked up per request as source registries are reloaded
+func New(inv *inventory.Inventory, copyQueue *queue.Queue, registryClients func() []registry.Client) *Server {
+	return &Server{
+		inventory:       inv,
+		queue:           copyQueue,
+		registryClients: registryClients,
+	}
+}
+
+// Handler returns the handler of the status page and the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.servePage)
+	mux.HandleFunc("GET /api/v1/images", s.serveImages)
+	mux.HandleFunc("GET /api/v1/jobs", s.serveJobs)
+	mux.HandleFunc("GET /api/v1/caches", s.serveCaches)
+	mux.HandleFunc("DELETE /api/v1/caches", s.servePurgeCaches)
+
+	return mux
+}
+
+// Images returns the mirrored images known since the start
+func (s *Server) Images() []inventory.Image {
+	if s.inventory == nil {
+		return []inventory.Image{}
+	}
+
+	return s.inventory.List()
+}
+
+// Jobs returns the queued jobs and the jobs which failed permanently or exhausted their attempts
+func (s *Server) Jobs(ctx context.Context) (Jobs, error) {
+	jobs := Jobs{Queued: []queue.Job{}, Failed: []queue.Job{}}
+
+	backlog, err := s.queue.Backlog(ctx)
+	if err != nil {
+		return jobs, err
+	}
+
+	for _, job := range backlog {
+		if job.DeadLetter {
+			jobs.Failed = append(jobs.Failed, job)
+		} else {
+			jobs.Queued = append(jobs.Queued, job)
+		}
+	}
+
+	return jobs, nil
+}
+
+// Caches returns the content of the caches of the registry clients which keep one
+func (s *Server) Caches(ctx context.Context) []Cache {
+	caches := []Cache{}
+	for _, registryClient := range s.registryClients() {
+		lister, ok := registryClient.(registry.CacheLister)
+		if !ok {
+			continue
+		}
+
+		cache := Cache{Registry: registryClient.Endpoint(), Entries: []registry.CacheEntry{}}
+		entries, err := lister.CacheEntries(ctx)
+		if err != nil {
+			cache.Error = err.Error()
+		} else {
+			cache.Entries = entries
+		}
+		caches = append(caches, cache)
+	}
+
+	return caches
+}
+
+// PurgeCaches deletes the entries starting with the prefix from the cache of the registry with the endpoint,
+// an empty endpoint purges the caches of all registry clients and an empty prefix purges all entries.
+// It returns the number of purged entries and false if no registry client has the endpoint.
+func (s *Server) PurgeCaches(ctx context.Context, endpoint string, prefix string) (int, bool, error) {
+	purged, matched := 0, false
+	for _, registryClient := range s.registryClients() {
+		if endpoint != "" && registryClient.Endpoint() != endpoint {
+			continue
+		}
+		matched = true
+
+		purger, ok := registryClient.(registry.CachePurger)
+		if !ok {
+			continue
+		}
+
+		n, err := purger.PurgeCache(ctx, prefix)
+		purged += n
+		if err != nil {
+			return purged, matched, fmt.Errorf("failed purging cache of %s: %w", registryClient.Endpoint(), err)
+		}
+	}
+
+	return purged, matched, nil
+}
+
+func (s *Server) servePage(w http.ResponseWriter, r *http.Request) {
+	jobs, err := s.Jobs(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Images []inventory.Image
+		Jobs   Jobs
+		Caches []Cache
+	}{
+		Images: s.Images(),
+		Jobs:   jobs,
+		Caches: s.Caches(r.Context()),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplate.Execute(w, data); err != nil {
+		log.Err(err).Msg("failed rendering status page")
+	}
+}
+
+func (s *Server) serveImages(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct {
+		Images []inventory.Image `json:"images"`
+	}{Images: s.Images()})
+}
+
+func (s *Server) serveJobs(w http.ResponseWriter, r *http.Request) {
+	jobs, err := s.Jobs(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, jobs)
+}
+
+func (s *Server) serveCaches(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct {
+		Caches []Cache `json:"caches"`
+	}{Caches: s.Caches(r.Context())})
+}
+
+// servePurgeCaches purges the caches limited by the query parameters "registry" and "prefix"
+func (s *Server) servePurgeCaches(w http.ResponseWriter, r *http.Request) {
+	endpoint := r.URL.Query().Get("registry")
+	prefix := r.URL.Query().Get("prefix")
+
+	purged, matched, err := s.PurgeCaches(r.Context(), endpoint, prefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !matched {
+		http.Error(w, fmt.Sprintf("unknown registry %q", endpoint), http.StatusNotFound)
+		return
+	}
+
+	log.Info().Str("registry", endpoint).Str("prefix", prefix).Int("purged", purged).Msg("purged registry caches")
+
+	writeJSON(w, struct {
+		Purged int `json:"purged"`
+	}{Purged: purged})
+}
+
+func writeJSON(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Err(err).Msg("failed writing status response")
+	}
+}
+
+// formatTime renders times in UTC, unset times are left empty
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
+
+// formatBytes renders a size in binary units, unknown sizes are left empty
+func formatBytes(size int64) string {
+	if size <= 0 {
+		return ""
+	}
+
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
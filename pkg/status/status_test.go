@@ -0,0 +1,203 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alitto/pond"
+	"github.com/estahn/k8s-image-swapper/pkg/inventory"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// cachingRegistryClient is a registry client keeping a cache
+type cachingRegistryClient struct {
+	registry.Client
+	entries []registry.CacheEntry
+}
+
+func (c cachingRegistryClient) Endpoint() string { return "target.example.com" }
+
+func (c cachingRegistryClient) CacheEntries(ctx context.Context) ([]registry.CacheEntry, error) {
+	return c.entries, nil
+}
+
+func (c cachingRegistryClient) PurgeCache(ctx context.Context, prefix string) (int, error) {
+	purged := 0
+	for _, entry := range c.entries {
+		if strings.HasPrefix(entry.Key, prefix) {
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+func newServer(t *testing.T) *Server {
+	inv := inventory.New()
+	inv.Record(queue.Job{SourceImage: "docker.io/library/nginx:stable", TargetImage: "target.example.com/docker.io/library/nginx:stable"},
+		&inventory.Admission{UID: "7f6b", Namespace: "default", Owner: "ReplicaSet/nginx-5d8f", Time: time.Now()})
+	inv.RecordCopy(queue.Job{SourceImage: "docker.io/library/nginx:stable", TargetImage: "target.example.com/docker.io/library/nginx:stable"})
+
+	store := queue.NewMemoryStore()
+	pool := pond.New(1, 10)
+	t.Cleanup(pool.StopAndWait)
+	copyQueue := queue.New(pool, func(ctx context.Context, job queue.Job) error { return nil }, queue.WithStore(store))
+	require.NoError(t, store.Put(context.Background(), queue.Job{ID: "a", TargetImage: "target.example.com/docker.io/library/redis:7"}))
+	require.NoError(t, store.Put(context.Background(), queue.Job{ID: "b", TargetImage: "target.example.com/docker.io/library/busybox:1.36", DeadLetter: true, LastError: "denied"}))
+
+	registryClients := func() []registry.Client {
+		return []registry.Client{cachingRegistryClient{entries: []registry.CacheEntry{{Key: "docker.io/library/nginx"}, {Key: "quay.io/prometheus/prometheus:v2.53.0", Missing: true}}}}
+	}
+
+	return New(inv, copyQueue, registryClients)
+}
+
+func get(handler http.Handler, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder
+}
+
+func TestServer_API(t *testing.T) {
+	handler := newServer(t).Handler()
+
+	recorder := get(handler, "/api/v1/images")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var images struct {
+		Images []inventory.Image `json:"images"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &images))
+	require.Len(t, images.Images, 1)
+	assert.Equal(t, "docker.io/library/nginx:stable", images.Images[0].SourceImage)
+	assert.Equal(t, 1, images.Images[0].Copies)
+	assert.Equal(t, "ReplicaSet/nginx-5d8f", images.Images[0].LastAdmission.Owner)
+
+	recorder = get(handler, "/api/v1/jobs")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var jobs Jobs
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &jobs))
+	require.Len(t, jobs.Queued, 1)
+	assert.Equal(t, "a", jobs.Queued[0].ID)
+	require.Len(t, jobs.Failed, 1)
+	assert.Equal(t, "denied", jobs.Failed[0].LastError)
+
+	recorder = get(handler, "/api/v1/caches")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"caches":[{"registry":"target.example.com","entries":[
+		{"key":"docker.io/library/nginx","expires":"0001-01-01T00:00:00Z"},
+		{"key":"quay.io/prometheus/prometheus:v2.53.0","missing":true,"expires":"0001-01-01T00:00:00Z"}
+	]}]}`, recorder.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, get(handler, "/api/v1/unknown").Code)
+}
+
+func TestServer_Page(t *testing.T) {
+	recorder := get(newServer(t).Handler(), "/")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "<code>target.example.com/docker.io/library/nginx:stable</code>")
+	assert.Contains(t, recorder.Body.String(), "default/ReplicaSet/nginx-5d8f")
+	assert.Contains(t, recorder.Body.String(), "Failed jobs (1)")
+	assert.Contains(t, recorder.Body.String(), "(2 entries)")
+	assert.Contains(t, recorder.Body.String(), "<td>missing</td>")
+}
+
+func TestServer_PurgeCaches(t *testing.T) {
+	handler := newServer(t).Handler()
+
+	for _, test := range []struct {
+		query   string
+		expCode int
+		expBody string
+	}{
+		{query: "", expCode: http.StatusOK, expBody: `{"purged":2}`},
+		{query: "?registry=target.example.com&prefix=quay.io/", expCode: http.StatusOK, expBody: `{"purged":1}`},
+		{query: "?registry=unknown.example.com", expCode: http.StatusNotFound},
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/api/v1/caches"+test.query, nil))
+		assert.Equal(t, test.expCode, recorder.Code, test.query)
+		if test.expBody != "" {
+			assert.JSONEq(t, test.expBody, recorder.Body.String(), test.query)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("secret\n"), 0600))
+
+	handler := BasicAuth("admin", passwordFile)(newServer(t).Handler())
+
+	recorder := get(handler, "/api/v1/images")
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("WWW-Authenticate"), "Basic")
+
+	for _, test := range []struct {
+		username string
+		password string
+		expCode  int
+	}{
+		{username: "admin", password: "secret", expCode: http.StatusOK},
+		{username: "admin", password: "wrong", expCode: http.StatusUnauthorized},
+		{username: "root", password: "secret", expCode: http.StatusUnauthorized},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/api/v1/images", nil)
+		request.SetBasicAuth(test.username, test.password)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		assert.Equal(t, test.expCode, recorder.Code, "%s:%s", test.username, test.password)
+	}
+}
+
+func TestKubernetesAuth(t *testing.T) {
+	clientset := fake.NewClientset()
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "valid" || review.Spec.Token == "forbidden" {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{Username: review.Spec.Token, Groups: []string{"system:authenticated"}}
+		}
+		return true, review, nil
+	})
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		review.Status.Allowed = review.Spec.User == "valid" &&
+			review.Spec.NonResourceAttributes.Path == "/api/v1/jobs" &&
+			review.Spec.NonResourceAttributes.Verb == "get"
+		return true, review, nil
+	})
+
+	handler := KubernetesAuth(clientset)(newServer(t).Handler())
+
+	assert.Equal(t, http.StatusUnauthorized, get(handler, "/api/v1/jobs").Code)
+
+	for _, test := range []struct {
+		token   string
+		expCode int
+	}{
+		{token: "valid", expCode: http.StatusOK},
+		{token: "forbidden", expCode: http.StatusForbidden},
+		{token: "expired", expCode: http.StatusUnauthorized},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/api/v1/jobs", nil)
+		request.Header.Set("Authorization", "Bearer "+test.token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		assert.Equal(t, test.expCode, recorder.Code, test.token)
+	}
+}
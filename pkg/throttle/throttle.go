@@ -0,0 +1,225 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/metrics"
+	"golang.org/x/time/rate"
+)
+
+// slotWait is how long a copy is delayed when all slots of the registry are taken, jitter is added to spread the attempts
+const slotWait = 10 * time.Second
+
+const (
+	reasonConcurrency = "concurrency"
+	reasonRate        = "rate"
+	reasonPaused      = "paused"
+)
+
+// LimitError is returned if a copy has to wait for a limit of the registry
+type LimitError struct {
+	Registry string
+	Reason   string
+	Wait     time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit of registry %s reached, waiting %s", e.Reason, e.Registry, e.Wait.Round(time.Millisecond))
+}
+
+// Limiter bounds the concurrent copies and the rate copies start at for each registry.
+// Registries without a limit of their own use the default limit, each with its own slots and tokens.
+type Limiter struct {
+	defaults   config.RegistryLimit
+	registries map[string]config.RegistryLimit
+
+	mu       sync.Mutex
+	limiters map[string]*registryLimiter
+}
+
+// registryLimiter holds the state of the limits of a single registry, unset limits are nil
+type registryLimiter struct {
+	slots chan struct{}
+	rate  *rate.Limiter
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+// New returns a limiter applying the limit of the registry if listed, the default limit otherwise
+func New(defaults config.RegistryLimit, registries []config.RegistryLimit) *Limiter {
+	l := &Limiter{
+		defaults:   defaults,
+		registries: map[string]config.RegistryLimit{},
+		limiters:   map[string]*registryLimiter{},
+	}
+	for _, limit := range registries {
+		l.registries[limit.Registry] = limit
+	}
+
+	return l
+}
+
+// registry returns the state of the limits of the registry, creating it on first use
+func (l *Limiter) registry(registry string) *registryLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if r, exists := l.limiters[registry]; exists {
+		return r
+	}
+
+	limit, exists := l.registries[registry]
+	if !exists {
+		limit = l.defaults
+	}
+
+	r := &registryLimiter{}
+	if limit.Concurrency > 0 {
+		r.slots = make(chan struct{}, limit.Concurrency)
+	}
+	if limit.Rate > 0 {
+		burst := limit.Burst
+		if burst == 0 {
+			burst = 1
+		}
+		r.rate = rate.NewLimiter(rate.Limit(limit.Rate), burst)
+	}
+	l.limiters[registry] = r
+
+	return r
+}
+
+// TryAcquire takes a slot of the registry without waiting, a LimitError tells how long to wait if a limit is reached.
+// The returned function releases the slot once the copy is done.
+func (l *Limiter) TryAcquire(registry string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	r := l.registry(registry)
+
+	if wait := r.pausedFor(); wait > 0 {
+		return nil, l.limited(registry, reasonPaused, wait)
+	}
+
+	if r.slots != nil {
+		select {
+		case r.slots <- struct{}{}:
+		default:
+			wait := slotWait/2 + time.Duration(rand.Int63n(int64(slotWait/2)))
+			return nil, l.limited(registry, reasonConcurrency, wait)
+		}
+	}
+
+	if r.rate != nil {
+		reservation := r.rate.Reserve()
+		if wait := reservation.Delay(); wait > 0 {
+			// hand back the token, the copy reserves again once it is attempted again
+			reservation.Cancel()
+			r.releaseSlot()
+			return nil, l.limited(registry, reasonRate, wait)
+		}
+	}
+
+	return r.acquired(registry), nil
+}
+
+// Acquire takes a slot of the registry, waiting for the limits until the context is done
+func (l *Limiter) Acquire(ctx context.Context, registry string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	r := l.registry(registry)
+
+	if wait := r.pausedFor(); wait > 0 {
+		metrics.CopyThrottles.WithLabelValues(registry, reasonPaused).Inc()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+
+	if r.slots != nil {
+		select {
+		case r.slots <- struct{}{}:
+		default:
+			metrics.CopyThrottles.WithLabelValues(registry, reasonConcurrency).Inc()
+			select {
+			case r.slots <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	if r.rate != nil {
+		if !r.rate.Allow() {
+			metrics.CopyThrottles.WithLabelValues(registry, reasonRate).Inc()
+			if err := r.rate.Wait(ctx); err != nil {
+				r.releaseSlot()
+				return nil, err
+			}
+		}
+	}
+
+	return r.acquired(registry), nil
+}
+
+// Pause delays all copies of the registry, e.g. after it responded with 429 Too Many Requests
+func (l *Limiter) Pause(registry string, d time.Duration) {
+	if l == nil {
+		return
+	}
+
+	r := l.registry(registry)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if until := time.Now().Add(d); until.After(r.pausedUntil) {
+		r.pausedUntil = until
+	}
+}
+
+func (l *Limiter) limited(registry string, reason string, wait time.Duration) error {
+	metrics.CopyThrottles.WithLabelValues(registry, reason).Inc()
+
+	return &LimitError{Registry: registry, Reason: reason, Wait: wait}
+}
+
+// pausedFor returns the time left until copies of the registry may resume
+func (r *registryLimiter) pausedFor() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return time.Until(r.pausedUntil)
+}
+
+// acquired accounts for a copy which took a slot and returns the function releasing it
+func (r *registryLimiter) acquired(registry string) func() {
+	metrics.CopiesInFlight.WithLabelValues(registry).Inc()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			metrics.CopiesInFlight.WithLabelValues(registry).Dec()
+			r.releaseSlot()
+		})
+	}
+}
+
+func (r *registryLimiter) releaseSlot() {
+	if r.slots != nil {
+		<-r.slots
+	}
+}
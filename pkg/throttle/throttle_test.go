@@ -0,0 +1,125 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func reason(err error) string {
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		return ""
+	}
+
+	return limitErr.Reason
+}
+
+func TestLimiter_Concurrency(t *testing.T) {
+	limiter := New(config.RegistryLimit{Concurrency: 2}, []config.RegistryLimit{{Registry: "docker.io", Concurrency: 1}})
+
+	release, err := limiter.TryAcquire("docker.io")
+	require.NoError(t, err)
+
+	_, err = limiter.TryAcquire("docker.io")
+	assert.Equal(t, "concurrency", reason(err))
+
+	// other registries have slots of their own
+	for range 2 {
+		_, err := limiter.TryAcquire("ghcr.io")
+		require.NoError(t, err)
+	}
+	_, err = limiter.TryAcquire("ghcr.io")
+	assert.Equal(t, "concurrency", reason(err))
+
+	release()
+	release()
+	_, err = limiter.TryAcquire("docker.io")
+	assert.NoError(t, err, "releasing twice frees a single slot")
+	_, err = limiter.TryAcquire("docker.io")
+	assert.Error(t, err)
+}
+
+func TestLimiter_Rate(t *testing.T) {
+	limiter := New(config.RegistryLimit{}, []config.RegistryLimit{{Registry: "docker.io", Rate: 1, Burst: 2}})
+
+	for range 2 {
+		_, err := limiter.TryAcquire("docker.io")
+		require.NoError(t, err)
+	}
+
+	_, err := limiter.TryAcquire("docker.io")
+	var limitErr *LimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, "rate", limitErr.Reason)
+	assert.InDelta(t, time.Second, limitErr.Wait, float64(100*time.Millisecond))
+
+	// unlimited by default
+	for range 10 {
+		_, err := limiter.TryAcquire("ghcr.io")
+		require.NoError(t, err)
+	}
+}
+
+func TestLimiter_Pause(t *testing.T) {
+	limiter := New(config.RegistryLimit{}, nil)
+	limiter.Pause("docker.io", time.Minute)
+
+	_, err := limiter.TryAcquire("docker.io")
+	var limitErr *LimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, "paused", limitErr.Reason)
+	assert.Greater(t, limitErr.Wait, 59*time.Second)
+
+	// a shorter pause does not end the current one
+	limiter.Pause("docker.io", time.Second)
+	_, err = limiter.TryAcquire("docker.io")
+	assert.Error(t, err)
+
+	_, err = limiter.TryAcquire("ghcr.io")
+	assert.NoError(t, err)
+}
+
+func TestLimiter_Acquire(t *testing.T) {
+	limiter := New(config.RegistryLimit{Concurrency: 1}, nil)
+
+	release, err := limiter.Acquire(context.Background(), "docker.io")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = limiter.Acquire(ctx, "docker.io")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	acquired := make(chan struct{})
+	go func() {
+		release, err := limiter.Acquire(context.Background(), "docker.io")
+		assert.NoError(t, err)
+		release()
+		close(acquired)
+	}()
+
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting copy did not acquire the released slot")
+	}
+}
+
+func TestLimiter_Nil(t *testing.T) {
+	var limiter *Limiter
+
+	release, err := limiter.TryAcquire("docker.io")
+	require.NoError(t, err)
+	release()
+
+	limiter.Pause("docker.io", time.Minute)
+	_, err = limiter.Acquire(context.Background(), "docker.io")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name identifies the tracer of k8s-image-swapper
+const Name = "github.com/estahn/k8s-image-swapper"
+
+const serviceName = "k8s-image-swapper"
+
+// Tracer returns the tracer of the globally configured provider, it does not record spans unless Setup has been called
+func Tracer() trace.Tracer {
+	return otel.Tracer(Name)
+}
+
+// Setup configures the global tracer provider to export spans via OTLP and returns a function flushing pending spans
+func Setup(ctx context.Context, cfg config.Tracing) (func(context.Context) error, error) {
+	opts := []otlptracegrpc.Option{}
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	samplingRatio := config.DefaultTracingSamplingRatio
+	if cfg.SamplingRatio != 0 {
+		samplingRatio = cfg.SamplingRatio
+	}
+
+	provider := NewTracerProvider(sdktrace.NewBatchSpanProcessor(exporter), samplingRatio, sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(Propagator())
+
+	return provider.Shutdown, nil
+}
+
+// NewTracerProvider returns a provider sampling the given ratio of traces, child spans follow the decision of their parent
+func NewTracerProvider(processor sdktrace.SpanProcessor, samplingRatio float64, opts ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	opts = append(opts,
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(samplingRatio))),
+		sdktrace.WithSpanProcessor(processor),
+	)
+
+	return sdktrace.NewTracerProvider(opts...)
+}
+
+// Propagator returns the propagator for W3C trace context and baggage
+func Propagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+}
+
+// Inject returns the trace context of the span in ctx, e.g. to persist it along with a job
+func Inject(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+
+	return carrier
+}
+
+// Extract returns the span context previously injected into the carrier
+func Extract(carrier map[string]string) trace.SpanContext {
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier(carrier))
+
+	return trace.SpanContextFromContext(ctx)
+}
+
+// End records the error, if any, and ends the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
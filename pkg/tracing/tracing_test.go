@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestNewTracerProvider_Sampling(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := NewTracerProvider(sdktrace.NewSimpleSpanProcessor(exporter), 0)
+	tracer := provider.Tracer(Name)
+
+	_, span := tracer.Start(context.Background(), "unsampled")
+	span.End()
+	assert.Empty(t, exporter.GetSpans())
+
+	exporter = tracetest.NewInMemoryExporter()
+	provider = NewTracerProvider(sdktrace.NewSimpleSpanProcessor(exporter), 1)
+	tracer = provider.Tracer(Name)
+
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	_, child := tracer.Start(ctx, "child")
+	child.End()
+	parent.End()
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, spans[1].SpanContext.SpanID(), spans[0].Parent.SpanID())
+}
+
+func TestInjectExtract(t *testing.T) {
+	assert.Nil(t, Inject(context.Background()))
+	assert.False(t, Extract(nil).IsValid())
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := NewTracerProvider(sdktrace.NewSimpleSpanProcessor(exporter), 1)
+
+	ctx, span := provider.Tracer(Name).Start(context.Background(), "admission")
+	defer span.End()
+
+	carrier := Inject(ctx)
+	assert.Contains(t, carrier, "traceparent")
+
+	spanContext := Extract(carrier)
+	assert.True(t, spanContext.IsValid())
+	assert.Equal(t, span.SpanContext().TraceID(), spanContext.TraceID())
+	assert.Equal(t, span.SpanContext().SpanID(), spanContext.SpanID())
+}
+
+func TestEnd(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := NewTracerProvider(sdktrace.NewSimpleSpanProcessor(exporter), 1)
+	tracer := provider.Tracer(Name)
+
+	_, span := tracer.Start(context.Background(), "success")
+	End(span, nil)
+	_, span = tracer.Start(context.Background(), "failure")
+	End(span, errors.New("copy failed"))
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, codes.Unset, spans[0].Status.Code)
+	assert.Equal(t, codes.Error, spans[1].Status.Code)
+	assert.Equal(t, "copy failed", spans[1].Status.Description)
+	assert.Len(t, spans[1].Events, 1)
+}
@@ -71,3 +71,93 @@ func ParseImageCopyPolicy(p string) (ImageCopyPolicy, error) {
 	}
 	return ImageCopyPolicyDelayed, fmt.Errorf("unknown image copy policy string: '%s', defaulting to delayed", p)
 }
+
+type QueueOverflowPolicy int
+
+const (
+	QueueOverflowPolicyBlock = iota
+	QueueOverflowPolicyDrop
+	QueueOverflowPolicyDefer
+)
+
+func (p QueueOverflowPolicy) String() string {
+	return [...]string{"block", "drop", "defer"}[p]
+}
+
+func ParseQueueOverflowPolicy(p string) (QueueOverflowPolicy, error) {
+	switch p {
+	case QueueOverflowPolicy(QueueOverflowPolicyBlock).String():
+		return QueueOverflowPolicyBlock, nil
+	case QueueOverflowPolicy(QueueOverflowPolicyDrop).String():
+		return QueueOverflowPolicyDrop, nil
+	case QueueOverflowPolicy(QueueOverflowPolicyDefer).String():
+		return QueueOverflowPolicyDefer, nil
+	}
+	return QueueOverflowPolicyBlock, fmt.Errorf("unknown queue overflow policy string: '%s', defaulting to block", p)
+}
+
+type QueueStore int
+
+const (
+	QueueStoreMemory = iota
+	QueueStoreFile
+	QueueStoreKubernetes
+)
+
+func (p QueueStore) String() string {
+	return [...]string{"memory", "file", "kubernetes"}[p]
+}
+
+func ParseQueueStore(p string) (QueueStore, error) {
+	switch p {
+	case QueueStore(QueueStoreMemory).String():
+		return QueueStoreMemory, nil
+	case QueueStore(QueueStoreFile).String():
+		return QueueStoreFile, nil
+	case QueueStore(QueueStoreKubernetes).String():
+		return QueueStoreKubernetes, nil
+	}
+	return QueueStoreMemory, fmt.Errorf("unknown queue store string: '%s', defaulting to memory", p)
+}
+
+type StatusAuth int
+
+const (
+	StatusAuthKubernetes = iota
+	StatusAuthBasic
+)
+
+func (p StatusAuth) String() string {
+	return [...]string{"kubernetes", "basic"}[p]
+}
+
+func ParseStatusAuth(p string) (StatusAuth, error) {
+	switch p {
+	case StatusAuth(StatusAuthKubernetes).String():
+		return StatusAuthKubernetes, nil
+	case StatusAuth(StatusAuthBasic).String():
+		return StatusAuthBasic, nil
+	}
+	return StatusAuthKubernetes, fmt.Errorf("unknown status auth string: '%s', defaulting to kubernetes", p)
+}
+
+type CacheType int
+
+const (
+	CacheTypeMemory = iota
+	CacheTypeRedis
+)
+
+func (p CacheType) String() string {
+	return [...]string{"memory", "redis"}[p]
+}
+
+func ParseCacheType(p string) (CacheType, error) {
+	switch p {
+	case CacheType(CacheTypeMemory).String():
+		return CacheTypeMemory, nil
+	case CacheType(CacheTypeRedis).String():
+		return CacheTypeRedis, nil
+	}
+	return CacheTypeMemory, fmt.Errorf("unknown cache type string: '%s', defaulting to memory", p)
+}
@@ -93,3 +93,177 @@ func TestParseImageCopyPolicy(t *testing.T) {
 		})
 	}
 }
+
+func TestParseQueueOverflowPolicy(t *testing.T) {
+	type args struct {
+		p string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    QueueOverflowPolicy
+		wantErr bool
+	}{
+		{
+			name: "block",
+			args: args{p: "block"},
+			want: QueueOverflowPolicyBlock,
+		},
+		{
+			name: "drop",
+			args: args{p: "drop"},
+			want: QueueOverflowPolicyDrop,
+		},
+		{
+			name: "defer",
+			args: args{p: "defer"},
+			want: QueueOverflowPolicyDefer,
+		},
+		{
+			name:    "random-non-existent",
+			args:    args{p: "random-non-existent"},
+			want:    QueueOverflowPolicyBlock,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseQueueOverflowPolicy(tt.args.p)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseQueueOverflowPolicy() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseQueueOverflowPolicy() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQueueStore(t *testing.T) {
+	type args struct {
+		p string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    QueueStore
+		wantErr bool
+	}{
+		{
+			name: "memory",
+			args: args{p: "memory"},
+			want: QueueStoreMemory,
+		},
+		{
+			name: "file",
+			args: args{p: "file"},
+			want: QueueStoreFile,
+		},
+		{
+			name: "kubernetes",
+			args: args{p: "kubernetes"},
+			want: QueueStoreKubernetes,
+		},
+		{
+			name:    "random-non-existent",
+			args:    args{p: "random-non-existent"},
+			want:    QueueStoreMemory,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseQueueStore(tt.args.p)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseQueueStore() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseQueueStore() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStatusAuth(t *testing.T) {
+	type args struct {
+		p string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    StatusAuth
+		wantErr bool
+	}{
+		{
+			name: "kubernetes",
+			args: args{p: "kubernetes"},
+			want: StatusAuthKubernetes,
+		},
+		{
+			name: "basic",
+			args: args{p: "basic"},
+			want: StatusAuthBasic,
+		},
+		{
+			name:    "random-non-existent",
+			args:    args{p: "random-non-existent"},
+			want:    StatusAuthKubernetes,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseStatusAuth(tt.args.p)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseStatusAuth() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseStatusAuth() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCacheType(t *testing.T) {
+	type args struct {
+		p string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    CacheType
+		wantErr bool
+	}{
+		{
+			name: "memory",
+			args: args{p: "memory"},
+			want: CacheTypeMemory,
+		},
+		{
+			name: "redis",
+			args: args{p: "redis"},
+			want: CacheTypeRedis,
+		},
+		{
+			name:    "random-non-existent",
+			args:    args{p: "random-non-existent"},
+			want:    CacheTypeMemory,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCacheType(tt.args.p)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseCacheType() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseCacheType() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
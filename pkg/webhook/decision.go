@@ -0,0 +1,51 @@
+package webhook
+
+// Decision explains how the image of a container was handled by an admission
+type Decision struct {
+	Container     string `json:"container"`
+	InitContainer bool   `json:"initContainer,omitempty"`
+	SourceImage   string `json:"sourceImage"`
+	TargetImage   string `json:"targetImage,omitempty"`
+
+	// Filters are the filters evaluated in order, up to the first match or error
+	Filters []FilterResult `json:"filters,omitempty"`
+
+	// Copy is the image copy policy applied, empty if the image is not copied
+	Copy string `json:"copy,omitempty"`
+
+	// Result is the outcome as counted by the swaps metric, e.g. swapped, filtered or not_found
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// FilterResult is the result of evaluating a filter for a container
+type FilterResult struct {
+	JMESPath string      `json:"jmespath"`
+	Result   interface{} `json:"result"`
+	Matched  bool        `json:"matched"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// Decisions allows to pass a function receiving the decision about each container of an admitted pod, e.g. to explain it
+func Decisions(record func(Decision)) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.decisionRecorder = record
+	}
+}
+
+// DecisionsOnly makes the swapper only decide about the images of admitted pods, e.g. to explain the decisions.
+// Images are never copied nor queued, and no metrics, events or inventory are recorded.
+func DecisionsOnly() Option {
+	return func(swapper *ImageSwapper) {
+		swapper.decisionsOnly = true
+	}
+}
+
+// recordDecision passes the decision to the recorder if configured
+func (p *ImageSwapper) recordDecision(decision Decision) {
+	if p.decisionRecorder == nil {
+		return
+	}
+
+	p.decisionRecorder(decision)
+}
@@ -0,0 +1,64 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/types"
+	kwhmodel "github.com/slok/kubewebhook/v2/pkg/model"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestImageSwapper_Decisions(t *testing.T) {
+	decisions := []Decision{}
+	imageSwapper := NewImageSwapperWithOpts(
+		emptyRegistryClient{},
+		Filters([]config.JMESPathFilter{
+			{JMESPath: "obj.metadata.name"},
+			{JMESPath: "container.name == 'sidecar'"},
+		}),
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyNone),
+		Decisions(func(decision Decision) { decisions = append(decisions, decision) }),
+	)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx"},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "Invalid:Image"}},
+			Containers: []corev1.Container{
+				{Name: "nginx", Image: "nginx:latest"},
+				{Name: "sidecar", Image: "busybox:1.36"},
+			},
+		},
+	}
+	_, err := imageSwapper.Mutate(context.Background(), &kwhmodel.AdmissionReview{
+		Namespace:  "test-ns",
+		RequestGVK: &metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+	}, pod)
+	assert.NoError(t, err)
+
+	assert.Len(t, decisions, 3)
+
+	assert.Equal(t, "nginx", decisions[0].Container)
+	assert.Equal(t, "registry.example.com/docker.io/library/nginx:latest", decisions[0].TargetImage)
+	assert.Equal(t, "not_found", decisions[0].Result)
+	assert.Empty(t, decisions[0].Copy)
+	assert.Equal(t, []FilterResult{
+		{JMESPath: "obj.metadata.name", Result: "nginx", Error: "filter does not return a bool value"},
+		{JMESPath: "container.name == 'sidecar'", Result: false},
+	}, decisions[0].Filters)
+
+	assert.Equal(t, "sidecar", decisions[1].Container)
+	assert.Equal(t, "filtered", decisions[1].Result)
+	assert.Empty(t, decisions[1].TargetImage)
+	assert.True(t, decisions[1].Filters[1].Matched)
+
+	assert.Equal(t, "init", decisions[2].Container)
+	assert.True(t, decisions[2].InitContainer)
+	assert.Equal(t, "invalid", decisions[2].Result)
+	assert.NotEmpty(t, decisions[2].Error)
+}
@@ -0,0 +1,60 @@
+package webhook
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Reasons of the events recorded for the outcome of copies, swaps and re-syncs
+const (
+	EventReasonImageMirrored     = "ImageMirrored"
+	EventReasonImageMirrorFailed = "ImageMirrorFailed"
+	EventReasonImageNotSwapped   = "ImageNotSwapped"
+	EventReasonImageDrifted      = "ImageDrifted"
+)
+
+// maxEventMessageLength keeps messages within the limit the kubelet applies, copy errors carry the skopeo output
+const maxEventMessageLength = 1024
+
+// eventTarget returns the object events about the pod are recorded on.
+// Pods are admitted before they exist and often carry a generated name, the owning controller,
+// e.g. a ReplicaSet, is the object application teams look at.
+func eventTarget(pod *corev1.Pod) *corev1.ObjectReference {
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		return &corev1.ObjectReference{
+			APIVersion: owner.APIVersion,
+			Kind:       owner.Kind,
+			Namespace:  pod.Namespace,
+			Name:       owner.Name,
+			UID:        owner.UID,
+		}
+	}
+
+	if pod.Name == "" {
+		return nil
+	}
+
+	return &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Namespace:  pod.Namespace,
+		Name:       pod.Name,
+		UID:        pod.UID,
+	}
+}
+
+// recordEvent records an event on the target if events are enabled
+func (p *ImageSwapper) recordEvent(target *corev1.ObjectReference, eventType, reason, messageFmt string, args ...interface{}) {
+	if p.eventRecorder == nil || target == nil {
+		return
+	}
+
+	message := fmt.Sprintf(messageFmt, args...)
+	if len(message) > maxEventMessageLength {
+		message = message[:maxEventMessageLength-3] + "..."
+	}
+
+	p.eventRecorder.Event(target, eventType, reason, message)
+}
@@ -0,0 +1,124 @@
+package webhook
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/estahn/k8s-image-swapper/pkg/types"
+	kwhmodel "github.com/slok/kubewebhook/v2/pkg/model"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// emptyRegistryClient is a target registry not holding any image
+type emptyRegistryClient struct{}
+
+func (emptyRegistryClient) CreateRepository(ctx context.Context, name string) error { return nil }
+func (emptyRegistryClient) RepositoryExists() bool                                  { return false }
+func (emptyRegistryClient) CopyImage(ctx context.Context, src ctypes.ImageReference, srcCreds string, dest ctypes.ImageReference, destCreds string) error {
+	return nil
+}
+func (emptyRegistryClient) PullImage() error { return nil }
+func (emptyRegistryClient) PutImage() error  { return nil }
+func (emptyRegistryClient) ImageExists(ctx context.Context, ref ctypes.ImageReference) bool {
+	return false
+}
+func (emptyRegistryClient) ListImages(ctx context.Context) ([]registry.Image, error) {
+	return []registry.Image{}, nil
+}
+func (emptyRegistryClient) DeleteImage(ctx context.Context, image registry.Image) error { return nil }
+func (emptyRegistryClient) DeleteRepository(ctx context.Context, name string) error     { return nil }
+func (emptyRegistryClient) Endpoint() string                                            { return "registry.example.com" }
+func (emptyRegistryClient) Credentials() string                                         { return "" }
+func (emptyRegistryClient) IsOrigin(imageRef ctypes.ImageReference) bool                { return false }
+func (emptyRegistryClient) Close()                                                      {}
+
+func TestEventTarget(t *testing.T) {
+	controller := true
+	ownedPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:    "test-ns",
+			GenerateName: "nginx-5d8f9c-",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "apps/v1",
+				Kind:       "ReplicaSet",
+				Name:       "nginx-5d8f9c",
+				UID:        "1234",
+				Controller: &controller,
+			}},
+		},
+	}
+	assert.Equal(t, &corev1.ObjectReference{
+		APIVersion: "apps/v1",
+		Kind:       "ReplicaSet",
+		Namespace:  "test-ns",
+		Name:       "nginx-5d8f9c",
+		UID:        "1234",
+	}, eventTarget(ownedPod))
+
+	namedPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "nginx"}}
+	assert.Equal(t, &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Namespace:  "test-ns",
+		Name:       "nginx",
+	}, eventTarget(namedPod))
+
+	// a pod with a generated name does not exist yet, there is nothing to record events on
+	assert.Nil(t, eventTarget(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", GenerateName: "nginx-"}}))
+}
+
+func TestImageSwapper_recordEvent(t *testing.T) {
+	target := &corev1.ObjectReference{Kind: "Pod", Namespace: "test-ns", Name: "nginx"}
+
+	// events are not recorded without recorder
+	imageSwapper := NewImageSwapperWithOpts(nil)
+	imageSwapper.recordEvent(target, corev1.EventTypeNormal, EventReasonImageMirrored, "Mirrored image %s", "nginx")
+
+	recorder := record.NewFakeRecorder(10)
+	imageSwapper = NewImageSwapperWithOpts(nil, EventRecorder(recorder))
+
+	imageSwapper.recordEvent(nil, corev1.EventTypeNormal, EventReasonImageMirrored, "Mirrored image %s", "nginx")
+	imageSwapper.recordEvent(target, corev1.EventTypeNormal, EventReasonImageMirrored, "Mirrored image %s", "nginx")
+	imageSwapper.recordEvent(target, corev1.EventTypeWarning, EventReasonImageMirrorFailed, "Failed: %s", strings.Repeat("x", 2000))
+
+	assert.Equal(t, "Normal ImageMirrored Mirrored image nginx", <-recorder.Events)
+
+	event := <-recorder.Events
+	assert.True(t, strings.HasPrefix(event, "Warning ImageMirrorFailed Failed: xxx"))
+	assert.True(t, strings.HasSuffix(event, "..."))
+	assert.Len(t, event, len("Warning ImageMirrorFailed ")+maxEventMessageLength)
+
+	assert.Empty(t, recorder.Events)
+}
+
+func TestImageSwapper_MutateRecordsImageNotSwapped(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	imageSwapper := NewImageSwapperWithOpts(
+		emptyRegistryClient{},
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyNone),
+		EventRecorder(recorder),
+	)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "nginx", Image: "nginx:latest"}},
+		},
+	}
+
+	result, err := imageSwapper.Mutate(context.Background(), &kwhmodel.AdmissionReview{
+		Namespace:  "test-ns",
+		RequestGVK: &metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+	}, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, "nginx:latest", result.MutatedObject.(*corev1.Pod).Spec.Containers[0].Image)
+
+	assert.Equal(t, "Warning ImageNotSwapped Image nginx:latest of container nginx not swapped, registry.example.com/docker.io/library/nginx:latest not found in target registry", <-recorder.Events)
+}
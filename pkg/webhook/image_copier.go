@@ -4,11 +4,25 @@ import (
 	"context"
 	"errors"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/transports/alltransports"
 	ctypes "github.com/containers/image/v5/types"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/inventory"
+	"github.com/estahn/k8s-image-swapper/pkg/metrics"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/estahn/k8s-image-swapper/pkg/throttle"
+	"github.com/estahn/k8s-image-swapper/pkg/tracing"
 	"github.com/rs/zerolog/log"
+	kwhmodel "github.com/slok/kubewebhook/v2/pkg/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // struct representing a job of copying an image with its subcontext
@@ -20,11 +34,21 @@ type ImageCopier struct {
 	imagePullPolicy corev1.PullPolicy
 	imageSwapper    *ImageSwapper
 
+	// eventTarget is the object events about the copy are recorded on
+	eventTarget *corev1.ObjectReference
+
+	// queued copies do not wait for the limits of the registries, the job is rescheduled instead
+	queued bool
+
+	// receivedBytes is the data the copy received, it is only measured by the bandwidth limiter
+	receivedBytes int64
+
 	context       context.Context
 	cancelContext context.CancelFunc
 }
 
 type Task struct {
+	name        string
 	function    func() error
 	description string
 }
@@ -33,48 +57,304 @@ var ErrImageAlreadyPresent = errors.New("image already present in target registr
 
 // replace the default context with a new one with a timeout
 func (ic *ImageCopier) withDeadline() *ImageCopier {
-	imageCopierContext, imageCopierContextCancel := context.WithTimeout(ic.context, ic.imageSwapper.imageCopyDeadline)
+	imageCopierContext, imageCopierContextCancel := context.WithTimeout(ic.context, ic.imageSwapper.settings().ImageCopyDeadline)
 	ic.context = imageCopierContext
 	ic.cancelContext = imageCopierContextCancel
 	return ic
 }
 
-// start the image copy job
+// job returns the description of the copy which can be persisted in the copy queue
+func (ic *ImageCopier) job() queue.Job {
+	imagePullSecrets := []string{}
+	for _, imagePullSecret := range ic.sourcePod.Spec.ImagePullSecrets {
+		imagePullSecrets = append(imagePullSecrets, imagePullSecret.Name)
+	}
+
+	return queue.Job{
+		SourceImage:        ic.sourceImageRef.DockerReference().String(),
+		TargetImage:        ic.targetImageRef.DockerReference().String(),
+		ImagePullPolicy:    ic.imagePullPolicy,
+		Namespace:          ic.sourcePod.Namespace,
+		PodName:            ic.sourcePod.Name,
+		ServiceAccountName: ic.sourcePod.Spec.ServiceAccountName,
+		ImagePullSecrets:   imagePullSecrets,
+		EventTarget:        ic.eventTarget,
+	}
+}
+
+// ErrTargetImage is returned for images which originate from the target registry already
+var ErrTargetImage = errors.New("image originates from the target registry")
+
+// sourceRef parses the image to mirror, images of the target registry are not mirrored
+func (p *ImageSwapper) sourceRef(image string) (ctypes.ImageReference, error) {
+	normalizedName, err := imageNamesWithDigestOrTag(image)
+	if err != nil {
+		return nil, err
+	}
+
+	srcRef, err := alltransports.ParseImageName("docker://" + normalizedName)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.registryClient.IsOrigin(srcRef) {
+		return nil, ErrTargetImage
+	}
+
+	return srcRef, nil
+}
+
+// CopyJob returns the job mirroring the image of a container the same way an admission of the pod does.
+// It returns false if the image is not mirrored, i.e. it is invalid, originates from the target registry or is filtered.
+func (p *ImageSwapper) CopyJob(pod *corev1.Pod, container corev1.Container) (queue.Job, bool) {
+	srcRef, err := p.sourceRef(container.Image)
+	if err != nil {
+		return queue.Job{}, false
+	}
+
+	filterCtx := NewFilterContext(kwhmodel.AdmissionReview{Namespace: pod.Namespace}, pod, container)
+	if filterMatch(filterCtx, p.settings().Filters) {
+		return queue.Job{}, false
+	}
+
+	imageCopier := ImageCopier{
+		sourcePod:       pod,
+		eventTarget:     eventTarget(pod),
+		sourceImageRef:  srcRef,
+		targetImageRef:  p.targetRef(srcRef),
+		imagePullPolicy: container.ImagePullPolicy,
+	}
+	job := imageCopier.job()
+	job.ID = queue.JobID(job.TargetImage)
+
+	return job, true
+}
+
+// ImageJob returns the job mirroring an image independent of any pod, e.g. an image read from a list.
+// Filters do not apply as they match pods, images of the target registry return ErrTargetImage.
+func (p *ImageSwapper) ImageJob(image string) (queue.Job, error) {
+	srcRef, err := p.sourceRef(image)
+	if err != nil {
+		return queue.Job{}, err
+	}
+
+	imageCopier := ImageCopier{
+		sourcePod:       &corev1.Pod{},
+		sourceImageRef:  srcRef,
+		targetImageRef:  p.targetRef(srcRef),
+		imagePullPolicy: corev1.PullIfNotPresent,
+	}
+	job := imageCopier.job()
+	job.ID = queue.JobID(job.TargetImage)
+
+	return job, nil
+}
+
+// Copy executes a copy job on the backfill lane instead of queueing it, waiting for the limits of the registries
+func (p *ImageSwapper) Copy(ctx context.Context, job queue.Job) (err error) {
+	p.backfillCopier.SubmitAndWait(func() {
+		err = p.copyJob(ctx, job, false)
+	})
+
+	return err
+}
+
+// processCopyJob executes a job of the copy queue
+func (p *ImageSwapper) processCopyJob(ctx context.Context, job queue.Job) error {
+	return p.copyJob(ctx, job, true)
+}
+
+// copyJob rebuilds an image copier from a job and executes it
+func (p *ImageSwapper) copyJob(ctx context.Context, job queue.Job, queued bool) (err error) {
+	spanOptions := []trace.SpanStartOption{trace.WithAttributes(
+		attribute.String("job.id", job.ID),
+		attribute.Int("job.attempts", job.Attempts),
+	)}
+	// link the copy to the admission which queued it, the admission has finished long ago
+	if spanContext := tracing.Extract(job.TraceContext); spanContext.IsValid() {
+		spanOptions = append(spanOptions, trace.WithLinks(trace.Link{SpanContext: spanContext}))
+	}
+
+	ctx, span := tracing.Tracer().Start(ctx, "ImageSwapper.processCopyJob", spanOptions...)
+	defer func() { tracing.End(span, err) }()
+
+	logger := log.With().
+		Str("job", job.ID).
+		Str("namespace", job.Namespace).
+		Str("name", job.PodName).
+		Str("source-image", job.SourceImage).
+		Str("target-image", job.TargetImage).
+		Logger()
+
+	srcRef, err := alltransports.ParseImageName("docker://" + job.SourceImage)
+	if err != nil {
+		logger.Err(err).Msg("invalid source image in copy job")
+		return queue.Permanent(err)
+	}
+
+	targetRef, err := alltransports.ParseImageName("docker://" + job.TargetImage)
+	if err != nil {
+		logger.Err(err).Msg("invalid target image in copy job")
+		return queue.Permanent(err)
+	}
+
+	imageCopier := &ImageCopier{
+		sourcePod:       jobPod(job),
+		sourceImageRef:  srcRef,
+		targetImageRef:  targetRef,
+		imagePullPolicy: job.ImagePullPolicy,
+		imageSwapper:    p,
+		eventTarget:     job.EventTarget,
+		queued:          queued,
+		context:         logger.WithContext(ctx),
+	}
+
+	return imageCopier.copy()
+}
+
+// jobPod returns the pod of a job, it only carries the details required to look up image pull secrets
+func jobPod(job queue.Job) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: job.Namespace,
+			Name:      job.PodName,
+		},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: job.ServiceAccountName,
+		},
+	}
+	for _, imagePullSecret := range job.ImagePullSecrets {
+		pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: imagePullSecret})
+	}
+
+	return pod
+}
+
+// start the image copy job, errors are logged
 func (ic *ImageCopier) start() {
-	if _, hasDeadline := ic.context.Deadline(); hasDeadline {
+	_ = ic.copy()
+}
+
+// copy executes the tasks required to copy the image and returns the error of the failed task.
+// Errors retrying will not resolve are marked as permanent.
+func (ic *ImageCopier) copy() (err error) {
+	if ic.cancelContext != nil {
 		defer ic.cancelContext()
 	}
 
+	var span trace.Span
+	ic.context, span = tracing.Tracer().Start(ic.context, "ImageCopier.copy", trace.WithAttributes(
+		attribute.String("source.image", ic.sourceImageRef.DockerReference().String()),
+		attribute.String("target.image", ic.targetImageRef.DockerReference().String()),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	sourceRegistry := reference.Domain(ic.sourceImageRef.DockerReference())
+	start := time.Now()
+	result := "success"
+	defer func() {
+		// the copy has not been attempted while waiting for a limit of a registry
+		if result == "throttled" {
+			return
+		}
+
+		metrics.Copies.WithLabelValues(result, sourceRegistry).Inc()
+		metrics.CopyDuration.WithLabelValues(result, sourceRegistry).Observe(time.Since(start).Seconds())
+		switch result {
+		case "success":
+			ic.recordCopiedBytes(sourceRegistry)
+			ic.imageSwapper.recordEvent(ic.eventTarget, corev1.EventTypeNormal, EventReasonImageMirrored,
+				"Mirrored image %s to %s", ic.sourceImageRef.DockerReference().String(), ic.targetImageRef.DockerReference().String())
+		case "failure", "timeout":
+			ic.imageSwapper.recordEvent(ic.eventTarget, corev1.EventTypeWarning, EventReasonImageMirrorFailed,
+				"Failed to mirror image %s to %s: %v", ic.sourceImageRef.DockerReference().String(), ic.targetImageRef.DockerReference().String(), err)
+		}
+	}()
+
 	// list of actions to execute in order to copy an image
 	tasks := []*Task{
 		{
+			name:        "checkImage",
 			function:    ic.taskCheckImage,
 			description: "checking image presence in target registry",
 		},
 		{
+			name:        "createRepository",
 			function:    ic.taskCreateRepository,
 			description: "creating a new repository in target registry",
 		},
 		{
+			name:        "copyImage",
 			function:    ic.taskCopyImage,
 			description: "copying image data to target repository",
 		},
 	}
 
 	for _, task := range tasks {
-		err := ic.run(task.function)
+		err := ic.runTask(task)
 
 		if err != nil {
-			if errors.Is(err, context.DeadlineExceeded) {
+			var limitErr *throttle.LimitError
+			if errors.As(err, &limitErr) {
+				result = "throttled"
+				log.Ctx(ic.context).Debug().Err(err).Msg("image copy throttled")
+			} else if errors.Is(err, context.DeadlineExceeded) {
+				result = "timeout"
 				log.Ctx(ic.context).Err(err).Msg("timeout during image copy")
 			} else if errors.Is(err, ErrImageAlreadyPresent) {
+				result = "already_present"
 				log.Ctx(ic.context).Trace().Msgf("image copy aborted: %s", err.Error())
+				return nil
 			} else {
+				result = "failure"
 				log.Ctx(ic.context).Err(err).Msgf("image copy error while %s", task.description)
 			}
-			break
+
+			if registry.IsPermanentError(err) {
+				return queue.Permanent(err)
+			}
+			return err
 		}
 	}
+
+	return nil
+}
+
+// recordCopiedBytes accounts for the bytes received by the copy and records the copy in the inventory
+func (ic *ImageCopier) recordCopiedBytes(sourceRegistry string) {
+	if ic.receivedBytes > 0 {
+		metrics.CopyBytes.WithLabelValues(sourceRegistry).Add(float64(ic.receivedBytes))
+	}
+
+	if ic.imageSwapper.inventory == nil {
+		return
+	}
+
+	ic.imageSwapper.inventory.RecordCopy(ic.job())
+	if ic.receivedBytes > 0 {
+		ic.imageSwapper.inventory.Update(ic.targetImageRef.DockerReference().String(), func(image *inventory.Image) {
+			image.Size = ic.receivedBytes
+		})
+	}
+}
+
+// runTask runs a task within its own span
+func (ic *ImageCopier) runTask(task *Task) error {
+	parent := ic.context
+	defer func() { ic.context = parent }()
+
+	var span trace.Span
+	ic.context, span = tracing.Tracer().Start(parent, "ImageCopier."+task.name)
+
+	err := ic.run(task.function)
+	if errors.Is(err, ErrImageAlreadyPresent) {
+		span.SetAttributes(attribute.Bool("image.present", true))
+		span.End()
+	} else {
+		tracing.End(span, err)
+	}
+
+	return err
 }
 
 // run a task function and check for timeout
@@ -108,7 +388,15 @@ func (ic *ImageCopier) taskCreateRepository() error {
 
 func (ic *ImageCopier) taskCopyImage() error {
 	ctx := ic.context
+
+	release, err := ic.acquireCopyLimits()
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	// Retrieve secrets and auth credentials
+	defer ic.imageSwapper.useCredentials()()
 	imagePullSecrets, err := ic.imageSwapper.imagePullSecretProvider.GetImagePullSecrets(ctx, ic.sourcePod)
 	// not possible at the moment
 	if err != nil {
@@ -130,10 +418,78 @@ func (ic *ImageCopier) taskCopyImage() error {
 		return err
 	}
 
+	env, done := ic.imageSwapper.bandwidth.Job()
+	ctx = registry.WithEnv(ctx, env...)
+
 	// Copy image
 	// TODO: refactor to use structure instead of passing file name / string
 	//
 	//	or transform registryClient creds into auth compatible form, e.g.
 	//	{"auths":{"aws_account_id.dkr.ecr.region.amazonaws.com":{"username":"AWS","password":"..."	}}}
-	return ic.imageSwapper.registryClient.CopyImage(ctx, ic.sourceImageRef, authFile.Name(), ic.targetImageRef, ic.imageSwapper.registryClient.Credentials())
+	err = ic.imageSwapper.registryClient.CopyImage(ctx, ic.sourceImageRef, authFile.Name(), ic.targetImageRef, ic.imageSwapper.registryClient.Credentials())
+	ic.receivedBytes = done()
+	if registry.IsTooManyRequests(err) {
+		return ic.tooManyRequests(err)
+	}
+
+	return err
+}
+
+// acquireCopyLimits takes a slot of the source and the target registry, the returned function releases both.
+// Queued copies do not wait for a limit, the job is rescheduled once the limit is expected to allow it.
+func (ic *ImageCopier) acquireCopyLimits() (func(), error) {
+	acquire := func(limiter *throttle.Limiter, registryName string) (func(), error) {
+		if !ic.queued {
+			return limiter.Acquire(ic.context, registryName)
+		}
+
+		release, err := limiter.TryAcquire(registryName)
+		var limitErr *throttle.LimitError
+		if errors.As(err, &limitErr) {
+			return nil, queue.Throttled(err, limitErr.Wait)
+		}
+
+		return release, err
+	}
+
+	releaseSource, err := acquire(ic.imageSwapper.sourceLimiter, reference.Domain(ic.sourceImageRef.DockerReference()))
+	if err != nil {
+		return nil, err
+	}
+
+	releaseTarget, err := acquire(ic.imageSwapper.targetLimiter, ic.imageSwapper.registryClient.Endpoint())
+	if err != nil {
+		releaseSource()
+		return nil, err
+	}
+
+	return func() {
+		releaseTarget()
+		releaseSource()
+	}, nil
+}
+
+// tooManyRequests pauses the copies against the registry which responded with 429 Too Many Requests for the requested
+// Retry-After, or the configured backoff. The job is rescheduled once the pause is over, the queue counts the attempt
+// once the registry rejected the job too often.
+func (ic *ImageCopier) tooManyRequests(err error) error {
+	backoff := config.DefaultTooManyRequestsBackoff
+	if ic.imageSwapper.tooManyRequestsBackoff != 0 {
+		backoff = ic.imageSwapper.tooManyRequestsBackoff
+	}
+	if retryAfter, ok := registry.RetryAfter(err); ok {
+		backoff = retryAfter
+	}
+
+	// the target repositories are named after the source, the target is only blamed if its domain is mentioned
+	limiter, registryName := ic.imageSwapper.sourceLimiter, reference.Domain(ic.sourceImageRef.DockerReference())
+	if targetRegistry := ic.imageSwapper.registryClient.Endpoint(); strings.Contains(err.Error(), targetRegistry) {
+		limiter, registryName = ic.imageSwapper.targetLimiter, targetRegistry
+	}
+
+	log.Ctx(ic.context).Warn().Str("registry", registryName).Dur("backoff", backoff).Msg("registry responded with too many requests, pausing copies")
+	metrics.TooManyRequests.WithLabelValues(registryName).Inc()
+	limiter.Pause(registryName, backoff)
+
+	return queue.TooManyRequests(err, backoff)
 }
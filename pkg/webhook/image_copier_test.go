@@ -8,20 +8,26 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
 	"github.com/estahn/k8s-image-swapper/pkg/registry"
+	"github.com/estahn/k8s-image-swapper/pkg/tracing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestImageCopier_withDeadline(t *testing.T) {
-	mutator := NewImageSwapperWithOpts(
+	imageSwapper := NewImageSwapperWithOpts(
 		nil,
 		ImageCopyDeadline(8*time.Second),
 	)
 
-	imageSwapper, _ := mutator.(*ImageSwapper)
-
 	imageCopier := &ImageCopier{
 		imageSwapper: imageSwapper,
 		context:      context.Background(),
@@ -70,13 +76,11 @@ func TestImageCopier_tasksTimeout(t *testing.T) {
 	registryClient, _ := registry.NewMockECRClient(ecrClient, "ap-southeast-2", "123456789.dkr.ecr.ap-southeast-2.amazonaws.com", "123456789", "arn:aws:iam::123456789:role/fakerole")
 
 	// image swapper with an instant timeout for testing purpose
-	mutator := NewImageSwapperWithOpts(
+	imageSwapper := NewImageSwapperWithOpts(
 		registryClient,
 		ImageCopyDeadline(0*time.Second),
 	)
 
-	imageSwapper, _ := mutator.(*ImageSwapper)
-
 	srcRef, _ := alltransports.ParseImageName("docker://library/init-container:latest")
 	targetRef, _ := alltransports.ParseImageName("docker://123456789.dkr.ecr.ap-southeast-2.amazonaws.com/docker.io/library/init-container:latest")
 	imageCopier := &ImageCopier{
@@ -115,3 +119,135 @@ func TestImageCopier_tasksTimeout(t *testing.T) {
 	timeoutError = imageCopier.taskCopyImage()
 	assert.Equal(t, context.DeadlineExceeded, timeoutError)
 }
+
+func TestImageCopier_acquireCopyLimits(t *testing.T) {
+	registryClient, _ := registry.NewMockECRClient(nil, "ap-southeast-2", "123456789.dkr.ecr.ap-southeast-2.amazonaws.com", "123456789", "arn:aws:iam::123456789:role/fakerole")
+	imageSwapper := NewImageSwapperWithOpts(
+		registryClient,
+		CopyLimits(config.CopyLimits{
+			Registries: []config.RegistryLimit{{Registry: "docker.io", Concurrency: 1}},
+			Target:     config.RegistryLimit{Concurrency: 2},
+		}),
+	)
+
+	srcRef, _ := alltransports.ParseImageName("docker://library/nginx:latest")
+	newImageCopier := func(ctx context.Context, queued bool) *ImageCopier {
+		return &ImageCopier{imageSwapper: imageSwapper, context: ctx, sourceImageRef: srcRef, queued: queued}
+	}
+
+	release, err := newImageCopier(context.Background(), true).acquireCopyLimits()
+	assert.NoError(t, err)
+
+	// queued copies are rescheduled instead of waiting for the slot of the source registry
+	_, err = newImageCopier(context.Background(), true).acquireCopyLimits()
+	delay, throttled := queue.IsThrottled(err)
+	assert.True(t, throttled)
+	assert.Greater(t, delay, time.Duration(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = newImageCopier(ctx, false).acquireCopyLimits()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	release()
+	release, err = newImageCopier(context.Background(), false).acquireCopyLimits()
+	assert.NoError(t, err)
+	release()
+}
+
+func TestImageCopier_job(t *testing.T) {
+	srcRef, _ := alltransports.ParseImageName("docker://library/nginx:latest")
+	targetRef, _ := alltransports.ParseImageName("docker://123456789.dkr.ecr.ap-southeast-2.amazonaws.com/docker.io/library/nginx:latest")
+	imageCopier := &ImageCopier{
+		sourceImageRef:  srcRef,
+		targetImageRef:  targetRef,
+		imagePullPolicy: corev1.PullIfNotPresent,
+		sourcePod: &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "test-ns",
+				Name:      "my-pod",
+			},
+			Spec: corev1.PodSpec{
+				ServiceAccountName: "my-service-account",
+				ImagePullSecrets:   []corev1.LocalObjectReference{{Name: "my-pod-secret"}},
+			},
+		},
+	}
+
+	assert.Equal(t, queue.Job{
+		SourceImage:        "docker.io/library/nginx:latest",
+		TargetImage:        "123456789.dkr.ecr.ap-southeast-2.amazonaws.com/docker.io/library/nginx:latest",
+		ImagePullPolicy:    corev1.PullIfNotPresent,
+		Namespace:          "test-ns",
+		PodName:            "my-pod",
+		ServiceAccountName: "my-service-account",
+		ImagePullSecrets:   []string{"my-pod-secret"},
+	}, imageCopier.job())
+}
+
+func TestImageSwapper_processCopyJobLinksAdmission(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.NewTracerProvider(sdktrace.NewSimpleSpanProcessor(exporter), 1)
+	previousProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previousProvider)
+
+	admissionCtx, admissionSpan := provider.Tracer(tracing.Name).Start(context.Background(), "admission")
+	admissionSpan.End()
+
+	imageSwapper := NewImageSwapperWithOpts(nil)
+	err := imageSwapper.processCopyJob(context.Background(), queue.Job{
+		ID:           "invalid",
+		SourceImage:  "INVALID::image",
+		TraceContext: tracing.Inject(admissionCtx),
+	})
+	assert.True(t, queue.IsPermanent(err))
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+
+	jobSpan := spans[1]
+	assert.Equal(t, "ImageSwapper.processCopyJob", jobSpan.Name)
+	assert.Equal(t, codes.Error, jobSpan.Status.Code)
+	// the copy starts a new trace linked to the admission
+	assert.NotEqual(t, admissionSpan.SpanContext().TraceID(), jobSpan.SpanContext.TraceID())
+	assert.Len(t, jobSpan.Links, 1)
+	assert.Equal(t, admissionSpan.SpanContext().SpanID(), jobSpan.Links[0].SpanContext.SpanID())
+}
+
+func TestImageSwapper_CopyJob(t *testing.T) {
+	imageSwapper := NewImageSwapperWithOpts(
+		emptyRegistryClient{},
+		Filters([]config.JMESPathFilter{{JMESPath: "obj.metadata.namespace == 'excluded-ns'"}}),
+	)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "nginx"},
+		Spec:       corev1.PodSpec{ServiceAccountName: "my-service-account"},
+	}
+
+	job, ok := imageSwapper.CopyJob(pod, corev1.Container{Name: "nginx", Image: "nginx:latest"})
+	assert.True(t, ok)
+	assert.Equal(t, queue.JobID("registry.example.com/docker.io/library/nginx:latest"), job.ID)
+	assert.Equal(t, "docker.io/library/nginx:latest", job.SourceImage)
+	assert.Equal(t, "registry.example.com/docker.io/library/nginx:latest", job.TargetImage)
+	assert.Equal(t, "my-service-account", job.ServiceAccountName)
+
+	// filtered the same way as an admission of the pod
+	pod.Namespace = "excluded-ns"
+	_, ok = imageSwapper.CopyJob(pod, corev1.Container{Name: "nginx", Image: "nginx:latest"})
+	assert.False(t, ok)
+}
+
+func TestImageSwapper_ImageJob(t *testing.T) {
+	imageSwapper := NewImageSwapperWithOpts(emptyRegistryClient{})
+
+	job, err := imageSwapper.ImageJob("nginx:latest")
+	assert.NoError(t, err)
+	assert.Equal(t, queue.JobID("registry.example.com/docker.io/library/nginx:latest"), job.ID)
+	assert.Equal(t, "docker.io/library/nginx:latest", job.SourceImage)
+	assert.Equal(t, "registry.example.com/docker.io/library/nginx:latest", job.TargetImage)
+
+	_, err = imageSwapper.ImageJob("Invalid:Image:Name")
+	assert.Error(t, err)
+}
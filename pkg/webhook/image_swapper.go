@@ -4,23 +4,33 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/alitto/pond"
 	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/transports/alltransports"
 	ctypes "github.com/containers/image/v5/types"
+	"github.com/estahn/k8s-image-swapper/pkg/bandwidth"
 	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/inventory"
+	"github.com/estahn/k8s-image-swapper/pkg/metrics"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
 	"github.com/estahn/k8s-image-swapper/pkg/registry"
 	"github.com/estahn/k8s-image-swapper/pkg/secrets"
+	"github.com/estahn/k8s-image-swapper/pkg/throttle"
+	"github.com/estahn/k8s-image-swapper/pkg/tracing"
 	types "github.com/estahn/k8s-image-swapper/pkg/types"
 	jmespath "github.com/jmespath/go-jmespath"
 	"github.com/rs/zerolog/log"
 	kwhmodel "github.com/slok/kubewebhook/v2/pkg/model"
 	"github.com/slok/kubewebhook/v2/pkg/webhook"
 	kwhmutating "github.com/slok/kubewebhook/v2/pkg/webhook/mutating"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 // Option represents an option that can be passed when instantiating the image swapper to customize it
@@ -61,67 +71,197 @@ func ImageCopyDeadline(deadline time.Duration) Option {
 	}
 }
 
-// Copier allows to pass the copier option
+// Copier allows to pass the worker pool of the delayed lane processing the copy queue
 func Copier(pool *pond.WorkerPool) Option {
 	return func(swapper *ImageSwapper) {
 		swapper.copier = pool
 	}
 }
 
+// ImmediateCopier allows to pass the worker pool of the immediate lane processing copies blocking an admission
+func ImmediateCopier(pool *pond.WorkerPool) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.immediateCopier = pool
+	}
+}
+
+// BackfillCopier allows to pass the worker pool of the backfill lane processing background copies,
+// e.g. of drifted tags or of the backfill command
+func BackfillCopier(pool *pond.WorkerPool) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.backfillCopier = pool
+	}
+}
+
+// CopyLimits allows to pass the limits of the copies per source registry and against the target registry
+func CopyLimits(limits config.CopyLimits) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.sourceLimiter = throttle.New(limits.Default, limits.Registries)
+		swapper.targetLimiter = throttle.New(limits.Target, nil)
+		swapper.tooManyRequestsBackoff = limits.TooManyRequestsBackoff
+	}
+}
+
+// Bandwidth allows to pass the proxy capping the bandwidth of the copies
+func Bandwidth(proxy *bandwidth.Proxy) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.bandwidth = proxy
+	}
+}
+
+// CopyQueue allows to pass options for the queue holding delayed copy jobs, e.g. a persistent store
+func CopyQueue(opts ...queue.Option) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.queueOptions = opts
+	}
+}
+
+// EventRecorder allows to pass a recorder for Kubernetes events about the outcome of copies and swaps
+func EventRecorder(recorder record.EventRecorder) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.eventRecorder = recorder
+	}
+}
+
+// Inventory allows to pass the inventory recording the mirrored images, e.g. to re-sync mutable tags
+func Inventory(inv *inventory.Inventory) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.inventory = inv
+	}
+}
+
+// ResyncPods allows to pass a function listing the pods of the cluster, the images of their containers are re-synced
+// in addition to the images admitted by this replica
+func ResyncPods(list func(ctx context.Context) ([]corev1.Pod, error)) Option {
+	return func(swapper *ImageSwapper) {
+		swapper.resyncPods = list
+	}
+}
+
 // ImageSwapper is a mutator that will download images and change the image name.
 type ImageSwapper struct {
 	registryClient          registry.Client
 	imagePullSecretProvider secrets.ImagePullSecretsProvider
 
+	// settingsMu guards the settings which can be updated on a configuration reload
+	settingsMu sync.RWMutex
+
 	// filters defines a list of expressions to remove objects that should not be processed,
 	// by default all objects will be processed
 	filters []config.JMESPathFilter
 
-	// copier manages the jobs copying the images to the target registry
+	// copier, immediateCopier and backfillCopier are the worker pools of the copy lanes,
+	// copies of a lane never wait for a worker of another lane
 	copier            *pond.WorkerPool
+	immediateCopier   *pond.WorkerPool
+	backfillCopier    *pond.WorkerPool
 	imageCopyDeadline time.Duration
 
+	// sourceLimiter and targetLimiter bound the copies per registry, copies are unlimited if nil
+	sourceLimiter          *throttle.Limiter
+	targetLimiter          *throttle.Limiter
+	tooManyRequestsBackoff time.Duration
+
+	// bandwidth caps the throughput of the copies, copies are unlimited if nil
+	bandwidth *bandwidth.Proxy
+
+	// queue persists delayed copy jobs until they are processed by the copier
+	queue        *queue.Queue
+	queueOptions []queue.Option
+
 	imageSwapPolicy types.ImageSwapPolicy
 	imageCopyPolicy types.ImageCopyPolicy
+
+	// eventRecorder records events on the admitted pods, events are not recorded if nil
+	eventRecorder record.EventRecorder
+
+	// decisionRecorder receives the decision about each container, decisions are not recorded if nil
+	decisionRecorder func(Decision)
+	// decisionsOnly skips copies and all records of admissions except the decisions
+	decisionsOnly bool
+
+	// inventory records the mirrored images, images are not recorded if nil
+	inventory *inventory.Inventory
+
+	// resyncPods lists the pods whose images are re-synced, only admitted images are re-synced if nil
+	resyncPods func(ctx context.Context) ([]corev1.Pod, error)
+
+	// imageDigest resolves the digest of an image in a registry
+	imageDigest func(ctx context.Context, imageRef ctypes.ImageReference, authFile string, creds string) (string, error)
+
+	// credentialUsers tracks the work using the credentials of the source registries,
+	// it is replaced once the registries are, so the replaced clients are closed after the work using them
+	credentialUsersMu sync.Mutex
+	credentialUsers   *sync.WaitGroup
 }
 
 // NewImageSwapper returns a new ImageSwapper initialized.
 func NewImageSwapper(registryClient registry.Client, imagePullSecretProvider secrets.ImagePullSecretsProvider, filters []config.JMESPathFilter, imageSwapPolicy types.ImageSwapPolicy, imageCopyPolicy types.ImageCopyPolicy, imageCopyDeadline time.Duration) kwhmutating.Mutator {
-	return &ImageSwapper{
+	swapper := &ImageSwapper{
 		registryClient:          registryClient,
 		imagePullSecretProvider: imagePullSecretProvider,
 		filters:                 filters,
-		copier:                  pond.New(100, 1000),
+		copier:                  pond.New(config.DefaultDelayedCopyWorkers, config.DefaultCopyQueueCapacity),
+		immediateCopier:         pond.New(config.DefaultImmediateCopyWorkers, 0),
+		backfillCopier:          pond.New(config.DefaultBackfillCopyWorkers, config.DefaultCopyQueueCapacity),
 		imageSwapPolicy:         imageSwapPolicy,
 		imageCopyPolicy:         imageCopyPolicy,
 		imageCopyDeadline:       imageCopyDeadline,
+		imageDigest:             registry.ImageDigest,
 	}
+	swapper.queue = queue.New(swapper.copier, swapper.processCopyJob, queue.WithBackfillPool(swapper.backfillCopier))
+
+	return swapper
 }
 
 // NewImageSwapperWithOpts returns a configured ImageSwapper instance
-func NewImageSwapperWithOpts(registryClient registry.Client, opts ...Option) kwhmutating.Mutator {
+func NewImageSwapperWithOpts(registryClient registry.Client, opts ...Option) *ImageSwapper {
 	swapper := &ImageSwapper{
 		registryClient:          registryClient,
 		imagePullSecretProvider: secrets.NewDummyImagePullSecretsProvider(),
 		filters:                 []config.JMESPathFilter{},
 		imageSwapPolicy:         types.ImageSwapPolicyExists,
 		imageCopyPolicy:         types.ImageCopyPolicyDelayed,
+		imageDigest:             registry.ImageDigest,
 	}
 
 	for _, opt := range opts {
 		opt(swapper)
 	}
 
-	// Initialise worker pool if not configured
+	// nothing is copied, so neither worker pools nor a queue are needed
+	if swapper.decisionsOnly {
+		return swapper
+	}
+
+	// Initialise the worker pools of the lanes if not configured
 	if swapper.copier == nil {
-		swapper.copier = pond.New(100, 1000)
+		swapper.copier = pond.New(config.DefaultDelayedCopyWorkers, config.DefaultCopyQueueCapacity)
+	}
+	if swapper.immediateCopier == nil {
+		swapper.immediateCopier = pond.New(config.DefaultImmediateCopyWorkers, 0)
+	}
+	if swapper.backfillCopier == nil {
+		swapper.backfillCopier = pond.New(config.DefaultBackfillCopyWorkers, config.DefaultCopyQueueCapacity)
+	}
+
+	queueOptions := append([]queue.Option{queue.WithBackfillPool(swapper.backfillCopier)}, swapper.queueOptions...)
+	swapper.queue = queue.New(swapper.copier, swapper.processCopyJob, queueOptions...)
+
+	// resume copy jobs persisted before a restart
+	if err := swapper.queue.Restore(context.Background()); err != nil {
+		log.Err(err).Msg("failed restoring copy jobs")
 	}
 
 	return swapper
 }
 
 func NewImageSwapperWebhookWithOpts(registryClient registry.Client, opts ...Option) (webhook.Webhook, error) {
-	imageSwapper := NewImageSwapperWithOpts(registryClient, opts...)
+	return NewWebhook(NewImageSwapperWithOpts(registryClient, opts...))
+}
+
+// NewWebhook returns the mutating webhook for an ImageSwapper
+func NewWebhook(imageSwapper kwhmutating.Mutator) (webhook.Webhook, error) {
 	mt := kwhmutating.MutatorFunc(imageSwapper.Mutate)
 	mcfg := kwhmutating.WebhookConfig{
 		ID:      "k8s-image-swapper",
@@ -133,15 +273,83 @@ func NewImageSwapperWebhookWithOpts(registryClient registry.Client, opts ...Opti
 }
 
 func NewImageSwapperWebhook(registryClient registry.Client, imagePullSecretProvider secrets.ImagePullSecretsProvider, filters []config.JMESPathFilter, imageSwapPolicy types.ImageSwapPolicy, imageCopyPolicy types.ImageCopyPolicy, imageCopyDeadline time.Duration) (webhook.Webhook, error) {
-	imageSwapper := NewImageSwapper(registryClient, imagePullSecretProvider, filters, imageSwapPolicy, imageCopyPolicy, imageCopyDeadline)
-	mt := kwhmutating.MutatorFunc(imageSwapper.Mutate)
-	mcfg := kwhmutating.WebhookConfig{
-		ID:      "k8s-image-swapper",
-		Obj:     &corev1.Pod{},
-		Mutator: mt,
+	return NewWebhook(NewImageSwapper(registryClient, imagePullSecretProvider, filters, imageSwapPolicy, imageCopyPolicy, imageCopyDeadline))
+}
+
+// Settings are the parts of the image swapper configuration that can be changed at runtime
+type Settings struct {
+	Filters           []config.JMESPathFilter
+	ImageSwapPolicy   types.ImageSwapPolicy
+	ImageCopyPolicy   types.ImageCopyPolicy
+	ImageCopyDeadline time.Duration
+}
+
+// settings returns a consistent snapshot of the current settings
+func (p *ImageSwapper) settings() Settings {
+	p.settingsMu.RLock()
+	defer p.settingsMu.RUnlock()
+
+	return Settings{
+		Filters:           p.filters,
+		ImageSwapPolicy:   p.imageSwapPolicy,
+		ImageCopyPolicy:   p.imageCopyPolicy,
+		ImageCopyDeadline: p.imageCopyDeadline,
 	}
+}
 
-	return kwhmutating.NewWebhook(mcfg)
+// UpdateSettings atomically replaces the settings, admissions in flight finish with the previous settings
+func (p *ImageSwapper) UpdateSettings(settings Settings) {
+	p.settingsMu.Lock()
+	defer p.settingsMu.Unlock()
+
+	p.filters = settings.Filters
+	p.imageSwapPolicy = settings.ImageSwapPolicy
+	p.imageCopyPolicy = settings.ImageCopyPolicy
+	p.imageCopyDeadline = settings.ImageCopyDeadline
+}
+
+// useCredentials marks the start of work using the credentials of the source registries, the returned function marks its end
+func (p *ImageSwapper) useCredentials() func() {
+	p.credentialUsersMu.Lock()
+	defer p.credentialUsersMu.Unlock()
+
+	if p.credentialUsers == nil {
+		p.credentialUsers = &sync.WaitGroup{}
+	}
+	users := p.credentialUsers
+	users.Add(1)
+
+	return users.Done
+}
+
+// AfterCredentialUsers calls fn in background once the work using the credentials of the source registries has finished,
+// e.g. to close the clients of source registries replaced by a configuration reload. Work started later is not waited for.
+func (p *ImageSwapper) AfterCredentialUsers(fn func()) {
+	p.credentialUsersMu.Lock()
+	users := p.credentialUsers
+	p.credentialUsers = &sync.WaitGroup{}
+	p.credentialUsersMu.Unlock()
+
+	go func() {
+		if users != nil {
+			users.Wait()
+		}
+		fn()
+	}()
+}
+
+// Queue returns the queue holding delayed copy jobs
+func (p *ImageSwapper) Queue() *queue.Queue {
+	return p.queue
+}
+
+// CopyLanes returns the worker pools of the copy lanes by name
+func (p *ImageSwapper) CopyLanes() map[string]metrics.WorkerPool {
+	return map[string]metrics.WorkerPool{
+		types.ImageCopyPolicy(types.ImageCopyPolicyImmediate).String(): p.immediateCopier,
+		string(queue.LaneDelayed):                                      p.copier,
+		string(queue.LaneBackfill):                                     p.backfillCopier,
+	}
 }
 
 // imageNamesWithDigestOrTag strips the tag from ambiguous image references that have a digest as well (e.g. `image:tag@sha256:123...`).
@@ -164,6 +372,22 @@ func imageNamesWithDigestOrTag(imageName string) (string, error) {
 	return imageName, nil
 }
 
+// admission describes the admission of the pod for the inventory.
+// Pods created by controllers are named by the API server after the admission, their owner identifies them.
+func admission(ar *kwhmodel.AdmissionReview, pod *corev1.Pod) *inventory.Admission {
+	admission := &inventory.Admission{
+		UID:       string(ar.ID),
+		Namespace: ar.Namespace,
+		Pod:       pod.Name,
+		Time:      time.Now().UTC(),
+	}
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		admission.Owner = owner.Kind + "/" + owner.Name
+	}
+
+	return admission
+}
+
 // Mutate replaces the image ref. Satisfies mutating.Mutator interface.
 func (p *ImageSwapper) Mutate(ctx context.Context, ar *kwhmodel.AdmissionReview, obj metav1.Object) (*kwhmutating.MutatorResult, error) {
 	pod, ok := obj.(*corev1.Pod)
@@ -171,6 +395,13 @@ func (p *ImageSwapper) Mutate(ctx context.Context, ar *kwhmodel.AdmissionReview,
 		return &kwhmutating.MutatorResult{}, nil
 	}
 
+	_, span := tracing.Tracer().Start(ctx, "ImageSwapper.Mutate", trace.WithAttributes(
+		attribute.String("k8s.namespace.name", ar.Namespace),
+		attribute.String("k8s.pod.name", pod.Name),
+		attribute.String("admission.uid", string(ar.ID)),
+	))
+	defer span.End()
+
 	logger := log.With().
 		Str("uid", string(ar.ID)).
 		Str("kind", ar.RequestGVK.String()).
@@ -178,38 +409,70 @@ func (p *ImageSwapper) Mutate(ctx context.Context, ar *kwhmodel.AdmissionReview,
 		Str("name", pod.Name).
 		Logger()
 
-	lctx := logger.WithContext(context.Background())
+	// the span is carried over without the cancellation of the request, copies may outlive it
+	lctx := logger.WithContext(trace.ContextWithSpan(context.Background(), span))
+
+	// all containers of the pod are processed with the same settings, even if they are reloaded meanwhile
+	settings := p.settings()
 
 	containerSets := []*[]corev1.Container{&pod.Spec.Containers, &pod.Spec.InitContainers}
 	for _, containerSet := range containerSets {
 		containers := *containerSet
 		for i, container := range containers {
+			decision := Decision{
+				Container:     container.Name,
+				InitContainer: containerSet == &pod.Spec.InitContainers,
+				SourceImage:   container.Image,
+			}
+			decide := func(result string) {
+				if !p.decisionsOnly {
+					metrics.Swaps.WithLabelValues(result).Inc()
+				}
+				decision.Result = result
+				p.recordDecision(decision)
+			}
+
 			normalizedName, err := imageNamesWithDigestOrTag(container.Image)
 			if err != nil {
 				log.Ctx(lctx).Warn().Msgf("unable to normalize source name %s: %v", container.Image, err)
+				decision.Error = err.Error()
+				decide("invalid")
 				continue
 			}
 
 			srcRef, err := alltransports.ParseImageName("docker://" + normalizedName)
 			if err != nil {
 				log.Ctx(lctx).Warn().Msgf("invalid source name %s: %v", normalizedName, err)
+				decision.Error = err.Error()
+				decide("invalid")
 				continue
 			}
 
 			// skip if the source originates from the target registry
 			if p.registryClient.IsOrigin(srcRef) {
 				log.Ctx(lctx).Debug().Str("registry", srcRef.DockerReference().String()).Msg("skip due to source and target being the same registry")
+				decide("same_registry")
 				continue
 			}
 
 			filterCtx := NewFilterContext(*ar, pod, container)
-			if filterMatch(filterCtx, p.filters) {
+			_, filterSpan := tracing.Tracer().Start(lctx, "filterMatch", trace.WithAttributes(attribute.String("container.name", container.Name)))
+			matched, filterResults := evaluateFilters(filterCtx, settings.Filters)
+			decision.Filters = filterResults
+			filterSpan.SetAttributes(attribute.Bool("filter.matched", matched))
+			filterSpan.End()
+			if matched {
+				if !p.decisionsOnly {
+					countFilterMatch(filterResults)
+				}
 				log.Ctx(lctx).Debug().Msg("skip due to filter condition")
+				decide("filtered")
 				continue
 			}
 
 			targetRef := p.targetRef(srcRef)
 			targetImage := targetRef.DockerReference().String()
+			decision.TargetImage = targetImage
 
 			imageCopierLogger := logger.With().
 				Str("source-image", srcRef.DockerReference().String()).
@@ -220,6 +483,7 @@ func (p *ImageSwapper) Mutate(ctx context.Context, ar *kwhmodel.AdmissionReview,
 			// create an object responsible for the image copy
 			imageCopier := ImageCopier{
 				sourcePod:       pod,
+				eventTarget:     eventTarget(pod),
 				sourceImageRef:  srcRef,
 				targetImageRef:  targetRef,
 				imagePullPolicy: container.ImagePullPolicy,
@@ -228,30 +492,52 @@ func (p *ImageSwapper) Mutate(ctx context.Context, ar *kwhmodel.AdmissionReview,
 			}
 
 			// imageCopyPolicy
-			switch p.imageCopyPolicy {
-			case types.ImageCopyPolicyDelayed:
-				p.copier.Submit(imageCopier.start)
-			case types.ImageCopyPolicyImmediate:
-				p.copier.SubmitAndWait(imageCopier.withDeadline().start)
-			case types.ImageCopyPolicyForce:
+			switch {
+			case p.decisionsOnly:
+				// the policy is only reported
+			case settings.ImageCopyPolicy == types.ImageCopyPolicyDelayed:
+				job := imageCopier.job()
+				job.TraceContext = tracing.Inject(imageCopierContext)
+				// a full queue blocking the admission is waited for until the request is cancelled, e.g. by the timeout of the API server
+				submitCtx := logger.WithContext(trace.ContextWithSpan(ctx, span))
+				if err := p.queue.Submit(submitCtx, job); err != nil {
+					log.Ctx(lctx).Err(err).Str("image", targetImage).Msg("failed queueing image copy")
+					decision.Error = err.Error()
+				}
+			case settings.ImageCopyPolicy == types.ImageCopyPolicyImmediate:
+				p.immediateCopier.SubmitAndWait(imageCopier.withDeadline().start)
+			case settings.ImageCopyPolicy == types.ImageCopyPolicyForce:
 				imageCopier.withDeadline().start()
-			case types.ImageCopyPolicyNone:
+			case settings.ImageCopyPolicy == types.ImageCopyPolicyNone:
 				// do not copy image
 			default:
 				panic("unknown imageCopyPolicy")
 			}
+			if settings.ImageCopyPolicy != types.ImageCopyPolicyNone {
+				decision.Copy = settings.ImageCopyPolicy.String()
+				if p.inventory != nil && !p.decisionsOnly {
+					p.inventory.Record(imageCopier.job(), admission(ar, pod))
+				}
+			}
 
 			// imageSwapPolicy
-			switch p.imageSwapPolicy {
+			switch settings.ImageSwapPolicy {
 			case types.ImageSwapPolicyAlways:
 				log.Ctx(lctx).Debug().Str("image", targetImage).Msg("set new container image")
 				containers[i].Image = targetImage
+				decide("swapped")
 			case types.ImageSwapPolicyExists:
 				if p.registryClient.ImageExists(lctx, targetRef) {
 					log.Ctx(lctx).Debug().Str("image", targetImage).Msg("set new container image")
 					containers[i].Image = targetImage
+					decide("swapped")
 				} else {
 					log.Ctx(lctx).Debug().Str("image", targetImage).Msg("container image not found in target registry, not swapping")
+					decide("not_found")
+					if !p.decisionsOnly {
+						p.recordEvent(imageCopier.eventTarget, corev1.EventTypeWarning, EventReasonImageNotSwapped,
+							"Image %s of container %s not swapped, %s not found in target registry", container.Image, container.Name, targetImage)
+					}
 				}
 			default:
 				panic("unknown imageSwapPolicy")
@@ -262,20 +548,37 @@ func (p *ImageSwapper) Mutate(ctx context.Context, ar *kwhmodel.AdmissionReview,
 	return &kwhmutating.MutatorResult{MutatedObject: pod}, nil
 }
 
-// filterMatch returns true if one of the filters matches the context
+// filterMatch returns true if one of the filters matches the context, a match is counted
 func filterMatch(ctx FilterContext, filters []config.JMESPathFilter) bool {
+	matched, filterResults := evaluateFilters(ctx, filters)
+	if matched {
+		countFilterMatch(filterResults)
+	}
+	return matched
+}
+
+// countFilterMatch counts the match of the last filter evaluated
+func countFilterMatch(filterResults []FilterResult) {
+	metrics.FilterMatches.WithLabelValues(filterResults[len(filterResults)-1].JMESPath).Inc()
+}
+
+// evaluateFilters returns true if one of the filters matches the context, and the results of the filters evaluated.
+// Filters are evaluated in order until the first match, a filter which cannot be evaluated stops the evaluation without a match.
+func evaluateFilters(ctx FilterContext, filters []config.JMESPathFilter) (bool, []FilterResult) {
+	filterResults := []FilterResult{}
+
 	// Simplify FilterContext to be easier searchable by marshaling it to JSON and back to an interface
 	var filterContext interface{}
 	jsonBlob, err := json.Marshal(ctx)
 	if err != nil {
 		log.Err(err).Msg("could not marshal filter context")
-		return false
+		return false, filterResults
 	}
 
 	err = json.Unmarshal(jsonBlob, &filterContext)
 	if err != nil {
 		log.Err(err).Msg("could not unmarshal json blob")
-		return false
+		return false, filterResults
 	}
 
 	log.Debug().Interface("object", filterContext).Msg("generated filter context")
@@ -284,22 +587,27 @@ func filterMatch(ctx FilterContext, filters []config.JMESPathFilter) bool {
 		results, err := jmespath.Search(filter.JMESPath, filterContext)
 		log.Debug().Str("filter", filter.JMESPath).Interface("results", results).Msg("jmespath search results")
 
+		filterResult := FilterResult{JMESPath: filter.JMESPath, Result: results}
 		if err != nil {
 			log.Err(err).Str("filter", filter.JMESPath).Msgf("Filter (idx %v) could not be evaluated.", idx)
-			return false
+			filterResult.Error = err.Error()
+			return false, append(filterResults, filterResult)
 		}
 
 		switch results.(type) {
 		case bool:
 			if results == true {
-				return true
+				filterResult.Matched = true
+				return true, append(filterResults, filterResult)
 			}
 		default:
 			log.Warn().Str("filter", filter.JMESPath).Msg("filter does not return a bool value")
+			filterResult.Error = "filter does not return a bool value"
 		}
+		filterResults = append(filterResults, filterResult)
 	}
 
-	return false
+	return false, filterResults
 }
 
 // targetName returns the reference in the target repository
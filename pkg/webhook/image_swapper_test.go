@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/alitto/pond"
 	"github.com/aws/aws-sdk-go/aws"
@@ -12,9 +13,11 @@ import (
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
 	"github.com/estahn/k8s-image-swapper/pkg/config"
+	"github.com/estahn/k8s-image-swapper/pkg/metrics"
 	"github.com/estahn/k8s-image-swapper/pkg/registry"
 	"github.com/estahn/k8s-image-swapper/pkg/secrets"
 	"github.com/estahn/k8s-image-swapper/pkg/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/slok/kubewebhook/v2/pkg/model"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -190,6 +193,9 @@ func TestFilterMatch(t *testing.T) {
 	// non-boolean value
 	assert.False(t, filterMatch(filterContext, []config.JMESPathFilter{{JMESPath: "obj"}}))
 	assert.False(t, filterMatch(filterContext, []config.JMESPathFilter{{JMESPath: "contains(container.image, '.dkr.ecr.') && contains(container.image, '.amazonaws.com')"}}))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.FilterMatches.WithLabelValues("obj.metadata.namespace == 'kube-system'")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.FilterMatches.WithLabelValues("obj")))
 }
 
 type mockECRClient struct {
@@ -423,3 +429,68 @@ func TestImageSwapper_GAR_Mutate(t *testing.T) {
 	assert.Nil(t, resp.(*model.MutatingAdmissionResponse).Warnings)
 	assert.NoError(t, err, "Webhook executed without errors")
 }
+
+func TestImageSwapper_AfterCredentialUsers(t *testing.T) {
+	imageSwapper := NewImageSwapperWithOpts(emptyRegistryClient{})
+
+	running := imageSwapper.useCredentials()
+
+	called := make(chan struct{})
+	imageSwapper.AfterCredentialUsers(func() { close(called) })
+
+	// work started later does not delay the call
+	defer imageSwapper.useCredentials()()
+
+	select {
+	case <-called:
+		assert.Fail(t, "called while the credentials are in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	running()
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		assert.Fail(t, "not called once the credentials are no longer used")
+	}
+}
+
+func TestImageSwapper_UpdateSettings(t *testing.T) {
+	imageSwapper := NewImageSwapperWithOpts(
+		emptyRegistryClient{},
+		ImageSwapPolicy(types.ImageSwapPolicyExists),
+		ImageCopyPolicy(types.ImageCopyPolicyNone),
+	)
+
+	mutate := func() string {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "nginx"},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "nginx", Image: "nginx:latest"}},
+			},
+		}
+		result, err := imageSwapper.Mutate(context.Background(), &model.AdmissionReview{
+			Namespace:  "test-ns",
+			RequestGVK: &metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		}, pod)
+		assert.NoError(t, err)
+		return result.MutatedObject.(*corev1.Pod).Spec.Containers[0].Image
+	}
+
+	assert.Equal(t, "nginx:latest", mutate())
+
+	imageSwapper.UpdateSettings(Settings{
+		ImageSwapPolicy:   types.ImageSwapPolicyAlways,
+		ImageCopyPolicy:   types.ImageCopyPolicyNone,
+		ImageCopyDeadline: time.Second,
+	})
+	assert.Equal(t, "registry.example.com/docker.io/library/nginx:latest", mutate())
+
+	imageSwapper.UpdateSettings(Settings{
+		Filters:           []config.JMESPathFilter{{JMESPath: "obj.metadata.namespace == 'test-ns'"}},
+		ImageSwapPolicy:   types.ImageSwapPolicyAlways,
+		ImageCopyPolicy:   types.ImageCopyPolicyNone,
+		ImageCopyDeadline: time.Second,
+	})
+	assert.Equal(t, "nginx:latest", mutate())
+}
@@ -0,0 +1,201 @@
+package webhook
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/transports/alltransports"
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/estahn/k8s-image-swapper/pkg/inventory"
+	"github.com/estahn/k8s-image-swapper/pkg/metrics"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+	"github.com/estahn/k8s-image-swapper/pkg/types"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Results of comparing the digests of a mirrored tag
+const (
+	ResyncInSync  = "in_sync"
+	ResyncDrifted = "drifted"
+	ResyncFailed  = "failed"
+)
+
+// RunResync re-syncs the mirrored tags in the interval until the context is canceled
+func (p *ImageSwapper) RunResync(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Resync(ctx)
+		}
+	}
+}
+
+// Resync compares the digests of the mirrored images referenced by tag with their source and queues a copy of drifted ones.
+// Tags are mutable, e.g. nginx:stable is republished, while the target keeps the content it was mirrored with
+// as long as the image is found there. Images referenced by digest cannot drift and are skipped.
+// It returns the number of images by result.
+func (p *ImageSwapper) Resync(ctx context.Context) map[string]int {
+	results := map[string]int{}
+	if p.inventory == nil {
+		return results
+	}
+
+	// pods may have been admitted by other replicas, their images are missing in the inventory of this one
+	p.recordPods(ctx)
+
+	for _, image := range p.inventory.List() {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if !isTagged(image.SourceImage) {
+			continue
+		}
+
+		result := p.resyncImage(ctx, image)
+		metrics.ResyncChecks.WithLabelValues(result).Inc()
+		results[result]++
+	}
+
+	log.Ctx(ctx).Info().
+		Int(ResyncInSync, results[ResyncInSync]).
+		Int(ResyncDrifted, results[ResyncDrifted]).
+		Int(ResyncFailed, results[ResyncFailed]).
+		Msg("re-synced mirrored tags")
+
+	return results
+}
+
+// recordPods records the images of the containers of all pods in the inventory the same way an admission does
+func (p *ImageSwapper) recordPods(ctx context.Context) {
+	// admissions do not copy images either
+	if p.resyncPods == nil || p.settings().ImageCopyPolicy == types.ImageCopyPolicyNone {
+		return
+	}
+
+	pods, err := p.resyncPods(ctx)
+	if err != nil {
+		log.Ctx(ctx).Err(err).Msg("failed listing pods to re-sync, re-syncing admitted images only")
+		return
+	}
+
+	for i := range pods {
+		pod := &pods[i]
+		containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+		for _, container := range containers {
+			if job, ok := p.CopyJob(pod, container); ok {
+				p.inventory.Record(job, nil)
+			}
+		}
+	}
+}
+
+// resyncImage compares the digests of source and target image and queues a copy if they differ
+func (p *ImageSwapper) resyncImage(ctx context.Context, image inventory.Image) string {
+	logger := log.Ctx(ctx).With().
+		Str("source-image", image.SourceImage).
+		Str("target-image", image.TargetImage).
+		Logger()
+
+	srcRef, err := alltransports.ParseImageName("docker://" + image.SourceImage)
+	if err != nil {
+		logger.Err(err).Msg("invalid source image in inventory")
+		return ResyncFailed
+	}
+
+	targetRef, err := alltransports.ParseImageName("docker://" + image.TargetImage)
+	if err != nil {
+		logger.Err(err).Msg("invalid target image in inventory")
+		return ResyncFailed
+	}
+
+	// images missing in the target registry are copied on admission, there is nothing to compare yet
+	targetDigest, err := p.imageDigest(ctx, targetRef, "", p.registryClient.Credentials())
+	if err != nil {
+		logger.Debug().Err(err).Msg("failed resolving digest of target image")
+		return ResyncFailed
+	}
+
+	sourceDigest, err := p.sourceDigest(ctx, srcRef, image.Job)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed resolving digest of source image")
+		return ResyncFailed
+	}
+
+	now := time.Now().UTC()
+	drifted := sourceDigest != targetDigest
+	p.inventory.Update(image.TargetImage, func(image *inventory.Image) {
+		image.LastChecked = now
+		image.SourceDigest = sourceDigest
+		image.TargetDigest = targetDigest
+		if drifted {
+			image.Drifts++
+			image.LastDrift = now
+		}
+	})
+
+	if !drifted {
+		logger.Trace().Str("digest", targetDigest).Msg("mirrored tag in sync")
+		return ResyncInSync
+	}
+
+	logger.Info().
+		Str("source-digest", sourceDigest).
+		Str("target-digest", targetDigest).
+		Msg("mirrored tag drifted from source, queueing copy")
+	metrics.Drifts.WithLabelValues(reference.Domain(srcRef.DockerReference())).Inc()
+	p.recordEvent(image.Job.EventTarget, corev1.EventTypeNormal, EventReasonImageDrifted,
+		"Image %s was republished with digest %s, mirroring it again to %s", image.SourceImage, sourceDigest, image.TargetImage)
+
+	// the image is present in the target registry, the pull policy forces the copy
+	job := image.Job
+	job.ImagePullPolicy = corev1.PullAlways
+	job.EnqueuedAt = time.Time{}
+	job.Lane = queue.LaneBackfill
+	if err := p.queue.Submit(ctx, job); err != nil {
+		logger.Err(err).Msg("failed queueing copy of drifted image")
+	}
+
+	return ResyncDrifted
+}
+
+// sourceDigest resolves the digest of the source image with the pull secrets of the pod which last referenced it
+func (p *ImageSwapper) sourceDigest(ctx context.Context, srcRef ctypes.ImageReference, job queue.Job) (string, error) {
+	defer p.useCredentials()()
+	imagePullSecrets, err := p.imagePullSecretProvider.GetImagePullSecrets(ctx, jobPod(job))
+	if err != nil {
+		return "", err
+	}
+
+	authFile, err := imagePullSecrets.AuthFile()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := os.RemoveAll(authFile.Name()); err != nil {
+			log.Ctx(ctx).Err(err).Str("file", authFile.Name()).Msg("failed removing auth file")
+		}
+	}()
+
+	return p.imageDigest(ctx, srcRef, authFile.Name(), "")
+}
+
+// isTagged returns true if the image is referenced by a tag instead of a digest
+func isTagged(image string) bool {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return false
+	}
+
+	_, isDigested := ref.(reference.Canonical)
+
+	return !isDigested
+}
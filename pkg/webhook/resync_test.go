@@ -0,0 +1,147 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ctypes "github.com/containers/image/v5/types"
+	"github.com/estahn/k8s-image-swapper/pkg/inventory"
+	"github.com/estahn/k8s-image-swapper/pkg/queue"
+	kwhmodel "github.com/slok/kubewebhook/v2/pkg/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// copyRecordingClient is a target registry passing the copied target images to a channel
+type copyRecordingClient struct {
+	emptyRegistryClient
+	copies chan string
+}
+
+func (c copyRecordingClient) CopyImage(ctx context.Context, src ctypes.ImageReference, srcCreds string, dest ctypes.ImageReference, destCreds string) error {
+	c.copies <- dest.DockerReference().String()
+	return nil
+}
+
+func TestImageSwapper_Resync(t *testing.T) {
+	registryClient := copyRecordingClient{copies: make(chan string, 10)}
+	recorder := record.NewFakeRecorder(10)
+	inv := inventory.New()
+	imageSwapper := NewImageSwapperWithOpts(registryClient, Inventory(inv), EventRecorder(recorder))
+	defer imageSwapper.Queue().Stop(context.Background())
+
+	eventTarget := &corev1.ObjectReference{Kind: "Pod", Namespace: "test-ns", Name: "nginx"}
+	for _, job := range []queue.Job{
+		{SourceImage: "docker.io/library/nginx:stable", TargetImage: "registry.example.com/docker.io/library/nginx:stable", EventTarget: eventTarget},
+		{SourceImage: "docker.io/library/busybox:1.36", TargetImage: "registry.example.com/docker.io/library/busybox:1.36"},
+		{SourceImage: "docker.io/library/redis:7", TargetImage: "registry.example.com/docker.io/library/redis:7"},
+		{SourceImage: "docker.io/library/alpine@sha256:c5b1261d6d3e43071626931fc004f70149baeba2c8ec672bd4f27761f8e1ad6b", TargetImage: "registry.example.com/docker.io/library/alpine@sha256:c5b1261d6d3e43071626931fc004f70149baeba2c8ec672bd4f27761f8e1ad6b"},
+	} {
+		inv.Record(job, nil)
+	}
+
+	digests := map[string]string{
+		"docker.io/library/nginx:stable":                      "sha256:new",
+		"registry.example.com/docker.io/library/nginx:stable": "sha256:old",
+		"docker.io/library/busybox:1.36":                      "sha256:same",
+		"registry.example.com/docker.io/library/busybox:1.36": "sha256:same",
+	}
+	imageSwapper.imageDigest = func(ctx context.Context, imageRef ctypes.ImageReference, authFile string, creds string) (string, error) {
+		if digest, found := digests[imageRef.DockerReference().String()]; found {
+			return digest, nil
+		}
+		return "", errors.New("manifest unknown")
+	}
+
+	results := imageSwapper.Resync(context.Background())
+	assert.Equal(t, map[string]int{ResyncInSync: 1, ResyncDrifted: 1, ResyncFailed: 1}, results, "images referenced by digest are skipped")
+
+	select {
+	case target := <-registryClient.copies:
+		assert.Equal(t, "registry.example.com/docker.io/library/nginx:stable", target)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "drifted image not copied")
+	}
+
+	assert.Equal(t, "Normal ImageDrifted Image docker.io/library/nginx:stable was republished with digest sha256:new, mirroring it again to registry.example.com/docker.io/library/nginx:stable", <-recorder.Events)
+
+	nginx, _ := inv.Get("registry.example.com/docker.io/library/nginx:stable")
+	assert.Equal(t, 1, nginx.Drifts)
+	assert.Equal(t, "sha256:new", nginx.SourceDigest)
+	assert.Equal(t, "sha256:old", nginx.TargetDigest)
+	assert.False(t, nginx.LastChecked.IsZero())
+
+	busybox, _ := inv.Get("registry.example.com/docker.io/library/busybox:1.36")
+	assert.Equal(t, 0, busybox.Drifts)
+	assert.Equal(t, "sha256:same", busybox.TargetDigest)
+}
+
+func TestImageSwapper_MutateRecordsInventory(t *testing.T) {
+	inv := inventory.New()
+	imageSwapper := NewImageSwapperWithOpts(emptyRegistryClient{}, Inventory(inv))
+	defer imageSwapper.Queue().Stop(context.Background())
+
+	isController := true
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName:    "nginx-",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "nginx-5d8f", Controller: &isController}},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "nginx", Image: "nginx:stable"}},
+		},
+	}
+	_, err := imageSwapper.Mutate(context.Background(), &kwhmodel.AdmissionReview{
+		ID:         "7f6b",
+		Namespace:  "test-ns",
+		RequestGVK: &metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+	}, pod)
+	require.NoError(t, err)
+
+	images := inv.List()
+	require.Len(t, images, 1)
+	assert.Equal(t, "docker.io/library/nginx:stable", images[0].SourceImage)
+	assert.Equal(t, "registry.example.com/docker.io/library/nginx:stable", images[0].TargetImage)
+	require.NotNil(t, images[0].LastAdmission)
+	assert.Equal(t, "7f6b", images[0].LastAdmission.UID)
+	assert.Equal(t, "test-ns", images[0].LastAdmission.Namespace)
+	assert.Equal(t, "ReplicaSet/nginx-5d8f", images[0].LastAdmission.Owner)
+}
+
+func TestImageSwapper_ResyncPods(t *testing.T) {
+	inv := inventory.New()
+	pods := []corev1.Pod{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "nginx"},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: "nginx",
+			ImagePullSecrets:   []corev1.LocalObjectReference{{Name: "registry"}},
+			InitContainers:     []corev1.Container{{Name: "init", Image: "busybox:1.36"}},
+			Containers:         []corev1.Container{{Name: "nginx", Image: "nginx:stable"}},
+		},
+	}}
+	imageSwapper := NewImageSwapperWithOpts(emptyRegistryClient{}, Inventory(inv), ResyncPods(func(ctx context.Context) ([]corev1.Pod, error) {
+		return pods, nil
+	}))
+	defer imageSwapper.Queue().Stop(context.Background())
+
+	imageSwapper.imageDigest = func(ctx context.Context, imageRef ctypes.ImageReference, authFile string, creds string) (string, error) {
+		return "sha256:same", nil
+	}
+
+	results := imageSwapper.Resync(context.Background())
+	assert.Equal(t, map[string]int{ResyncInSync: 2}, results, "images of pods admitted by other replicas are re-synced")
+
+	nginx, found := inv.Get("registry.example.com/docker.io/library/nginx:stable")
+	require.True(t, found)
+	assert.Equal(t, "nginx", nginx.Job.ServiceAccountName)
+	assert.Equal(t, []string{"registry"}, nginx.Job.ImagePullSecrets)
+	assert.Nil(t, nginx.LastAdmission)
+
+	_, found = inv.Get("registry.example.com/docker.io/library/busybox:1.36")
+	assert.True(t, found)
+}